@@ -0,0 +1,541 @@
+// Package alert evaluates threshold alert rules on a database periodically
+// and sends notifications when alerts start firing and when they resolve.
+//
+// An alert is created for each group of series matching a rule (see Rule.By)
+// when the aggregated value over the rule window crosses the threshold. It
+// is pending until the condition holds for Rule.For and then it's firing.
+// A firing alert is resolved when the condition no longer holds (including
+// when there's no data). Pending alerts are dropped without notifications.
+// Resolved alerts are kept for Options.KeepResolved after they're notified.
+// Failed notifications are sent again with the next evaluation.
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb/atomicfile"
+	"github.com/kadirahq/kadiyadb/query"
+)
+
+// State is the state of an alert
+type State string
+
+const (
+	// Pending alerts meet the condition but not yet for Rule.For
+	Pending State = "pending"
+
+	// Firing alerts meet the condition for at least Rule.For
+	Firing State = "firing"
+
+	// Resolved alerts were firing but no longer meet the condition
+	Resolved State = "resolved"
+)
+
+var (
+	// ErrInvRule is returned when an alert rule is not valid
+	ErrInvRule = errors.New("invalid alert rule")
+
+	// ErrExists is returned when adding a rule with a name already in use
+	ErrExists = errors.New("alert rule already exists")
+)
+
+// Rule is an alert rule
+type Rule struct {
+	// Name identifies the rule and its alerts
+	Name string `json:"name"`
+
+	// Agg is the aggregation applied to matching series
+	Agg query.Agg `json:"agg"`
+
+	// By has 1-based field positions used to group series (optional)
+	By []int `json:"by"`
+
+	// Fields is the index field pattern
+	Fields []string `json:"fields"`
+
+	// Window is the time range used to calculate the value of the alert.
+	// The value is total/count of all aggregated points in the window.
+	// It must be a multiple of the database resolution.
+	Window time.Duration `json:"window"`
+
+	// Op is the comparison operator (>, >=, <, <=)
+	Op string `json:"op"`
+
+	// Threshold is the value compared against
+	Threshold float64 `json:"threshold"`
+
+	// For is the time the condition must hold before the alert is firing
+	For time.Duration `json:"for"`
+}
+
+// Alert is an alert created by a rule for a group of series
+type Alert struct {
+	Rule       string    `json:"rule"`
+	Fields     []string  `json:"fields"`
+	State      State     `json:"state"`
+	Value      float64   `json:"value"`
+	ActiveAt   time.Time `json:"activeAt"`
+	FiredAt    time.Time `json:"firedAt"`
+	ResolvedAt time.Time `json:"resolvedAt"`
+
+	// Notified is true when the notification for the current state
+	// (firing or resolved) is sent. It's not used with pending alerts.
+	Notified bool `json:"notified"`
+}
+
+// Notifier sends notifications for alerts which started firing or resolved
+type Notifier interface {
+	Notify(alerts []*Alert) (err error)
+}
+
+// Options are optional engine settings
+type Options struct {
+	// State is the path of a file used to store alerts. Without it,
+	// alerts start from scratch when the process restarts.
+	State string
+
+	// Interval is the time between evaluations (defaults to a minute)
+	Interval time.Duration
+
+	// KeepResolved is the time resolved alerts are kept after they're
+	// notified (defaults to an hour)
+	KeepResolved time.Duration
+}
+
+// Engine evaluates alert rules on a database
+type Engine struct {
+	db       *kadiyadb.DB
+	notifier Notifier
+	opts     *Options
+
+	rules  map[string]*Rule
+	alerts map[string]*Alert
+	mtx    *sync.Mutex
+	nmtx   *sync.Mutex
+
+	stop chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// New creates an alert engine for a database. Alerts are loaded from the
+// state file if it's given in options. Rules are evaluated periodically.
+// Rules should be added before the first evaluation because loaded alerts
+// of rules which are not registered at that time are dropped.
+func New(db *kadiyadb.DB, notifier Notifier, opts *Options) (e *Engine, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+
+	if opts.KeepResolved <= 0 {
+		opts.KeepResolved = time.Hour
+	}
+
+	e = &Engine{
+		db:       db,
+		notifier: notifier,
+		opts:     opts,
+		rules:    map[string]*Rule{},
+		alerts:   map[string]*Alert{},
+		mtx:      &sync.Mutex{},
+		nmtx:     &sync.Mutex{},
+		stop:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+	}
+
+	if opts.State != "" {
+		data, err := ioutil.ReadFile(opts.State)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err == nil {
+			var alerts []*Alert
+			if err := json.Unmarshal(data, &alerts); err != nil {
+				return nil, err
+			}
+
+			for _, a := range alerts {
+				e.alerts[key(a.Rule, a.Fields)] = a
+			}
+		}
+	}
+
+	e.wg.Add(1)
+	go e.loop()
+
+	return e, nil
+}
+
+// Add registers an alert rule
+func (e *Engine) Add(r *Rule) (err error) {
+	res := e.db.ResolutionAt(uint64(time.Now().UnixNano()))
+	if !r.valid(res) {
+		return ErrInvRule
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if _, ok := e.rules[r.Name]; ok {
+		return ErrExists
+	}
+
+	e.rules[r.Name] = r
+	return nil
+}
+
+// Remove removes an alert rule and its alerts without notifications
+func (e *Engine) Remove(name string) (err error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	delete(e.rules, name)
+	for k, a := range e.alerts {
+		if a.Rule == name {
+			delete(e.alerts, k)
+		}
+	}
+
+	return e.save()
+}
+
+// Alerts returns pending, firing and recently resolved alerts
+// sorted by rule and fields
+func (e *Engine) Alerts() (alerts []*Alert) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	keys := make([]string, 0, len(e.alerts))
+	for k := range e.alerts {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		a := *e.alerts[k]
+		alerts = append(alerts, &a)
+	}
+
+	return alerts
+}
+
+// Eval evaluates all rules as of given time, updates alerts and sends
+// notifications for alerts which started firing or resolved (and alerts
+// which failed to notify before). Notifications are sent without blocking
+// other engine methods. Alerts of rules which fail to evaluate are not
+// changed. The first error is returned.
+func (e *Engine) Eval(now time.Time) (err error) {
+	// notifications are sent by one evaluation at a time
+	e.nmtx.Lock()
+	defer e.nmtx.Unlock()
+
+	notify, err := e.update(now)
+	if len(notify) == 0 {
+		return err
+	}
+
+	// alerts loaded from the state file may not be notified yet
+	// but they are considered notified without a notifier
+	if e.notifier != nil {
+		if nerr := e.notifier.Notify(notify); nerr != nil {
+			if err == nil {
+				err = nerr
+			}
+
+			return err
+		}
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for _, n := range notify {
+		a, ok := e.alerts[key(n.Rule, n.Fields)]
+		if ok && a.State == n.State && a.FiredAt.Equal(n.FiredAt) && a.ResolvedAt.Equal(n.ResolvedAt) {
+			a.Notified = true
+		}
+	}
+
+	if serr := e.save(); serr != nil && err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// update evaluates all rules, updates alerts and stores them. It returns
+// copies of alerts which should be notified. Alerts are always considered
+// notified when the engine does not have a notifier. Alerts of rules which
+// are not registered are dropped without notifications.
+func (e *Engine) update(now time.Time) (notify []*Alert, err error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	notified := e.notifier == nil
+
+	for _, r := range e.rules {
+		values, rerr := r.eval(e.db, now)
+		if rerr != nil {
+			if err == nil {
+				err = fmt.Errorf("rule %s: %s", r.Name, rerr)
+			}
+
+			continue
+		}
+
+		for k, v := range values {
+			a, ok := e.alerts[k]
+			if !r.check(v.value) {
+				continue
+			}
+
+			// the resolution must be notified before the alert can start again
+			if ok && a.State == Resolved && !a.Notified {
+				continue
+			}
+
+			if !ok || a.State == Resolved {
+				a = &Alert{
+					Rule:     r.Name,
+					Fields:   v.fields,
+					State:    Pending,
+					ActiveAt: now,
+				}
+
+				e.alerts[k] = a
+			}
+
+			a.Value = v.value
+			if a.State == Pending && now.Sub(a.ActiveAt) >= r.For {
+				a.State = Firing
+				a.FiredAt = now
+				a.Notified = notified
+			}
+		}
+
+		for k, a := range e.alerts {
+			if a.Rule != r.Name {
+				continue
+			}
+
+			if v, ok := values[k]; ok && r.check(v.value) {
+				continue
+			}
+
+			switch a.State {
+			case Pending:
+				delete(e.alerts, k)
+			case Firing:
+				a.State = Resolved
+				a.ResolvedAt = now
+				a.Notified = notified
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(e.alerts))
+	for k := range e.alerts {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		a := e.alerts[k]
+
+		// alerts loaded from the state file may belong to removed rules
+		if _, ok := e.rules[a.Rule]; !ok {
+			delete(e.alerts, k)
+			continue
+		}
+
+		if a.State == Resolved && a.Notified && now.Sub(a.ResolvedAt) >= e.opts.KeepResolved {
+			delete(e.alerts, k)
+			continue
+		}
+
+		if a.State != Pending && !a.Notified {
+			notify = append(notify, copyAlert(a))
+		}
+	}
+
+	if serr := e.save(); serr != nil && err == nil {
+		err = serr
+	}
+
+	return notify, err
+}
+
+// Close stops evaluating rules
+func (e *Engine) Close() (err error) {
+	close(e.stop)
+	e.wg.Wait()
+	return nil
+}
+
+// save writes alerts to the state file.
+// The mutex must be locked when calling this function.
+func (e *Engine) save() (err error) {
+	if e.opts.State == "" {
+		return nil
+	}
+
+	keys := make([]string, 0, len(e.alerts))
+	for k := range e.alerts {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	alerts := make([]*Alert, len(keys))
+	for i, k := range keys {
+		alerts[i] = e.alerts[k]
+	}
+
+	data, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(e.opts.State, data)
+}
+
+func (e *Engine) loop() {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(e.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.stop:
+			return
+		case now := <-ticker.C:
+			if err := e.Eval(now); err != nil {
+				fmt.Println("Alert Error:", err)
+			}
+		}
+	}
+}
+
+// value is the value of a group of series with data in the window
+type value struct {
+	fields []string
+	value  float64
+}
+
+// eval calculates values for all groups of series with data in the
+// window which ends at the start of the current resolution interval.
+func (r *Rule) eval(db *kadiyadb.DB, now time.Time) (values map[string]*value, err error) {
+	end := now.UnixNano()
+	end -= end % db.ResolutionAt(uint64(end))
+
+	from := end - int64(r.Window)
+	if from < 0 {
+		from = 0
+	}
+
+	q := &query.Query{
+		Agg:    r.Agg,
+		By:     r.By,
+		Fields: r.Fields,
+		From:   uint64(from),
+		To:     uint64(end),
+		Step:   end - from,
+	}
+
+	chunk, err := q.Run(db)
+	if err != nil {
+		return nil, err
+	}
+
+	values = map[string]*value{}
+	for _, s := range chunk.Series {
+		var total, count float64
+		for _, p := range s.Points {
+			total += p.Total
+			count += p.Count
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		values[key(r.Name, s.Fields)] = &value{s.Fields, total / count}
+	}
+
+	return values, nil
+}
+
+// check checks whether the value meets the rule condition
+func (r *Rule) check(v float64) bool {
+	switch r.Op {
+	case ">":
+		return v > r.Threshold
+	case ">=":
+		return v >= r.Threshold
+	case "<":
+		return v < r.Threshold
+	case "<=":
+		return v <= r.Threshold
+	}
+
+	return false
+}
+
+// valid checks whether the rule is valid for a database with given resolution
+func (r *Rule) valid(res int64) bool {
+	if r.Name == "" || len(r.Fields) == 0 || r.Window <= 0 || r.For < 0 {
+		return false
+	}
+
+	if int64(r.Window)%res != 0 {
+		return false
+	}
+
+	switch r.Agg {
+	case query.Sum, query.Avg, query.Min, query.Max, query.Count:
+	default:
+		return false
+	}
+
+	switch r.Op {
+	case ">", ">=", "<", "<=":
+	default:
+		return false
+	}
+
+	for _, n := range r.By {
+		if n < 1 || n > len(r.Fields) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// key creates a unique key for an alert
+func key(rule string, fields []string) string {
+	return rule + "\x00" + strings.Join(fields, "\x00")
+}
+
+// copyAlert copies an alert to be used in notifications
+func copyAlert(a *Alert) *Alert {
+	c := *a
+	c.Fields = append([]string{}, a.Fields...)
+	return &c
+}
@@ -0,0 +1,497 @@
+package alert
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb/query"
+)
+
+var (
+	tmpdira = "/tmp/test-alert/"
+)
+
+type recorder struct {
+	alerts []*Alert
+	err    error
+}
+
+func (r *recorder) Notify(alerts []*Alert) (err error) {
+	r.alerts = append(r.alerts, alerts...)
+	return r.err
+}
+
+func setupa(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdira); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdira); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func rule() *Rule {
+	return &Rule{
+		Name:      "high",
+		Agg:       query.Avg,
+		By:        []int{2},
+		Fields:    []string{"app", "*", "latency"},
+		Window:    2 * time.Minute,
+		Op:        ">",
+		Threshold: 50,
+		For:       time.Minute,
+	}
+}
+
+func TestEval(t *testing.T) {
+	defer setupa(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdira+"db", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// "a" is above the threshold and "b" is below it
+	base := time.Now().Truncate(time.Hour)
+	for i := 0; i < 2; i++ {
+		ts := uint64(base.Add(time.Duration(i) * time.Minute).UnixNano())
+		if err := db.Track(ts, []string{"app", "a", "latency"}, 100, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Track(ts, []string{"app", "b", "latency"}, 10, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := &recorder{}
+	opts := &Options{State: tmpdira + "alerts.json", Interval: time.Hour}
+	e, err := New(db, rec, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Add(rule()); err != nil {
+		t.Fatal(err)
+	}
+
+	// condition is met but not yet for a minute
+	if err := e.Eval(base.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := e.Alerts()
+	if len(alerts) != 1 || alerts[0].State != Pending || alerts[0].Value != 100 ||
+		len(alerts[0].Fields) != 1 || alerts[0].Fields[0] != "a" || len(rec.alerts) != 0 {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// alerts are loaded from the state file
+	e, err = New(db, rec, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e.Close()
+
+	if err := e.Add(rule()); err != nil {
+		t.Fatal(err)
+	}
+
+	if alerts := e.Alerts(); len(alerts) != 1 || alerts[0].State != Pending {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	// condition is met for a minute (window still has data for "a")
+	if err := e.Eval(base.Add(3 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts = e.Alerts()
+	if len(alerts) != 1 || alerts[0].State != Firing || !alerts[0].FiredAt.Equal(base.Add(3*time.Minute)) {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	if len(rec.alerts) != 1 || rec.alerts[0].State != Firing {
+		t.Fatal("wrong notifications", rec.alerts)
+	}
+
+	// firing alerts are not notified again
+	if err := e.Eval(base.Add(3*time.Minute + 30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.alerts) != 1 {
+		t.Fatal("wrong notifications", rec.alerts)
+	}
+
+	// no data in the window
+	if err := e.Eval(base.Add(4 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// resolved alerts are kept for a while
+	if alerts := e.Alerts(); len(alerts) != 1 || alerts[0].State != Resolved || !alerts[0].Notified {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	if len(rec.alerts) != 2 || rec.alerts[1].State != Resolved || rec.alerts[1].Fields[0] != "a" {
+		t.Fatal("wrong notifications", rec.alerts)
+	}
+
+	if err := e.Eval(base.Add(2*time.Hour + 4*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if alerts := e.Alerts(); len(alerts) != 0 {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	// notification errors are returned
+	rec.err = errors.New("oops")
+	if err := e.Eval(base.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Eval(base.Add(3 * time.Minute)); err != rec.err {
+		t.Fatal("should return an error", err)
+	}
+
+	if alerts := e.Alerts(); len(alerts) != 1 || alerts[0].State != Firing || alerts[0].Notified {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	// failed notifications are sent again
+	rec.err = nil
+	if err := e.Eval(base.Add(3*time.Minute + 30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(rec.alerts); rec.alerts[n-1].State != Firing || rec.alerts[n-2].State != Firing {
+		t.Fatal("wrong notifications", rec.alerts)
+	}
+
+	if alerts := e.Alerts(); len(alerts) != 1 || !alerts[0].Notified {
+		t.Fatal("wrong alerts", alerts)
+	}
+}
+
+// blocker is a notifier which waits until it's released
+type blocker struct {
+	called  chan struct{}
+	release chan struct{}
+}
+
+func (b *blocker) Notify(alerts []*Alert) (err error) {
+	close(b.called)
+	<-b.release
+	return nil
+}
+
+func TestNotifyUnlocked(t *testing.T) {
+	defer setupa(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdira+"db", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// "a" is above the threshold and "b" is below it
+	base := time.Now().Truncate(time.Hour)
+	for i := 0; i < 2; i++ {
+		ts := uint64(base.Add(time.Duration(i) * time.Minute).UnixNano())
+		if err := db.Track(ts, []string{"app", "a", "latency"}, 100, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Track(ts, []string{"app", "b", "latency"}, 10, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := &blocker{called: make(chan struct{}), release: make(chan struct{})}
+	e, err := New(db, b, &Options{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e.Close()
+
+	r := rule()
+	r.For = 0
+	if err := e.Add(r); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Eval(base.Add(2 * time.Minute))
+	}()
+
+	<-b.called
+
+	// other methods can be used while notifying
+	if alerts := e.Alerts(); len(alerts) != 1 || alerts[0].Notified {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	close(b.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if alerts := e.Alerts(); len(alerts) != 1 || !alerts[0].Notified {
+		t.Fatal("wrong alerts", alerts)
+	}
+}
+
+func TestEvalNoNotifier(t *testing.T) {
+	defer setupa(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdira+"db", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Now().Truncate(time.Hour)
+	for i := 0; i < 2; i++ {
+		ts := uint64(base.Add(time.Duration(i) * time.Minute).UnixNano())
+		if err := db.Track(ts, []string{"app", "a", "latency"}, 100, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a firing alert which failed to notify with a notifier before
+	opts := &Options{State: tmpdira + "alerts.json", Interval: time.Hour}
+	e, err := New(db, &recorder{err: errors.New("failed")}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Add(rule()); err != nil {
+		t.Fatal(err)
+	}
+
+	e.Eval(base.Add(time.Minute))
+	if err := e.Eval(base.Add(2 * time.Minute)); err == nil {
+		t.Fatal("should return an error")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = New(db, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e.Close()
+
+	if err := e.Add(rule()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Eval(base.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if alerts := e.Alerts(); len(alerts) != 1 || alerts[0].State != Firing || !alerts[0].Notified {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	// alerts of rules which are no longer registered are dropped
+	e2, err := New(db, nil, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e2.Close()
+
+	if alerts := e2.Alerts(); len(alerts) != 1 {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	if err := e2.Eval(base.Add(3 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if alerts := e2.Alerts(); len(alerts) != 0 {
+		t.Fatal("wrong alerts", alerts)
+	}
+
+	data, err := ioutil.ReadFile(opts.State)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != "[]" {
+		t.Fatal("wrong state file", string(data))
+	}
+}
+
+func TestResolvedNotNotified(t *testing.T) {
+	defer setupa(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdira+"db", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// "a" is above the threshold, then below it and above it again
+	base := time.Now().Truncate(time.Hour)
+	for i, v := range []float64{100, 100, 10, 10, 100, 100} {
+		ts := uint64(base.Add(time.Duration(i) * time.Minute).UnixNano())
+		if err := db.Track(ts, []string{"app", "a", "latency"}, v, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := &recorder{}
+	e, err := New(db, rec, &Options{Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e.Close()
+
+	r := rule()
+	r.For = 0
+	if err := e.Add(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Eval(base.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the resolved notification fails
+	rec.err = errors.New("failed")
+	if err := e.Eval(base.Add(4 * time.Minute)); err == nil {
+		t.Fatal("should return an error")
+	}
+
+	// the alert stays resolved until its resolution is notified
+	rec.err = nil
+	rec.alerts = nil
+	if err := e.Eval(base.Add(6 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.alerts) != 1 || rec.alerts[0].State != Resolved {
+		t.Fatal("wrong notifications", rec.alerts)
+	}
+
+	rec.alerts = nil
+	if err := e.Eval(base.Add(6 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rec.alerts) != 1 || rec.alerts[0].State != Firing {
+		t.Fatal("wrong notifications", rec.alerts)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	defer setupa(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdira+"db", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	e, err := New(db, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer e.Close()
+
+	invalid := []func(r *Rule){
+		func(r *Rule) { r.Name = "" },
+		func(r *Rule) { r.Agg = "median" },
+		func(r *Rule) { r.Fields = nil },
+		func(r *Rule) { r.Window = 0 },
+		func(r *Rule) { r.Window = 90 * time.Second },
+		func(r *Rule) { r.Op = "==" },
+		func(r *Rule) { r.For = -time.Second },
+		func(r *Rule) { r.By = []int{4} },
+	}
+
+	for i, fn := range invalid {
+		r := rule()
+		fn(r)
+
+		if err := e.Add(r); err != ErrInvRule {
+			t.Fatal("should return an error", i)
+		}
+	}
+
+	if err := e.Add(rule()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Add(rule()); err != ErrExists {
+		t.Fatal("should return an error")
+	}
+
+	if err := e.Remove("high"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Add(rule()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,49 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Webhook is a notifier which sends alerts to a URL with a POST request.
+// The request body is a JSON object with an "alerts" array. Responses
+// with a non 2xx status code are considered as failed notifications.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhook creates a webhook notifier with a request timeout
+func NewWebhook(url string, timeout time.Duration) (w *Webhook) {
+	return &Webhook{
+		URL:    url,
+		Client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Notify sends alerts to the webhook URL
+func (w *Webhook) Notify(alerts []*Alert) (err error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"alerts": alerts,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	res, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", res.StatusCode)
+	}
+
+	return nil
+}
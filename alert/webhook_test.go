@@ -0,0 +1,52 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	var body struct {
+		Alerts []*Alert
+	}
+
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Fatal("wrong request")
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+
+		w.WriteHeader(status)
+	}))
+
+	defer ts.Close()
+
+	w := NewWebhook(ts.URL, time.Second)
+	alerts := []*Alert{{Rule: "high", Fields: []string{"a"}, State: Firing, Value: 100}}
+
+	if err := w.Notify(alerts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(body.Alerts) != 1 || body.Alerts[0].Rule != "high" || body.Alerts[0].State != Firing ||
+		body.Alerts[0].Fields[0] != "a" || body.Alerts[0].Value != 100 {
+		t.Fatal("wrong body", body.Alerts)
+	}
+
+	status = http.StatusInternalServerError
+	if err := w.Notify(alerts); err == nil {
+		t.Fatal("should return an error")
+	}
+
+	ts.Close()
+	if err := w.Notify(alerts); err == nil {
+		t.Fatal("should return an error")
+	}
+}
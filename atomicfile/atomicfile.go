@@ -0,0 +1,38 @@
+// Package atomicfile replaces files atomically. Data is written to a
+// temporary file in the same directory which is then renamed over the
+// original file therefore readers never see a partially written file.
+package atomicfile
+
+import (
+	"os"
+)
+
+// Write writes data to the file replacing it atomically. The file is created
+// if it does not exist.
+func Write(file string, data []byte) (err error) {
+	tmp := file + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
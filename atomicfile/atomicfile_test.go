@@ -0,0 +1,51 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+var (
+	tmpdir = "/tmp/test-atomicfile/"
+)
+
+func TestWrite(t *testing.T) {
+	if err := os.RemoveAll(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(tmpdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(tmpdir)
+
+	file := path.Join(tmpdir, "state")
+	for _, str := range []string{"first", "second"} {
+		if err := Write(file, []byte(str)); err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(data) != str {
+			t.Fatal("wrong data", string(data))
+		}
+	}
+
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary file should not exist")
+	}
+}
+
+func TestWriteNoDir(t *testing.T) {
+	file := path.Join(tmpdir, "missing", "state")
+	if err := Write(file, []byte("data")); err == nil {
+		t.Fatal("should return an error")
+	}
+}
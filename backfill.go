@@ -0,0 +1,336 @@
+package kadiyadb
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/epoch"
+)
+
+var (
+	// ErrVerify is returned when point sums of backfilled data
+	// do not match point sums of source data after backfilling.
+	ErrVerify = errors.New("backfilled data does not match source data")
+
+	// ErrNotEmpty is returned when the target database already has data
+	// within the time range which should be backfilled.
+	ErrNotEmpty = errors.New("target time range already has data")
+)
+
+// Backfill reads existing epochs of the database in `src` and writes points
+// within the time range [from, to) to the database in `dst` with params `p`.
+// Totals and counts are aggregated into the (coarser) resolution in params.
+// This can be used to fill a rollup database with data tracked before the
+// rollup was added. The target time range must not have any data already
+// (ErrNotEmpty is returned before writing anything if it has). After
+// writing, sums of all points in both databases are compared for each
+// record and ErrVerify is returned if they do not match. Rollups in params
+// are ignored, use the rollup directory and params to backfill a rollup.
+// The target database must not be in use (e.g. stop the server before
+// backfilling a rollup of a database it serves). The retention policy is
+// not applied to the target database while backfilling. Source epochs are
+// not modified therefore the source database can be in use but points
+// written to it while backfilling may not be backfilled or verified.
+func Backfill(src, dst string, p *Params, from, to int64) (err error) {
+	if p == nil || path.Clean(src) == path.Clean(dst) {
+		return ErrInvParams
+	}
+
+	params := *p
+	params.Rollups = nil
+
+	if !params.valid() {
+		return ErrInvParams
+	}
+
+	if from < 0 || to < from ||
+		from%params.Resolution != 0 ||
+		to%params.Resolution != 0 {
+		return ErrInvTime
+	}
+
+	metas, err := readMetas(src)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range metas {
+		if params.Resolution%m.Resolution != 0 {
+			return ErrInvParams
+		}
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		existing, err := sums(dst, from, to)
+		if err != nil {
+			return err
+		} else if len(existing) > 0 {
+			return ErrNotEmpty
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// backfilled epochs can be older than the retention period
+	db, err := open(dst, &params)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range metas {
+		if err := backfillEpoch(db, src, m, from, to); err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	if err := db.Sync(); err != nil {
+		db.Close()
+		return err
+	}
+
+	if err := db.Close(); err != nil {
+		return err
+	}
+
+	return verify(src, dst, from, to)
+}
+
+// backfillEpoch writes points of a source epoch within given range to db
+func backfillEpoch(db *DB, src string, m *epoch.Meta, from, to int64) (err error) {
+	start, end, ok := inRange(m, from, to)
+	if !ok {
+		return nil
+	}
+
+	dir := path.Join(src, strconv.FormatInt(m.Start, 10))
+	e, err := openEpoch(dir, m)
+	if err != nil {
+		return err
+	}
+
+	defer e.Close()
+
+	points, nodes, err := e.FetchAll(start, end)
+	if err != nil {
+		return err
+	}
+
+	for i, node := range nodes {
+		for j, point := range points[i] {
+			if point.Total == 0 && point.Count == 0 {
+				continue
+			}
+
+			ts := m.Start + (start+int64(j))*m.Resolution
+			if err := db.put(ts, node.Fields, point.Total, point.Count); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// put records a measurement the same way as Track but only the record which
+// exactly matches given fields is updated (see epoch.Epoch.Put for details).
+// Rollups are not updated when recording measurements with this method.
+func (d *DB) put(ts int64, fields []string, total, count float64) (err error) {
+	m, pos := d.split(ts)
+
+	e, err := d.cache.LoadRW(m.Start)
+	if err != nil {
+		return err
+	}
+
+	return e.Put(pos, fields, total, count)
+}
+
+// verify compares point sums of each record in two databases in given range
+func verify(src, dst string, from, to int64) (err error) {
+	srcSums, err := sums(src, from, to)
+	if err != nil {
+		return err
+	}
+
+	dstSums, err := sums(dst, from, to)
+	if err != nil {
+		return err
+	}
+
+	if len(srcSums) != len(dstSums) {
+		return ErrVerify
+	}
+
+	for key, sp := range srcSums {
+		dp, ok := dstSums[key]
+		if !ok || !equalish(sp.Total, dp.Total) || !equalish(sp.Count, dp.Count) {
+			return ErrVerify
+		}
+	}
+
+	return nil
+}
+
+// sums calculates the sum of all points in given range for each record.
+// Records are identified by their fields joined with a null character.
+// Records which only have empty points in the range are not included.
+func sums(dir string, from, to int64) (res map[string]*protocol.Point, err error) {
+	metas, err := readMetas(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	res = map[string]*protocol.Point{}
+
+	for _, m := range metas {
+		start, end, ok := inRange(m, from, to)
+		if !ok {
+			continue
+		}
+
+		edir := path.Join(dir, strconv.FormatInt(m.Start, 10))
+		e, err := openEpoch(edir, m)
+		if err != nil {
+			return nil, err
+		}
+
+		points, nodes, err := e.FetchAll(start, end)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+
+		for i, node := range nodes {
+			for _, point := range points[i] {
+				if point.Total == 0 && point.Count == 0 {
+					continue
+				}
+
+				key := strings.Join(node.Fields, "\x00")
+				sum, ok := res[key]
+				if !ok {
+					sum = &protocol.Point{}
+					res[key] = sum
+				}
+
+				sum.Total += point.Total
+				sum.Count += point.Count
+			}
+		}
+
+		if err := e.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// openEpoch loads an existing epoch to read its points. Epochs are loaded in
+// read-write mode because loading them in read-only mode writes an index
+// snapshot if it's missing. The snapshot would not have records added later
+// if the epoch is still being written (e.g. active epochs of the source).
+func openEpoch(dir string, m *epoch.Meta) (e *epoch.Epoch, err error) {
+	return epoch.NewRW(dir, m)
+}
+
+// readMetas reads metadata of all epochs in a database directory. Epochs
+// created before metadata files were introduced use the params history
+// or the param file if the database doesn't have a params history either.
+func readMetas(dir string) (metas []*epoch.Meta, err error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var history []*period
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		// only epoch directories are named with numbers
+		ets, err := strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		m, err := epoch.ReadMeta(path.Join(dir, file.Name()))
+		if err == nil {
+			metas = append(metas, m)
+			continue
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if history == nil {
+			history, err = readHistory(dir)
+			if os.IsNotExist(err) {
+				history, err = paramHistory(dir)
+			}
+
+			if err != nil {
+				return nil, err
+			} else if len(history) == 0 {
+				return nil, ErrInvParams
+			}
+		}
+
+		p := findPeriod(history, ets)
+		metas = append(metas, epoch.NewMeta(ets, p.Duration, p.Resolution))
+	}
+
+	return metas, nil
+}
+
+// paramHistory returns the params history of a database without a history
+// file. All of its epochs were created with params in its param file.
+func paramHistory(dir string) (history []*period, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, paramfile))
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := ParseParams(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*period{{0, p.Duration, p.Resolution}}, nil
+}
+
+// inRange returns the range of point positions in an epoch which have
+// their start times within given time range [from, to) if there's any.
+func inRange(m *epoch.Meta, from, to int64) (start, end int64, ok bool) {
+	ets := m.Start + m.Duration
+	if to <= m.Start || from >= ets {
+		return 0, 0, false
+	}
+
+	if from > m.Start {
+		start = (from - m.Start + m.Resolution - 1) / m.Resolution
+	}
+
+	end = m.RecordSize
+	if to < ets {
+		end = (to - m.Start + m.Resolution - 1) / m.Resolution
+	}
+
+	return start, end, start < end
+}
+
+// equalish checks whether two float values are equal with a small tolerance
+// Sums of same values can be slightly different when they're added in a
+// different order therefore the exact values cannot be compared safely.
+func equalish(a, b float64) bool {
+	max := math.Max(math.Max(math.Abs(a), math.Abs(b)), 1)
+	return math.Abs(a-b) <= max*1e-9
+}
@@ -0,0 +1,154 @@
+package kadiyadb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestBackfill(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	src := dir + "/src"
+	dst := dir + "/dst"
+	hour := int64(time.Hour)
+
+	p := &Params{
+		Duration:    hour,
+		Retention:   24 * hour,
+		Resolution:  int64(time.Minute),
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(src, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two points in first hour, one in the second hour
+	// the last one is outside the backfill time range
+	tracks := []struct {
+		ts     int64
+		fields []string
+	}{
+		{0, []string{"a", "b"}},
+		{30 * int64(time.Minute), []string{"a", "c"}},
+		{hour + int64(time.Minute), []string{"a", "b"}},
+		{3 * hour, []string{"a", "b"}},
+	}
+
+	for _, tr := range tracks {
+		if err := db.Track(uint64(tr.ts), tr.fields, 2, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := &Params{
+		Duration:    12 * hour,
+		Retention:   48 * hour,
+		Resolution:  hour,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	if err := Backfill(src, dst, p2, 0, 2*hour); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := Open(dst, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	db2.Fetch(0, uint64(4*hour), []string{"a"}, func(res []*protocol.Chunk, err error) {
+		defer wg.Done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points := []protocol.Point{{4, 2}, {2, 1}, {0, 0}, {0, 0}}
+		if len(res) != 1 || !reflect.DeepEqual(res[0].Series[0].Points, points) {
+			t.Fatal("wrong points")
+		}
+	})
+
+	db2.Fetch(0, uint64(4*hour), []string{"a", "b"}, func(res []*protocol.Chunk, err error) {
+		defer wg.Done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points := []protocol.Point{{2, 1}, {2, 1}, {0, 0}, {0, 0}}
+		if len(res) != 1 || !reflect.DeepEqual(res[0].Series[0].Points, points) {
+			t.Fatal("wrong points")
+		}
+	})
+
+	wg.Wait()
+
+	if err := db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the target range already has data
+	if err := Backfill(src, dst, p2, 0, 2*hour); err != ErrNotEmpty {
+		t.Fatal("should return an error")
+	}
+
+	// the target range is not aligned to the resolution
+	if err := Backfill(src, dst, p2, 0, hour/2); err != ErrInvTime {
+		t.Fatal("should return an error")
+	}
+
+	// source epochs should not be modified (no index snapshots are written)
+	snaps, err := filepath.Glob(src + "/*/snap*")
+	if err != nil || len(snaps) != 0 {
+		t.Fatal("source epochs should not have snapshots", snaps, err)
+	}
+
+	// databases created before meta and history files were introduced
+	metas, err := filepath.Glob(src + "/*/meta.json")
+	if err != nil || len(metas) != 3 {
+		t.Fatal("wrong meta files", metas, err)
+	}
+
+	for _, f := range append(metas, src+"/"+histfile) {
+		if err := os.Remove(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := []byte(`{"duration": "1h", "resolution": "1m", "retention": "24h", "maxROEpochs": 2, "maxRWEpochs": 2}`)
+	if err := ioutil.WriteFile(src+"/"+paramfile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Backfill(src, dir+"/dst2", p2, 0, 2*hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
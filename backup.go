@@ -0,0 +1,319 @@
+package kadiyadb
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// manifestfile is the name of the manifest in backup archives. It's the
+	// last entry in the archive because it has checksums of all other files.
+	//
+	// Manifest File Format:
+	//
+	//   {
+	//     "version": 1,
+	//     "created": 1450000000000000000,
+	//     "files": [
+	//       {"name": "params.json", "size": 120, "sha256": "9f86d0..."}
+	//     ]
+	//   }
+	//
+	manifestfile = "manifest.json"
+
+	// ManifestVersion is the current version of the backup manifest format
+	ManifestVersion = 1
+)
+
+var (
+	// ErrNoManifest is returned when restoring an archive without a manifest
+	ErrNoManifest = errors.New("backup manifest not found")
+
+	// ErrChecksum is returned when restored files do not match the manifest
+	ErrChecksum = errors.New("backup checksum mismatch")
+
+	// ErrRestoreDir is returned when restoring into an existing directory
+	ErrRestoreDir = errors.New("restore directory already exists")
+)
+
+// Manifest describes the content of a backup archive
+type Manifest struct {
+	Version int64           `json:"version"`
+	Created int64           `json:"created"`
+	Files   []*ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file in a backup archive
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Backup writes a copy of the database (including rollups) to w in tar format
+// while the database is in use. Each epoch is consistent but epochs are copied
+// one at a time, so writes made during the backup may be in some epochs only.
+// Writes to the epoch being copied wait until it's copied into a temporary
+// directory. Only param and history files and epochs are included (restored
+// databases start new change logs and state files).
+// A manifest with checksums of all files is written at the end of the archive.
+func (d *DB) Backup(w io.Writer) (err error) {
+	m := &Manifest{
+		Version: ManifestVersion,
+		Created: time.Now().UnixNano(),
+	}
+
+	tw := tar.NewWriter(w)
+	if err := d.backup(tw, "", m); err != nil {
+		return err
+	}
+
+	for _, r := range d.rollups {
+		prefix := path.Base(r.dir)
+		if err := r.backup(tw, prefix, m); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:    manifestfile,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// Restore extracts a backup archive written with Backup into a directory
+// which must not exist. Files are extracted into a temporary directory and
+// moved into place only if they match sizes and checksums in the manifest.
+// The restored database can be loaded with LoadAll or opened with Open.
+func Restore(r io.Reader, dir string) (err error) {
+	dir = path.Clean(dir)
+	if _, err := os.Stat(dir); err == nil {
+		return ErrRestoreDir
+	}
+
+	if err := os.MkdirAll(path.Dir(dir), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(path.Dir(dir), "."+path.Base(dir)+"-")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	if err := readTar(tar.NewReader(r), tmp); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(path.Join(tmp, manifestfile))
+	if os.IsNotExist(err) {
+		return ErrNoManifest
+	} else if err != nil {
+		return err
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return err
+	}
+
+	if err := verifyFiles(tmp, m); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path.Join(tmp, manifestfile)); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, dir)
+}
+
+// backup writes param and history files and all epochs to tw.
+// Rollup directories and the change log directory are not included.
+func (d *DB) backup(tw *tar.Writer, prefix string, m *Manifest) (err error) {
+	for _, name := range []string{paramfile, histfile} {
+		p := path.Join(d.dir, name)
+
+		info, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = path.Join(prefix, name)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if err := writeFile(tw, p, hdr.Name, info.Size(), m); err != nil {
+			return err
+		}
+	}
+
+	starts, err := d.epochs()
+	if err != nil {
+		return err
+	}
+
+	for _, start := range starts {
+		if err := d.backupEpoch(tw, start, prefix, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backupEpoch writes a copy of epoch files to tw. Writes to the epoch are
+// only blocked while the copy is made, not while it's written to tw.
+func (d *DB) backupEpoch(tw *tar.Writer, start int64, prefix string, m *Manifest) (err error) {
+	tmp, _, err := d.copyEpoch(start)
+	if err == ErrNoEpoch {
+		// the epoch may have been removed by the retention policy
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+
+	name := strconv.FormatInt(start, 10)
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = path.Join(prefix, name) + "/"
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	return writeTar(tw, tmp, path.Join(prefix, name), m)
+}
+
+// freeze blocks writes to an epoch until it's unfrozen.
+// It waits until writes in progress are completed.
+func (d *DB) freeze(start int64) {
+	d.barrier.Lock()
+	d.frozen[start] = true
+	d.barrier.Unlock()
+}
+
+// unfreeze allows writes to a frozen epoch
+func (d *DB) unfreeze(start int64) {
+	d.barrier.Lock()
+	delete(d.frozen, start)
+	d.barrier.Unlock()
+
+	d.thaw.Broadcast()
+}
+
+// verifyFiles checks whether extracted files match the manifest
+func verifyFiles(dir string, m *Manifest) (err error) {
+	expected := make(map[string]*ManifestFile, len(m.Files))
+	for _, f := range m.Files {
+		expected[f.Name] = f
+	}
+
+	found := 0
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		if name == manifestfile {
+			return nil
+		}
+
+		f, ok := expected[name]
+		if !ok || f.Size != info.Size() {
+			return ErrChecksum
+		}
+
+		sum, err := checksum(p)
+		if err != nil {
+			return err
+		} else if sum != f.SHA256 {
+			return ErrChecksum
+		}
+
+		found++
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if found != len(expected) {
+		return ErrChecksum
+	}
+
+	return nil
+}
+
+// checksum returns the hex encoded sha256 checksum of a file
+func checksum(p string) (sum string, err error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
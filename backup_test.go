@@ -0,0 +1,207 @@
+package kadiyadb
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func backupParams() *Params {
+	return &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Rollups: []*Params{
+			{Resolution: 600000000000, Retention: 36000000000000},
+		},
+	}
+}
+
+func sum(t *testing.T, db *DB, from, to uint64, fields []string) (total float64) {
+	db.Fetch(from, to, fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range chunks {
+			for _, s := range c.Series {
+				for _, p := range s.Points {
+					total += p.Total
+				}
+			}
+		}
+	})
+
+	return total
+}
+
+func TestBackupRestore(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir+"/src", backupParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	now := time.Now().Truncate(time.Hour)
+	from := uint64(now.Add(-2 * time.Hour).UnixNano())
+	to := uint64(now.Add(time.Hour).UnixNano())
+
+	for i := 0; i < 3; i++ {
+		ts := uint64(now.Add(-time.Duration(i) * time.Hour).UnixNano())
+		if err := db.Track(ts, []string{"a", "b"}, float64(i+1), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// state files of other packages are not included
+	if err := ioutil.WriteFile(dir+"/src/state.json", []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// writes made while the backup is in progress should not fail
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if err := db.Track(uint64(now.UnixNano()), []string{"a", "c"}, 1, 1); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// segment files are large, write the archive to a file
+	archive := dir + "/backup.tar"
+	file, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	if err := db.Backup(file); err != nil {
+		t.Fatal(err)
+	}
+
+	<-done
+
+	restore := func(dst string) (err error) {
+		if _, err := file.Seek(0, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		return Restore(file, dst)
+	}
+
+	if err := restore(dir + "/dst"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(dir + "/dst"); err != ErrRestoreDir {
+		t.Fatal("should return an error")
+	}
+
+	if _, err := os.Stat(dir + "/dst/state.json"); !os.IsNotExist(err) {
+		t.Fatal("should not restore state files")
+	}
+
+	restored, err := Open(dir+"/dst", backupParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer restored.Close()
+
+	if total := sum(t, restored, from, to, []string{"a", "b"}); total != 6 {
+		t.Fatal("wrong total", total)
+	}
+
+	// all writes made to the active epoch either made it or not
+	if total := sum(t, restored, from, to, []string{"a", "c"}); total < 0 || total > 100 {
+		t.Fatal("wrong total", total)
+	}
+
+	if total := sum(t, restored.rollups[0], from, to, []string{"a", "b"}); total != 6 {
+		t.Fatal("wrong rollup total", total)
+	}
+
+	// corrupt a byte in the first file (the manifest is not changed)
+	if _, err := file.WriteAt([]byte{'x'}, 512); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(dir + "/bad"); err != ErrChecksum {
+		t.Fatal("should return an error", err)
+	}
+
+	if _, err := os.Stat(dir + "/bad"); !os.IsNotExist(err) {
+		t.Fatal("should not create the directory")
+	}
+
+	empty := &bytes.Buffer{}
+	tar.NewWriter(empty).Close()
+	if err := Restore(empty, dir+"/bad"); err != ErrNoManifest {
+		t.Fatal("should return an error", err)
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	db, err := Open(dir, backupParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	now := time.Now().Truncate(time.Hour)
+	ts := uint64(now.UnixNano())
+
+	db.freeze(now.UnixNano())
+
+	tracked := make(chan error, 1)
+	go func() {
+		tracked <- db.Track(ts, []string{"a"}, 1, 1)
+	}()
+
+	// writes to other epochs are not blocked
+	if err := db.Track(uint64(now.Add(-time.Hour).UnixNano()), []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-tracked:
+		t.Fatal("write to a frozen epoch should wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	db.unfreeze(now.UnixNano())
+
+	select {
+	case err := <-tracked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write should continue after unfreezing")
+	}
+}
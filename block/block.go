@@ -25,6 +25,14 @@ const (
 	pointsz = 16
 )
 
+const (
+	// PointSize is the size of a single point in bytes as stored on disk.
+	PointSize = pointsz
+
+	// SegmentSize is the size of a block segment file as stored on disk.
+	SegmentSize = segsz
+)
+
 func init() {
 	// Make sure that the point size is what we're expecting
 	// it depends on hardware devices therefore can change.
@@ -0,0 +1,174 @@
+package kadiyadb
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// Bucket is a calendar period used to merge points with FetchBuckets
+type Bucket int
+
+const (
+	// BucketDay merges points into calendar days
+	BucketDay Bucket = iota
+
+	// BucketWeek merges points into calendar weeks starting on Monday
+	BucketWeek
+)
+
+var (
+	// ErrInvBucket is returned when the bucket is invalid or when points
+	// cannot be merged into buckets because they span bucket boundaries
+	// (e.g. 1h resolution with a timezone which has a 30 minute offset).
+	ErrInvBucket = errors.New("points are not aligned with calendar buckets")
+)
+
+// FetchBuckets fetches data the same way as Fetch but merges points into
+// calendar day or week buckets in given location. The time range is extended
+// to start and end at bucket boundaries. A chunk is returned for each bucket
+// with a single point for each series. Chunks have different durations when
+// daylight saving time changes during the bucket. Totals and counts of merged
+// points are summed up. The result does not share memory with the database.
+func (d *DB) FetchBuckets(from, to uint64, fields []string, b Bucket, loc *time.Location, fn Handler) {
+	if b < BucketDay || b > BucketWeek || loc == nil || to < from || int64(to) < 0 {
+		fn(nil, ErrInvBucket)
+		return
+	}
+
+	start := bucketStart(time.Unix(0, int64(from)).In(loc), b)
+	if start.UnixNano() < 0 {
+		start = time.Unix(0, 0)
+	}
+
+	end := bucketStart(time.Unix(0, int64(to)).In(loc), b)
+	if end.UnixNano() < int64(to) {
+		end = bucketEnd(end, b)
+	}
+
+	d.Fetch(uint64(start.UnixNano()), uint64(end.UnixNano()), fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		res, err := Buckets(chunks, b, loc)
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		fn(res, nil)
+	})
+}
+
+// Buckets merges points of consecutive chunks into calendar day or week
+// buckets in given location. A chunk is returned for each bucket from the
+// one containing the start of the first chunk to the one containing the end
+// of the last chunk. All result chunks have all series (matched by fields
+// and ordered by first appearance) with a single point.
+func Buckets(chunks []*protocol.Chunk, b Bucket, loc *time.Location) (res []*protocol.Chunk, err error) {
+	if b < BucketDay || b > BucketWeek || loc == nil {
+		return nil, ErrInvBucket
+	}
+
+	res = []*protocol.Chunk{}
+	if len(chunks) == 0 {
+		return res, nil
+	}
+
+	keys := map[string]int{}
+	fields := [][]string{}
+	for _, c := range chunks {
+		for _, s := range c.Series {
+			key := strings.Join(s.Fields, "\x00")
+			if _, ok := keys[key]; !ok {
+				keys[key] = len(fields)
+				fields = append(fields, s.Fields)
+			}
+		}
+	}
+
+	first := chunks[0].From
+	last := chunks[len(chunks)-1].To
+
+	for t := bucketStart(time.Unix(0, int64(first)).In(loc), b); ; {
+		next := bucketEnd(t, b)
+		c := &protocol.Chunk{
+			From:   uint64(t.UnixNano()),
+			To:     uint64(next.UnixNano()),
+			Series: make([]*protocol.Series, len(fields)),
+		}
+
+		for i, f := range fields {
+			c.Series[i] = &protocol.Series{
+				Fields: append([]string{}, f...),
+				Points: make([]protocol.Point, 1),
+			}
+		}
+
+		res = append(res, c)
+
+		if c.To >= last {
+			break
+		}
+
+		t = next
+	}
+
+	for _, c := range chunks {
+		for _, s := range c.Series {
+			count := uint64(len(s.Points))
+			if count == 0 {
+				continue
+			}
+
+			resolution := (c.To - c.From) / count
+			idx := keys[strings.Join(s.Fields, "\x00")]
+
+			for i, p := range s.Points {
+				if p.Count == 0 && p.Total == 0 {
+					continue
+				}
+
+				ts := c.From + uint64(i)*resolution
+				j := sort.Search(len(res), func(k int) bool { return res[k].To > ts })
+				if j == len(res) || res[j].From > ts || ts+resolution > res[j].To {
+					return nil, ErrInvBucket
+				}
+
+				bp := &res[j].Series[idx].Points[0]
+				bp.Total += p.Total
+				bp.Count += p.Count
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// bucketStart returns the start of the bucket containing the time
+func bucketStart(t time.Time, b Bucket) time.Time {
+	y, m, d := t.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+
+	if b == BucketWeek {
+		// weekdays start from Sunday (0)
+		days := (int(start.Weekday()) + 6) % 7
+		start = start.AddDate(0, 0, -days)
+	}
+
+	return start
+}
+
+// bucketEnd returns the end of the bucket which starts at given time
+func bucketEnd(start time.Time, b Bucket) time.Time {
+	if b == BucketWeek {
+		return start.AddDate(0, 0, 7)
+	}
+
+	return start.AddDate(0, 0, 1)
+}
@@ -0,0 +1,149 @@
+package kadiyadb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestBuckets(t *testing.T) {
+	// 2 hours ahead of UTC, local days start at 22:00 UTC
+	loc := time.FixedZone("UTC+2", 2*3600)
+	hour := uint64(time.Hour)
+	base := uint64(time.Date(2016, 1, 4, 20, 0, 0, 0, time.UTC).UnixNano())
+
+	chunks := []*protocol.Chunk{
+		{
+			// 2016-01-04 20:00 - 2016-01-05 00:00 UTC (1h resolution)
+			From: base,
+			To:   base + 4*hour,
+			Series: []*protocol.Series{
+				{Fields: []string{"a"}, Points: []protocol.Point{{1, 1}, {2, 1}, {3, 1}, {4, 1}}},
+			},
+		},
+		{
+			// 2016-01-05 00:00 - 2016-01-05 02:00 UTC (2h resolution)
+			From: base + 4*hour,
+			To:   base + 6*hour,
+			Series: []*protocol.Series{
+				{Fields: []string{"b"}, Points: []protocol.Point{{5, 1}}},
+			},
+		},
+	}
+
+	res, err := Buckets(chunks, BucketDay, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	day1 := uint64(time.Date(2016, 1, 4, 0, 0, 0, 0, loc).UnixNano())
+	day2 := uint64(time.Date(2016, 1, 5, 0, 0, 0, 0, loc).UnixNano())
+	day3 := uint64(time.Date(2016, 1, 6, 0, 0, 0, 0, loc).UnixNano())
+
+	exp := []*protocol.Chunk{
+		{
+			From: day1,
+			To:   day2,
+			Series: []*protocol.Series{
+				{Fields: []string{"a"}, Points: []protocol.Point{{3, 2}}},
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 0}}},
+			},
+		},
+		{
+			From: day2,
+			To:   day3,
+			Series: []*protocol.Series{
+				{Fields: []string{"a"}, Points: []protocol.Point{{7, 2}}},
+				{Fields: []string{"b"}, Points: []protocol.Point{{5, 1}}},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatal("wrong result", res)
+	}
+
+	// 2016-01-04 is a Monday (local time)
+	res, err = Buckets(chunks, BucketWeek, loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	week := uint64(time.Date(2016, 1, 11, 0, 0, 0, 0, loc).UnixNano())
+	if len(res) != 1 || res[0].From != day1 || res[0].To != week ||
+		res[0].Series[0].Points[0] != (protocol.Point{10, 4}) {
+		t.Fatal("wrong result", res)
+	}
+
+	// the 2h point of "b" spans local midnight (01:00 UTC)
+	loc = time.FixedZone("UTC-1", -3600)
+	if _, err := Buckets(chunks, BucketDay, loc); err != ErrInvBucket {
+		t.Fatal("should return an error")
+	}
+
+	if res, err := Buckets(nil, BucketDay, loc); err != nil || len(res) != 0 {
+		t.Fatal("should return no chunks")
+	}
+}
+
+func TestFetchBuckets(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    int64(24 * time.Hour),
+		Retention:   int64(1000 * 24 * time.Hour),
+		Resolution:  int64(time.Hour),
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	defer db.Close()
+
+	// use recent days so that data is not removed by retention
+	loc := time.FixedZone("UTC-5", -5*3600)
+	now := time.Now().In(loc)
+	y, m, d := now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	yesterday := today.AddDate(0, 0, -1)
+
+	fields := []string{"a"}
+	for _, ts := range []time.Time{yesterday, today.Add(-time.Hour), today, today.Add(time.Hour)} {
+		if err := db.Track(uint64(ts.UnixNano()), fields, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from := uint64(yesterday.Add(3 * time.Hour).UnixNano())
+	to := uint64(today.Add(2 * time.Hour).UnixNano())
+
+	db.FetchBuckets(from, to, fields, BucketDay, loc, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 2 ||
+			res[0].From != uint64(yesterday.UnixNano()) ||
+			res[1].To != uint64(today.AddDate(0, 0, 1).UnixNano()) ||
+			res[0].Series[0].Points[0] != (protocol.Point{2, 2}) ||
+			res[1].Series[0].Points[0] != (protocol.Point{2, 2}) {
+			t.Fatal("wrong result", res)
+		}
+	})
+
+	db.FetchBuckets(from, to, fields, BucketWeek+1, loc, func(res []*protocol.Chunk, err error) {
+		if err != ErrInvBucket {
+			t.Fatal("should return an error")
+		}
+	})
+}
@@ -0,0 +1,522 @@
+// Package changelog implements an append-only log of tracked values. Each
+// entry records a Track call made on a database epoch (the timestamp, the
+// epoch start time, series fields, point id and values). The log is split
+// into segment files which are rotated when they reach the configured size.
+// Consumers read entries starting from an offset which makes it possible to
+// replicate, audit or replay writes made to a database.
+//
+// Offsets are byte positions in the log. The offset of the first entry in a
+// segment is used to name the segment file therefore an offset can be used to
+// locate the segment and the position of an entry without reading the log.
+//
+// Change Log Entry Format:
+//
+//	[size uint32][crc32 uint32][payload]
+//
+// Payload Format (little endian):
+//
+//	[time int64][epoch int64][pid int64][total float64][count float64]
+//	[nfields uint16]([len uint16][field])...
+package changelog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// segment file prefix
+	// segment files will be named "changes_00000000000000000000, ..."
+	prefixseg = "changes_"
+
+	// size of the entry header (size and checksum)
+	headersz = 8
+
+	// size of fixed size fields in the entry payload
+	fixedsz = 8*5 + 2
+
+	// DefaultSegmentSize is the segment size used when one is not given
+	DefaultSegmentSize = 1024 * 1024 * 64
+)
+
+var (
+	// ErrOffset is returned when reading from an offset which is not available
+	// in the log (removed with old segments or not written to the log yet).
+	ErrOffset = errors.New("offset is not available in the change log")
+
+	// ErrCorrupt is returned when an entry does not match its checksum
+	ErrCorrupt = errors.New("corrupt change log entry")
+
+	// ErrClosed is returned when using a change log after closing it
+	ErrClosed = errors.New("change log is closed")
+
+	// ErrInvEntry is returned when an entry cannot be encoded
+	ErrInvEntry = errors.New("invalid change log entry")
+)
+
+// Entry is a Track call recorded in the change log
+type Entry struct {
+	// Offset of the entry in the change log (set when appending or reading)
+	Offset int64 `json:"offset"`
+
+	// Time is the timestamp given with the Track call in nanoseconds.
+	// Epoch and PID depend on epoch params of the database which made the
+	// entry, the timestamp should be used when tracking it elsewhere.
+	Time int64 `json:"time"`
+
+	// Epoch is the start time of the epoch in nanoseconds
+	Epoch int64 `json:"epoch"`
+
+	// Fields of the tracked series
+	Fields []string `json:"fields"`
+
+	// PID is the position of the point in the epoch
+	PID int64 `json:"pid"`
+
+	// Total and Count are tracked values (added to the point)
+	Total float64 `json:"total"`
+	Count float64 `json:"count"`
+}
+
+// Options is used when opening a change log
+type Options struct {
+	// SegmentSize is the size in bytes after which a new segment is created
+	SegmentSize int64 `json:"segmentSize"`
+
+	// MaxSegments is the maximum number of segments to keep (0 keeps all).
+	// Oldest segments are removed when a new segment is created.
+	MaxSegments int `json:"maxSegments"`
+}
+
+// segment is a change log file
+type segment struct {
+	start int64
+	size  int64
+}
+
+// Log is an append-only log of Track calls
+type Log struct {
+	dir      string
+	opts     Options
+	segments []*segment
+	file     *os.File
+	closed   bool
+	mtx      *sync.RWMutex
+}
+
+// Open opens the change log in a directory (creates it if it does not exist).
+// Partially written entries at the end of the log are removed when opening.
+func Open(dir string, opts *Options) (l *Log, err error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = DefaultSegmentSize
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l = &Log{
+		dir:  dir,
+		opts: o,
+		mtx:  &sync.RWMutex{},
+	}
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Append appends an entry to the log and sets its offset
+func (l *Log) Append(e *Entry) (err error) {
+	buf, err := encode(e)
+	if err != nil {
+		return err
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	seg := l.segments[len(l.segments)-1]
+	if seg.size > 0 && seg.size+int64(len(buf)) > l.opts.SegmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+
+		seg = l.segments[len(l.segments)-1]
+	}
+
+	n, err := l.file.Write(buf)
+	if err != nil {
+		// remove the partial entry so the next one starts at the right offset
+		l.file.Truncate(seg.size)
+		l.file.Seek(seg.size, 0)
+		return err
+	}
+
+	e.Offset = seg.start + seg.size
+	seg.size += int64(n)
+
+	return nil
+}
+
+// Read reads up to max entries starting from an entry offset. It returns the
+// entries and the offset to use when reading next. Reading from the end of
+// the log returns no entries. ErrOffset is returned if the offset is older
+// than the first entry in the log or newer than the end of the log.
+func (l *Log) Read(offset int64, max int) (entries []*Entry, next int64, err error) {
+	l.mtx.RLock()
+	if l.closed {
+		l.mtx.RUnlock()
+		return nil, 0, ErrClosed
+	}
+
+	// entries written after this point are read with the next call
+	segs := make([]segment, len(l.segments))
+	for i, s := range l.segments {
+		segs[i] = *s
+	}
+
+	l.mtx.RUnlock()
+
+	last := segs[len(segs)-1]
+	if offset < segs[0].start || offset > last.start+last.size {
+		return nil, 0, ErrOffset
+	}
+
+	entries = []*Entry{}
+	next = offset
+
+	for _, seg := range segs {
+		if len(entries) >= max {
+			break
+		}
+
+		if next >= seg.start+seg.size {
+			continue
+		}
+
+		batch, n, err := l.readSegment(seg, next, max-len(entries))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		entries = append(entries, batch...)
+		next = n
+	}
+
+	return entries, next, nil
+}
+
+// First returns the offset of the oldest entry in the log
+func (l *Log) First() (offset int64) {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	return l.segments[0].start
+}
+
+// End returns the offset where the next entry will be written
+func (l *Log) End() (offset int64) {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	last := l.segments[len(l.segments)-1]
+	return last.start + last.size
+}
+
+// Sync flushes written entries to disk
+func (l *Log) Sync() (err error) {
+	l.mtx.RLock()
+	defer l.mtx.RUnlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	return l.file.Sync()
+}
+
+// Close closes the log file
+func (l *Log) Close() (err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	return l.file.Close()
+}
+
+// readSegment reads up to max entries from a segment starting from an offset
+func (l *Log) readSegment(seg segment, offset int64, max int) (entries []*Entry, next int64, err error) {
+	file, err := os.Open(segmentPath(l.dir, seg.start))
+	if err != nil {
+		// the segment may have been removed after rotating
+		if os.IsNotExist(err) {
+			return nil, 0, ErrOffset
+		}
+
+		return nil, 0, err
+	}
+
+	defer file.Close()
+
+	pos := offset - seg.start
+	header := make([]byte, headersz)
+
+	for len(entries) < max && pos < seg.size {
+		if _, err := file.ReadAt(header, pos); err != nil {
+			return nil, 0, err
+		}
+
+		size := int64(binary.LittleEndian.Uint32(header)) + headersz
+		if pos+size > seg.size {
+			return nil, 0, ErrCorrupt
+		}
+
+		data := make([]byte, size)
+		if _, err := file.ReadAt(data, pos); err != nil {
+			return nil, 0, err
+		}
+
+		e, _, err := decode(data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		e.Offset = seg.start + pos
+		entries = append(entries, e)
+		pos += size
+	}
+
+	next = seg.start + pos
+	return entries, next, nil
+}
+
+// load finds existing segments and opens the last one for writing
+func (l *Log) load() (err error) {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, prefixseg) {
+			continue
+		}
+
+		start, err := strconv.ParseInt(strings.TrimPrefix(name, prefixseg), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		l.segments = append(l.segments, &segment{start: start, size: file.Size()})
+	}
+
+	sort.Sort(byStart(l.segments))
+
+	if len(l.segments) == 0 {
+		l.segments = []*segment{{start: 0}}
+	}
+
+	last := l.segments[len(l.segments)-1]
+	file, err := os.OpenFile(segmentPath(l.dir, last.start), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	size, err := validSize(file, last.size)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	if size != last.size {
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return err
+		}
+
+		last.size = size
+	}
+
+	if _, err := file.Seek(size, 0); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+
+	return nil
+}
+
+// rotate creates a new segment and removes old segments if needed.
+// The caller must hold the lock.
+func (l *Log) rotate() (err error) {
+	last := l.segments[len(l.segments)-1]
+	start := last.start + last.size
+
+	file, err := os.OpenFile(segmentPath(l.dir, start), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := l.file.Close(); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.segments = append(l.segments, &segment{start: start})
+
+	max := l.opts.MaxSegments
+	for max > 0 && len(l.segments) > max {
+		if err := os.Remove(segmentPath(l.dir, l.segments[0].start)); err != nil {
+			fmt.Println("ChangeLog Error: remove:", err)
+		}
+
+		l.segments = l.segments[1:]
+	}
+
+	return nil
+}
+
+// validSize returns the size of the file which contains complete entries
+func validSize(file *os.File, size int64) (valid int64, err error) {
+	data := make([]byte, size)
+	if _, err := file.ReadAt(data, 0); err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	for len(data) > 0 {
+		_, n, err := decode(data)
+		if err != nil {
+			break
+		}
+
+		data = data[n:]
+		valid += int64(n)
+	}
+
+	return valid, nil
+}
+
+// encode encodes an entry with its header
+func encode(e *Entry) (buf []byte, err error) {
+	size := fixedsz
+	for _, f := range e.Fields {
+		if len(f) > math.MaxUint16 {
+			return nil, ErrInvEntry
+		}
+
+		size += 2 + len(f)
+	}
+
+	if len(e.Fields) > math.MaxUint16 {
+		return nil, ErrInvEntry
+	}
+
+	buf = make([]byte, headersz+size)
+	p := buf[headersz:]
+
+	binary.LittleEndian.PutUint64(p[0:], uint64(e.Time))
+	binary.LittleEndian.PutUint64(p[8:], uint64(e.Epoch))
+	binary.LittleEndian.PutUint64(p[16:], uint64(e.PID))
+	binary.LittleEndian.PutUint64(p[24:], math.Float64bits(e.Total))
+	binary.LittleEndian.PutUint64(p[32:], math.Float64bits(e.Count))
+	binary.LittleEndian.PutUint16(p[40:], uint16(len(e.Fields)))
+
+	pos := fixedsz
+	for _, f := range e.Fields {
+		binary.LittleEndian.PutUint16(p[pos:], uint16(len(f)))
+		pos += 2
+		pos += copy(p[pos:], f)
+	}
+
+	binary.LittleEndian.PutUint32(buf[0:], uint32(size))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(p))
+
+	return buf, nil
+}
+
+// decode decodes the entry at the start of data and returns its encoded size
+func decode(data []byte) (e *Entry, n int, err error) {
+	if len(data) < headersz {
+		return nil, 0, ErrCorrupt
+	}
+
+	size := int(binary.LittleEndian.Uint32(data[0:]))
+	if size < fixedsz || len(data) < headersz+size {
+		return nil, 0, ErrCorrupt
+	}
+
+	p := data[headersz : headersz+size]
+	if crc32.ChecksumIEEE(p) != binary.LittleEndian.Uint32(data[4:]) {
+		return nil, 0, ErrCorrupt
+	}
+
+	e = &Entry{
+		Time:   int64(binary.LittleEndian.Uint64(p[0:])),
+		Epoch:  int64(binary.LittleEndian.Uint64(p[8:])),
+		PID:    int64(binary.LittleEndian.Uint64(p[16:])),
+		Total:  math.Float64frombits(binary.LittleEndian.Uint64(p[24:])),
+		Count:  math.Float64frombits(binary.LittleEndian.Uint64(p[32:])),
+		Fields: make([]string, binary.LittleEndian.Uint16(p[40:])),
+	}
+
+	pos := fixedsz
+	for i := range e.Fields {
+		if pos+2 > size {
+			return nil, 0, ErrCorrupt
+		}
+
+		flen := int(binary.LittleEndian.Uint16(p[pos:]))
+		pos += 2
+
+		if pos+flen > size {
+			return nil, 0, ErrCorrupt
+		}
+
+		e.Fields[i] = string(p[pos : pos+flen])
+		pos += flen
+	}
+
+	return e, headersz + size, nil
+}
+
+// segmentPath returns the path of the segment which starts at an offset
+func segmentPath(dir string, start int64) string {
+	return path.Join(dir, fmt.Sprintf("%s%020d", prefixseg, start))
+}
+
+// byStart is used to sort segments by start offset
+type byStart []*segment
+
+func (a byStart) Len() int           { return len(a) }
+func (a byStart) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStart) Less(i, j int) bool { return a[i].start < a[j].start }
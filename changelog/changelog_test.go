@@ -0,0 +1,175 @@
+package changelog
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+var (
+	tmpdircg = "/tmp/test-changelog/"
+)
+
+func setupcg(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdircg); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdircg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func entries(n int) (es []*Entry) {
+	for i := 0; i < n; i++ {
+		es = append(es, &Entry{
+			Time:   1000 + int64(i)*10,
+			Epoch:  1000,
+			Fields: []string{"a", "b"},
+			PID:    int64(i),
+			Total:  float64(i) + 0.5,
+			Count:  1,
+		})
+	}
+
+	return es
+}
+
+func TestAppendRead(t *testing.T) {
+	defer setupcg(t)()
+
+	l, err := Open(tmpdircg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	es := entries(5)
+	for _, e := range es {
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, next, err := l.Read(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, es[:3]) {
+		t.Fatal("wrong entries", res)
+	} else if next != es[3].Offset {
+		t.Fatal("wrong next offset", next)
+	}
+
+	res, next, err = l.Read(next, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, es[3:]) {
+		t.Fatal("wrong entries", res)
+	} else if next != l.End() {
+		t.Fatal("wrong next offset", next)
+	}
+
+	// reading from the end returns no entries
+	res, next, err = l.Read(next, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(res) != 0 || next != l.End() {
+		t.Fatal("should not read entries", res)
+	}
+
+	if _, _, err := l.Read(l.End()+1, 10); err != ErrOffset {
+		t.Fatal("should return an error")
+	}
+}
+
+func TestRotate(t *testing.T) {
+	// each entry is 8 + 42 + 2*3 = 56 bytes (2 entries in a segment)
+	defer setupcg(t)()
+
+	l, err := Open(tmpdircg, &Options{SegmentSize: 120, MaxSegments: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	es := entries(7)
+	for _, e := range es {
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// segments with first 4 entries are removed
+	if first := l.First(); first != es[4].Offset {
+		t.Fatal("wrong first offset", first)
+	}
+
+	if _, _, err := l.Read(0, 10); err != ErrOffset {
+		t.Fatal("should return an error")
+	}
+
+	res, _, err := l.Read(l.First(), 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, es[4:]) {
+		t.Fatal("wrong entries", res)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	defer setupcg(t)()
+
+	l, err := Open(tmpdircg, &Options{SegmentSize: 120})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es := entries(3)
+	for _, e := range es {
+		if err := l.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	end := l.End()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a partially written entry
+	f, err := os.OpenFile(segmentPath(tmpdircg, es[2].Offset), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	l, err = Open(tmpdircg, &Options{SegmentSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	if l.End() != end {
+		t.Fatal("wrong end offset", l.End())
+	}
+
+	e := &Entry{Time: 2010, Epoch: 2000, Fields: []string{"c"}, PID: 1, Total: 1, Count: 1}
+	if err := l.Append(e); err != nil {
+		t.Fatal(err)
+	}
+
+	res, _, err := l.Read(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, append(es, e)) {
+		t.Fatal("wrong entries", res)
+	}
+}
@@ -0,0 +1,57 @@
+package kadiyadb
+
+import (
+	"errors"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/changelog"
+)
+
+var (
+	// ErrNoChangeLog is returned when the database does not have a change log
+	ErrNoChangeLog = errors.New("change log is not enabled")
+)
+
+// Changes returns the change log of the database. Consumers can read Track
+// calls made on the database from an offset with its Read method. It returns
+// nil if the change log is not enabled with params (see Params.ChangeLog).
+// Values written with Backfill are not recorded in the change log.
+func (d *DB) Changes() (l *changelog.Log) {
+	return d.changes
+}
+
+// ReadChanges reads up to max change log entries starting from an offset.
+// It returns the entries and the offset to use when reading next.
+func (d *DB) ReadChanges(offset int64, max int) (entries []*changelog.Entry, next int64, err error) {
+	if d.changes == nil {
+		return nil, 0, ErrNoChangeLog
+	}
+
+	return d.changes.Read(offset, max)
+}
+
+// Replay tracks a change log entry (usually read from another database).
+// The entry is recorded in the change log of this database if it has one.
+// The timestamp of the entry is used because epoch params of this database
+// can be different from the database which made the entry.
+func (d *DB) Replay(e *changelog.Entry) (err error) {
+	if e.Time < 0 {
+		return ErrInvTime
+	}
+
+	return d.Track(uint64(e.Time), e.Fields, e.Total, e.Count)
+}
+
+// ReplayTo tracks a change log entry like Replay but only in the database
+// and rollups for which want returns true. It's called with the rollup name
+// (empty for the database itself) and the start time of the epoch the entry
+// is written to. Replicas use this to skip entries which are already in
+// epochs copied from the primary (see Snapshot).
+func (d *DB) ReplayTo(e *changelog.Entry, want func(rollup string, start int64) bool) (err error) {
+	if e.Time < 0 {
+		return ErrInvTime
+	}
+
+	defer trackLatency.ObserveSince(time.Now())
+	return d.track(uint64(e.Time), e.Fields, e.Total, e.Count, want)
+}
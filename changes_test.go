@@ -0,0 +1,112 @@
+package kadiyadb
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/changelog"
+)
+
+func TestChanges(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		ChangeLog:   &changelog.Options{},
+	}
+
+	src, err := Open(dir+"/src", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer src.Close()
+
+	// the destination uses a different epoch duration and resolution
+	q := *p
+	q.Duration = 7200000000000
+	q.Resolution = 300000000000
+	q.ChangeLog = nil
+
+	dst, err := Open(dir+"/dst", &q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dst.Close()
+
+	if _, _, err := dst.ReadChanges(0, 10); err != ErrNoChangeLog {
+		t.Fatal("should return an error")
+	}
+
+	now := time.Now().Truncate(time.Hour)
+	ts := uint64(now.Add(5 * time.Minute).UnixNano())
+
+	if err := src.Track(ts, []string{"a", "b"}, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.Track(ts, []string{"a", "c"}, 4, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, next, err := src.ReadChanges(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 || next != src.Changes().End() {
+		t.Fatal("wrong entries", entries)
+	}
+
+	e := entries[0]
+	if e.Time != int64(ts) || e.Epoch != now.UnixNano() || e.PID != 5 || e.Total != 3 || e.Count != 1 ||
+		len(e.Fields) != 2 || e.Fields[0] != "a" || e.Fields[1] != "b" {
+		t.Fatal("wrong entry", e)
+	}
+
+	for _, e := range entries {
+		if err := dst.Replay(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from := uint64(now.UnixNano())
+	to := from + uint64(10*time.Minute)
+
+	dst.Fetch(from, to, []string{"a", "*"}, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		total := 0.0
+		for _, c := range chunks {
+			for _, s := range c.Series {
+				for i, p := range s.Points {
+					if i != 1 && p.Total != 0 {
+						t.Fatal("wrong point", i)
+					}
+
+					total += p.Total
+				}
+			}
+		}
+
+		if total != 7 {
+			t.Fatal("wrong total", total)
+		}
+	})
+
+	bad := &changelog.Entry{Time: -1, Fields: []string{"a"}}
+	if err := src.Replay(bad); err != ErrInvTime {
+		t.Fatal("should return an error")
+	}
+}
@@ -0,0 +1,263 @@
+// Package cluster spreads series across several kadiyadb nodes. Series are
+// sharded by a hash of their first fields therefore all series which share
+// these fields are stored in the same node. Track calls are routed to the
+// node which owns the series. Fetch calls are routed to the owner when the
+// pattern has values for all shard fields. Otherwise they are sent to all
+// nodes and results are merged.
+//
+// Track also records parent field sets of a series (see epoch.Track). When
+// series are sharded by more than one field, parent field sets with fewer
+// fields can be found in more than one node. Points of series with the same
+// fields are summed when results are merged so these still have totals and
+// counts of all child series.
+//
+// All nodes must use the same database params. Series are assigned to nodes
+// by their position in the node list therefore adding, removing or reordering
+// nodes moves series to other nodes (existing data is not moved).
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+var (
+	// ErrNoNodes is returned when creating a coordinator without nodes
+	ErrNoNodes = errors.New("cluster has no nodes")
+
+	// ErrMismatch is returned when fetch results from nodes cannot be merged
+	// because their chunks have different time ranges or point counts. This
+	// can happen when nodes use different epoch durations or resolutions.
+	ErrMismatch = errors.New("node results do not match")
+)
+
+// Node is a database which stores a part of the series in the cluster.
+// Both *kadiyadb.DB and *Remote can be used as nodes.
+type Node interface {
+	Track(ts uint64, fields []string, total, count float64) (err error)
+	Fetch(from, to uint64, fields []string, fn kadiyadb.Handler)
+}
+
+// Options is used to configure how series are sharded
+type Options struct {
+	// ShardFields is the number of fields (from the start) used to select
+	// the node which stores a series (default: 1)
+	ShardFields int
+}
+
+// Coordinator routes requests to nodes in the cluster
+type Coordinator struct {
+	nodes  []Node
+	fields int
+}
+
+// New creates a coordinator for given nodes
+func New(nodes []Node, opts *Options) (c *Coordinator, err error) {
+	if len(nodes) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	fields := opts.ShardFields
+	if fields <= 0 {
+		fields = 1
+	}
+
+	c = &Coordinator{
+		nodes:  nodes,
+		fields: fields,
+	}
+
+	return c, nil
+}
+
+// Track records a measurement in the node which owns the series
+func (c *Coordinator) Track(ts uint64, fields []string, total, count float64) (err error) {
+	return c.nodes[c.Owner(fields)].Track(ts, fields, total, count)
+}
+
+// Fetch fetches data from the node which owns series matching the pattern or
+// from all nodes if the pattern has a wildcard in shard fields (or if it has
+// fewer fields). The handler is called once with merged results.
+func (c *Coordinator) Fetch(from, to uint64, fields []string, fn kadiyadb.Handler) {
+	if c.exact(fields) {
+		c.nodes[c.Owner(fields)].Fetch(from, to, fields, fn)
+		return
+	}
+
+	results := make([][]*protocol.Chunk, len(c.nodes))
+	errs := make([]error, len(c.nodes))
+	wg := &sync.WaitGroup{}
+
+	for i, node := range c.nodes {
+		wg.Add(1)
+
+		go func(i int, node Node) {
+			defer wg.Done()
+
+			// fetch results are only valid inside the handler function
+			node.Fetch(from, to, fields, func(chunks []*protocol.Chunk, err error) {
+				if err != nil {
+					errs[i] = err
+					return
+				}
+
+				results[i] = copyChunks(chunks)
+			})
+		}(i, node)
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			fn(nil, fmt.Errorf("node %d: %s", i, err))
+			return
+		}
+	}
+
+	chunks, err := merge(results)
+	if err != nil {
+		fn(nil, err)
+		return
+	}
+
+	fn(chunks, nil)
+}
+
+// Owner returns the index of the node which owns series with given fields
+func (c *Coordinator) Owner(fields []string) (n int) {
+	key := fields
+	if len(key) > c.fields {
+		key = key[:c.fields]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(key, "\x00")))
+
+	return int(h.Sum32() % uint32(len(c.nodes)))
+}
+
+// exact checks whether all series matching a pattern are in the same node
+func (c *Coordinator) exact(fields []string) bool {
+	if len(fields) < c.fields {
+		return false
+	}
+
+	for _, f := range fields[:c.fields] {
+		if f == "*" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// copyChunks makes a copy of chunks which can be used after the handler returns
+func copyChunks(chunks []*protocol.Chunk) (res []*protocol.Chunk) {
+	res = make([]*protocol.Chunk, len(chunks))
+
+	for i, c := range chunks {
+		series := make([]*protocol.Series, len(c.Series))
+		for j, s := range c.Series {
+			series[j] = &protocol.Series{
+				Fields: append([]string{}, s.Fields...),
+				Points: append([]protocol.Point{}, s.Points...),
+			}
+		}
+
+		res[i] = &protocol.Chunk{
+			From:   c.From,
+			To:     c.To,
+			Series: series,
+		}
+	}
+
+	return res
+}
+
+// merge merges chunks from all nodes. Chunks are matched by their time range
+// and series are matched by fields. Points of matching series are summed.
+// Chunks with overlapping time ranges or matching series with different
+// point counts cannot be summed and an error is returned instead.
+func merge(results [][]*protocol.Chunk) (chunks []*protocol.Chunk, err error) {
+	type key struct{ from, to uint64 }
+
+	byRange := map[key]*protocol.Chunk{}
+	bySeries := map[key]map[string]*protocol.Series{}
+
+	for _, result := range results {
+		for _, c := range result {
+			k := key{c.From, c.To}
+
+			chunk, ok := byRange[k]
+			if !ok {
+				chunk = &protocol.Chunk{From: c.From, To: c.To}
+				byRange[k] = chunk
+				bySeries[k] = map[string]*protocol.Series{}
+				chunks = append(chunks, chunk)
+			}
+
+			for _, s := range c.Series {
+				sk := strings.Join(s.Fields, "\x00")
+
+				prev, ok := bySeries[k][sk]
+				if !ok {
+					bySeries[k][sk] = s
+					chunk.Series = append(chunk.Series, s)
+					continue
+				}
+
+				if len(prev.Points) != len(s.Points) {
+					return nil, ErrMismatch
+				}
+
+				for i := range s.Points {
+					prev.Points[i].Total += s.Points[i].Total
+					prev.Points[i].Count += s.Points[i].Count
+				}
+			}
+		}
+	}
+
+	sort.Sort(byFrom(chunks))
+	for i, c := range chunks {
+		if i > 0 && c.From < chunks[i-1].To {
+			return nil, ErrMismatch
+		}
+
+		sort.Sort(byFields(c.Series))
+	}
+
+	if chunks == nil {
+		chunks = []*protocol.Chunk{}
+	}
+
+	return chunks, nil
+}
+
+// byFrom is used to sort chunks by start time
+type byFrom []*protocol.Chunk
+
+func (a byFrom) Len() int           { return len(a) }
+func (a byFrom) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byFrom) Less(i, j int) bool { return a[i].From < a[j].From }
+
+// byFields is used to sort series by fields
+type byFields []*protocol.Series
+
+func (a byFields) Len() int      { return len(a) }
+func (a byFields) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byFields) Less(i, j int) bool {
+	return strings.Join(a[i].Fields, "\x00") < strings.Join(a[j].Fields, "\x00")
+}
@@ -0,0 +1,216 @@
+package cluster
+
+import (
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/server"
+)
+
+var (
+	tmpdircl = "/tmp/test-cluster/"
+)
+
+func setupcl(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdircl); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(tmpdircl, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdircl); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// series returns fields and point totals of series in a fetch result
+func series(t *testing.T, n Node, from, to uint64, fields []string) (res map[string][]float64) {
+	res = map[string][]float64{}
+
+	n.Fetch(from, to, fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range chunks {
+			for _, s := range c.Series {
+				key := ""
+				for _, f := range s.Fields {
+					key += f + "."
+				}
+
+				for _, p := range s.Points {
+					res[key] = append(res[key], p.Total)
+				}
+			}
+		}
+	})
+
+	return res
+}
+
+func TestCoordinator(t *testing.T) {
+	defer setupcl(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	dbs := make([]*kadiyadb.DB, 3)
+	nodes := make([]Node, 3)
+	for i := range dbs {
+		db, err := kadiyadb.Open(tmpdircl+strconv.Itoa(i), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer db.Close()
+		dbs[i] = db
+		nodes[i] = db
+	}
+
+	if _, err := New(nil, nil); err != ErrNoNodes {
+		t.Fatal("should return an error")
+	}
+
+	c, err := New(nodes, &Options{ShardFields: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	from := uint64(time.Now().Truncate(time.Hour).UnixNano())
+	to := from + uint64(2*time.Minute)
+
+	apps := []string{"a", "b", "c", "d", "e", "f"}
+	for i, app := range apps {
+		if err := c.Track(from, []string{"app", app, "requests"}, float64(i+1), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// each series is stored only in the owner node
+	owners := map[int]bool{}
+	for _, app := range apps {
+		fields := []string{"app", app, "requests"}
+		owner := c.Owner(fields)
+		owners[owner] = true
+
+		for i, db := range dbs {
+			res := series(t, db, from, to, fields)
+			if (i == owner) != (len(res) == 1) {
+				t.Fatal("wrong node", app, i)
+			}
+		}
+
+		// fetch with all shard fields is routed to the owner
+		res := series(t, c, from, to, fields)
+		if len(res) != 1 {
+			t.Fatal("wrong result", res)
+		}
+	}
+
+	if len(owners) < 2 {
+		t.Fatal("series should be spread across nodes", owners)
+	}
+
+	// wildcard fetch merges results from all nodes
+	res := series(t, c, from, to, []string{"app", "*", "requests"})
+	if len(res) != len(apps) {
+		t.Fatal("wrong result", res)
+	}
+
+	for i, app := range apps {
+		if ps := res["app."+app+".requests."]; len(ps) != 2 || ps[0] != float64(i+1) {
+			t.Fatal("wrong points", app, ps)
+		}
+	}
+
+	// parent series are in several nodes and they are summed
+	res = series(t, c, from, to, []string{"app"})
+	if ps := res["app."]; len(ps) != 2 || ps[0] != 21 {
+		t.Fatal("wrong points", res)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	defer setupcl(t)()
+
+	s := server.New(tmpdircl)
+	defer s.Close(time.Second)
+
+	if _, err := s.Create("test", []byte(`{"duration": "1h", "resolution": "1m",
+    "retention": "24h", "maxROEpochs": 2, "maxRWEpochs": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := NewRemote(ts.URL, "test", time.Second)
+
+	from := uint64(time.Now().Truncate(time.Hour).UnixNano())
+	to := from + uint64(2*time.Minute)
+
+	if err := r.Track(from, []string{"a", "b"}, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	res := series(t, r, from, to, []string{"a", "b"})
+	if ps := res["a.b."]; len(ps) != 2 || ps[0] != 5 {
+		t.Fatal("wrong points", res)
+	}
+
+	bad := NewRemote(ts.URL, "nope", time.Second)
+	if err := bad.Track(from, []string{"a"}, 1, 1); err == nil {
+		t.Fatal("should return an error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	chunk := func(from, to uint64, n int) *protocol.Chunk {
+		points := make([]protocol.Point, n)
+		for i := range points {
+			points[i] = protocol.Point{Total: 1, Count: 1}
+		}
+
+		return &protocol.Chunk{From: from, To: to, Series: []*protocol.Series{
+			{Fields: []string{"a"}, Points: points},
+		}}
+	}
+
+	chunks, err := merge([][]*protocol.Chunk{
+		{chunk(0, 10, 2), chunk(10, 20, 2)},
+		{chunk(10, 20, 2)},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(chunks) != 2 || chunks[1].Series[0].Points[1].Total != 2 {
+		t.Fatal("wrong result", chunks)
+	}
+
+	// nodes with different epoch durations
+	if _, err := merge([][]*protocol.Chunk{{chunk(0, 10, 2)}, {chunk(0, 20, 4)}}); err != ErrMismatch {
+		t.Fatal("should return an error", err)
+	}
+
+	// nodes with different resolutions
+	if _, err := merge([][]*protocol.Chunk{{chunk(0, 10, 2)}, {chunk(0, 10, 5)}}); err != ErrMismatch {
+		t.Fatal("should return an error", err)
+	}
+}
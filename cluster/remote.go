@@ -0,0 +1,104 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// Remote is a node which uses a database in another kadiyadb server.
+// Requests are made to track and fetch endpoints of the server package.
+type Remote struct {
+	URL      string
+	Database string
+	Client   *http.Client
+}
+
+// NewRemote creates a remote node with a request timeout. The URL is the
+// base URL of the server ("http://host:8000") and db is the database name.
+func NewRemote(url, db string, timeout time.Duration) (r *Remote) {
+	return &Remote{
+		URL:      strings.TrimRight(url, "/"),
+		Database: db,
+		Client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Track records a measurement in the remote database
+func (r *Remote) Track(ts uint64, fields []string, total, count float64) (err error) {
+	data, err := json.Marshal(map[string]interface{}{
+		"time":   ts,
+		"fields": fields,
+		"total":  total,
+		"count":  count,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	res, err := r.Client.Post(r.endpoint("track"), "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	return check(res)
+}
+
+// Fetch fetches data from the remote database
+func (r *Remote) Fetch(from, to uint64, fields []string, fn kadiyadb.Handler) {
+	q := url.Values{}
+	q.Set("from", strconv.FormatUint(from, 10))
+	q.Set("to", strconv.FormatUint(to, 10))
+	q.Set("fields", strings.Join(fields, ","))
+
+	res, err := r.Client.Get(r.endpoint("fetch") + "?" + q.Encode())
+	if err != nil {
+		fn(nil, err)
+		return
+	}
+
+	defer res.Body.Close()
+
+	if err := check(res); err != nil {
+		fn(nil, err)
+		return
+	}
+
+	out := struct {
+		Chunks []*protocol.Chunk `json:"chunks"`
+	}{}
+
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		fn(nil, err)
+		return
+	}
+
+	fn(out.Chunks, nil)
+}
+
+// endpoint returns the URL of a database endpoint
+func (r *Remote) endpoint(name string) string {
+	return r.URL + "/db/" + url.PathEscape(r.Database) + "/" + name
+}
+
+// check returns an error with the error message sent by the server
+// if the response status code is not 200
+func check(res *http.Response) (err error) {
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body := struct{ Error string }{}
+	json.NewDecoder(res.Body).Decode(&body)
+	return fmt.Errorf("server returned status %d: %s", res.StatusCode, body.Error)
+}
@@ -0,0 +1,88 @@
+// Command kadiyadb-backfill copies existing data of a database into another
+// database with a coarser resolution. This can be used to fill rollups with
+// data which was tracked before rollups were added to database params.
+// The target database must not be in use, stop the server before running
+// it with a rollup directory of a database served by the server. The end
+// time is required, it should be before epochs which are still written.
+//
+//	kadiyadb-backfill -src /data/mydb -dst /data/mydb/rollup_1h0m0s \
+//	  -duration 12h -resolution 1h -retention 48h -to 2016-01-01T00:00:00Z
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+func main() {
+	src := flag.String("src", "", "source database directory")
+	dst := flag.String("dst", "", "target database directory")
+	durStr := flag.String("duration", "", "epoch duration of the target database")
+	resStr := flag.String("resolution", "", "resolution of the target database")
+	retStr := flag.String("retention", "", "retention of the target database")
+	maxRO := flag.Int64("maxROEpochs", 2, "max read-only epochs to keep open")
+	maxRW := flag.Int64("maxRWEpochs", 2, "max read-write epochs to keep open")
+	fromStr := flag.String("from", "", "start time (RFC3339), defaults to zero")
+	toStr := flag.String("to", "", "end time (RFC3339)")
+	flag.Parse()
+
+	if *src == "" || *dst == "" {
+		fail("source and target directories are required")
+	}
+
+	if *toStr == "" {
+		fail("end time is required")
+	}
+
+	p := &kadiyadb.Params{
+		DurationStr:   *durStr,
+		ResolutionStr: *resStr,
+		RetentionStr:  *retStr,
+		MaxROEpochs:   *maxRO,
+		MaxRWEpochs:   *maxRW,
+	}
+
+	p.Duration = parseDuration("duration", *durStr)
+	p.Resolution = parseDuration("resolution", *resStr)
+	p.Retention = parseDuration("retention", *retStr)
+
+	var from int64
+	if *fromStr != "" {
+		from = parseTime("from", *fromStr)
+	}
+
+	to := parseTime("to", *toStr)
+
+	if err := kadiyadb.Backfill(*src, *dst, p, from, to); err != nil {
+		fail(err)
+	}
+
+	fmt.Println("backfill complete:", *src, "=>", *dst)
+}
+
+func parseDuration(name, str string) int64 {
+	dur, err := time.ParseDuration(str)
+	if err != nil || dur <= 0 {
+		fail("invalid " + name + ": " + str)
+	}
+
+	return int64(dur)
+}
+
+func parseTime(name, str string) int64 {
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		fail("invalid " + name + ": " + str)
+	}
+
+	return t.UnixNano()
+}
+
+func fail(v interface{}) {
+	fmt.Fprintln(os.Stderr, "Error:", v)
+	os.Exit(1)
+}
@@ -0,0 +1,391 @@
+// Command kadiyadb serves all databases in a directory over HTTP.
+// Other protocols are enabled when their listen addresses are given.
+// Databases are synced and closed when the process is interrupted. Param
+// files are checked periodically and safe changes are applied without a
+// restart (see kadiyadb.Watch).
+//
+//	kadiyadb -dir /data -addr :8000 -rpc :8001 \
+//	  -graphite-tcp :2003 -graphite-db metrics -graphite-mode counter \
+//	  -statsd :8125 -statsd-db metrics -statsd-tags region,host \
+//	  -influx -influx-tags region,host -influx-max-series 100000 \
+//	  -prometheus -prometheus-db prometheus -prometheus-labels job,instance \
+//	  -monitor 1m -cq /etc/kadiyadb/cq.json
+//
+// Continuous queries are loaded from a JSON file with queries grouped by
+// database name. State files are stored in database directories.
+//
+//	{"mydb": [{"name": "total", "agg": "sum", "fields": ["app", "*", "requests"], "target": ["total", "requests"]}]}
+//
+// Alert rules are loaded from a JSON file with rules grouped by database
+// name. Notifications are sent to the webhook URL if it's given.
+//
+//	{"mydb": [{"name": "slow", "agg": "avg", "by": [2], "fields": ["app", "*", "latency"],
+//	  "window": "5m", "op": ">", "threshold": 500, "for": "10m"}]}
+//
+// Databases with change logs can be replicated to other servers. Replica
+// databases must be created with the same params before replication starts.
+// Replica status (including lag) is available on /replication/status.
+//
+//	kadiyadb -addr :8000 -replication
+//	kadiyadb -addr :9000 -replicate http://primary:8000 -replicate-dbs mydb
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb/alert"
+	"github.com/kadirahq/kadiyadb/continuous"
+	"github.com/kadirahq/kadiyadb/graphite"
+	"github.com/kadirahq/kadiyadb/influx"
+	"github.com/kadirahq/kadiyadb/monitor"
+	"github.com/kadirahq/kadiyadb/prometheus"
+	"github.com/kadirahq/kadiyadb/replication"
+	"github.com/kadirahq/kadiyadb/rpc"
+	"github.com/kadirahq/kadiyadb/server"
+	"github.com/kadirahq/kadiyadb/statsd"
+)
+
+func main() {
+	dir := flag.String("dir", "/data", "directory with database directories")
+	addr := flag.String("addr", ":8000", "HTTP server address")
+	rpcAddr := flag.String("rpc", "", "rpc server address (disabled if empty)")
+	graphiteTCP := flag.String("graphite-tcp", "", "graphite TCP address (disabled if empty)")
+	graphiteUDP := flag.String("graphite-udp", "", "graphite UDP address (disabled if empty)")
+	graphiteDB := flag.String("graphite-db", "graphite", "database used for graphite metrics")
+	graphiteMode := flag.String("graphite-mode", "gauge", "graphite value mode (gauge or counter)")
+	graphiteExpire := flag.Duration("graphite-expire", time.Hour, "time to keep previous values of graphite counters")
+	statsdAddr := flag.String("statsd", "", "statsd UDP address (disabled if empty)")
+	statsdDB := flag.String("statsd-db", "statsd", "database used for statsd metrics")
+	statsdTags := flag.String("statsd-tags", "", "comma separated statsd tag keys added to fields")
+	influxOn := flag.Bool("influx", false, "accept InfluxDB line protocol on /write")
+	influxTags := flag.String("influx-tags", "", "comma separated influx tag keys added to fields")
+	influxMax := flag.Int("influx-max-series", 0, "max series in each database written with influx (0 for no limit)")
+	promOn := flag.Bool("prometheus", false, "accept Prometheus remote write on /api/v1/write")
+	promDB := flag.String("prometheus-db", "prometheus", "default database used for remote write")
+	promLabels := flag.String("prometheus-labels", "", "comma separated label names added to fields")
+	promExpire := flag.Duration("prometheus-expire", time.Hour, "time to keep previous samples of prometheus counters")
+	monInterval := flag.Duration("monitor", 0, "interval to record stats in the _internal database (disabled if 0)")
+	cqFile := flag.String("cq", "", "JSON file with continuous queries (disabled if empty)")
+	cqDelay := flag.Duration("cq-delay", 0, "time to wait for late data before evaluating continuous queries")
+	alertFile := flag.String("alerts", "", "JSON file with alert rules (disabled if empty)")
+	alertWebhook := flag.String("alert-webhook", "", "URL to POST alert notifications")
+	alertInterval := flag.Duration("alert-interval", time.Minute, "time between alert rule evaluations")
+	replPrimary := flag.Bool("replication", false, "serve databases to replicas on /replication/*")
+	replURL := flag.String("replicate", "", "URL of a primary server to replicate from (disabled if empty)")
+	replDBs := flag.String("replicate-dbs", "", "comma separated databases to replicate (must exist locally)")
+	reload := flag.Duration("reload", 10*time.Second, "interval to check param files for changes (disabled if 0)")
+	timeout := flag.Duration("timeout", 10*time.Second, "graceful shutdown timeout")
+	flag.Parse()
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		fail(err)
+	}
+
+	s := server.New(*dir)
+
+	// closers are called in reverse order before closing the server
+	var closers []func() error
+
+	if *rpcAddr != "" {
+		r := rpc.NewServer(s)
+		closers = append(closers, r.Close)
+
+		go func() {
+			fmt.Println("rpc listening on", *rpcAddr)
+			if err := r.ListenAndServe(*rpcAddr); err != nil {
+				fail(err)
+			}
+		}()
+	}
+
+	if *graphiteTCP != "" || *graphiteUDP != "" {
+		db := s.DB(*graphiteDB)
+		if db == nil {
+			fail("graphite database not found: " + *graphiteDB)
+		}
+
+		mode := graphite.Gauge
+		switch *graphiteMode {
+		case "gauge":
+		case "counter":
+			mode = graphite.Counter
+		default:
+			fail("invalid graphite mode: " + *graphiteMode)
+		}
+
+		g := graphite.New(db, mode, *graphiteExpire)
+		closers = append(closers, g.Close)
+
+		if *graphiteTCP != "" {
+			if err := g.ListenTCP(*graphiteTCP); err != nil {
+				fail(err)
+			}
+
+			fmt.Println("graphite listening on tcp", *graphiteTCP)
+		}
+
+		if *graphiteUDP != "" {
+			if err := g.ListenUDP(*graphiteUDP); err != nil {
+				fail(err)
+			}
+
+			fmt.Println("graphite listening on udp", *graphiteUDP)
+		}
+	}
+
+	if *statsdAddr != "" {
+		db := s.DB(*statsdDB)
+		if db == nil {
+			fail("statsd database not found: " + *statsdDB)
+		}
+
+		opts := &statsd.Options{}
+		if *statsdTags != "" {
+			opts.Tags = strings.Split(*statsdTags, ",")
+		}
+
+		sd := statsd.New(db, opts)
+		closers = append(closers, sd.Close)
+
+		if err := sd.ListenUDP(*statsdAddr); err != nil {
+			fail(err)
+		}
+
+		fmt.Println("statsd listening on udp", *statsdAddr)
+	}
+
+	if *influxOn {
+		opts := &influx.Options{MaxSeries: *influxMax}
+		if *influxTags != "" {
+			opts.Tags = strings.Split(*influxTags, ",")
+		}
+
+		s.Handle("/write", influx.NewHandler(s, opts))
+	}
+
+	if *promOn {
+		opts := &prometheus.Options{Database: *promDB, Expire: *promExpire}
+		if *promLabels != "" {
+			opts.Labels = strings.Split(*promLabels, ",")
+		}
+
+		s.Handle("/api/v1/write", prometheus.NewHandler(s, opts))
+	}
+
+	if *monInterval > 0 {
+		db := s.DB(monitor.Database)
+		if db == nil {
+			var err error
+			db, err = s.CreateInternal(monitor.Database, []byte(monitor.DefaultParams))
+			if err != nil {
+				fail(err)
+			}
+		}
+
+		m := monitor.New(db, s, *monInterval)
+		closers = append(closers, m.Close)
+	}
+
+	if *cqFile != "" {
+		data, err := ioutil.ReadFile(*cqFile)
+		if err != nil {
+			fail(err)
+		}
+
+		cqs := map[string][]*continuous.Query{}
+		if err := json.Unmarshal(data, &cqs); err != nil {
+			fail(err)
+		}
+
+		for name, queries := range cqs {
+			db := s.DB(name)
+			if db == nil {
+				fail("continuous query database not found: " + name)
+			}
+
+			r, err := continuous.New(db, &continuous.Options{
+				State: path.Join(*dir, name, "cq-state.json"),
+				Delay: *cqDelay,
+			})
+
+			if err != nil {
+				fail(err)
+			}
+
+			closers = append(closers, r.Close)
+
+			for _, q := range queries {
+				if err := r.Add(q); err != nil {
+					fail(fmt.Sprintf("continuous query %s/%s: %s", name, q.Name, err))
+				}
+			}
+		}
+	}
+
+	if *alertFile != "" {
+		var notifier alert.Notifier
+		if *alertWebhook != "" {
+			notifier = alert.NewWebhook(*alertWebhook, 10*time.Second)
+		}
+
+		rules, err := readRules(*alertFile)
+		if err != nil {
+			fail(err)
+		}
+
+		for name, rules := range rules {
+			db := s.DB(name)
+			if db == nil {
+				fail("alert database not found: " + name)
+			}
+
+			e, err := alert.New(db, notifier, &alert.Options{
+				State:    path.Join(*dir, name, "alerts.json"),
+				Interval: *alertInterval,
+			})
+
+			if err != nil {
+				fail(err)
+			}
+
+			closers = append(closers, e.Close)
+
+			for _, r := range rules {
+				if err := e.Add(r); err != nil {
+					fail(fmt.Sprintf("alert rule %s/%s: %s", name, r.Name, err))
+				}
+			}
+		}
+	}
+
+	if *replPrimary {
+		p := replication.NewPrimary(s)
+		for _, route := range replication.Paths {
+			s.Handle(route, p)
+		}
+	}
+
+	if *replURL != "" {
+		replicas := replication.Replicas{}
+
+		for _, name := range strings.Split(*replDBs, ",") {
+			db := s.DB(name)
+			if db == nil {
+				fail("replica database not found: " + name)
+			}
+
+			r, err := replication.NewReplica(db, &replication.Options{
+				URL:      *replURL,
+				Database: name,
+				State:    path.Join(*dir, name, "replication.json"),
+			})
+
+			if err != nil {
+				fail(err)
+			}
+
+			closers = append(closers, r.Close)
+			replicas[name] = r
+		}
+
+		s.Handle("/replication/status", replicas)
+	}
+
+	if *reload > 0 {
+		// databases created later are not reloaded until the next restart
+		dbs := map[string]*kadiyadb.DB{}
+		for _, name := range s.Names() {
+			dbs[name] = s.DB(name)
+		}
+
+		stop := kadiyadb.Watch(dbs, *reload)
+		closers = append(closers, func() error {
+			stop()
+			return nil
+		})
+	}
+
+	done := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sig
+		for i := len(closers) - 1; i >= 0; i-- {
+			if err := closers[i](); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+			}
+		}
+
+		if err := s.Close(*timeout); err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+		}
+
+		close(done)
+	}()
+
+	fmt.Println("listening on", *addr)
+	if err := s.ListenAndServe(*addr); err != nil {
+		fail(err)
+	}
+
+	<-done
+}
+
+// alertRule is an alert rule in the alerts file with string durations
+type alertRule struct {
+	*alert.Rule
+	Window string `json:"window"`
+	For    string `json:"for"`
+}
+
+// readRules reads alert rules grouped by database name
+func readRules(file string) (rules map[string][]*alert.Rule, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := map[string][]*alertRule{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	rules = map[string][]*alert.Rule{}
+	for name, list := range cfg {
+		for _, r := range list {
+			if r.Rule == nil {
+				r.Rule = &alert.Rule{}
+			}
+
+			if r.Rule.Window, err = time.ParseDuration(r.Window); err != nil {
+				return nil, fmt.Errorf("alert rule %s/%s: invalid window", name, r.Name)
+			}
+
+			if r.For != "" {
+				if r.Rule.For, err = time.ParseDuration(r.For); err != nil {
+					return nil, fmt.Errorf("alert rule %s/%s: invalid for", name, r.Name)
+				}
+			}
+
+			rules[name] = append(rules[name], r.Rule)
+		}
+	}
+
+	return rules, nil
+}
+
+func fail(v interface{}) {
+	fmt.Fprintln(os.Stderr, "Error:", v)
+	os.Exit(1)
+}
@@ -0,0 +1,390 @@
+// Package continuous runs continuous queries which aggregate series of a
+// database and write results back into the database with Track. Expensive
+// aggregates can then be fetched as a single series instead of aggregating
+// many series each time they are needed.
+//
+// Queries are evaluated once for each complete resolution interval of the
+// database. Each interval is evaluated only once (totals and counts are
+// added up by Track) so data tracked for an interval after it's evaluated
+// is not included in results. Use Options.Delay to allow for late data.
+package continuous
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/atomicfile"
+	"github.com/kadirahq/kadiyadb/query"
+)
+
+var (
+	// ErrInvQuery is returned when a continuous query is not valid
+	ErrInvQuery = errors.New("invalid continuous query")
+
+	// ErrExists is returned when adding a query with a name already in use
+	ErrExists = errors.New("continuous query already exists")
+
+	// maxIntervals is the maximum number of intervals evaluated for a query
+	// in one run. The runner is locked while evaluating so catching up after
+	// a long downtime is done over several runs.
+	maxIntervals = 1440
+)
+
+// Query is a continuous query
+type Query struct {
+	// Name identifies the query in the runner and its state
+	Name string `json:"name"`
+
+	// Agg is the aggregation applied to matching series
+	Agg query.Agg `json:"agg"`
+
+	// By has 1-based field positions used to group series (optional)
+	By []int `json:"by"`
+
+	// Fields is the index field pattern
+	Fields []string `json:"fields"`
+
+	// Target is the field set results are written to. When series are
+	// grouped, group field values are appended to target fields.
+	Target []string `json:"target"`
+}
+
+// Options are optional runner settings
+type Options struct {
+	// State is the path of a file used to store the last evaluated time
+	// of each query. Without it, queries start from the current interval
+	// after a restart and the interval in progress may be lost.
+	State string
+
+	// Delay is the time to wait after the end of an interval before
+	// evaluating it to include data which arrives late.
+	Delay time.Duration
+}
+
+// Runner evaluates continuous queries on a database
+type Runner struct {
+	db   *kadiyadb.DB
+	opts *Options
+
+	queries map[string]*Query
+	last    map[string]uint64
+	mtx     *sync.Mutex
+
+	stop chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// New creates a runner for a database. Queries are checked every second
+// and evaluated when an interval is complete. Last evaluated times are
+// loaded from the state file if it's given in options.
+func New(db *kadiyadb.DB, opts *Options) (r *Runner, err error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	r = &Runner{
+		db:      db,
+		opts:    opts,
+		queries: map[string]*Query{},
+		last:    map[string]uint64{},
+		mtx:     &sync.Mutex{},
+		stop:    make(chan struct{}),
+		wg:      &sync.WaitGroup{},
+	}
+
+	if opts.State != "" {
+		data, err := ioutil.ReadFile(opts.State)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		if err == nil {
+			if err := json.Unmarshal(data, &r.last); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	r.wg.Add(1)
+	go r.loop()
+
+	return r, nil
+}
+
+// Add registers a continuous query. Target fields cannot be matched by
+// the query pattern to avoid aggregating results of the query itself.
+func (r *Runner) Add(q *Query) (err error) {
+	if !q.valid() {
+		return ErrInvQuery
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.queries[q.Name]; ok {
+		return ErrExists
+	}
+
+	r.queries[q.Name] = q
+	return nil
+}
+
+// Remove removes a continuous query. The state of the query is kept
+// so it can continue from where it stopped if it's added again.
+func (r *Runner) Remove(name string) {
+	r.mtx.Lock()
+	delete(r.queries, name)
+	r.mtx.Unlock()
+}
+
+// Run evaluates all complete intervals of all queries which are not yet
+// evaluated as of given time (up to maxIntervals per query). A query added
+// for the first time starts from the interval in progress.
+func (r *Runner) Run(now time.Time) (err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	end := now.Add(-r.opts.Delay).UnixNano()
+	if end < 0 {
+		return nil
+	}
+
+	start, _, res := r.db.FetchPeriod(uint64(end))
+	end -= (end - int64(start)) % res
+
+	changed := false
+	for name, q := range r.queries {
+		last, ok := r.last[name]
+		if !ok {
+			r.last[name] = uint64(end)
+			changed = true
+			continue
+		}
+
+		if last >= uint64(end) {
+			continue
+		}
+
+		next, e := r.catchUp(q, last, uint64(end))
+		if e != nil && err == nil {
+			err = e
+		}
+
+		if next != last {
+			r.last[name] = next
+			changed = true
+		}
+	}
+
+	if changed {
+		if e := r.save(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// Close stops evaluating queries
+func (r *Runner) Close() (err error) {
+	close(r.stop)
+	r.wg.Wait()
+	return nil
+}
+
+// catchUp evaluates complete intervals from the last evaluated time until
+// end. The range is split where the resolution of fetched data changes
+// (epoch param changes and rollups used for old data) and each part is
+// evaluated with its own resolution. When the resolution becomes coarser,
+// the partial interval at the start of the new part is skipped. At most
+// maxIntervals intervals are evaluated, the rest is left for the next run.
+// It returns the time to continue from next time. Intervals are counted as
+// evaluated even if tracking some results fails to avoid adding up results
+// which were already tracked again.
+func (r *Runner) catchUp(q *Query, from, end uint64) (last uint64, err error) {
+	budget := uint64(maxIntervals)
+
+	for from < end {
+		start, next, res := r.db.FetchPeriod(from)
+		step := uint64(res)
+
+		to := end
+		if next != 0 && next < to {
+			to = next
+		}
+
+		// intervals are aligned to the start of the period
+		if off := (from - start) % step; off != 0 {
+			from += step - off
+		}
+
+		stop := to - (to-start)%step
+		if from < stop && (stop-from)/step >= budget {
+			stop = from + budget*step
+			to = stop
+		}
+
+		if from < stop {
+			chunk, e := r.query(q, from, stop, res)
+			if e != nil {
+				if err == nil {
+					err = e
+				}
+
+				return from, err
+			}
+
+			if e := r.track(q, chunk, res); e != nil && err == nil {
+				err = e
+			}
+
+			budget -= (stop - from) / step
+		}
+
+		// the last interval is not complete yet
+		if stop < to {
+			if stop > from {
+				return stop, err
+			}
+
+			return from, err
+		}
+
+		from = to
+		if budget == 0 {
+			break
+		}
+	}
+
+	return from, err
+}
+
+// query runs the query for a time range
+func (r *Runner) query(q *Query, from, to uint64, step int64) (chunk *protocol.Chunk, err error) {
+	qq := &query.Query{
+		Agg:    q.Agg,
+		By:     q.By,
+		Fields: q.Fields,
+		From:   from,
+		To:     to,
+		Step:   step,
+	}
+
+	return qq.Run(r.db)
+}
+
+// track writes query results to target series. All points are tracked
+// even if some of them fail and the first error is returned.
+func (r *Runner) track(q *Query, chunk *protocol.Chunk, step int64) (err error) {
+	for _, s := range chunk.Series {
+		target := q.Target
+		if len(q.By) > 0 {
+			target = append(append([]string{}, q.Target...), s.Fields...)
+		}
+
+		for i, p := range s.Points {
+			if p.Count == 0 {
+				continue
+			}
+
+			ts := chunk.From + uint64(int64(i)*step)
+			if e := r.db.Track(ts, target, p.Total, p.Count); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+
+	return err
+}
+
+// save writes last evaluated times to the state file.
+// The mutex must be locked when calling this function.
+func (r *Runner) save() (err error) {
+	if r.opts.State == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(r.last)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(r.opts.State, data)
+}
+
+// valid checks whether the query is valid
+func (q *Query) valid() bool {
+	if q.Name == "" || len(q.Fields) == 0 || len(q.Target) == 0 {
+		return false
+	}
+
+	switch q.Agg {
+	case query.Sum, query.Avg, query.Min, query.Max, query.Count:
+	default:
+		return false
+	}
+
+	for _, n := range q.By {
+		if n < 1 || n > len(q.Fields) {
+			return false
+		}
+	}
+
+	target := q.Target
+	if len(q.By) > 0 {
+		// group values can be anything, use wildcards to check
+		target = append([]string{}, q.Target...)
+		for range q.By {
+			target = append(target, "*")
+		}
+	}
+
+	// Track also writes to all parent series of the target
+	for i := 1; i <= len(target); i++ {
+		if overlaps(q.Fields, target[:i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// overlaps checks whether two field patterns can match the same fields
+func overlaps(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != "*" && b[i] != "*" && a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *Runner) loop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			if err := r.Run(now); err != nil {
+				fmt.Println("Continuous Query Error:", err)
+			}
+		}
+	}
+}
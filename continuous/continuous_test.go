@@ -0,0 +1,373 @@
+package continuous
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/query"
+)
+
+var (
+	tmpdircq = "/tmp/test-continuous/"
+)
+
+func setupcq(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdircq); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdircq); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	defer setupcq(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdircq+"db", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Now().Truncate(time.Hour)
+	from := uint64(base.UnixNano())
+	to := from + 240000000000
+
+	for i := 0; i < 3; i++ {
+		ts := uint64(base.Add(time.Duration(i) * time.Minute).UnixNano())
+		if err := db.Track(ts, []string{"app", "a", "requests"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Track(ts, []string{"app", "b", "requests"}, 2, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Track(ts, []string{"web", "c", "requests"}, 4, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := &Options{State: tmpdircq + "state.json"}
+	r, err := New(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Add(&Query{
+		Name:   "total",
+		Agg:    query.Sum,
+		Fields: []string{"app", "*", "requests"},
+		Target: []string{"total", "requests"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.Add(&Query{
+		Name:   "byapp",
+		Agg:    query.Avg,
+		By:     []int{1},
+		Fields: []string{"*", "*", "requests"},
+		Target: []string{"avg"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first run only records the start time
+	if err := r.Run(base.Add(30 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// evaluates the first two minutes (the third is in progress)
+	// running it again should not evaluate the same intervals again
+	for i := 0; i < 2; i++ {
+		if err := r.Run(base.Add(2*time.Minute + 30*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Fetch(from, to, []string{"total", "requests"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		exp := []protocol.Point{{3, 2}, {3, 2}, {0, 0}, {0, 0}}
+		if ps := res[0].Series[0].Points; !reflect.DeepEqual(ps, exp) {
+			t.Fatal("wrong points", ps)
+		}
+	})
+
+	// avg is tracked as the sum of series averages and the series count
+	db.Fetch(from, to, []string{"avg", "app"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		exp := []protocol.Point{{3, 2}, {3, 2}, {0, 0}, {0, 0}}
+		if ps := res[0].Series[0].Points; !reflect.DeepEqual(ps, exp) {
+			t.Fatal("wrong points", ps)
+		}
+	})
+
+	db.Fetch(from, to, []string{"avg", "web"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		exp := []protocol.Point{{4, 1}, {4, 1}, {0, 0}, {0, 0}}
+		if ps := res[0].Series[0].Points; !reflect.DeepEqual(ps, exp) {
+			t.Fatal("wrong points", ps)
+		}
+	})
+
+	// a new runner continues from the saved state
+	r, err = New(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	err = r.Add(&Query{
+		Name:   "total",
+		Agg:    query.Sum,
+		Fields: []string{"app", "*", "requests"},
+		Target: []string{"total", "requests"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Run(base.Add(3*time.Minute + 30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Fetch(from, to, []string{"total", "requests"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		exp := []protocol.Point{{3, 2}, {3, 2}, {3, 2}, {0, 0}}
+		if ps := res[0].Series[0].Points; !reflect.DeepEqual(ps, exp) {
+			t.Fatal("wrong points", ps)
+		}
+	})
+}
+
+func TestRunParamsChange(t *testing.T) {
+	defer setupcq(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdircq+"db", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	base := time.Now().Truncate(time.Hour)
+	from := uint64(base.UnixNano())
+	to := from + 240000000000
+
+	for i := 0; i < 3; i++ {
+		if err := db.Track(uint64(base.Add(time.Duration(i)*time.Minute).UnixNano()), []string{"app", "a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// epochs after the current one use a finer resolution
+	if err := db.SetEpochParams(int64(time.Hour), int64(30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := New(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	q := &Query{Name: "total", Agg: query.Sum, Fields: []string{"app", "*"}, Target: []string{"total"}}
+	if err := r.Add(q); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Run(base.Add(30 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// intervals before and after the change are evaluated separately
+	if err := r.Run(base.Add(time.Hour + 70*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Fetch(from, to, []string{"total"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		exp := []protocol.Point{{1, 1}, {1, 1}, {1, 1}, {0, 0}}
+		if ps := res[0].Series[0].Points; !reflect.DeepEqual(ps, exp) {
+			t.Fatal("wrong points", ps)
+		}
+	})
+
+	if last := r.last["total"]; last != uint64(base.Add(time.Hour+time.Minute).UnixNano()) {
+		t.Fatal("wrong last evaluated time", last)
+	}
+}
+
+func TestRunMaxIntervals(t *testing.T) {
+	defer setupcq(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdircq+"db", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	defer func(n int) { maxIntervals = n }(maxIntervals)
+	maxIntervals = 2
+
+	r, err := New(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	q := &Query{Name: "total", Agg: query.Sum, Fields: []string{"app", "*"}, Target: []string{"total"}}
+	if err := r.Add(q); err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now().Truncate(time.Hour)
+	if err := r.Run(base.Add(30 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// three intervals are complete but only two are evaluated in a run
+	now := base.Add(3*time.Minute + 30*time.Second)
+	for i := 2; i <= 3; i++ {
+		if err := r.Run(now); err != nil {
+			t.Fatal(err)
+		}
+
+		if last := r.last["total"]; last != uint64(base.Add(time.Duration(i)*time.Minute).UnixNano()) {
+			t.Fatal("wrong last evaluated time", i, last)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	defer setupcq(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdircq+"db", p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	r, err := New(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	invalid := []*Query{
+		{Agg: query.Sum, Fields: []string{"a", "*"}, Target: []string{"b"}},
+		{Name: "q", Agg: "median", Fields: []string{"a", "*"}, Target: []string{"b"}},
+		{Name: "q", Agg: query.Sum, Target: []string{"b"}},
+		{Name: "q", Agg: query.Sum, Fields: []string{"a", "*"}},
+		{Name: "q", Agg: query.Sum, By: []int{3}, Fields: []string{"a", "*"}, Target: []string{"b"}},
+		{Name: "q", Agg: query.Sum, Fields: []string{"a", "*"}, Target: []string{"a", "total"}},
+		{Name: "q", Agg: query.Sum, By: []int{2}, Fields: []string{"*", "*"}, Target: []string{"x"}},
+		{Name: "q", Agg: query.Sum, Fields: []string{"*"}, Target: []string{"total", "requests"}},
+		{Name: "q", Agg: query.Sum, Fields: []string{"x", "*"}, Target: []string{"x", "y", "z"}},
+	}
+
+	for i, q := range invalid {
+		if err := r.Add(q); err != ErrInvQuery {
+			t.Fatal("should return an error", i)
+		}
+	}
+
+	q := &Query{Name: "q", Agg: query.Sum, Fields: []string{"a", "*"}, Target: []string{"b", "total"}}
+	if err := r.Add(q); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Add(q); err != ErrExists {
+		t.Fatal("should return an error")
+	}
+
+	r.Remove("q")
+	if err := r.Add(q); err != nil {
+		t.Fatal(err)
+	}
+}
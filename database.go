@@ -5,17 +5,26 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/changelog"
 	"github.com/kadirahq/kadiyadb/epoch"
+	"github.com/kadirahq/kadiyadb/metrics"
 )
 
 const (
 	// paramfile is the name of the config file placed in the database directory.
-	// Param files are only read when the database server starts therefore
-	// a server re-start is required for changes to take effect (for now).
+	// Param files are read when the database server starts. Changes to epoch
+	// cache sizes and retention can be applied with DB.Reload but changes to
+	// duration and resolution require a restart and only apply to new epochs.
+	// DB.SetEpochParams updates duration and resolution in this file.
 	//
 	// Param File Format:
 	//
@@ -24,10 +33,20 @@ const (
 	//     "resolution": "1m",
 	//     "retention": "24h",
 	//     "maxROEpochs": 12,
-	//     "maxRWEpochs": 2
+	//     "maxRWEpochs": 2,
+	//     "rollups": [
+	//       {"resolution": "1h", "retention": "8760h"}
+	//     ],
+	//     "changelog": {"segmentSize": 67108864, "maxSegments": 8}
 	//   }
 	//
+	// Rollups are optional (see Params.Rollups for rollup defaults).
+	// The change log is disabled unless it's given (see Params.ChangeLog).
+	//
 	paramfile = "params.json"
+
+	// changedir is the name of the change log directory
+	changedir = "changelog"
 )
 
 var (
@@ -38,6 +57,16 @@ var (
 	ErrInvTime = errors.New("invalid timestamp")
 )
 
+var (
+	// trackLatency has latencies of Track calls for all databases
+	trackLatency = metrics.NewHistogram("kadiyadb_track_duration_seconds",
+		"Latency of DB.Track calls (including rollups) in seconds.", nil)
+
+	// fetchLatency has latencies of Fetch calls for all databases
+	fetchLatency = metrics.NewHistogram("kadiyadb_fetch_duration_seconds",
+		"Latency of DB.Fetch calls (including result handlers) in seconds.", nil)
+)
+
 // Handler is a function which is called with Fetch result
 // The data returned here is only valid inside this function
 // For extended use of results, a copy of the data must be made.
@@ -53,13 +82,46 @@ type Params struct {
 	Retention     int64  `json:"-"`
 	MaxROEpochs   int64  `json:"maxROEpochs"`
 	MaxRWEpochs   int64  `json:"maxRWEpochs"`
+
+	// Rollups are downsampled copies of database data with coarser resolutions
+	// and independent retention periods. Duration and epoch cache sizes can be
+	// omitted. By default, rollup epochs will have the same number of points
+	// as database epochs and will use the same epoch cache size limits.
+	Rollups []*Params `json:"rollups,omitempty"`
+
+	// ChangeLog enables recording all Track calls in an append-only log
+	// stored in the database directory (see DB.Changes). Rollups cannot
+	// have change logs because they only receive writes from the database.
+	ChangeLog *changelog.Options `json:"changelog,omitempty"`
+}
+
+// Databases is used to find databases by name. Handlers which serve
+// databases of a server (server.Server can be used here) depend on this.
+type Databases interface {
+	DB(name string) (db *DB)
 }
 
 // DB is a database
 type DB struct {
-	params *Params
-	cache  *epoch.Cache
-	rsize  int64
+	params  *Params
+	cache   *epoch.Cache
+	dir     string
+	history []*period
+	histmtx *sync.RWMutex
+	stop    chan struct{}
+	stopper *sync.Once
+	wake    chan struct{}
+	rollups []*DB
+	changes *changelog.Log
+
+	// writes to frozen epochs wait until they are thawed (see Backup)
+	frozen  map[int64]bool
+	barrier *sync.RWMutex
+	thaw    *sync.Cond
+
+	// live subscriptions (see Subscribe)
+	subs   map[*Subscription]struct{}
+	submtx *sync.RWMutex
 }
 
 // LoadAll loads all databases inside the path
@@ -84,33 +146,12 @@ func LoadAll(dir string) (dbs map[string]*DB) {
 			continue
 		}
 
-		params := &Params{}
-		if err := json.Unmarshal(data, params); err != nil {
+		params, err := ParseParams(data)
+		if err != nil {
 			fmt.Println("DB Error: params:", name, err)
 			continue
 		}
 
-		if dur, err := time.ParseDuration(params.DurationStr); err != nil {
-			fmt.Println("DB Error: duration", name, params.DurationStr, err)
-			continue
-		} else {
-			params.Duration = int64(dur)
-		}
-
-		if dur, err := time.ParseDuration(params.ResolutionStr); err != nil {
-			fmt.Println("DB Error: resolution", name, params.ResolutionStr, err)
-			continue
-		} else {
-			params.Resolution = int64(dur)
-		}
-
-		if dur, err := time.ParseDuration(params.RetentionStr); err != nil {
-			fmt.Println("DB Error: retention", name, params.RetentionStr, err)
-			continue
-		} else {
-			params.Retention = int64(dur)
-		}
-
 		db, err := Open(base, params)
 		if err != nil {
 			fmt.Println("DB Error: open:", name, err)
@@ -123,26 +164,84 @@ func LoadAll(dir string) (dbs map[string]*DB) {
 	return dbs
 }
 
+// ParseParams parses the content of a database param file. Duration values
+// are parsed and set to Duration, Resolution and Retention fields in params.
+func ParseParams(data []byte) (p *Params, err error) {
+	p = &Params{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+
+	for i, r := range p.Rollups {
+		if err := r.parse(); err != nil {
+			return nil, fmt.Errorf("rollup %d: %s", i, err)
+		}
+	}
+
+	return p, nil
+}
+
 // Open opens an existing database with given parameters
 func Open(dir string, p *Params) (db *DB, err error) {
-	if p == nil ||
-		p.Duration == 0 ||
-		p.Resolution == 0 ||
-		p.Retention == 0 ||
-		p.MaxROEpochs == 0 ||
-		p.MaxRWEpochs == 0 ||
-		p.Duration%p.Resolution != 0 ||
-		p.Retention%p.Duration != 0 {
+	db, err = open(dir, p)
+	if err != nil {
+		return nil, err
+	}
+
+	go db.retain()
+
+	return db, nil
+}
+
+// open opens a database without starting the retention worker
+func open(dir string, p *Params) (db *DB, err error) {
+	if p == nil || !p.valid() {
 		return nil, ErrInvParams
 	}
 
-	rsize := p.Duration / p.Resolution
-	cache := epoch.NewCache(p.MaxRWEpochs, p.MaxROEpochs, dir, rsize)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// params can change later (SetEpochParams)
+	// make a copy to avoid changing given struct
+	params := *p
+	barrier := &sync.RWMutex{}
 
 	db = &DB{
-		params: p,
-		cache:  cache,
-		rsize:  rsize,
+		params:  &params,
+		dir:     dir,
+		histmtx: &sync.RWMutex{},
+		stop:    make(chan struct{}),
+		stopper: &sync.Once{},
+		wake:    make(chan struct{}, 1),
+		frozen:  map[int64]bool{},
+		barrier: barrier,
+		thaw:    sync.NewCond(barrier.RLocker()),
+		subs:    map[*Subscription]struct{}{},
+		submtx:  &sync.RWMutex{},
+	}
+
+	if err := db.loadHistory(); err != nil {
+		return nil, err
+	}
+
+	if p.ChangeLog != nil {
+		db.changes, err = changelog.Open(path.Join(dir, changedir), p.ChangeLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	db.cache = epoch.NewCache(p.MaxRWEpochs, p.MaxROEpochs, dir, db.meta)
+
+	if err := db.openRollups(); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	return db, nil
@@ -151,13 +250,54 @@ func Open(dir string, p *Params) (db *DB, err error) {
 // Track records a measurement with given total value and measurement count.
 // It uses the field combination and the timestamp to locate the data point.
 func (d *DB) Track(ts uint64, fields []string, total, count float64) (err error) {
-	ets, pos := d.split(ts)
+	defer trackLatency.ObserveSince(time.Now())
+	return d.track(ts, fields, total, count, nil)
+}
 
-	if ets < 0 {
+// track records a measurement in the database and its rollups. If want is
+// not nil, the measurement is only recorded in the database and rollups for
+// which it returns true (see ReplayTo).
+func (d *DB) track(ts uint64, fields []string, total, count float64, want func(rollup string, start int64) bool) (err error) {
+	if int64(ts) < 0 {
 		return ErrInvTime
 	}
 
-	e, err := d.cache.LoadRW(ets)
+	m, pos := d.split(int64(ts))
+
+	// rollups are also written while holding the barrier (see copyRollupEpoch)
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+
+	if want == nil || want("", m.Start) {
+		if err := d.write(ts, m, pos, fields, total, count); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range d.rollups {
+		if want != nil {
+			rm, _ := r.split(int64(ts))
+			if !want(r.name(), rm.Start) {
+				continue
+			}
+		}
+
+		if err := r.track(ts, fields, total, count, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write records a measurement in an epoch of the database.
+// The barrier must be read locked when calling this function.
+func (d *DB) write(ts uint64, m *epoch.Meta, pos int64, fields []string, total, count float64) (err error) {
+	for d.frozen[m.Start] {
+		d.thaw.Wait()
+	}
+
+	e, err := d.cache.LoadRW(m.Start)
 	if err != nil {
 		return err
 	}
@@ -167,53 +307,65 @@ func (d *DB) Track(ts uint64, fields []string, total, count float64) (err error)
 		return err
 	}
 
+	// only changes which were written successfully are logged
+	if d.changes != nil {
+		entry := &changelog.Entry{
+			Time:   int64(ts),
+			Epoch:  m.Start,
+			Fields: fields,
+			PID:    pos,
+			Total:  total,
+			Count:  count,
+		}
+
+		if err := d.changes.Append(entry); err != nil {
+			return err
+		}
+	}
+
+	d.publish(e, m, pos, fields)
+
 	return nil
 }
 
 // Fetch fetches data from database by given field pattern and timestamp range.
 // The handler function is called with the result and errors (if any).
+// A chunk is returned for each epoch in the range. Chunks can have different
+// resolutions if epoch params were changed or if data is read from a rollup.
+// Data is read from the finest rollup which still has data for the range.
+// The resolution of a chunk is (To-From)/len(Points) for any of its series.
 func (d *DB) Fetch(from, to uint64, fields []string, fn Handler) {
-	if to < from {
-		fn(nil, ErrInvTime)
-		return
-	}
-
-	ets0, pos0 := d.split(from)
-	ets1, pos1 := d.split(to)
-
-	if pos1 == 0 {
-		ets1 -= d.params.Duration
-		pos1 = d.rsize
-	}
+	defer fetchLatency.ObserveSince(time.Now())
+	d.tier(int64(from)).fetch(from, to, fields, fn)
+}
 
-	// check timestamp bounds
-	if ets0 < 0 || ets1 < 0 {
+// fetch fetches data from database without using rollups
+func (d *DB) fetch(from, to uint64, fields []string, fn Handler) {
+	if to < from || int64(from) < 0 || int64(to) < 0 {
 		fn(nil, ErrInvTime)
 		return
 	}
 
-	// no points in given time range
-	if ets0 == ets1 && pos0 == pos1 {
-		fn([]*protocol.Chunk{}, nil)
-		return
-	}
-
-	nchunks := (ets1-ets0)/d.params.Duration + 1
-	chunks := make([]*protocol.Chunk, 0, nchunks)
+	chunks := []*protocol.Chunk{}
 
-	for ets := ets0; ets <= ets1; ets += d.params.Duration {
-		var start int64
-		end := d.rsize
+	for ts, end := int64(from), int64(to); ts < end; {
+		m, start := d.split(ts)
+		ets := m.Start + m.Duration
+		stop := m.RecordSize
 
-		if ets == ets0 {
-			start = pos0
+		if end < ets {
+			stop = (end - m.Start) / m.Resolution
 		}
 
-		if ets == ets1 {
-			end = pos1
+		// next epoch starts right after this one
+		ts = ets
+
+		// no points in this part of the time range
+		if stop <= start {
+			continue
 		}
 
-		e, err := d.cache.LoadRO(ets)
+		e, err := d.cache.LoadRO(m.Start)
 		if err != nil {
 			fn(nil, err)
 			return
@@ -225,7 +377,7 @@ func (d *DB) Fetch(from, to uint64, fields []string, fn Handler) {
 		e.RLock()
 		defer e.RUnlock()
 
-		points, nodes, err := e.Fetch(start, end, fields)
+		points, nodes, err := e.Fetch(start, stop, fields)
 		if err != nil {
 			fn(nil, err)
 			return
@@ -242,8 +394,8 @@ func (d *DB) Fetch(from, to uint64, fields []string, fn Handler) {
 		}
 
 		chunk := &protocol.Chunk{
-			From:   uint64(ets + start*d.params.Resolution),
-			To:     uint64(ets + end*d.params.Resolution),
+			From:   uint64(m.Start + start*m.Resolution),
+			To:     uint64(m.Start + stop*m.Resolution),
 			Series: series,
 		}
 
@@ -254,24 +406,204 @@ func (d *DB) Fetch(from, to uint64, fields []string, fn Handler) {
 	return
 }
 
+// Series returns fields of all series recorded in epochs of the database
+// which are within the retention period. Parent series recorded by Track for
+// each prefix of fields are included. Epochs which can still be written (the
+// last MaxRWEpochs epochs) are loaded for writing and other epochs which are
+// not in the cache are read without adding them to the cache.
+func (d *DB) Series() (series [][]string, err error) {
+	starts, err := d.epochs()
+	if err != nil {
+		return nil, err
+	}
+
+	d.histmtx.RLock()
+	retention := d.params.Retention
+	maxRW := d.params.MaxRWEpochs
+	d.histmtx.RUnlock()
+
+	// epochs before the one containing the retention start are expired
+	now := time.Now().UnixNano()
+	rm, _ := d.split(now - retention)
+	m, _ := d.split(now)
+	cutoff := m.Start - (maxRW-1)*m.Duration
+
+	seen := map[string]bool{}
+
+	for _, start := range starts {
+		if start < rm.Start {
+			continue
+		}
+
+		e, release, err := d.readEpoch(start, start >= cutoff)
+		if err != nil {
+			return nil, err
+		}
+
+		nodes, err := e.Nodes()
+		if err != nil {
+			release()
+			return nil, err
+		}
+
+		for _, node := range nodes {
+			key := strings.Join(node.Fields, "\x00")
+			if !seen[key] {
+				seen[key] = true
+				series = append(series, append([]string{}, node.Fields...))
+			}
+		}
+
+		release()
+	}
+
+	return series, nil
+}
+
+// readEpoch loads an epoch to read its index nodes. Active epochs are loaded
+// for writing because loading them in read-only mode writes an index snapshot
+// which would not have records added later. Other epochs are only loaded in
+// the cache if they are already there to avoid evicting epochs in use. The
+// release function must be called after reading the epoch.
+func (d *DB) readEpoch(start int64, active bool) (e *epoch.Epoch, release func(), err error) {
+	if active {
+		if e, err = d.cache.LoadRW(start); err != nil {
+			return nil, nil, err
+		}
+	} else if cached, ok := d.cache.Loaded(start); ok {
+		e = cached
+	} else {
+		dir := path.Join(d.dir, strconv.FormatInt(start, 10))
+		if e, err = epoch.NewRO(dir, d.meta(start)); err != nil {
+			return nil, nil, err
+		}
+
+		return e, func() { e.Close() }, nil
+	}
+
+	// epochs are RLocked to make sure they are not closed while in use
+	e.RLock()
+	return e, e.RUnlock, nil
+}
+
+// parse parses duration strings in params. Empty strings are parsed as zero.
+func (p *Params) parse() (err error) {
+	fields := []struct {
+		name string
+		str  string
+		dst  *int64
+	}{
+		{"duration", p.DurationStr, &p.Duration},
+		{"resolution", p.ResolutionStr, &p.Resolution},
+		{"retention", p.RetentionStr, &p.Retention},
+	}
+
+	for _, f := range fields {
+		if f.str == "" {
+			*f.dst = 0
+			continue
+		}
+
+		dur, err := time.ParseDuration(f.str)
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.name, err)
+		}
+
+		*f.dst = int64(dur)
+	}
+
+	return nil
+}
+
+// valid checks whether param values can be used with a database
+func (p *Params) valid() bool {
+	return p.Duration > 0 &&
+		p.Resolution > 0 &&
+		p.Retention > 0 &&
+		p.MaxROEpochs > 0 &&
+		p.MaxRWEpochs > 0 &&
+		p.Duration%p.Resolution == 0 &&
+		p.Retention%p.Duration == 0 &&
+		p.validRollups()
+}
+
+// DiskUsage returns the total size of files in the database directory
+// (including rollups) in bytes. Segment files are allocated in advance
+// therefore this can be larger than the size of data stored in them.
+func (d *DB) DiskUsage() (size int64, err error) {
+	err = filepath.Walk(d.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
 // Sync flushes pending writes to the filesystem
 func (d *DB) Sync() (err error) {
 	if err := d.cache.Sync(); err != nil {
 		return err
 	}
 
+	if d.changes != nil {
+		if err := d.changes.Sync(); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range d.rollups {
+		if err := r.Sync(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-// split the time into epoch start time and point position
-func (d *DB) split(ts uint64) (ets, pos int64) {
-	t64 := int64(ts)
-	if t64 < d.params.Resolution {
-		return 0, 0
+// Close stops background workers and releases resources
+// It's safe to call Close more than once.
+func (d *DB) Close() (err error) {
+	d.stopper.Do(func() {
+		close(d.stop)
+	})
+
+	d.submtx.RLock()
+	subs := make([]*Subscription, 0, len(d.subs))
+	for s := range d.subs {
+		subs = append(subs, s)
 	}
+	d.submtx.RUnlock()
 
-	ets = d.params.Duration * (t64 / d.params.Duration)
-	pos = (t64 - ets) / d.params.Resolution
+	for _, s := range subs {
+		s.Close()
+	}
 
-	return ets, pos
+	if err := d.cache.Close(); err != nil {
+		return err
+	}
+
+	if d.changes != nil {
+		if err := d.changes.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, r := range d.rollups {
+		if err := r.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
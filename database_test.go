@@ -4,10 +4,13 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/epoch"
 )
 
 const (
@@ -133,6 +136,72 @@ func TestTrack(t *testing.T) {
 	}
 }
 
+func TestSeries(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UnixNano()
+	now -= now % p.Duration
+
+	// series in different epochs are returned once
+	// series in epochs older than retention are not returned
+	tracks := []struct {
+		ts     int64
+		fields []string
+	}{
+		{now, []string{"a", "b"}},
+		{now - p.Duration, []string{"a", "b"}},
+		{now - p.Duration, []string{"a", "c"}},
+		{now - p.Retention - p.Duration, []string{"x"}},
+	}
+
+	for _, tr := range tracks {
+		if err := db.Track(uint64(tr.ts), tr.fields, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	series, err := db.Series()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]int{}
+	for _, fields := range series {
+		found[strings.Join(fields, ".")]++
+	}
+
+	exp := map[string]int{"a": 1, "a.b": 1, "a.c": 1}
+	if !reflect.DeepEqual(found, exp) {
+		t.Fatal("wrong series", found)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestFetchSimple(t *testing.T) {
 	if err := os.RemoveAll(dir); err != nil {
 		t.Fatal(err)
@@ -366,3 +435,127 @@ func TestFetchMultiChunk(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestParamsChange(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"a", "b", "d"}
+
+	if err := db.Track(0, fields, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	p2 := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  10000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	// older epochs should use older params
+	db2, err := Open(dir, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db2.Track(0, fields, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := db2.ResolutionAt(0); res != p.Resolution {
+		t.Fatal("wrong resolution")
+	}
+
+	if err := db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// epochs without params history cannot be verified
+	if err := os.Remove(dir + "/history.json"); err != nil {
+		t.Fatal(err)
+	}
+
+	db3, err := Open(dir, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db3.Track(0, fields, 5, 1)
+	if _, ok := err.(*epoch.MismatchError); !ok {
+		t.Fatal("should return a mismatch error")
+	}
+
+	if err := db3.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskUsage(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(dir, &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := db.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Track(uint64(time.Now().UnixNano()), []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := db.DiskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before <= 0 || after <= before {
+		t.Fatal("wrong disk usage", before, after)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
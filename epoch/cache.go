@@ -1,12 +1,15 @@
 package epoch
 
 import (
+	"io/ioutil"
 	"math"
 	"os"
 	"path"
 	"strconv"
 	"sync"
 	"sync/atomic"
+
+	"github.com/kadirahq/kadiyadb/metrics"
 )
 
 const (
@@ -15,6 +18,33 @@ const (
 	ExpireAll = math.MaxInt64
 )
 
+// cacheMetrics has metrics for one category of epochs (read-only/read-write)
+type cacheMetrics struct {
+	hits      *metrics.Counter
+	misses    *metrics.Counter
+	evictions *metrics.Counter
+	loaded    *metrics.Gauge
+}
+
+var (
+	// cache metrics are collected for all databases in the process
+	rometrics = newCacheMetrics("ro")
+	rwmetrics = newCacheMetrics("rw")
+)
+
+func newCacheMetrics(mode string) *cacheMetrics {
+	return &cacheMetrics{
+		hits: metrics.NewCounter("kadiyadb_epoch_cache_requests_total",
+			"Number of epoch cache requests by mode and result.", "mode", mode, "result", "hit"),
+		misses: metrics.NewCounter("kadiyadb_epoch_cache_requests_total",
+			"Number of epoch cache requests by mode and result.", "mode", mode, "result", "miss"),
+		evictions: metrics.NewCounter("kadiyadb_epoch_cache_evictions_total",
+			"Number of epochs closed to keep the cache within its size limit.", "mode", mode),
+		loaded: metrics.NewGauge("kadiyadb_epochs_loaded",
+			"Number of epochs currently loaded in epoch caches.", "mode", mode),
+	}
+}
+
 // item structs are used as items in caches to store epochs and their weights.
 // Items with a higher number for weights are considered important so they less
 // likely to be removed when the cache runs out of space.
@@ -34,11 +64,12 @@ type Cache struct {
 	dbpath string
 	nextID int64
 	mapmtx *sync.RWMutex
-	rsize  int64
+	metafn MetaFunc
 }
 
 // NewCache crates an LRU cache with given RO/RW size limits
-func NewCache(rwsz, rosz int64, dir string, rsz int64) (c *Cache) {
+// Epoch metadata for each epoch start time is taken from `fn`.
+func NewCache(rwsz, rosz int64, dir string, fn MetaFunc) (c *Cache) {
 	return &Cache{
 		rosize: rosz,
 		rodata: make(map[int64]*item, rosz),
@@ -46,7 +77,7 @@ func NewCache(rwsz, rosz int64, dir string, rsz int64) (c *Cache) {
 		rwdata: make(map[int64]*item, rwsz),
 		dbpath: dir,
 		mapmtx: &sync.RWMutex{},
-		rsize:  rsz,
+		metafn: fn,
 	}
 }
 
@@ -59,19 +90,23 @@ func (c *Cache) LoadRO(key int64) (epoch *Epoch, err error) {
 	if item, ok := c.rwdata[key]; ok {
 		nextID := atomic.AddInt64(&c.nextID, 1)
 		atomic.StoreInt64(&item.weight, nextID)
+		rometrics.hits.Inc()
 		return item.epoch, nil
 	}
 
 	if item, ok := c.rodata[key]; ok {
 		nextID := atomic.AddInt64(&c.nextID, 1)
 		atomic.StoreInt64(&item.weight, nextID)
+		rometrics.hits.Inc()
 		return item.epoch, nil
 	}
 
+	rometrics.misses.Inc()
+
 	keystr := strconv.Itoa(int(key))
 	dir := path.Join(c.dbpath, keystr)
 
-	epoch, err = NewRO(dir, c.rsize)
+	epoch, err = NewRO(dir, c.metafn(key))
 	if err != nil {
 		return nil, err
 	}
@@ -83,29 +118,61 @@ func (c *Cache) LoadRO(key int64) (epoch *Epoch, err error) {
 		epoch:  epoch,
 	}
 
+	rometrics.loaded.Add(1)
+
 	// enforce read-only cache size
-	c.enforceSize(c.rodata, c.rosize)
+	// evicted epochs may be read locked by the goroutine loading this epoch
+	// (Fetch keeps all epochs in the range locked until its handler returns)
+	// therefore they are closed in the background to avoid a deadlock
+	for _, e := range c.enforceSize(c.rodata, c.rosize, rometrics) {
+		go e.Close()
+	}
 
 	return epoch, nil
 }
 
+// Loaded returns an epoch if it's already loaded in the cache (in either
+// mode) without loading it or changing its weight in the cache.
+func (c *Cache) Loaded(key int64) (epoch *Epoch, ok bool) {
+	c.mapmtx.RLock()
+	defer c.mapmtx.RUnlock()
+
+	if item, ok := c.rwdata[key]; ok {
+		return item.epoch, true
+	}
+
+	if item, ok := c.rodata[key]; ok {
+		return item.epoch, true
+	}
+
+	return nil, false
+}
+
 // LoadRW fetches an epoch for writing. It will make sure that
-// the epoch is not already loaded in read-only mode.
+// the epoch is not already loaded in read-only mode. Epochs removed from
+// the cache are closed after releasing the cache lock (see closeAll).
 func (c *Cache) LoadRW(key int64) (epoch *Epoch, err error) {
+	var evicted []*Epoch
+	defer func() { closeAll(evicted) }()
+
 	c.mapmtx.Lock()
 	defer c.mapmtx.Unlock()
 
 	if item, ok := c.rodata[key]; ok {
 		delete(c.rodata, key)
-		item.epoch.Close()
+		evicted = append(evicted, item.epoch)
+		rometrics.loaded.Add(-1)
 	}
 
 	if item, ok := c.rwdata[key]; ok {
 		nextID := atomic.AddInt64(&c.nextID, 1)
 		atomic.StoreInt64(&item.weight, nextID)
+		rwmetrics.hits.Inc()
 		return item.epoch, nil
 	}
 
+	rwmetrics.misses.Inc()
+
 	keystr := strconv.Itoa(int(key))
 	dir := path.Join(c.dbpath, keystr)
 
@@ -113,7 +180,7 @@ func (c *Cache) LoadRW(key int64) (epoch *Epoch, err error) {
 		return nil, err
 	}
 
-	epoch, err = NewRW(dir, c.rsize)
+	epoch, err = NewRW(dir, c.metafn(key))
 	if err != nil {
 		return nil, err
 	}
@@ -125,36 +192,97 @@ func (c *Cache) LoadRW(key int64) (epoch *Epoch, err error) {
 		epoch:  epoch,
 	}
 
+	rwmetrics.loaded.Add(1)
+
 	// enforce read-write cache size
-	c.enforceSize(c.rwdata, c.rwsize)
+	evicted = append(evicted, c.enforceSize(c.rwdata, c.rwsize, rwmetrics)...)
 
 	return epoch, nil
 }
 
 // Expire removes all epochs from cache which are older than given timestamp
 // To remove all epochs, use ExpireAll (maximum int64 value) as the timestamp.
-func (c *Cache) Expire(ts int64) {
+// Epoch directories which are not loaded in the cache are removed as well.
+// Epochs currently loaded in read-write mode are not removed and neither are
+// epochs for which keep returns true (keep can be nil). Expired epochs are
+// closed without holding the cache lock because they may be read locked by
+// a goroutine waiting to load another epoch. Directories of epochs which
+// fail to close are not removed.
+func (c *Cache) Expire(ts int64, keep func(key int64) bool) {
 	todo := make(map[int64]*item, c.rosize)
 
 	c.mapmtx.Lock()
-	defer c.mapmtx.Unlock()
-
 	for k, el := range c.rodata {
-		if k < ts {
+		if k < ts && (keep == nil || !keep(k)) {
 			todo[k] = el
 			delete(c.rodata, k)
 		}
 	}
+	c.mapmtx.Unlock()
 
+	rometrics.loaded.Add(-float64(len(todo)))
+
+	failed := make(map[int64]bool)
 	for k, el := range todo {
-		if err := el.epoch.Close(); err == nil {
-			keystr := strconv.Itoa(int(k))
-			dir := path.Join(c.dbpath, keystr)
-			os.RemoveAll(dir)
+		if err := el.epoch.Close(); err != nil {
+			failed[k] = true
+		}
+	}
+
+	files, err := ioutil.ReadDir(c.dbpath)
+	if err != nil {
+		return
+	}
+
+	// epochs cannot be loaded while their directories are removed
+	c.mapmtx.Lock()
+	defer c.mapmtx.Unlock()
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		// only epoch directories are named with numbers
+		k, err := strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil || k >= ts || failed[k] {
+			continue
+		}
+
+		// epochs may have been loaded again after they were closed
+		if _, ok := c.rwdata[k]; ok {
+			continue
+		}
+
+		if _, ok := c.rodata[k]; ok {
+			continue
 		}
+
+		if keep != nil && keep(k) {
+			continue
+		}
+
+		os.RemoveAll(path.Join(c.dbpath, file.Name()))
 	}
 }
 
+// Resize changes RO/RW size limits of the cache. If the cache contains more
+// epochs than new limits allow, least recently used epochs will be closed.
+// Evicted epochs are closed after releasing the cache lock (see closeAll).
+func (c *Cache) Resize(rwsz, rosz int64) {
+	c.mapmtx.Lock()
+
+	c.rwsize = rwsz
+	c.rosize = rosz
+
+	evicted := c.enforceSize(c.rwdata, c.rwsize, rwmetrics)
+	evicted = append(evicted, c.enforceSize(c.rodata, c.rosize, rometrics)...)
+
+	c.mapmtx.Unlock()
+
+	closeAll(evicted)
+}
+
 // Sync flushes all data to disk
 func (c *Cache) Sync() (err error) {
 	c.mapmtx.RLock()
@@ -169,28 +297,48 @@ func (c *Cache) Sync() (err error) {
 	return nil
 }
 
+// SyncEpoch flushes data of a loaded read-write epoch to disk
+func (c *Cache) SyncEpoch(key int64) (err error) {
+	c.mapmtx.RLock()
+	defer c.mapmtx.RUnlock()
+
+	if el, ok := c.rwdata[key]; ok {
+		return el.epoch.Sync()
+	}
+
+	return nil
+}
+
 // Close releases resources
 func (c *Cache) Close() (err error) {
 	c.mapmtx.Lock()
 	defer c.mapmtx.Unlock()
 
-	for _, el := range c.rwdata {
+	for k, el := range c.rwdata {
 		if err := el.epoch.Close(); err != nil {
 			return err
 		}
+
+		delete(c.rwdata, k)
+		rwmetrics.loaded.Add(-1)
 	}
 
-	for _, el := range c.rodata {
+	for k, el := range c.rodata {
 		if err := el.epoch.Close(); err != nil {
 			return err
 		}
+
+		delete(c.rodata, k)
+		rometrics.loaded.Add(-1)
 	}
 
 	return nil
 }
 
 // enforceSize checks size limits for given data map and size
-func (c *Cache) enforceSize(data map[int64]*item, size int64) {
+// Evicted epochs are recorded with given cache metrics and returned.
+// They are removed from the map but the caller is responsible for closing them.
+func (c *Cache) enforceSize(data map[int64]*item, size int64, m *cacheMetrics) (evicted []*Epoch) {
 	for len(data) > int(size) {
 		var minKey int64
 		var minEl *item
@@ -203,6 +351,20 @@ func (c *Cache) enforceSize(data map[int64]*item, size int64) {
 		}
 
 		delete(data, minKey)
-		minEl.epoch.Close()
+		evicted = append(evicted, minEl.epoch)
+		m.evictions.Inc()
+		m.loaded.Add(-1)
+	}
+
+	return evicted
+}
+
+// closeAll closes epochs removed from the cache. This must be called without
+// holding the cache lock. Evicted epochs may be read locked by a Fetch which
+// needs the cache lock to load the next epoch in its range and Close waits
+// until all read locks are released.
+func closeAll(epochs []*Epoch) {
+	for _, e := range epochs {
+		e.Close()
 	}
 }
@@ -3,6 +3,7 @@ package epoch
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 var (
@@ -29,7 +30,7 @@ func TestNewCache(t *testing.T) {
 	defer setupc(t)()
 
 	for i := 0; i < 3; i++ {
-		c := NewCache(2, 2, tmpdirc, 5)
+		c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
 
 		if err := c.Close(); err != nil {
 			t.Fatal(err)
@@ -40,7 +41,7 @@ func TestNewCache(t *testing.T) {
 func TestOpenCache(t *testing.T) {
 	defer setupc(t)()
 
-	c := NewCache(2, 2, tmpdirc, 5)
+	c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
 
 	e, err := c.LoadRW(0)
 	if err != nil {
@@ -55,7 +56,7 @@ func TestOpenCache(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	c = NewCache(2, 2, tmpdirc, 5)
+	c = NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
 
 	e, err = c.LoadRO(0)
 	if err != nil {
@@ -81,7 +82,7 @@ func TestCacheLoadRO(t *testing.T) {
 	defer setupc(t)()
 
 	for i := 0; i < 3; i++ {
-		c := NewCache(2, 2, tmpdirc, 5)
+		c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
 
 		for j := 0; j < 3; j++ {
 			if _, err := c.LoadRO(0); err != nil {
@@ -113,11 +114,44 @@ func TestCacheLoadRO(t *testing.T) {
 	}
 }
 
+func TestCacheLoaded(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
+	defer c.Close()
+
+	if _, ok := c.Loaded(0); ok {
+		t.Fatal("should not be loaded")
+	}
+
+	ro, err := c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw, err := c.LoadRW(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, ok := c.Loaded(0); !ok || e != ro {
+		t.Fatal("wrong epoch")
+	}
+
+	if e, ok := c.Loaded(1); !ok || e != rw {
+		t.Fatal("wrong epoch")
+	}
+
+	if len(c.rodata) != 1 || len(c.rwdata) != 1 {
+		t.Fatal("wrong count")
+	}
+}
+
 func TestCacheLoadRW(t *testing.T) {
 	defer setupc(t)()
 
 	for i := 0; i < 3; i++ {
-		c := NewCache(2, 2, tmpdirc, 5)
+		c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
 
 		for j := 0; j < 3; j++ {
 			if _, err := c.LoadRW(0); err != nil {
@@ -152,7 +186,7 @@ func TestCacheLoadRW(t *testing.T) {
 func TestCacheLoadRORW(t *testing.T) {
 	defer setupc(t)()
 
-	c := NewCache(2, 2, tmpdirc, 5)
+	c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
 
 	if _, err := c.LoadRO(0); err != nil {
 		t.Fatal(err)
@@ -184,7 +218,7 @@ func TestCacheLoadRORW(t *testing.T) {
 func TestCacheLoadRWRO(t *testing.T) {
 	defer setupc(t)()
 
-	c := NewCache(2, 2, tmpdirc, 5)
+	c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
 
 	if _, err := c.LoadRW(0); err != nil {
 		t.Fatal(err)
@@ -216,7 +250,7 @@ func TestCacheLoadRWRO(t *testing.T) {
 func TestSyncCache(t *testing.T) {
 	defer setupc(t)()
 
-	c := NewCache(2, 2, tmpdirc, 5)
+	c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
 
 	if err := c.Sync(); err != nil {
 		t.Fatal(err)
@@ -226,3 +260,244 @@ func TestSyncCache(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCacheResize(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.LoadRO(int64(i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.LoadRW(int64(i + 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.Resize(1, 1)
+
+	if len(c.rodata) != 1 || len(c.rwdata) != 1 {
+		t.Fatal("wrong count")
+	}
+
+	if _, ok := c.rodata[1]; !ok {
+		t.Fatal("should keep recently used epochs")
+	}
+	if _, ok := c.rwdata[3]; !ok {
+		t.Fatal("should keep recently used epochs")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheExpire(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
+
+	for _, k := range []int64{0, 5, 10} {
+		if _, err := c.LoadRW(k); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
+
+	if _, err := c.LoadRO(5); err != nil {
+		t.Fatal(err)
+	}
+
+	// epochs can be kept (e.g. while they are being copied)
+	c.Expire(10, func(k int64) bool { return k == 0 })
+
+	if _, err := os.Stat(tmpdirc + "5"); !os.IsNotExist(err) {
+		t.Fatal("epoch should be removed")
+	}
+
+	if _, err := os.Stat(tmpdirc + "0"); err != nil {
+		t.Fatal("epoch should not be removed")
+	}
+
+	c.Expire(10, nil)
+
+	for _, k := range []string{"0", "5"} {
+		if _, err := os.Stat(tmpdirc + k); !os.IsNotExist(err) {
+			t.Fatal("epoch should be removed")
+		}
+	}
+
+	if _, err := os.Stat(tmpdirc + "10"); err != nil {
+		t.Fatal("epoch should not be removed")
+	}
+
+	if len(c.rodata) != 0 {
+		t.Fatal("wrong count")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(1, 1, tmpdirc, FixedMeta(5, 1))
+
+	hits := rometrics.hits.Value()
+	misses := rometrics.misses.Value()
+	evictions := rometrics.evictions.Value()
+	loaded := rometrics.loaded.Value()
+
+	for _, key := range []int64{0, 0, 5} {
+		if _, err := c.LoadRO(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if rometrics.hits.Value()-hits != 1 ||
+		rometrics.misses.Value()-misses != 2 ||
+		rometrics.evictions.Value()-evictions != 1 ||
+		rometrics.loaded.Value()-loaded != 1 {
+		t.Fatal("wrong metrics")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rometrics.loaded.Value() != loaded {
+		t.Fatal("wrong loaded epochs")
+	}
+}
+
+func TestCacheEvictLocked(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(1, 1, tmpdirc, FixedMeta(5, 1))
+
+	// Fetch keeps epochs read locked while loading other epochs
+	// loading more epochs than the cache size should not block
+	var locked []*Epoch
+	for _, key := range []int64{0, 5, 10} {
+		e, err := c.LoadRO(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e.RLock()
+		locked = append(locked, e)
+	}
+
+	for _, e := range locked {
+		e.RUnlock()
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheResizeLocked(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
+
+	for _, key := range []int64{0, 5} {
+		if _, err := c.LoadRW(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Fetch keeps the least recently used epoch read locked
+	e, err := c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.LoadRW(5); err != nil {
+		t.Fatal(err)
+	}
+
+	e.RLock()
+
+	done := make(chan bool)
+	go func() {
+		c.Resize(1, 1)
+		done <- true
+	}()
+
+	// the fetch loads the next epoch in its range while the epoch is evicted
+	time.Sleep(10 * time.Millisecond)
+	if _, err := c.LoadRO(10); err != nil {
+		t.Fatal(err)
+	}
+
+	e.RUnlock()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("resize should not block")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheLoadRWLocked(t *testing.T) {
+	defer setupc(t)()
+
+	c := NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
+
+	if _, err := c.LoadRW(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewCache(2, 2, tmpdirc, FixedMeta(5, 1))
+
+	// Fetch keeps the read-only epoch read locked
+	e, err := c.LoadRO(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.RLock()
+
+	done := make(chan bool)
+	go func() {
+		if _, err := c.LoadRW(0); err != nil {
+			t.Error(err)
+		}
+		done <- true
+	}()
+
+	// the fetch loads the next epoch in its range while the epoch is reopened
+	time.Sleep(10 * time.Millisecond)
+	if _, err := c.LoadRO(5); err != nil {
+		t.Fatal(err)
+	}
+
+	e.RUnlock()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("load should not block")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
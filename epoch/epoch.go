@@ -18,9 +18,15 @@ type Epoch struct {
 	block block.Block
 }
 
-// NewRW function will load an epoch in read-write mode
-func NewRW(dir string, rsz int64) (e *Epoch, err error) {
-	b, err := block.NewRW(dir, rsz)
+// NewRW function will load an epoch in read-write mode. Metadata stored in
+// the epoch directory is verified and a *MismatchError is returned if the
+// epoch was created with different parameters. New epochs will store it.
+func NewRW(dir string, m *Meta) (e *Epoch, err error) {
+	if err := ensureMeta(dir, m, true); err != nil {
+		return nil, err
+	}
+
+	b, err := block.NewRW(dir, m.RecordSize)
 	if err != nil {
 		return nil, err
 	}
@@ -39,9 +45,15 @@ func NewRW(dir string, rsz int64) (e *Epoch, err error) {
 	return e, nil
 }
 
-// NewRO function will load an epoch in read-only mode
-func NewRO(dir string, rsz int64) (e *Epoch, err error) {
-	b, err := block.NewRO(dir, rsz)
+// NewRO function will load an epoch in read-only mode. Metadata stored in
+// the epoch directory is verified and a *MismatchError is returned if the
+// epoch was created with different parameters.
+func NewRO(dir string, m *Meta) (e *Epoch, err error) {
+	if err := ensureMeta(dir, m, false); err != nil {
+		return nil, err
+	}
+
+	b, err := block.NewRO(dir, m.RecordSize)
 	if err != nil {
 		return nil, err
 	}
@@ -79,6 +91,18 @@ func (e *Epoch) Track(pid int64, fields []string, total, count float64) (err err
 	return nil
 }
 
+// Put records a measurement the same way as Track but only the record which
+// exactly matches given fields is updated. Records of parent field sets are
+// not updated. This can be used to copy records from one epoch to another.
+func (e *Epoch) Put(pid int64, fields []string, total, count float64) (err error) {
+	node, err := e.index.Ensure(fields)
+	if err != nil {
+		return err
+	}
+
+	return e.block.Track(node.RecordID, pid, total, count)
+}
+
 // Fetch fetches data from database from zero or more matching records
 // Matching records are identified from the index by given array of fields.
 // For each matching recods, points within the given range are extracted.
@@ -100,6 +124,30 @@ func (e *Epoch) Fetch(from, to int64, fields []string) (points [][]protocol.Poin
 	return points, nodes, nil
 }
 
+// FetchAll fetches data from all records in the epoch. Points within the
+// given range are extracted and returned with index nodes separately.
+func (e *Epoch) FetchAll(from, to int64) (points [][]protocol.Point, nodes []*index.Node, err error) {
+	nodes, err = e.index.All()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	points = make([][]protocol.Point, len(nodes))
+	for i, node := range nodes {
+		points[i], err = e.block.Fetch(node.RecordID, from, to)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return points, nodes, nil
+}
+
+// Nodes returns index nodes of all records in the epoch
+func (e *Epoch) Nodes() (nodes []*index.Node, err error) {
+	return e.index.All()
+}
+
 // Sync flushes pending writes to the filesystem
 func (e *Epoch) Sync() (err error) {
 	if err := e.block.Sync(); err != nil {
@@ -37,7 +37,7 @@ func TestNewIndexRW(t *testing.T) {
 	}
 
 	for j := 0; j < 3; j++ {
-		e, err := NewRW(dir, 10)
+		e, err := NewRW(dir, NewMeta(0, 10, 1))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -61,7 +61,7 @@ func TestNewIndexRO(t *testing.T) {
 	}
 
 	for j := 0; j < 3; j++ {
-		e, err := NewRO(dir, 10)
+		e, err := NewRO(dir, NewMeta(0, 10, 1))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -84,7 +84,7 @@ func TestTrackValue(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	e, err := NewRW(dir, 5)
+	e, err := NewRW(dir, NewMeta(0, 5, 1))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -205,7 +205,7 @@ func TestFetchSlow(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	e, err := NewRW(dir, 5)
+	e, err := NewRW(dir, NewMeta(0, 5, 1))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -294,6 +294,60 @@ func TestFetchSlow(t *testing.T) {
 	}
 }
 
+func TestPutFetchAll(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, NewMeta(0, 5, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Put(1, []string{"a", "b"}, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put(2, []string{"a"}, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	points, nodes, err := e.FetchAll(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Sort(Nodes(nodes))
+	expNodes := Nodes{
+		{RecordID: 0, Fields: []string{"a", "b"}},
+		{RecordID: 1, Fields: []string{"a"}},
+	}
+
+	if !reflect.DeepEqual(Nodes(nodes), expNodes) {
+		t.Fatal("wrong nodes")
+	}
+
+	sort.Sort(Series(points))
+	expPoints := Series{
+		{{0, 0}, {3, 1}},
+		{{2, 1}, {0, 0}},
+	}
+
+	if !reflect.DeepEqual(Series(points), expPoints) {
+		t.Fatal("wrong points")
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkTrackValue(b *testing.B) {
 	if err := os.RemoveAll(dir); err != nil {
 		b.Fatal(err)
@@ -302,7 +356,7 @@ func BenchmarkTrackValue(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	e, err := NewRW(dir, 120)
+	e, err := NewRW(dir, NewMeta(0, 120, 1))
 	if err != nil {
 		b.Fatal(err)
 	}
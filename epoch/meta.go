@@ -0,0 +1,177 @@
+package epoch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/kadirahq/kadiyadb/atomicfile"
+	"github.com/kadirahq/kadiyadb/block"
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+const (
+	// metafile is the name of the metadata file placed in the epoch directory.
+	// It records parameters and the storage layout used to write epoch data.
+	//
+	// Meta File Format:
+	//
+	//   {
+	//     "version": 1,
+	//     "start": 0,
+	//     "duration": 3600000000000,
+	//     "resolution": 60000000000,
+	//     "pointSize": 16,
+	//     "recordSize": 60,
+	//     "blockSegSize": 209715200,
+	//     "logsSegSize": 20971520,
+	//     "snapSegSize": 20971520
+	//   }
+	//
+	metafile = "meta.json"
+
+	// MetaVersion is the current version of the epoch storage format.
+	// Increment this when the storage format changes in a way which
+	// makes it impossible to read data written with older versions.
+	MetaVersion = 1
+)
+
+// Meta describes the parameters and the storage layout of an epoch.
+// It is stored with epoch data and verified when the epoch is loaded
+// to make sure that data is not read with incompatible parameters.
+type Meta struct {
+	Version      int64 `json:"version"`
+	Start        int64 `json:"start"`
+	Duration     int64 `json:"duration"`
+	Resolution   int64 `json:"resolution"`
+	PointSize    int64 `json:"pointSize"`
+	RecordSize   int64 `json:"recordSize"`
+	BlockSegSize int64 `json:"blockSegSize"`
+	LogsSegSize  int64 `json:"logsSegSize"`
+	SnapSegSize  int64 `json:"snapSegSize"`
+}
+
+// MetaFunc returns expected epoch metadata for given epoch start time.
+type MetaFunc func(start int64) (m *Meta)
+
+// MismatchError is returned when the metadata stored with an epoch
+// does not match the metadata expected when loading the epoch.
+type MismatchError struct {
+	Field    string
+	Expected int64
+	Actual   int64
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("epoch metadata mismatch: %s (expected %d, found %d)",
+		e.Field, e.Expected, e.Actual)
+}
+
+// NewMeta creates epoch metadata for given epoch start time, duration
+// and resolution using the storage layout of the current version.
+func NewMeta(start, duration, resolution int64) (m *Meta) {
+	return &Meta{
+		Version:    MetaVersion,
+		Start:      start,
+		Duration:   duration,
+		Resolution: resolution,
+
+		// storage sizes are recorded to detect layout changes
+		PointSize:    block.PointSize,
+		RecordSize:   duration / resolution,
+		BlockSegSize: block.SegmentSize,
+		LogsSegSize:  index.LogsSegmentSize,
+		SnapSegSize:  index.SnapSegmentSize,
+	}
+}
+
+// FixedMeta returns a MetaFunc which uses the same duration and resolution
+// for all epochs. This can be used when epoch parameters never change.
+func FixedMeta(duration, resolution int64) MetaFunc {
+	return func(start int64) (m *Meta) {
+		return NewMeta(start, duration, resolution)
+	}
+}
+
+// ReadMeta reads epoch metadata from the epoch directory.
+// If the file does not exist, an os.IsNotExist error is returned.
+func ReadMeta(dir string) (m *Meta, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, metafile))
+	if err != nil {
+		return nil, err
+	}
+
+	m = &Meta{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// WriteMeta writes epoch metadata to the epoch directory.
+func WriteMeta(dir string, m *Meta) (err error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(path.Join(dir, metafile), data)
+}
+
+// Check compares metadata with another and returns a *MismatchError
+// describing the first field which is different (if there's any).
+func (m *Meta) Check(o *Meta) (err error) {
+	fields := []struct {
+		name     string
+		exp, act int64
+	}{
+		{"version", m.Version, o.Version},
+		{"start", m.Start, o.Start},
+		{"duration", m.Duration, o.Duration},
+		{"resolution", m.Resolution, o.Resolution},
+		{"pointSize", m.PointSize, o.PointSize},
+		{"recordSize", m.RecordSize, o.RecordSize},
+		{"blockSegSize", m.BlockSegSize, o.BlockSegSize},
+		{"logsSegSize", m.LogsSegSize, o.LogsSegSize},
+		{"snapSegSize", m.SnapSegSize, o.SnapSegSize},
+	}
+
+	for _, f := range fields {
+		if f.exp != f.act {
+			return &MismatchError{Field: f.name, Expected: f.exp, Actual: f.act}
+		}
+	}
+
+	return nil
+}
+
+// ensureMeta verifies metadata stored in the epoch directory. If the epoch
+// does not have a metadata file yet, it's created only when `create` is set
+// and the epoch directory is empty (a new epoch). Epochs written before
+// metadata files were introduced will not have one and are left as they are.
+func ensureMeta(dir string, m *Meta, create bool) (err error) {
+	stored, err := ReadMeta(dir)
+	if os.IsNotExist(err) {
+		if !create {
+			return nil
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		if len(files) > 0 {
+			return nil
+		}
+
+		return WriteMeta(dir, m)
+	} else if err != nil {
+		return err
+	}
+
+	return m.Check(stored)
+}
@@ -0,0 +1,140 @@
+package epoch
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestWriteReadMeta(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadMeta(dir); !os.IsNotExist(err) {
+		t.Fatal("should not exist")
+	}
+
+	m := NewMeta(3600, 3600, 60)
+	if err := WriteMeta(dir, m); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := ReadMeta(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(m, r) {
+		t.Fatal("wrong metadata")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaCheck(t *testing.T) {
+	m := NewMeta(0, 3600, 60)
+
+	if err := m.Check(NewMeta(0, 3600, 60)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := m.Check(NewMeta(0, 3600, 10))
+	merr, ok := err.(*MismatchError)
+	if !ok {
+		t.Fatal("wrong error type")
+	}
+
+	if merr.Field != "resolution" || merr.Expected != 60 || merr.Actual != 10 {
+		t.Fatal("wrong error values")
+	}
+}
+
+func TestMetaMismatch(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, NewMeta(0, 10, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewRW(dir, NewMeta(0, 10, 2)); err == nil {
+		t.Fatal("should return an error")
+	} else if _, ok := err.(*MismatchError); !ok {
+		t.Fatal("wrong error type")
+	}
+
+	if _, err := NewRO(dir, NewMeta(0, 20, 1)); err == nil {
+		t.Fatal("should return an error")
+	} else if _, ok := err.(*MismatchError); !ok {
+		t.Fatal("wrong error type")
+	}
+
+	e, err = NewRO(dir, NewMeta(0, 10, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaLegacy(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := NewRW(dir, NewMeta(0, 10, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate an epoch created before metadata files were introduced
+	if err := os.Remove(path.Join(dir, metafile)); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err = NewRW(dir, NewMeta(0, 10, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadMeta(dir); !os.IsNotExist(err) {
+		t.Fatal("metadata should not be written to existing epochs")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,210 @@
+package kadiyadb
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// FillMode is the way points without data (Count == 0) are filled
+type FillMode int
+
+const (
+	// FillNull leaves points without data as they are. Clients can use
+	// the zero count to tell them apart from measured zero values.
+	FillNull FillMode = iota
+
+	// FillZero fills points without data with a zero value
+	FillZero
+
+	// FillPrevious fills points with the value of the previous point with
+	// data. Points before the first point with data are not filled.
+	FillPrevious
+
+	// FillLinear fills points with values interpolated linearly between
+	// surrounding points with data (using point timestamps). Points before
+	// the first and after the last point with data are not filled.
+	FillLinear
+)
+
+var (
+	// ErrInvFill is returned when the fill mode is invalid
+	ErrInvFill = errors.New("invalid fill mode")
+)
+
+// FetchFill fetches data the same way as Fetch but fills points without
+// data using the fill mode. Filled points have the value as the total with
+// a count of 1. Chunks given to `fn` do not share memory with the database.
+func (d *DB) FetchFill(from, to uint64, fields []string, mode FillMode, fn Handler) {
+	if mode < FillNull || mode > FillLinear {
+		fn(nil, ErrInvFill)
+		return
+	}
+
+	d.Fetch(from, to, fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		fn(Fill(chunks, mode), nil)
+	})
+}
+
+// Fill fills points without data in consecutive chunks. Series are matched
+// by their fields so values can be carried across chunks. Series missing in
+// a chunk with other series are added to the chunk before filling them.
+// The result does not share memory with given chunks.
+func Fill(chunks []*protocol.Chunk, mode FillMode) (res []*protocol.Chunk) {
+	res = make([]*protocol.Chunk, len(chunks))
+	keys := []string{}
+	fields := map[string][]string{}
+
+	for i, c := range chunks {
+		res[i] = &protocol.Chunk{
+			From:   c.From,
+			To:     c.To,
+			Series: make([]*protocol.Series, len(c.Series)),
+		}
+
+		for j, s := range c.Series {
+			res[i].Series[j] = &protocol.Series{
+				Fields: append([]string{}, s.Fields...),
+				Points: append([]protocol.Point{}, s.Points...),
+			}
+
+			key := strings.Join(s.Fields, "\x00")
+			if _, ok := fields[key]; !ok {
+				keys = append(keys, key)
+				fields[key] = s.Fields
+			}
+		}
+	}
+
+	if mode == FillNull {
+		return res
+	}
+
+	for _, key := range keys {
+		var series []*protocol.Series
+		for _, c := range res {
+			if s := ensureSeries(c, key, fields[key]); s != nil {
+				series = append(series, s)
+			}
+		}
+
+		switch mode {
+		case FillZero:
+			fillZero(series)
+		case FillPrevious:
+			fillPrevious(series)
+		case FillLinear:
+			fillLinear(res, series)
+		}
+	}
+
+	return res
+}
+
+// ensureSeries finds the series in a chunk or adds it if the chunk has
+// other series to get the point count from. It returns nil otherwise.
+func ensureSeries(c *protocol.Chunk, key string, fields []string) (s *protocol.Series) {
+	if len(c.Series) == 0 {
+		return nil
+	}
+
+	for _, s := range c.Series {
+		if strings.Join(s.Fields, "\x00") == key {
+			return s
+		}
+	}
+
+	s = &protocol.Series{
+		Fields: append([]string{}, fields...),
+		Points: make([]protocol.Point, len(c.Series[0].Points)),
+	}
+
+	c.Series = append(c.Series, s)
+	return s
+}
+
+// fillZero fills points without data with zeroes
+func fillZero(series []*protocol.Series) {
+	for _, s := range series {
+		for i := range s.Points {
+			if s.Points[i].Count == 0 {
+				s.Points[i] = protocol.Point{Total: 0, Count: 1}
+			}
+		}
+	}
+}
+
+// fillPrevious fills points without data with the previous value
+func fillPrevious(series []*protocol.Series) {
+	var prev *protocol.Point
+
+	for _, s := range series {
+		for i := range s.Points {
+			p := &s.Points[i]
+			if p.Count != 0 {
+				prev = &protocol.Point{Total: p.Total / p.Count, Count: 1}
+			} else if prev != nil {
+				*p = *prev
+			}
+		}
+	}
+}
+
+// fillLinear fills points without data by linear interpolation. Series
+// must be from consecutive chunks (in order) but not all chunks may have
+// the series therefore chunks are used to find point timestamps.
+func fillLinear(chunks []*protocol.Chunk, series []*protocol.Series) {
+	type slot struct {
+		p  *protocol.Point
+		ts float64
+	}
+
+	var prev *slot
+	var pending []slot
+
+	for _, c := range chunks {
+		var s *protocol.Series
+		for _, cs := range c.Series {
+			if len(series) > 0 && cs == series[0] {
+				s, series = cs, series[1:]
+				break
+			}
+		}
+
+		if s == nil || len(s.Points) == 0 {
+			continue
+		}
+
+		res := float64(c.To-c.From) / float64(len(s.Points))
+
+		for i := range s.Points {
+			cur := slot{&s.Points[i], float64(c.From) + float64(i)*res}
+			if cur.p.Count == 0 {
+				if prev != nil {
+					pending = append(pending, cur)
+				}
+
+				continue
+			}
+
+			if prev != nil {
+				v1 := prev.p.Total / prev.p.Count
+				v2 := cur.p.Total / cur.p.Count
+
+				for _, m := range pending {
+					v := v1 + (v2-v1)*(m.ts-prev.ts)/(cur.ts-prev.ts)
+					*m.p = protocol.Point{Total: v, Count: 1}
+				}
+			}
+
+			prev = &cur
+			pending = pending[:0]
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package kadiyadb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestFill(t *testing.T) {
+	chunks := []*protocol.Chunk{
+		{
+			From: 0,
+			To:   4,
+			Series: []*protocol.Series{
+				{Fields: []string{"a"}, Points: []protocol.Point{{0, 0}, {2, 2}, {0, 0}, {0, 0}}},
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 1}, {0, 0}, {0, 0}, {0, 0}}},
+			},
+		},
+		{
+			// different resolution and "a" is missing
+			From: 4,
+			To:   12,
+			Series: []*protocol.Series{
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 0}, {0, 0}, {0, 0}, {10, 1}}},
+			},
+		},
+	}
+
+	cases := map[FillMode][][]*protocol.Series{
+		FillNull: {
+			{
+				{Fields: []string{"a"}, Points: []protocol.Point{{0, 0}, {2, 2}, {0, 0}, {0, 0}}},
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 1}, {0, 0}, {0, 0}, {0, 0}}},
+			},
+			{
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 0}, {0, 0}, {0, 0}, {10, 1}}},
+			},
+		},
+		FillZero: {
+			{
+				{Fields: []string{"a"}, Points: []protocol.Point{{0, 1}, {2, 2}, {0, 1}, {0, 1}}},
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 1}, {0, 1}, {0, 1}, {0, 1}}},
+			},
+			{
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 1}, {0, 1}, {0, 1}, {10, 1}}},
+				{Fields: []string{"a"}, Points: []protocol.Point{{0, 1}, {0, 1}, {0, 1}, {0, 1}}},
+			},
+		},
+		FillPrevious: {
+			{
+				{Fields: []string{"a"}, Points: []protocol.Point{{0, 0}, {2, 2}, {1, 1}, {1, 1}}},
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 1}, {0, 1}, {0, 1}, {0, 1}}},
+			},
+			{
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 1}, {0, 1}, {0, 1}, {10, 1}}},
+				{Fields: []string{"a"}, Points: []protocol.Point{{1, 1}, {1, 1}, {1, 1}, {1, 1}}},
+			},
+		},
+		FillLinear: {
+			{
+				{Fields: []string{"a"}, Points: []protocol.Point{{0, 0}, {2, 2}, {0, 0}, {0, 0}}},
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 1}, {1, 1}, {2, 1}, {3, 1}}},
+			},
+			{
+				{Fields: []string{"b"}, Points: []protocol.Point{{4, 1}, {6, 1}, {8, 1}, {10, 1}}},
+				{Fields: []string{"a"}, Points: []protocol.Point{{0, 0}, {0, 0}, {0, 0}, {0, 0}}},
+			},
+		},
+	}
+
+	for mode, exp := range cases {
+		res := Fill(chunks, mode)
+		if len(res) != 2 {
+			t.Fatal("wrong chunk count", mode)
+		}
+
+		for i, c := range res {
+			if c.From != chunks[i].From || c.To != chunks[i].To {
+				t.Fatal("wrong chunk range", mode)
+			}
+
+			if !reflect.DeepEqual(c.Series, exp[i]) {
+				t.Fatal("wrong series", mode, i, c.Series)
+			}
+		}
+	}
+
+	// given chunks should not change
+	if chunks[0].Series[0].Points[0] != (protocol.Point{}) || len(chunks[1].Series) != 1 {
+		t.Fatal("should not modify chunks")
+	}
+}
+
+func TestFetchFill(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	defer db.Close()
+
+	fields := []string{"a"}
+	if err := db.Track(0, fields, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(uint64(2*p.Resolution), fields, 6, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	db.FetchFill(0, uint64(4*p.Resolution), fields, FillLinear, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exp := []protocol.Point{{2, 1}, {4, 1}, {6, 1}, {0, 0}}
+		if len(res) != 1 || len(res[0].Series) != 1 || !reflect.DeepEqual(res[0].Series[0].Points, exp) {
+			t.Fatal("wrong result", res)
+		}
+	})
+
+	db.FetchFill(0, uint64(p.Resolution), fields, FillLinear+1, func(res []*protocol.Chunk, err error) {
+		if err != ErrInvFill {
+			t.Fatal("should return an error")
+		}
+	})
+}
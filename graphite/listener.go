@@ -0,0 +1,307 @@
+// Package graphite receives metrics in the graphite plaintext protocol
+// over TCP and UDP and tracks them in a kadiyadb database.
+package graphite
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+const (
+	// maxPacketSize is the maximum size of a UDP packet
+	maxPacketSize = 65536
+
+	// defaultExpire is the default time to keep previous counter values
+	defaultExpire = time.Hour
+)
+
+// Mode decides how metric values are tracked in the database
+type Mode int
+
+const (
+	// Gauge tracks each value with a count of 1. The average value
+	// for a point can be calculated with its total and count values.
+	Gauge Mode = iota
+
+	// Counter treats values as cumulative counters and tracks the
+	// difference from the previous value of the same metric path.
+	// The first value of a path is only used to start counting.
+	// If a counter is reset (value decreases), the value is tracked.
+	Counter
+)
+
+// Stats has counters for lines processed by the listener
+type Stats struct {
+	Received  uint64
+	Tracked   uint64
+	Malformed uint64
+	Failed    uint64
+}
+
+// counter has the previous value of a counter and when it was received
+type counter struct {
+	value float64
+	seen  time.Time
+}
+
+// Listener receives graphite lines and tracks them in a database
+type Listener struct {
+	db   *kadiyadb.DB
+	mode Mode
+
+	prev    map[string]*counter
+	expire  time.Duration
+	swept   time.Time
+	prevmtx *sync.Mutex
+
+	received  uint64
+	tracked   uint64
+	malformed uint64
+	failed    uint64
+
+	lis    []net.Listener
+	pcs    []net.PacketConn
+	conns  map[net.Conn]bool
+	mtx    *sync.Mutex
+	wg     *sync.WaitGroup
+	closed bool
+}
+
+// New creates a listener which tracks metrics in given database.
+// In counter mode, previous values of metric paths which are not received
+// for the expire duration are removed (default: 1h if expire is zero).
+// The next value of an expired path is only used to start counting again.
+func New(db *kadiyadb.DB, mode Mode, expire time.Duration) (l *Listener) {
+	if expire <= 0 {
+		expire = defaultExpire
+	}
+
+	return &Listener{
+		db:      db,
+		mode:    mode,
+		prev:    map[string]*counter{},
+		expire:  expire,
+		swept:   time.Now(),
+		prevmtx: &sync.Mutex{},
+		conns:   map[net.Conn]bool{},
+		mtx:     &sync.Mutex{},
+		wg:      &sync.WaitGroup{},
+	}
+}
+
+// Stats returns line counters of the listener
+func (l *Listener) Stats() (s Stats) {
+	return Stats{
+		Received:  atomic.LoadUint64(&l.received),
+		Tracked:   atomic.LoadUint64(&l.tracked),
+		Malformed: atomic.LoadUint64(&l.malformed),
+		Failed:    atomic.LoadUint64(&l.failed),
+	}
+}
+
+// Handle parses a line and tracks it in the database
+func (l *Listener) Handle(line string) (err error) {
+	atomic.AddUint64(&l.received, 1)
+
+	now := time.Now()
+	m, err := Parse(line, now)
+	if err != nil {
+		atomic.AddUint64(&l.malformed, 1)
+		return err
+	}
+
+	value := m.Value
+	if l.mode == Counter {
+		var ok bool
+		if value, ok = l.delta(m, now); !ok {
+			return nil
+		}
+	}
+
+	if err := l.db.Track(m.Time, m.Fields, value, 1); err != nil {
+		atomic.AddUint64(&l.failed, 1)
+		return err
+	}
+
+	atomic.AddUint64(&l.tracked, 1)
+	return nil
+}
+
+// delta returns the difference from the previous counter value
+func (l *Listener) delta(m *Metric, now time.Time) (d float64, ok bool) {
+	key := strings.Join(m.Fields, ".")
+
+	l.prevmtx.Lock()
+	defer l.prevmtx.Unlock()
+
+	// expired values are removed at most once in an expire duration
+	if now.Sub(l.swept) >= l.expire {
+		l.sweep(now)
+	}
+
+	prev, ok := l.prev[key]
+	l.prev[key] = &counter{value: m.Value, seen: now}
+	if !ok || now.Sub(prev.seen) >= l.expire {
+		return 0, false
+	}
+
+	if m.Value < prev.value {
+		return m.Value, true
+	}
+
+	return m.Value - prev.value, true
+}
+
+// sweep removes previous counter values which are expired at given time.
+// The prevmtx mutex must be locked when calling this function.
+func (l *Listener) sweep(now time.Time) {
+	for key, c := range l.prev {
+		if now.Sub(c.seen) >= l.expire {
+			delete(l.prev, key)
+		}
+	}
+
+	l.swept = now
+}
+
+// ListenTCP starts accepting TCP connections on given address
+func (l *Listener) ListenTCP(addr string) (err error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return l.ServeTCP(lis)
+}
+
+// ListenUDP starts reading UDP packets on given address
+func (l *Listener) ListenUDP(addr string) (err error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	return l.ServeUDP(pc)
+}
+
+// ServeTCP starts accepting connections from given listener in the
+// background. The listener will be closed when the Close method is called.
+func (l *Listener) ServeTCP(lis net.Listener) (err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		lis.Close()
+		return nil
+	}
+
+	l.lis = append(l.lis, lis)
+	l.wg.Add(1)
+	go l.accept(lis)
+
+	return nil
+}
+
+// ServeUDP starts reading packets from given connection in the
+// background. The connection will be closed when Close is called.
+func (l *Listener) ServeUDP(pc net.PacketConn) (err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.closed {
+		pc.Close()
+		return nil
+	}
+
+	l.pcs = append(l.pcs, pc)
+	l.wg.Add(1)
+	go l.readPackets(pc)
+
+	return nil
+}
+
+// Close stops the listener and waits until received lines are processed
+func (l *Listener) Close() (err error) {
+	l.mtx.Lock()
+	l.closed = true
+
+	for _, lis := range l.lis {
+		lis.Close()
+	}
+
+	for _, pc := range l.pcs {
+		pc.Close()
+	}
+
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mtx.Unlock()
+
+	l.wg.Wait()
+	return nil
+}
+
+func (l *Listener) accept(lis net.Listener) {
+	defer l.wg.Done()
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+
+		l.mtx.Lock()
+		if l.closed {
+			l.mtx.Unlock()
+			conn.Close()
+			return
+		}
+		l.conns[conn] = true
+		l.wg.Add(1)
+		l.mtx.Unlock()
+
+		go l.readLines(conn)
+	}
+}
+
+func (l *Listener) readLines(conn net.Conn) {
+	defer l.wg.Done()
+
+	s := bufio.NewScanner(conn)
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			l.Handle(line)
+		}
+	}
+
+	conn.Close()
+
+	l.mtx.Lock()
+	delete(l.conns, conn)
+	l.mtx.Unlock()
+}
+
+func (l *Listener) readPackets(pc net.PacketConn) {
+	defer l.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				l.Handle(line)
+			}
+		}
+	}
+}
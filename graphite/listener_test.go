@@ -0,0 +1,225 @@
+package graphite
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+var (
+	tmpdirg = "/tmp/test-graphite/"
+)
+
+func setupg(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdirg); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdirg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// wait waits until the listener has received given number of lines
+func wait(t *testing.T, l *Listener, n uint64) {
+	for i := 0; i < 100; i++ {
+		if l.Stats().Received >= n {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timeout waiting for lines")
+}
+
+func TestHandle(t *testing.T) {
+	defer setupg(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdirg, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	now -= now % 3600
+	ts := uint64(now) * 1e9
+
+	// Test 1: gauges
+	l := New(db, Gauge, 0)
+	for _, v := range []int{3, 5} {
+		line := fmt.Sprintf("a.b %d %d", v, now)
+		if err := l.Handle(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := l.Handle("a.b"); err != ErrMalformed {
+		t.Fatal("should fail with malformed lines")
+	}
+
+	db.Fetch(ts, ts+60000000000, []string{"a", "b"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		if p := res[0].Series[0].Points[0]; p.Total != 8 || p.Count != 2 {
+			t.Fatal("wrong point", p)
+		}
+	})
+
+	if s := l.Stats(); s != (Stats{Received: 3, Tracked: 2, Malformed: 1}) {
+		t.Fatal("wrong stats", s)
+	}
+
+	// Test 2: counters
+	l = New(db, Counter, 0)
+	for _, v := range []int{10, 15, 22, 4} {
+		line := fmt.Sprintf("a.c %d %d", v, now)
+		if err := l.Handle(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deltas: 5, 7 and 4 (after counter reset)
+	db.Fetch(ts, ts+60000000000, []string{"a", "c"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		if p := res[0].Series[0].Points[0]; p.Total != 16 || p.Count != 3 {
+			t.Fatal("wrong point", p)
+		}
+	})
+}
+
+func TestCounterExpire(t *testing.T) {
+	l := New(nil, Counter, time.Minute)
+	now := time.Now()
+
+	m := &Metric{Fields: []string{"a", "b"}, Value: 10}
+	if _, ok := l.delta(m, now); ok {
+		t.Fatal("first value should only start counting")
+	}
+
+	m.Value = 15
+	if d, ok := l.delta(m, now.Add(time.Second)); !ok || d != 5 {
+		t.Fatal("wrong delta", d)
+	}
+
+	// other paths remove expired values
+	other := &Metric{Fields: []string{"a", "c"}, Value: 1}
+	l.delta(other, now.Add(2*time.Minute))
+
+	if len(l.prev) != 1 {
+		t.Fatal("should remove expired values", len(l.prev))
+	}
+
+	// the next value of an expired path starts counting again
+	m.Value = 20
+	if _, ok := l.delta(m, now.Add(2*time.Minute)); ok {
+		t.Fatal("should start counting again")
+	}
+}
+
+func TestListen(t *testing.T) {
+	defer setupg(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdirg, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	l := New(db, Gauge, 0)
+
+	tl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ServeTCP(tl); err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ServeUDP(pc); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	now -= now % 3600
+	ts := uint64(now) * 1e9
+
+	tc, err := net.Dial("tcp", tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(tc, "a.b 1 %d\nbad line\na.b 2 %d\n", now, now)
+	tc.Close()
+
+	uc, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(uc, "a.b 3 %d\na.c 4 %d", now, now)
+	uc.Close()
+
+	wait(t, l, 5)
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Fetch(ts, ts+60000000000, []string{"a", "b"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		if p := res[0].Series[0].Points[0]; p.Total != 6 || p.Count != 3 {
+			t.Fatal("wrong point", p)
+		}
+	})
+
+	if s := l.Stats(); s != (Stats{Received: 5, Tracked: 4, Malformed: 1}) {
+		t.Fatal("wrong stats", s)
+	}
+}
@@ -0,0 +1,81 @@
+package graphite
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMalformed is returned when a line is not in the plaintext format
+	ErrMalformed = errors.New("malformed graphite line")
+)
+
+// Metric is a measurement parsed from a plaintext protocol line
+type Metric struct {
+	Fields []string
+	Value  float64
+	Time   uint64
+}
+
+// Parse parses a line in the graphite plaintext protocol format.
+// The dotted metric path is split into fields and the timestamp
+// (unix seconds, can be fractional) is converted to nanoseconds.
+// A timestamp of -1 is replaced with given current time.
+//
+//	path.to.metric value timestamp
+func Parse(line string, now time.Time) (m *Metric, err error) {
+	parts := strings.Fields(line)
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	fields := strings.Split(parts[0], ".")
+	for _, f := range fields {
+		if f == "" || f == "*" {
+			return nil, ErrMalformed
+		}
+	}
+
+	value, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, ErrMalformed
+	}
+
+	ts, err := parseTime(parts[2], now)
+	if err != nil {
+		return nil, err
+	}
+
+	m = &Metric{
+		Fields: fields,
+		Value:  value,
+		Time:   ts,
+	}
+
+	return m, nil
+}
+
+// parseTime parses a unix timestamp in seconds and returns nanoseconds
+func parseTime(str string, now time.Time) (ts uint64, err error) {
+	if str == "-1" {
+		return uint64(now.UnixNano()), nil
+	}
+
+	if secs, err := strconv.ParseInt(str, 10, 64); err == nil {
+		if secs < 0 || secs > math.MaxInt64/int64(time.Second) {
+			return 0, ErrMalformed
+		}
+
+		return uint64(secs) * 1e9, nil
+	}
+
+	secs, err := strconv.ParseFloat(str, 64)
+	if err != nil || !(secs >= 0 && secs <= math.MaxInt64/1e9) {
+		return 0, ErrMalformed
+	}
+
+	return uint64(secs * 1e9), nil
+}
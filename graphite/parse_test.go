@@ -0,0 +1,48 @@
+package graphite
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Unix(1450000000, 0)
+
+	valid := map[string]*Metric{
+		"a.b.c 1.5 1450000100":   {[]string{"a", "b", "c"}, 1.5, 1450000100e9},
+		"a  -2\t1450000100.5":    {[]string{"a"}, -2, 1450000100500000000},
+		"a.b 3 -1":               {[]string{"a", "b"}, 3, 1450000000e9},
+		" a.b 1e3 1450000100 \r": {[]string{"a", "b"}, 1000, 1450000100e9},
+	}
+
+	for line, exp := range valid {
+		m, err := Parse(line, now)
+		if err != nil {
+			t.Fatal(line, err)
+		} else if !reflect.DeepEqual(m, exp) {
+			t.Fatal("wrong metric", line, m)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"a.b 1",
+		"a.b 1 2 3",
+		"a..b 1 1450000100",
+		"a.* 1 1450000100",
+		".a 1 1450000100",
+		"a.b x 1450000100",
+		"a.b NaN 1450000100",
+		"a.b 1 x",
+		"a.b 1 -5",
+		"a.b 1 NaN",
+		"a.b 1 1e20",
+	}
+
+	for _, line := range invalid {
+		if _, err := Parse(line, now); err != ErrMalformed {
+			t.Fatal("should fail", line)
+		}
+	}
+}
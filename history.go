@@ -0,0 +1,279 @@
+package kadiyadb
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/atomicfile"
+	"github.com/kadirahq/kadiyadb/epoch"
+)
+
+const (
+	// histfile is the name of the file which records epoch parameter changes.
+	// Each item starts a period where new epochs use given duration/resolution.
+	// Epochs created before a change will continue to use older parameters.
+	//
+	// History File Format:
+	//
+	//   [
+	//     {"start": 0, "duration": 3600000000000, "resolution": 60000000000},
+	//     {"start": 1450000800000000000, "duration": 3600000000000, "resolution": 10000000000}
+	//   ]
+	//
+	histfile = "history.json"
+)
+
+var (
+	// ErrFutureEpoch is returned when epoch params cannot be changed because
+	// epochs exist after the current one (data tracked with future timestamps)
+	ErrFutureEpoch = errors.New("epochs exist after the current epoch")
+)
+
+// period is a time range where all epochs use the same duration/resolution.
+// A period starts at `Start` and continues until the start of the next one.
+// Epoch start times are aligned to multiples of duration from period start.
+type period struct {
+	Start      int64 `json:"start"`
+	Duration   int64 `json:"duration"`
+	Resolution int64 `json:"resolution"`
+}
+
+// SetEpochParams changes the epoch duration and resolution of the database.
+// Changes apply only to epochs created after the epoch currently in use,
+// therefore existing data will still be available with older parameters.
+// The param file (if there's one) is updated to use the new values. If any
+// epochs exist after the current one (e.g. created by clients with a clock
+// skew), ErrFutureEpoch is returned as they would not match new params.
+func (d *DB) SetEpochParams(duration, resolution int64) (err error) {
+	// retention can be changed by Reload while holding histmtx
+	d.histmtx.Lock()
+	defer d.histmtx.Unlock()
+
+	if duration == 0 ||
+		resolution == 0 ||
+		duration%resolution != 0 ||
+		d.params.Retention%duration != 0 {
+		return ErrInvParams
+	}
+
+	now := time.Now().UnixNano()
+	last := d.history[len(d.history)-1]
+	if last.Duration == duration && last.Resolution == resolution {
+		return nil
+	}
+
+	// The new period starts when the current epoch ends. If the last period
+	// hasn't started yet, it's replaced as it can't have any epochs in it.
+	p := d.periodAt(now)
+	ets := p.Start + p.Duration*((now-p.Start)/p.Duration)
+	next := &period{ets + p.Duration, duration, resolution}
+
+	history := d.history
+	if last.Start > now {
+		history = history[:len(history)-1]
+	}
+
+	prev := history[len(history)-1]
+	if prev.Duration != duration || prev.Resolution != resolution {
+		history = append(history[:len(history):len(history)], next)
+	}
+
+	starts, err := d.epochs()
+	if err != nil {
+		return err
+	}
+
+	if len(starts) > 0 && starts[len(starts)-1] >= next.Start {
+		return ErrFutureEpoch
+	}
+
+	// The param file is updated first. If the history cannot be written,
+	// the change will be applied again when the database is opened.
+	if err := updateParamFile(d.dir, duration, resolution); err != nil {
+		return err
+	}
+
+	if err := writeHistory(d.dir, history); err != nil {
+		return err
+	}
+
+	d.history = history
+	d.params.Duration = duration
+	d.params.Resolution = resolution
+
+	return nil
+}
+
+// ResolutionAt returns the resolution of the epoch which contains given time.
+// Epochs can have different resolutions when epoch params are changed.
+// This does not consider rollups which have their own resolutions.
+func (d *DB) ResolutionAt(ts uint64) (res int64) {
+	d.histmtx.RLock()
+	defer d.histmtx.RUnlock()
+
+	return d.periodAt(int64(ts)).Resolution
+}
+
+// FetchPeriod returns the resolution of data returned by Fetch for a time
+// range starting at given time. This considers rollups used for old data.
+// It also returns the start and the end of the period with this resolution
+// (end is zero if the resolution has not changed after the given time).
+// Fetched points are aligned to the start of the period.
+func (d *DB) FetchPeriod(ts uint64) (start, end uint64, res int64) {
+	t := d.tier(int64(ts))
+
+	t.histmtx.RLock()
+	defer t.histmtx.RUnlock()
+
+	p := t.periodAt(int64(ts))
+	for _, next := range t.history {
+		if next.Start > p.Start {
+			end = uint64(next.Start)
+			break
+		}
+	}
+
+	return uint64(p.Start), end, p.Resolution
+}
+
+// loadHistory reads epoch parameter history from the database directory.
+// A history file is created if it's not available. If given params are
+// different from the last period, a new period is added to the history
+// (see SetEpochParams which also keeps the param file up to date).
+func (d *DB) loadHistory() (err error) {
+	history, err := readHistory(d.dir)
+	if os.IsNotExist(err) {
+		history = []*period{{0, d.params.Duration, d.params.Resolution}}
+		if err := writeHistory(d.dir, history); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	} else if len(history) == 0 {
+		return ErrInvParams
+	}
+
+	duration := d.params.Duration
+	resolution := d.params.Resolution
+
+	last := history[len(history)-1]
+	d.params.Duration = last.Duration
+	d.params.Resolution = last.Resolution
+	d.history = history
+
+	return d.SetEpochParams(duration, resolution)
+}
+
+// meta returns expected metadata for the epoch starting at given time
+func (d *DB) meta(ets int64) (m *epoch.Meta) {
+	d.histmtx.RLock()
+	p := d.periodAt(ets)
+	d.histmtx.RUnlock()
+
+	return epoch.NewMeta(ets, p.Duration, p.Resolution)
+}
+
+// split the time into epoch metadata and point position
+func (d *DB) split(ts int64) (m *epoch.Meta, pos int64) {
+	d.histmtx.RLock()
+	p := d.periodAt(ts)
+	d.histmtx.RUnlock()
+
+	ets := p.Start + p.Duration*((ts-p.Start)/p.Duration)
+	pos = (ts - ets) / p.Resolution
+	m = epoch.NewMeta(ets, p.Duration, p.Resolution)
+
+	return m, pos
+}
+
+// periodAt returns the period which contains given time.
+// histmtx must be locked when calling this function.
+func (d *DB) periodAt(ts int64) (p *period) {
+	return findPeriod(d.history, ts)
+}
+
+// findPeriod returns the period which contains given time from history
+func findPeriod(history []*period, ts int64) (p *period) {
+	p = history[0]
+	for _, next := range history[1:] {
+		if next.Start > ts {
+			break
+		}
+
+		p = next
+	}
+
+	return p
+}
+
+// readHistory reads the epoch parameter history file in given directory
+func readHistory(dir string) (history []*period, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, histfile))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// writeHistory writes the epoch parameter history file in given directory
+func writeHistory(dir string, history []*period) (err error) {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(path.Join(dir, histfile), data)
+}
+
+// updateParamFile sets the duration and resolution in the param file of the
+// database directory. Nothing is written if the file does not exist or if it
+// already has the same values. Other params in the file are not changed.
+func updateParamFile(dir string, duration, resolution int64) (err error) {
+	file := path.Join(dir, paramfile)
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	p, err := ParseParams(data)
+	if err != nil {
+		return err
+	}
+
+	if p.Duration == duration && p.Resolution == resolution {
+		return nil
+	}
+
+	params := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &params); err != nil {
+		return err
+	}
+
+	values := map[string]int64{"duration": duration, "resolution": resolution}
+	for name, val := range values {
+		str, err := json.Marshal(time.Duration(val).String())
+		if err != nil {
+			return err
+		}
+
+		params[name] = str
+	}
+
+	data, err = json.MarshalIndent(params, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(file, data)
+}
@@ -0,0 +1,226 @@
+package kadiyadb
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestSetEpochParams(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetEpochParams(3600000000000, 7000000000); err != ErrInvParams {
+		t.Fatal("should return an error")
+	}
+
+	if err := db.SetEpochParams(3600000000000, 10000000000); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.history) != 2 {
+		t.Fatal("wrong history length")
+	}
+
+	// the new period should start after the current epoch
+	start := db.history[1].Start
+	if start <= time.Now().UnixNano() || start%p.Duration != 0 {
+		t.Fatal("wrong period start")
+	}
+
+	// setting params again should replace the pending period
+	if err := db.SetEpochParams(3600000000000, 20000000000); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetEpochParams(3600000000000, 10000000000); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.history) != 2 {
+		t.Fatal("wrong history length")
+	}
+
+	fields := []string{"a", "b"}
+	ts0 := uint64(start - 60000000000)
+	ts1 := uint64(start)
+
+	if err := db.Track(ts0, fields, 6, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(ts1, fields, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(ts1+10000000000, fields, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := db.ResolutionAt(ts0); res != 60000000000 {
+		t.Fatal("wrong resolution")
+	}
+	if res := db.ResolutionAt(ts1); res != 10000000000 {
+		t.Fatal("wrong resolution")
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	db.Fetch(ts0, ts1+60000000000, fields, func(res []*protocol.Chunk, err error) {
+		defer wg.Done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 2 {
+			t.Fatal("wrong chunk count")
+		}
+
+		if len(res[0].Series[0].Points) != 1 || len(res[1].Series[0].Points) != 6 {
+			t.Fatal("wrong point count")
+		}
+	})
+
+	db.FetchStep(ts0, ts1+60000000000, 60000000000, fields, func(res []*protocol.Chunk, err error) {
+		defer wg.Done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 {
+			t.Fatal("wrong chunk count")
+		}
+
+		points := []protocol.Point{{6, 1}, {5, 2}}
+		if !reflect.DeepEqual(res[0].Series[0].Points, points) {
+			t.Fatal("wrong points")
+		}
+	})
+
+	wg.Wait()
+
+	// the pending period cannot be replaced because it has epochs in it
+	if _, err := Open(dir, p); err != ErrFutureEpoch {
+		t.Fatal("should return an error")
+	}
+
+	// history should be loaded when the database is opened again
+	p2 := *p
+	p2.Resolution = 10000000000
+	db2, err := Open(dir, &p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db2.history) != 2 {
+		t.Fatal("wrong history length")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetEpochParamsFile(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(`{
+		"duration": "1h",
+		"resolution": "1m",
+		"retention": "10h",
+		"maxROEpochs": 2,
+		"maxRWEpochs": 2
+	}`)
+
+	file := path.Join(dir, paramfile)
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ParseParams(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SetEpochParams(3600000000000, 10000000000); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err = ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p2, err := ParseParams(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p2.Duration != 3600000000000 ||
+		p2.Resolution != 10000000000 ||
+		p2.Retention != p.Retention ||
+		p2.MaxROEpochs != p.MaxROEpochs {
+		t.Fatal("wrong params")
+	}
+
+	// reloading the param file should not try to change epoch params
+	if err := db.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the change should not be reverted when the database is opened again
+	db2, err := Open(dir, p2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db2.history) != 2 {
+		t.Fatal("wrong history length")
+	}
+
+	// epochs which exist after the current epoch would not match new params
+	if err := db2.Track(uint64(db2.history[1].Start), []string{"a"}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db2.SetEpochParams(3600000000000, 20000000000); err != ErrFutureEpoch {
+		t.Fatal("should return an error")
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
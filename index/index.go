@@ -3,6 +3,8 @@ package index
 import (
 	"errors"
 	"sync/atomic"
+
+	"github.com/kadirahq/kadiyadb/metrics"
 )
 
 var (
@@ -10,6 +12,12 @@ var (
 	ErrInvFields = errors.New("requested fields are not valid")
 )
 
+var (
+	// nodesCreated counts index nodes created in all indexes
+	nodesCreated = metrics.NewCounter("kadiyadb_index_nodes_created_total",
+		"Number of index nodes created.")
+)
+
 // Index stores record IDs for each unique field combination as a tree.
 // The index tree starts from a single root node and can have many levels.
 // Index tree may use an append only log or a snapshot to read/write to disk.
@@ -96,6 +104,8 @@ func (i *Index) Ensure(fields []string) (node *Node, err error) {
 			tn.Mutex.Unlock()
 			return nil, err
 		}
+
+		nodesCreated.Inc()
 	}
 	tn.Mutex.Unlock()
 
@@ -122,6 +132,25 @@ func (i *Index) FindOne(fields []string) (n *Node, err error) {
 	return i.root.FindOne(fields)
 }
 
+// All returns all index nodes in the index. When the index is loaded from a
+// snapshot, all branches of the index tree will be loaded to collect nodes.
+func (i *Index) All() (ns []*Node, err error) {
+	i.root.Mutex.RLock()
+	names := make([]string, 0, len(i.root.Children))
+	for name := range i.root.Children {
+		names = append(names, name)
+	}
+	i.root.Mutex.RUnlock()
+
+	for _, name := range names {
+		if err := i.ensureBranch([]string{name}); err != nil {
+			return nil, err
+		}
+	}
+
+	return i.root.All(), nil
+}
+
 // Sync syncs the index
 func (i *Index) Sync() (err error) {
 	if i.logs != nil {
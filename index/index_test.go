@@ -455,3 +455,75 @@ func BenchmarkFindSlow(b *testing.B) {
 		b.Fatal(err)
 	}
 }
+
+func TestAllNodes(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewRW(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sets := [][]string{
+		{"a"},
+		{"a", "b", "c"},
+		{"d", "e"},
+	}
+
+	for _, f := range sets {
+		if _, err := i.Ensure(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	test := func(i *Index) {
+		ns, err := i.All()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ns) != len(sets) {
+			t.Fatal("wrong node count")
+		}
+
+		found := map[int64][]string{}
+		for _, n := range ns {
+			found[n.RecordID] = n.Fields
+		}
+
+		for j, f := range sets {
+			if !reflect.DeepEqual(found[int64(j)], f) {
+				t.Fatal("wrong node")
+			}
+		}
+	}
+
+	test(i)
+
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// load twice to use the snapshot
+	for j := 0; j < 2; j++ {
+		i, err = NewRO(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		test(i)
+
+		if err := i.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
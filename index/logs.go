@@ -10,6 +10,7 @@ import (
 	"github.com/kadirahq/go-tools/hybrid"
 	"github.com/kadirahq/go-tools/segments"
 	"github.com/kadirahq/go-tools/segments/segmmap"
+	"github.com/kadirahq/kadiyadb/metrics"
 )
 
 const (
@@ -23,6 +24,17 @@ const (
 	segszlogs = 1024 * 1024 * 20
 )
 
+const (
+	// LogsSegmentSize is the size of an index log segment file on disk.
+	LogsSegmentSize = segszlogs
+)
+
+var (
+	// logBytes counts bytes written to index logs
+	logBytes = metrics.NewCounter("kadiyadb_index_log_bytes_total",
+		"Number of bytes written to index log files.")
+)
+
 var (
 	// ErrShortWrite is returned when number of bytes written does not
 	// match the number of bytes used with the write operation.
@@ -122,6 +134,7 @@ func (l *Logs) Store(n *TNode) (err error) {
 
 	// next item offset
 	l.nextOff += full
+	logBytes.Add(float64(full))
 
 	return nil
 }
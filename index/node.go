@@ -81,6 +81,14 @@ func (n *TNode) Ensure(fields []string) (tn *TNode) {
 	leaf, ok := node.Children[last]
 	if ok {
 		tn = leaf
+
+		// intermediate nodes are created without an index node
+		// this happens when a longer field set is ensured first
+		tn.Mutex.Lock()
+		if tn.Node == nil {
+			tn.Node = &Node{Fields: fields, RecordID: Placeholder}
+		}
+		tn.Mutex.Unlock()
 	} else {
 		tn = WrapNode(&Node{Fields: fields, RecordID: Placeholder})
 		node.Children[last] = tn
@@ -197,6 +205,25 @@ func (n *TNode) Find(fields []string) (ns []*Node, err error) {
 	return c.Find(cdr)
 }
 
+// All collects all valid nodes under this node (including this node).
+// Intermediate tree nodes without a record ID are not included.
+func (n *TNode) All() (ns []*Node) {
+	n.Mutex.RLock()
+	defer n.Mutex.RUnlock()
+
+	if n.Node != nil && n.Node.Validate() == nil {
+		ns = append(ns, n.Node)
+	}
+
+	for _, c := range n.Children {
+		if c != nil {
+			ns = append(ns, c.All()...)
+		}
+	}
+
+	return ns
+}
+
 // isValidFields checks whether given set of fields are valid.
 // TODO define a `Fields` type and add these methods there.
 func isValidFields(fields []string) bool {
@@ -58,3 +58,17 @@ func TestValidateTNode(t *testing.T) {
 		t.Fatal("should return error")
 	}
 }
+
+func TestEnsureIntermediate(t *testing.T) {
+	root := WrapNode(&Node{Fields: []string{}})
+	root.Ensure([]string{"a", "b"})
+
+	tn := root.Ensure([]string{"a"})
+	if tn.Node == nil || tn.Node.RecordID != Placeholder || len(tn.Node.Fields) != 1 {
+		t.Fatal("should create the index node")
+	}
+
+	if len(tn.Children) != 1 {
+		t.Fatal("should not replace the tree node")
+	}
+}
@@ -23,6 +23,11 @@ const (
 	segszsnap = 1024 * 1024 * 20
 )
 
+const (
+	// SnapSegmentSize is the size of an index snapshot segment file on disk.
+	SnapSegmentSize = segszsnap
+)
+
 var (
 	// ErrNoSnap is returned when there's no snapshot available
 	ErrNoSnap = errors.New("no snapshot available")
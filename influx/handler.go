@@ -0,0 +1,356 @@
+// Package influx receives data in the InfluxDB line protocol over HTTP.
+// Each numeric field value of a line is tracked as a separate series.
+// Fields of the series are made with the measurement name, values of
+// configured tags (in configured order) and finally the field key.
+//
+//	cpu,host=h1,region=us usage=0.5,idle=0.2  (Tags: region, host)
+//	=> ["cpu", "us", "h1", "usage"] and ["cpu", "us", "h1", "idle"]
+package influx
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+const (
+	// missingTag is the default field value used for missing tags
+	missingTag = "_"
+
+	// maxBodySize is the default maximum size of a request body
+	maxBodySize = 32 << 20
+)
+
+var (
+	// ErrNoDB is returned when the requested database does not exist
+	ErrNoDB = errors.New("database not found")
+
+	// ErrCardinality is returned when a line would add more series
+	// to a database than the limit given with Options.MaxSeries.
+	ErrCardinality = errors.New("series limit exceeded")
+
+	// ErrTooLarge is returned when a request body is larger than the
+	// limit given with Options.MaxBodySize (before or after decompression).
+	ErrTooLarge = errors.New("request body too large")
+)
+
+// Options is used to configure how points are mapped to fields
+type Options struct {
+	// Tags has tag keys in the order they are added to fields
+	Tags []string
+
+	// Missing is used when a tag is not available (default: "_")
+	Missing string
+
+	// MaxSeries is the maximum number of series in each database. Lines
+	// which would add new series after reaching the limit are rejected.
+	// Series already in the database within the retention period (with as
+	// many fields as lines of this handler make) are counted when the
+	// handler first writes to it. After that, the limit applies to all
+	// series seen by the handler, series are not dropped when they expire.
+	// Zero means no limit.
+	MaxSeries int
+
+	// MaxBodySize is the maximum size of a request body in bytes. It's
+	// checked before and after decompression (default: 32MB).
+	MaxBodySize int64
+}
+
+// storageError is returned when a valid line cannot be written to the database
+type storageError struct {
+	err error
+}
+
+func (e *storageError) Error() string { return e.err.Error() }
+func (e *storageError) Unwrap() error { return e.err }
+
+// Handler handles line protocol write requests
+type Handler struct {
+	dbs       kadiyadb.Databases
+	tags      []string
+	missing   string
+	maxSeries int
+	maxBody   int64
+
+	series map[string]map[string]bool
+	smtx   *sync.Mutex
+}
+
+// NewHandler creates a handler which writes to given databases
+func NewHandler(dbs kadiyadb.Databases, opts *Options) (h *Handler) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	missing := opts.Missing
+	if missing == "" {
+		missing = missingTag
+	}
+
+	maxBody := opts.MaxBodySize
+	if maxBody == 0 {
+		maxBody = maxBodySize
+	}
+
+	return &Handler{
+		dbs:       dbs,
+		tags:      opts.Tags,
+		missing:   missing,
+		maxSeries: opts.MaxSeries,
+		maxBody:   maxBody,
+		series:    map[string]map[string]bool{},
+		smtx:      &sync.Mutex{},
+	}
+}
+
+// Write reads lines from the reader and writes them to the database with
+// given name. All valid lines are written even if some lines have failed.
+// It returns the number of lines written and the error of the first failed
+// line (if any). Storage errors are returned instead of earlier parse errors.
+// Timestamps are converted from given unit to nanoseconds.
+func (h *Handler) Write(name string, r io.Reader, unit int64) (n int, err error) {
+	db := h.dbs.DB(name)
+	if db == nil {
+		return 0, ErrNoDB
+	}
+
+	now := time.Now()
+	br := bufio.NewReader(r)
+
+	for num := 1; ; num++ {
+		line, rerr := br.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return n, rerr
+		}
+
+		line = strings.TrimSpace(line)
+		if line != "" && line[0] != '#' {
+			if e := h.write(db, name, line, unit, now); e != nil {
+				if err == nil || isStorage(e) && !isStorage(err) {
+					err = fmt.Errorf("line %d: %w", num, e)
+				}
+			} else {
+				n++
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+	}
+
+	return n, err
+}
+
+// write parses a line and tracks each numeric field in the database
+func (h *Handler) write(db *kadiyadb.DB, name, line string, unit int64, now time.Time) (err error) {
+	p, err := Parse(line, unit, now)
+	if err != nil {
+		return err
+	}
+
+	fieldsets := make([][]string, len(p.Fields))
+	for i, f := range p.Fields {
+		fieldsets[i], err = h.fields(p, f.Key)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := h.ensureSeries(db, name, fieldsets); err != nil {
+		return err
+	}
+
+	for i, f := range p.Fields {
+		if err := db.Track(p.Time, fieldsets[i], f.Value, 1); err == kadiyadb.ErrInvTime {
+			return err
+		} else if err != nil {
+			return &storageError{err}
+		}
+	}
+
+	return nil
+}
+
+// isStorage checks whether an error is (or wraps) a storage error
+func isStorage(err error) bool {
+	var serr *storageError
+	return errors.As(err, &serr)
+}
+
+// fields makes the field set for a field of a point
+func (h *Handler) fields(p *Point, key string) (fields []string, err error) {
+	fields = make([]string, 0, len(h.tags)+2)
+	fields = append(fields, p.Measurement)
+
+	for _, tag := range h.tags {
+		value, ok := p.Tags[tag]
+		if !ok {
+			value = h.missing
+		}
+
+		fields = append(fields, value)
+	}
+
+	fields = append(fields, key)
+
+	for _, f := range fields {
+		if f == "" || f == "*" {
+			return nil, ErrMalformed
+		}
+	}
+
+	return fields, nil
+}
+
+// ensureSeries records series of a line if the database
+// can have all of them without exceeding the series limit.
+// Known series are loaded from the database when it's first used.
+func (h *Handler) ensureSeries(db *kadiyadb.DB, name string, fieldsets [][]string) (err error) {
+	if h.maxSeries == 0 {
+		return nil
+	}
+
+	h.smtx.Lock()
+	defer h.smtx.Unlock()
+
+	known, ok := h.series[name]
+	if !ok {
+		if known, err = h.loadSeries(db); err != nil {
+			return &storageError{err}
+		}
+
+		h.series[name] = known
+	}
+
+	keys := make([]string, 0, len(fieldsets))
+	for _, fields := range fieldsets {
+		key := strings.Join(fields, "\x00")
+		if !known[key] {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(known)+len(keys) > h.maxSeries {
+		return ErrCardinality
+	}
+
+	for _, key := range keys {
+		known[key] = true
+	}
+
+	return nil
+}
+
+// loadSeries returns series in the database which have as many fields as
+// series written by the handler. Parent series recorded by Track for each
+// prefix of fields (and series written by other means) are not counted.
+func (h *Handler) loadSeries(db *kadiyadb.DB) (known map[string]bool, err error) {
+	series, err := db.Series()
+	if err != nil {
+		return nil, err
+	}
+
+	known = map[string]bool{}
+	for _, fields := range series {
+		if len(fields) == len(h.tags)+2 {
+			known[strings.Join(fields, "\x00")] = true
+		}
+	}
+
+	return known, nil
+}
+
+// ServeHTTP handles write requests compatible with the InfluxDB write API.
+// The database name is given with the "db" query parameter and timestamp
+// precision with the "precision" query parameter. Request bodies can be
+// compressed with gzip. Bodies larger than Options.MaxBodySize are rejected.
+//
+//	POST /write?db=mydb&precision=s
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	q := r.URL.Query()
+
+	unit, err := Precision(q.Get("precision"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, h.maxBody)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		defer gz.Close()
+		body = &limitReader{r: gz, n: h.maxBody}
+	}
+
+	_, err = h.Write(q.Get("db"), body, unit)
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		err = ErrTooLarge
+	}
+
+	if err == ErrNoDB {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err == ErrTooLarge {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if isStorage(err) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// limitReader reads from r until more than n bytes are read.
+// It returns ErrTooLarge instead of the data after the limit.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (n int, err error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err = l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		return 0, ErrTooLarge
+	}
+
+	return n, err
+}
+
+// writeError writes an error to the response encoded as JSON
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,225 @@
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+var (
+	tmpdiri = "/tmp/test-influx/"
+)
+
+type dbmap map[string]*kadiyadb.DB
+
+func (m dbmap) DB(name string) *kadiyadb.DB {
+	return m[name]
+}
+
+func setupi(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdiri); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdiri); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	defer setupi(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdiri, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	h := NewHandler(dbmap{"test": db}, &Options{Tags: []string{"region", "host"}, MaxSeries: 3})
+
+	now := time.Now().Unix()
+	now -= now % 3600
+	ts := uint64(now) * 1e9
+
+	data := fmt.Sprintf(`# comment
+cpu,host=h1,region=us usage=0.5,idle=2i %d
+cpu,host=h1,region=us usage=1.5 %d
+
+bad line
+cpu,host=h2 usage=1,idle=1 %d
+cpu,host=h3 usage=1 %d
+`, now, now, now, now)
+
+	n, err := h.Write("test", strings.NewReader(data), int64(time.Second))
+	if n != 3 {
+		t.Fatal("wrong line count", n)
+	}
+
+	// the first error is returned with its line number
+	if err == nil || err.Error() != "line 5: "+ErrMalformed.Error() {
+		t.Fatal("wrong error", err)
+	}
+
+	// the line with 2 new series would exceed the limit
+	// so there's no series with "h2" as the host
+	db.Fetch(ts, ts+60000000000, []string{"cpu", "*", "*", "*"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		pts := map[string]protocol.Point{}
+		for _, s := range res[0].Series {
+			pts[strings.Join(s.Fields, ".")] = s.Points[0]
+		}
+
+		if len(pts) != 3 {
+			t.Fatal("wrong series", pts)
+		}
+
+		if p := pts["cpu.us.h1.usage"]; p.Total != 2 || p.Count != 2 {
+			t.Fatal("wrong point", p)
+		}
+
+		if p := pts["cpu.us.h1.idle"]; p.Total != 2 || p.Count != 1 {
+			t.Fatal("wrong point", p)
+		}
+
+		if p := pts["cpu._.h3.usage"]; p.Total != 1 || p.Count != 1 {
+			t.Fatal("wrong point", p)
+		}
+	})
+
+	// series already in the database are counted by new handlers
+	h = NewHandler(dbmap{"test": db}, &Options{Tags: []string{"region", "host"}, MaxSeries: 3})
+
+	line := fmt.Sprintf("cpu,host=h4 usage=1 %d", now)
+	if _, err := h.Write("test", strings.NewReader(line), int64(time.Second)); err == nil || err.Error() != "line 1: "+ErrCardinality.Error() {
+		t.Fatal("wrong error", err)
+	}
+
+	line = fmt.Sprintf("cpu,host=h3 usage=1 %d", now)
+	if _, err := h.Write("test", strings.NewReader(line), int64(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := h.Write("nope", strings.NewReader(data), 1); err != ErrNoDB {
+		t.Fatal("should fail with missing databases")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	defer setupi(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdiri, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ts := httptest.NewServer(NewHandler(dbmap{"test": db}, &Options{MaxBodySize: 1000}))
+	defer ts.Close()
+
+	now := time.Now().UnixNano() / 1e6
+	now -= now % 3600000
+
+	send := func(query, body string, gz bool, code int) {
+		buf := &bytes.Buffer{}
+		if gz {
+			w := gzip.NewWriter(buf)
+			w.Write([]byte(body))
+			w.Close()
+		} else {
+			buf.WriteString(body)
+		}
+
+		req, err := http.NewRequest("POST", ts.URL+"/write?"+query, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if gz {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Fatal("wrong status", query, res.StatusCode)
+		}
+	}
+
+	line := fmt.Sprintf("cpu usage=1 %d", now)
+	send("db=test&precision=ms", line, false, 204)
+	send("db=test&precision=ms", line, true, 204)
+	send("db=test&precision=ms", "bad", false, 400)
+	send("db=test&precision=d", line, false, 400)
+	send("db=nope&precision=ms", line, false, 404)
+
+	// epochs which cannot be loaded are storage errors
+	prev := (now - 3600000) * 1e6
+	edir := fmt.Sprintf("%s%d", tmpdiri, prev)
+	if err := os.MkdirAll(edir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(edir+"/meta.json", []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	send("db=test&precision=ms", fmt.Sprintf("cpu usage=1 %d", now-3600000), false, 500)
+
+	// size limits are checked before and after decompression
+	big := strings.Repeat(fmt.Sprintf("big usage=1 %d\n", now), 100)
+	send("db=test&precision=ms", big, false, 413)
+	send("db=test&precision=ms", big, true, 413)
+
+	from := uint64(now) * 1e6
+	db.Fetch(from, from+60000000000, []string{"cpu", "usage"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		if p := res[0].Series[0].Points[0]; p.Total != 2 || p.Count != 2 {
+			t.Fatal("wrong point", p)
+		}
+	})
+}
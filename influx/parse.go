@@ -0,0 +1,183 @@
+package influx
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrMalformed is returned when a line is not in the line protocol format
+	ErrMalformed = errors.New("malformed line")
+
+	// ErrPrecision is returned when the timestamp precision is not valid
+	ErrPrecision = errors.New("invalid precision")
+)
+
+// Field is a numeric field value of a point. Boolean values are
+// converted to 1 (true) or 0 (false). String values are ignored.
+type Field struct {
+	Key   string
+	Value float64
+}
+
+// Point is a point parsed from a line protocol line
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      []Field
+	Time        uint64
+}
+
+// Precision returns the duration of a timestamp unit for given precision.
+// The default precision (an empty string) is nanoseconds.
+func Precision(str string) (unit int64, err error) {
+	switch str {
+	case "", "n", "ns":
+		return int64(time.Nanosecond), nil
+	case "u", "us":
+		return int64(time.Microsecond), nil
+	case "ms":
+		return int64(time.Millisecond), nil
+	case "s":
+		return int64(time.Second), nil
+	case "m":
+		return int64(time.Minute), nil
+	case "h":
+		return int64(time.Hour), nil
+	}
+
+	return 0, ErrPrecision
+}
+
+// Parse parses a line in the InfluxDB line protocol format. Timestamps are
+// converted from given unit to nanoseconds. If the line doesn't have a
+// timestamp, given current time is used instead.
+//
+//	measurement,tag=value,tag=value field=1.5,field=2i,field="str" 1450000000
+func Parse(line string, unit int64, now time.Time) (p *Point, err error) {
+	sections := split(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, ErrMalformed
+	}
+
+	p = &Point{Tags: map[string]string{}}
+
+	keys := split(sections[0], ',', false)
+	p.Measurement = unescape(keys[0])
+	if p.Measurement == "" {
+		return nil, ErrMalformed
+	}
+
+	for _, tag := range keys[1:] {
+		kv := split(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, ErrMalformed
+		}
+
+		p.Tags[unescape(kv[0])] = unescape(kv[1])
+	}
+
+	for _, field := range split(sections[1], ',', true) {
+		kv := split(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, ErrMalformed
+		}
+
+		value, ok, err := parseValue(kv[1])
+		if err != nil {
+			return nil, err
+		} else if ok {
+			p.Fields = append(p.Fields, Field{unescape(kv[0]), value})
+		}
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil || ts < 0 || ts > math.MaxInt64/unit {
+			return nil, ErrMalformed
+		}
+
+		p.Time = uint64(ts * unit)
+	} else {
+		p.Time = uint64(now.UnixNano())
+	}
+
+	return p, nil
+}
+
+// parseValue parses a field value. String values are valid
+// but they are not numeric therefore `ok` will be false.
+func parseValue(str string) (value float64, ok bool, err error) {
+	if str[0] == '"' {
+		if len(str) < 2 || str[len(str)-1] != '"' {
+			return 0, false, ErrMalformed
+		}
+
+		return 0, false, nil
+	}
+
+	switch str {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+
+	switch str[len(str)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(str[:len(str)-1], 10, 64)
+		if err != nil {
+			return 0, false, ErrMalformed
+		}
+
+		return float64(v), true, nil
+	case 'u':
+		v, err := strconv.ParseUint(str[:len(str)-1], 10, 64)
+		if err != nil {
+			return 0, false, ErrMalformed
+		}
+
+		return float64(v), true, nil
+	}
+
+	value, err = strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false, ErrMalformed
+	}
+
+	return value, true, nil
+}
+
+// split splits a string by a separator which is not escaped with a
+// backslash. If quotes is true, separators inside quotes are ignored.
+func split(str string, sep byte, quotes bool) (parts []string) {
+	start := 0
+	quoted := false
+
+	for i := 0; i < len(str); i++ {
+		switch c := str[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && quotes:
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, str[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, str[start:])
+}
+
+// unescape removes backslashes used to escape special characters
+func unescape(str string) string {
+	if strings.IndexByte(str, '\\') < 0 {
+		return str
+	}
+
+	r := strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\"`, `"`, `\\`, `\`)
+	return r.Replace(str)
+}
@@ -0,0 +1,87 @@
+package influx
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Unix(1450000000, 0)
+
+	valid := map[string]*Point{
+		`cpu,host=h1,region=us usage=0.5,idle=2i 1450000100`: {
+			Measurement: "cpu",
+			Tags:        map[string]string{"host": "h1", "region": "us"},
+			Fields:      []Field{{"usage", 0.5}, {"idle", 2}},
+			Time:        1450000100e9,
+		},
+		`cpu usage=1u,up=true,down=F,msg="a b,c=d"`: {
+			Measurement: "cpu",
+			Tags:        map[string]string{},
+			Fields:      []Field{{"usage", 1}, {"up", 1}, {"down", 0}},
+			Time:        1450000000e9,
+		},
+		`c\ p\,u,ho\=st=h\ 1 us\ age=1 1450000100`: {
+			Measurement: "c p,u",
+			Tags:        map[string]string{"ho=st": "h 1"},
+			Fields:      []Field{{"us age", 1}},
+			Time:        1450000100e9,
+		},
+	}
+
+	for line, exp := range valid {
+		p, err := Parse(line, int64(time.Second), now)
+		if err != nil {
+			t.Fatal(line, err)
+		} else if !reflect.DeepEqual(p, exp) {
+			t.Fatal("wrong point", line, p)
+		}
+	}
+
+	invalid := []string{
+		``,
+		`cpu`,
+		`cpu,host usage=1`,
+		`cpu,host= usage=1`,
+		`,host=h1 usage=1`,
+		`cpu usage`,
+		`cpu usage=`,
+		`cpu usage=x`,
+		`cpu usage=1x`,
+		`cpu usage=NaN`,
+		`cpu usage="x`,
+		`cpu usage=1 x`,
+		`cpu usage=1 -1`,
+		`cpu usage=1 1450000000000000000`,
+		`cpu usage=1 1 2`,
+	}
+
+	for _, line := range invalid {
+		if _, err := Parse(line, int64(time.Second), now); err != ErrMalformed {
+			t.Fatal("should fail", line, err)
+		}
+	}
+}
+
+func TestPrecision(t *testing.T) {
+	units := map[string]time.Duration{
+		"":   time.Nanosecond,
+		"ns": time.Nanosecond,
+		"u":  time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+	}
+
+	for str, exp := range units {
+		if unit, err := Precision(str); err != nil || unit != int64(exp) {
+			t.Fatal("wrong unit", str, unit)
+		}
+	}
+
+	if _, err := Precision("d"); err != ErrPrecision {
+		t.Fatal("should fail with invalid precision")
+	}
+}
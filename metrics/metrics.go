@@ -0,0 +1,182 @@
+// Package metrics collects internal metrics of the database and writes them
+// in the Prometheus text exposition format. Metrics are created once (usually
+// as package level variables) and they are registered in the default registry.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// DefaultBuckets are histogram buckets suitable for latencies in seconds
+	DefaultBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+)
+
+// value is a float64 value which can be updated atomically
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(d float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		next := math.Float64bits(math.Float64frombits(old) + d)
+		if atomic.CompareAndSwapUint64(&v.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter is a value which can only increase
+type Counter struct {
+	desc
+	val value
+}
+
+// NewCounter creates a counter and registers it in the default registry.
+// Labels are given as name/value pairs ("mode", "ro", "result", "hit").
+func NewCounter(name, help string, labels ...string) (c *Counter) {
+	c = &Counter{desc: newDesc(name, help, "counter", labels)}
+	Default.Register(c)
+	return c
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc() {
+	c.val.add(1)
+}
+
+// Add adds a positive value to the counter
+func (c *Counter) Add(v float64) {
+	if v > 0 {
+		c.val.add(v)
+	}
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() float64 {
+	return c.val.get()
+}
+
+func (c *Counter) samples() []sample {
+	return []sample{{c.name, c.labels, c.val.get()}}
+}
+
+// Gauge is a value which can increase and decrease
+type Gauge struct {
+	desc
+	val value
+}
+
+// NewGauge creates a gauge and registers it in the default registry.
+// Labels are given as name/value pairs ("mode", "ro").
+func NewGauge(name, help string, labels ...string) (g *Gauge) {
+	g = &Gauge{desc: newDesc(name, help, "gauge", labels)}
+	Default.Register(g)
+	return g
+}
+
+// Set sets the value of the gauge
+func (g *Gauge) Set(v float64) {
+	g.val.set(v)
+}
+
+// Add adds a value (can be negative) to the gauge
+func (g *Gauge) Add(v float64) {
+	g.val.add(v)
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() float64 {
+	return g.val.get()
+}
+
+func (g *Gauge) samples() []sample {
+	return []sample{{g.name, g.labels, g.val.get()}}
+}
+
+// Histogram counts observed values in buckets
+type Histogram struct {
+	desc
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    value
+}
+
+// NewHistogram creates a histogram with given bucket upper bounds and
+// registers it in the default registry. DefaultBuckets is used if no
+// buckets are given. Labels are given as name/value pairs.
+func NewHistogram(name, help string, buckets []float64, labels ...string) (h *Histogram) {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	bounds := append([]float64{}, buckets...)
+	sort.Float64s(bounds)
+
+	h = &Histogram{
+		desc:   newDesc(name, help, "histogram", labels),
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+
+	Default.Register(h)
+	return h
+}
+
+// Observe adds a value to the histogram
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(v)
+}
+
+// ObserveSince adds the time elapsed since given time in seconds
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Count returns the number of observed values
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the sum of observed values
+func (h *Histogram) Sum() float64 {
+	return h.sum.get()
+}
+
+func (h *Histogram) samples() (ss []sample) {
+	ss = make([]sample, 0, len(h.bounds)+3)
+
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		labels := append(h.labels[:len(h.labels):len(h.labels)], "le", formatFloat(bound))
+		ss = append(ss, sample{h.name + "_bucket", labels, float64(cumulative)})
+	}
+
+	count := float64(atomic.LoadUint64(&h.count))
+	labels := append(h.labels[:len(h.labels):len(h.labels)], "le", "+Inf")
+	ss = append(ss, sample{h.name + "_bucket", labels, count})
+	ss = append(ss, sample{h.name + "_sum", h.labels, h.sum.get()})
+	ss = append(ss, sample{h.name + "_count", h.labels, count})
+
+	return ss
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "test counter")
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc()
+			}
+		}()
+	}
+
+	wg.Wait()
+	c.Add(0.5)
+	c.Add(-5)
+
+	if v := c.Value(); v != 1000.5 {
+		t.Fatal("wrong value", v)
+	}
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_gauge", "test gauge")
+	g.Set(5)
+	g.Add(-2)
+
+	if v := g.Value(); v != 3 {
+		t.Fatal("wrong value", v)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_histogram", "test histogram", []float64{10, 1, 5})
+	for _, v := range []float64{0.5, 1, 3, 7, 20} {
+		h.Observe(v)
+	}
+
+	h.ObserveSince(time.Now())
+
+	if h.Count() != 6 || h.Sum() < 31.5 {
+		t.Fatal("wrong count or sum")
+	}
+
+	ss := h.samples()
+	exp := []float64{3, 4, 5, 6}
+	for i, v := range exp {
+		if ss[i].value != v {
+			t.Fatal("wrong bucket", i, ss[i].value)
+		}
+	}
+}
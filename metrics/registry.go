@@ -0,0 +1,189 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// Default is the registry used by metrics created with this package
+	Default = NewRegistry()
+)
+
+// Metric is implemented by all metric types
+type Metric interface {
+	describe() desc
+	samples() []sample
+}
+
+// desc has information common to all metric types
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func newDesc(name, help, typ string, labels []string) desc {
+	if len(labels)%2 != 0 {
+		panic("metrics: labels must be name/value pairs")
+	}
+
+	return desc{name, help, typ, labels}
+}
+
+func (d desc) describe() desc {
+	return d
+}
+
+// sample is a single line in the text format
+type sample struct {
+	name   string
+	labels []string
+	value  float64
+}
+
+// Registry is a collection of metrics
+type Registry struct {
+	metrics []Metric
+	mtx     *sync.RWMutex
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() (r *Registry) {
+	return &Registry{mtx: &sync.RWMutex{}}
+}
+
+// Register adds a metric to the registry. Metrics with the same name
+// must have the same type and different label values.
+func (r *Registry) Register(m Metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+// Metrics with the same name are written together with one HELP/TYPE line.
+func (r *Registry) WriteText(w io.Writer) (err error) {
+	r.mtx.RLock()
+	metrics := append([]Metric{}, r.metrics...)
+	r.mtx.RUnlock()
+
+	names := []string{}
+	groups := map[string][]Metric{}
+	for _, m := range metrics {
+		name := m.describe().name
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+		}
+
+		groups[name] = append(groups[name], m)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		d := groups[name][0].describe()
+		bw.WriteString("# HELP " + name + " " + escapeHelp(d.help) + "\n")
+		bw.WriteString("# TYPE " + name + " " + d.typ + "\n")
+
+		for _, m := range groups[name] {
+			for _, s := range m.samples() {
+				bw.WriteString(s.name)
+				writeLabels(bw, s.labels)
+				bw.WriteString(" " + formatFloat(s.value) + "\n")
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Value returns the sum of samples with given name which have all given
+// labels (name/value pairs). Histogram samples can be read using names
+// with "_sum" and "_count" suffixes. It returns false if none matched.
+func (r *Registry) Value(name string, labels ...string) (v float64, ok bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	for _, m := range r.metrics {
+		for _, s := range m.samples() {
+			if s.name == name && hasLabels(s.labels, labels) {
+				v += s.value
+				ok = true
+			}
+		}
+	}
+
+	return v, ok
+}
+
+// hasLabels checks whether all wanted labels are in given labels
+func hasLabels(labels, wanted []string) bool {
+	for i := 0; i < len(wanted); i += 2 {
+		found := false
+		for j := 0; j < len(labels); j += 2 {
+			if labels[j] == wanted[i] && labels[j+1] == wanted[i+1] {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Handler returns an HTTP handler which serves metrics in the default
+// registry in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Default.WriteText(w)
+	})
+}
+
+func writeLabels(w *bufio.Writer, labels []string) {
+	if len(labels) == 0 {
+		return
+	}
+
+	w.WriteByte('{')
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+
+		w.WriteString(labels[i] + `="` + escapeLabel(labels[i+1]) + `"`)
+	}
+	w.WriteByte('}')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(str string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(str)
+}
+
+func escapeLabel(str string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(str)
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	c1 := NewCounter("test_requests_total", "requests", "mode", "ro")
+	c2 := NewCounter("test_requests_total", "requests", "mode", "rw")
+	g := NewGauge("test_loaded", "loaded \"items\"\nsecond line", "name", `a"b`)
+	h := NewHistogram("test_latency_seconds", "latency", []float64{1, 2})
+
+	r.Register(c1)
+	r.Register(g)
+	r.Register(c2)
+	r.Register(h)
+
+	c1.Add(2)
+	c2.Inc()
+	g.Set(1.5)
+	h.Observe(1.5)
+
+	buf := &bytes.Buffer{}
+	if err := r.WriteText(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := `# HELP test_requests_total requests
+# TYPE test_requests_total counter
+test_requests_total{mode="ro"} 2
+test_requests_total{mode="rw"} 1
+# HELP test_loaded loaded "items"\nsecond line
+# TYPE test_loaded gauge
+test_loaded{name="a\"b"} 1.5
+# HELP test_latency_seconds latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="1"} 0
+test_latency_seconds_bucket{le="2"} 1
+test_latency_seconds_bucket{le="+Inf"} 1
+test_latency_seconds_sum 1.5
+test_latency_seconds_count 1
+`
+
+	if buf.String() != exp {
+		t.Fatal("wrong output", buf.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_handler_total", "handler").Inc()
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.Contains(w.Body.String(), "test_handler_total 1\n") {
+		t.Fatal("missing metric")
+	}
+
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatal("wrong content type")
+	}
+}
+
+func TestValue(t *testing.T) {
+	r := NewRegistry()
+
+	c1 := NewCounter("test_value_total", "value", "mode", "ro", "result", "hit")
+	c2 := NewCounter("test_value_total", "value", "mode", "rw", "result", "hit")
+	h := NewHistogram("test_value_seconds", "value", nil)
+
+	r.Register(c1)
+	r.Register(c2)
+	r.Register(h)
+
+	c1.Add(2)
+	c2.Add(3)
+	h.Observe(0.5)
+
+	if v, ok := r.Value("test_value_total"); !ok || v != 5 {
+		t.Fatal("wrong value", v)
+	}
+
+	if v, ok := r.Value("test_value_total", "mode", "rw"); !ok || v != 3 {
+		t.Fatal("wrong value", v)
+	}
+
+	if v, ok := r.Value("test_value_seconds_count"); !ok || v != 1 {
+		t.Fatal("wrong value", v)
+	}
+
+	if _, ok := r.Value("test_value_total", "mode", "x"); ok {
+		t.Fatal("should not match")
+	}
+}
@@ -0,0 +1,191 @@
+// Package monitor records operational stats of the database process into a
+// database so they can be graphed with the same query API as other data.
+// Stats are recorded periodically with following fields:
+//
+//	["process", "tracks"]              tracks per second (total/count)
+//	["process", "fetches"]             fetches per second (total/count)
+//	["process", "trackLatency"]        average track latency in ms (total/count)
+//	["process", "fetchLatency"]        average fetch latency in ms (total/count)
+//	["process", "epochsLoaded", mode]  loaded epochs ("ro" or "rw")
+//	["db", name, "diskBytes"]          bytes on disk for each database
+//
+// Track and fetch stats are collected for all databases in the process
+// (including tracks made by the monitor itself to record stats).
+package monitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb/metrics"
+)
+
+const (
+	// Database is the name reserved for the database used to record stats
+	Database = "_internal"
+
+	// DefaultParams are params used when creating the internal database
+	DefaultParams = `{
+  "duration": "24h",
+  "resolution": "1m",
+  "retention": "168h",
+  "maxROEpochs": 2,
+  "maxRWEpochs": 2
+}`
+)
+
+// Databases is used to find databases to monitor
+type Databases interface {
+	kadiyadb.Databases
+	Names() (names []string)
+}
+
+// Monitor periodically records stats into a database
+type Monitor struct {
+	target   *kadiyadb.DB
+	dbs      Databases
+	interval time.Duration
+
+	// previous values of counters used to calculate rates
+	prev     map[string]float64
+	prevTime time.Time
+	mtx      *sync.Mutex
+
+	stop chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// New creates a monitor which records stats of given databases into
+// the target database. Stats are recorded once in every interval.
+func New(target *kadiyadb.DB, dbs Databases, interval time.Duration) (m *Monitor) {
+	m = &Monitor{
+		target:   target,
+		dbs:      dbs,
+		interval: interval,
+		prev:     map[string]float64{},
+		prevTime: time.Now(),
+		mtx:      &sync.Mutex{},
+		stop:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+	}
+
+	m.mtx.Lock()
+	m.readCounters()
+	m.mtx.Unlock()
+
+	m.wg.Add(1)
+	go m.loop()
+
+	return m
+}
+
+// Close stops recording stats
+func (m *Monitor) Close() (err error) {
+	close(m.stop)
+	m.wg.Wait()
+	return nil
+}
+
+// Record records current stats with given time. Rates are calculated
+// using counter values from the previous time stats were recorded.
+func (m *Monitor) Record(now time.Time) (err error) {
+	ts := uint64(now.UnixNano())
+
+	m.mtx.Lock()
+	prev := m.prev
+	secs := now.Sub(m.prevTime).Seconds()
+	cur := m.readCounters()
+	m.prevTime = now
+	m.mtx.Unlock()
+
+	delta := func(name string) float64 {
+		if d := cur[name] - prev[name]; d > 0 {
+			return d
+		}
+
+		return 0
+	}
+
+	record := func(total, count float64, fields ...string) {
+		if e := m.target.Track(ts, fields, total, count); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	if secs > 0 {
+		record(delta("tracks"), secs, "process", "tracks")
+		record(delta("fetches"), secs, "process", "fetches")
+	}
+
+	if n := delta("tracks"); n > 0 {
+		record(delta("trackTime")*1000, n, "process", "trackLatency")
+	}
+
+	if n := delta("fetches"); n > 0 {
+		record(delta("fetchTime")*1000, n, "process", "fetchLatency")
+	}
+
+	for _, mode := range []string{"ro", "rw"} {
+		v, _ := metrics.Default.Value("kadiyadb_epochs_loaded", "mode", mode)
+		record(v, 1, "process", "epochsLoaded", mode)
+	}
+
+	for _, name := range m.dbs.Names() {
+		db := m.dbs.DB(name)
+		if db == nil {
+			continue
+		}
+
+		size, e := db.DiskUsage()
+		if e != nil {
+			if err == nil {
+				err = e
+			}
+
+			continue
+		}
+
+		record(float64(size), 1, "db", name, "diskBytes")
+	}
+
+	return err
+}
+
+// readCounters reads counter values and stores them as previous values.
+// The mutex must be locked when calling this function.
+func (m *Monitor) readCounters() (cur map[string]float64) {
+	read := func(name string) float64 {
+		v, _ := metrics.Default.Value(name)
+		return v
+	}
+
+	cur = map[string]float64{
+		"tracks":    read("kadiyadb_track_duration_seconds_count"),
+		"trackTime": read("kadiyadb_track_duration_seconds_sum"),
+		"fetches":   read("kadiyadb_fetch_duration_seconds_count"),
+		"fetchTime": read("kadiyadb_fetch_duration_seconds_sum"),
+	}
+
+	m.prev = cur
+	return cur
+}
+
+func (m *Monitor) loop() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case now := <-ticker.C:
+			if err := m.Record(now); err != nil {
+				fmt.Println("Monitor Error:", err)
+			}
+		}
+	}
+}
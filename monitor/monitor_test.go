@@ -0,0 +1,114 @@
+package monitor
+
+import (
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+const (
+	dir = "/tmp/test-monitor"
+)
+
+type dbmap map[string]*kadiyadb.DB
+
+func (m dbmap) DB(name string) *kadiyadb.DB {
+	return m[name]
+}
+
+func (m dbmap) Names() (names []string) {
+	for name := range m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func open(t *testing.T, name string) (db *kadiyadb.DB) {
+	db, err := kadiyadb.Open(dir+"/"+name, &kadiyadb.Params{
+		Duration:    int64(time.Hour),
+		Resolution:  int64(time.Minute),
+		Retention:   int64(24 * time.Hour),
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func point(t *testing.T, db *kadiyadb.DB, ts time.Time, fields []string) (p protocol.Point) {
+	from := uint64(ts.Truncate(time.Minute).UnixNano())
+	db.Fetch(from, from+uint64(time.Minute), fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(chunks) == 1 && len(chunks[0].Series) == 1 {
+			p = chunks[0].Series[0].Points[0]
+		}
+	})
+
+	return p
+}
+
+func TestRecord(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	internal := open(t, Database)
+	defer internal.Close()
+
+	test := open(t, "test")
+	defer test.Close()
+
+	dbs := dbmap{Database: internal, "test": test}
+	m := New(internal, dbs, time.Hour)
+	defer m.Close()
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := test.Track(uint64(now.UnixNano()), []string{"a"}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	test.Fetch(uint64(now.UnixNano()), uint64(now.UnixNano()), []string{"a"}, func([]*protocol.Chunk, error) {})
+
+	if err := m.Record(now); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := point(t, internal, now, []string{"process", "tracks"}); p.Total < 10 || p.Count <= 0 {
+		t.Fatal("wrong tracks", p)
+	}
+
+	if p := point(t, internal, now, []string{"process", "fetches"}); p.Total < 1 {
+		t.Fatal("wrong fetches", p)
+	}
+
+	if p := point(t, internal, now, []string{"process", "trackLatency"}); p.Count < 10 {
+		t.Fatal("wrong track latency", p)
+	}
+
+	if p := point(t, internal, now, []string{"process", "epochsLoaded", "rw"}); p.Total < 2 {
+		t.Fatal("wrong loaded epochs", p)
+	}
+
+	if p := point(t, internal, now, []string{"db", "test", "diskBytes"}); p.Total <= 0 || p.Count != 1 {
+		t.Fatal("wrong disk usage", p)
+	}
+
+	if p := point(t, internal, now, []string{"db", Database, "diskBytes"}); p.Total <= 0 {
+		t.Fatal("wrong disk usage", p)
+	}
+}
@@ -0,0 +1,385 @@
+// Package prometheus receives samples with the Prometheus remote write API
+// so a kadiyadb database can be used as long-term storage for Prometheus.
+// Fields of a series are made with the metric name followed by values of
+// configured labels (in configured order). Other labels are not stored.
+//
+//	http_requests_total{job="api",code="200"}  (Labels: job, code)
+//	=> ["http_requests_total", "api", "200"]
+//
+// Counters are cumulative in Prometheus therefore the difference from the
+// previous sample of the same series is tracked (with a count of 1). The
+// first sample of a counter series is only used to start counting. Other
+// metrics are tracked as gauges (each value is tracked with a count of 1).
+// A metric is a counter if metadata sent with requests says so or if its
+// name ends with one of "_total", "_count", "_sum" and "_bucket".
+package prometheus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/kadirahq/kadiyadb"
+)
+
+const (
+	// nameLabel is the label which has the metric name
+	nameLabel = "__name__"
+
+	// missingLabel is the default field value used for missing labels
+	missingLabel = "_"
+
+	// maxBodySize is the maximum size of a compressed request body
+	maxBodySize = 1024 * 1024 * 32
+
+	// maxDecodedSize is the maximum size of a decompressed request body
+	maxDecodedSize = 1024 * 1024 * 128
+
+	// defaultExpire is the default time to keep previous counter samples
+	defaultExpire = time.Hour
+)
+
+var (
+	// ErrNoDB is returned when the requested database does not exist
+	ErrNoDB = errors.New("database not found")
+
+	// ErrTooLarge is returned when a decompressed request body is too large
+	ErrTooLarge = errors.New("request body too large")
+
+	// counterSuffixes are metric name suffixes used by counters
+	counterSuffixes = []string{"_total", "_count", "_sum", "_bucket"}
+)
+
+// Options is used to configure how series are mapped to fields
+type Options struct {
+	// Labels has label names in the order they are added to fields
+	Labels []string
+
+	// Missing is used when a label is not available (default: "_")
+	Missing string
+
+	// Database is used when a database is not given with the request
+	Database string
+
+	// Expire is the time to keep the previous sample of a counter series
+	// which is not received again (default: 1h). The next sample of an
+	// expired series is only used to start counting again.
+	Expire time.Duration
+}
+
+// prevSample has the previous sample of a counter and when it was received
+type prevSample struct {
+	sample Sample
+	seen   time.Time
+}
+
+// storageError is returned when a valid sample cannot be written to the database
+type storageError struct {
+	err error
+}
+
+func (e *storageError) Error() string { return e.err.Error() }
+func (e *storageError) Unwrap() error { return e.err }
+
+// Handler handles remote write requests
+type Handler struct {
+	dbs      kadiyadb.Databases
+	labels   []string
+	missing  string
+	database string
+
+	prev   map[string]*prevSample
+	expire time.Duration
+	swept  time.Time
+	pmtx   *sync.Mutex
+}
+
+// NewHandler creates a handler which writes to given databases
+func NewHandler(dbs kadiyadb.Databases, opts *Options) (h *Handler) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	missing := opts.Missing
+	if missing == "" {
+		missing = missingLabel
+	}
+
+	expire := opts.Expire
+	if expire <= 0 {
+		expire = defaultExpire
+	}
+
+	return &Handler{
+		dbs:      dbs,
+		labels:   opts.Labels,
+		missing:  missing,
+		database: opts.Database,
+		prev:     map[string]*prevSample{},
+		expire:   expire,
+		swept:    time.Now(),
+		pmtx:     &sync.Mutex{},
+	}
+}
+
+// Write tracks samples of a request in the database with given name.
+// Samples are tracked even if some of them have failed. It returns the
+// number of samples tracked and the first error (if any). Storage errors
+// are returned instead of earlier errors caused by invalid series.
+func (h *Handler) Write(name string, req *WriteRequest) (n int, err error) {
+	db := h.dbs.DB(name)
+	if db == nil {
+		return 0, ErrNoDB
+	}
+
+	for _, s := range req.Series {
+		m, e := h.write(db, name, s, req.Counters)
+		n += m
+
+		if e != nil && (err == nil || isStorage(e) && !isStorage(err)) {
+			err = e
+		}
+	}
+
+	return n, err
+}
+
+// write tracks samples of a series in the database
+func (h *Handler) write(db *kadiyadb.DB, name string, s *TimeSeries, counters map[string]bool) (n int, err error) {
+	fields, err := h.fields(s)
+	if err != nil {
+		return 0, err
+	}
+
+	counter := isCounter(fields[0], counters)
+	key := seriesKey(name, s)
+	now := time.Now()
+
+	for _, p := range s.Samples {
+		// stale markers are NaN values
+		if math.IsNaN(p.Value) || math.IsInf(p.Value, 0) {
+			continue
+		}
+
+		// timestamps are in milliseconds and must fit in int64 nanoseconds
+		if p.Timestamp < 0 || p.Timestamp > math.MaxInt64/1000000 {
+			continue
+		}
+
+		value := p.Value
+		if counter {
+			var ok bool
+			if value, ok = h.delta(key, p, now); !ok {
+				continue
+			}
+		}
+
+		ts := uint64(p.Timestamp) * 1e6
+		if e := db.Track(ts, fields, value, 1); e != nil {
+			if e != kadiyadb.ErrInvTime {
+				e = &storageError{e}
+			}
+
+			if err == nil || isStorage(e) && !isStorage(err) {
+				err = e
+			}
+
+			continue
+		}
+
+		n++
+	}
+
+	return n, err
+}
+
+// isStorage checks whether an error is (or wraps) a storage error
+func isStorage(err error) bool {
+	var serr *storageError
+	return errors.As(err, &serr)
+}
+
+// delta returns the difference from the previous counter sample
+func (h *Handler) delta(key string, p Sample, now time.Time) (d float64, ok bool) {
+	h.pmtx.Lock()
+	defer h.pmtx.Unlock()
+
+	// expired samples are removed at most once in an expire duration
+	if now.Sub(h.swept) >= h.expire {
+		h.sweep(now)
+	}
+
+	prev, ok := h.prev[key]
+	if ok && now.Sub(prev.seen) >= h.expire {
+		ok = false
+	}
+
+	if ok && p.Timestamp <= prev.sample.Timestamp {
+		return 0, false
+	}
+
+	h.prev[key] = &prevSample{sample: p, seen: now}
+	if !ok {
+		return 0, false
+	}
+
+	if p.Value < prev.sample.Value {
+		return p.Value, true
+	}
+
+	return p.Value - prev.sample.Value, true
+}
+
+// sweep removes previous counter samples which are expired at given time.
+// The pmtx mutex must be locked when calling this function.
+func (h *Handler) sweep(now time.Time) {
+	for key, prev := range h.prev {
+		if now.Sub(prev.seen) >= h.expire {
+			delete(h.prev, key)
+		}
+	}
+
+	h.swept = now
+}
+
+// seriesKey returns a key which identifies a series of a database using all
+// labels of the series. Series which only differ with labels not used as
+// fields (e.g. "instance") are different counters with their own values.
+func seriesKey(name string, s *TimeSeries) (key string) {
+	labels := make([]Label, len(s.Labels))
+	copy(labels, s.Labels)
+	sort.Sort(byName(labels))
+
+	parts := make([]string, 0, 2*len(labels)+1)
+	parts = append(parts, name)
+	for _, l := range labels {
+		parts = append(parts, l.Name, l.Value)
+	}
+
+	return strings.Join(parts, "\x00")
+}
+
+// fields makes the field set for a series using its labels
+func (h *Handler) fields(s *TimeSeries) (fields []string, err error) {
+	labels := make(map[string]string, len(s.Labels))
+	for _, l := range s.Labels {
+		labels[l.Name] = l.Value
+	}
+
+	fields = make([]string, 0, len(h.labels)+1)
+	fields = append(fields, labels[nameLabel])
+
+	for _, name := range h.labels {
+		value, ok := labels[name]
+		if !ok || value == "" {
+			value = h.missing
+		}
+
+		fields = append(fields, value)
+	}
+
+	for _, f := range fields {
+		if f == "" || f == "*" {
+			return nil, fmt.Errorf("invalid series labels: %v", s.Labels)
+		}
+	}
+
+	return fields, nil
+}
+
+// isCounter checks whether a metric is a counter using metadata
+// sent with the request and common metric naming conventions.
+func isCounter(name string, counters map[string]bool) bool {
+	if counters[name] {
+		return true
+	}
+
+	for _, suffix := range counterSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServeHTTP handles remote write requests. Request bodies must be snappy
+// compressed protocol buffers. The database name can be given with the
+// "db" query parameter, otherwise Options.Database is used.
+//
+//	POST /api/v1/write?db=prometheus
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	name := r.URL.Query().Get("db")
+	if name == "" {
+		name = h.database
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if size > maxDecodedSize {
+		writeError(w, http.StatusRequestEntityTooLarge, ErrTooLarge)
+		return
+	}
+
+	data, err = snappy.Decode(nil, data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	req, err := Decode(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := h.Write(name, req); err == ErrNoDB {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if isStorage(err) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// byName is used to sort labels by name
+type byName []Label
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// writeError writes an error to the response encoded as JSON
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": err.Error(),
+	})
+}
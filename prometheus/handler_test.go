@@ -0,0 +1,299 @@
+package prometheus
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+var (
+	tmpdirp = "/tmp/test-prometheus/"
+)
+
+// staleNaN is the value used by Prometheus as a staleness marker
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+type dbmap map[string]*kadiyadb.DB
+
+func (m dbmap) DB(name string) *kadiyadb.DB {
+	return m[name]
+}
+
+func setupp(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdirp); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdirp); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	defer setupp(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdirp, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	h := NewHandler(dbmap{"test": db}, &Options{Labels: []string{"job", "code"}})
+
+	now := time.Now().Unix()
+	now = (now - now%3600) * 1000
+
+	req := &WriteRequest{
+		Series: []*TimeSeries{
+			{
+				Labels:  []Label{{"code", "200"}, {"__name__", "temp"}, {"job", "api"}},
+				Samples: []Sample{{20, now}, {30, now + 15000}, {staleNaN, now + 30000}, {1, -1}, {1, math.MaxInt64}},
+			},
+			{
+				Labels:  []Label{{"__name__", "requests_total"}, {"job", "api"}},
+				Samples: []Sample{{100, now}, {110, now + 15000}, {115, now + 30000}},
+			},
+			{
+				Labels:  []Label{{"__name__", "errors"}},
+				Samples: []Sample{{5, now}, {2, now + 15000}},
+			},
+			{
+				Labels:  []Label{{"job", "api"}},
+				Samples: []Sample{{5, now}},
+			},
+		},
+		Counters: map[string]bool{"errors": true},
+	}
+
+	n, err := h.Write("test", req)
+	if err == nil {
+		t.Fatal("should fail with series without a name")
+	}
+
+	if n != 5 {
+		t.Fatal("wrong sample count", n)
+	}
+
+	from := uint64(now) * 1e6
+	db.Fetch(from, from+60000000000, []string{"*", "*", "*"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		pts := map[string]protocol.Point{}
+		for _, s := range res[0].Series {
+			pts[strings.Join(s.Fields, ".")] = s.Points[0]
+		}
+
+		if p := pts["temp.api.200"]; p.Total != 50 || p.Count != 2 {
+			t.Fatal("wrong gauge point", p)
+		}
+
+		if p := pts["requests_total.api._"]; p.Total != 15 || p.Count != 2 {
+			t.Fatal("wrong counter point", p)
+		}
+
+		// counter reset: the new value is tracked
+		if p := pts["errors._._"]; p.Total != 2 || p.Count != 1 {
+			t.Fatal("wrong counter point", p)
+		}
+	})
+
+	// samples which were already seen are ignored
+	req.Series = req.Series[1:2]
+	if n, err := h.Write("test", req); err != nil || n != 0 {
+		t.Fatal("should ignore old samples", n, err)
+	}
+
+	if _, err := h.Write("nope", req); err != ErrNoDB {
+		t.Fatal("should fail with missing databases")
+	}
+}
+
+func TestCounterLabels(t *testing.T) {
+	defer setupp(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdirp, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	h := NewHandler(dbmap{"test": db}, nil)
+
+	now := time.Now().Unix()
+	now = (now - now%3600) * 1000
+
+	// series only differ with labels which are not used as fields
+	req := &WriteRequest{
+		Series: []*TimeSeries{
+			{
+				Labels:  []Label{{"__name__", "requests_total"}, {"instance", "a"}},
+				Samples: []Sample{{100, now}, {110, now + 15000}},
+			},
+			{
+				Labels:  []Label{{"instance", "b"}, {"__name__", "requests_total"}},
+				Samples: []Sample{{5, now}, {8, now + 15000}},
+			},
+		},
+	}
+
+	if n, err := h.Write("test", req); err != nil || n != 2 {
+		t.Fatal("wrong sample count", n, err)
+	}
+
+	from := uint64(now) * 1e6
+	db.Fetch(from, from+60000000000, []string{"requests_total"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		if p := res[0].Series[0].Points[0]; p.Total != 13 || p.Count != 2 {
+			t.Fatal("wrong counter point", p)
+		}
+	})
+}
+
+func TestCounterExpire(t *testing.T) {
+	h := NewHandler(dbmap{}, &Options{Expire: time.Minute})
+	now := time.Now()
+
+	if _, ok := h.delta("a", Sample{10, 1000}, now); ok {
+		t.Fatal("first sample should only start counting")
+	}
+
+	if d, ok := h.delta("a", Sample{15, 2000}, now.Add(time.Second)); !ok || d != 5 {
+		t.Fatal("wrong delta", d)
+	}
+
+	// other series remove expired samples
+	h.delta("b", Sample{1, 3000}, now.Add(2*time.Minute))
+
+	if len(h.prev) != 1 {
+		t.Fatal("should remove expired samples", len(h.prev))
+	}
+
+	// the next sample of an expired series starts counting again
+	if _, ok := h.delta("a", Sample{20, 4000}, now.Add(2*time.Minute)); ok {
+		t.Fatal("should start counting again")
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	defer setupp(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdirp, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ts := httptest.NewServer(NewHandler(dbmap{"test": db}, &Options{Database: "test"}))
+	defer ts.Close()
+
+	now := time.Now().Unix()
+	now = (now - now%3600) * 1000
+
+	data := encodeRequest([]*TimeSeries{{
+		Labels:  []Label{{"__name__", "temp"}},
+		Samples: []Sample{{20, now}},
+	}}, nil)
+
+	send := func(query string, body []byte, code int) {
+		res, err := http.Post(ts.URL+"/api/v1/write"+query, "application/x-protobuf", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Fatal("wrong status", query, res.StatusCode)
+		}
+	}
+
+	send("", snappy.Encode(nil, data), 204)
+	send("?db=test", snappy.Encode(nil, data), 204)
+	send("?db=nope", snappy.Encode(nil, data), 404)
+	send("", data, 400)
+	send("", snappy.Encode(nil, data[:len(data)-3]), 400)
+
+	// the decoded length in the header is checked before decoding
+	send("", []byte{0x80, 0x80, 0x80, 0x80, 0x01}, 413)
+
+	// epochs which cannot be loaded are storage errors
+	prev := now - 3600000
+	edir := tmpdirp + strconv.FormatInt(prev*1e6, 10)
+	if err := os.MkdirAll(edir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(edir+"/meta.json", []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old := encodeRequest([]*TimeSeries{{
+		Labels:  []Label{{"__name__", "temp"}},
+		Samples: []Sample{{20, prev}},
+	}}, nil)
+
+	send("", snappy.Encode(nil, old), 500)
+
+	from := uint64(now) * 1e6
+	db.Fetch(from, from+60000000000, []string{"temp"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result", res)
+		}
+
+		if p := res[0].Series[0].Points[0]; p.Total != 40 || p.Count != 2 {
+			t.Fatal("wrong point", p)
+		}
+	})
+}
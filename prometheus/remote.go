@@ -0,0 +1,244 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Remote write messages are decoded by hand as only a few fields are used.
+// Unknown fields are skipped therefore newer versions can still be read.
+//
+//	message WriteRequest {
+//	  repeated TimeSeries timeseries = 1;
+//	  repeated MetricMetadata metadata = 3;
+//	}
+//
+//	message TimeSeries {
+//	  repeated Label labels = 1;
+//	  repeated Sample samples = 2;
+//	}
+//
+//	message Label {
+//	  string name = 1;
+//	  string value = 2;
+//	}
+//
+//	message Sample {
+//	  double value = 1;
+//	  int64 timestamp = 2;
+//	}
+//
+//	message MetricMetadata {
+//	  MetricType type = 1;
+//	  string metric_family_name = 2;
+//	}
+
+const (
+	// wire types used in remote write messages
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+
+	// metric types used in metadata (MetricMetadata.MetricType)
+	typeCounter = 1
+)
+
+var (
+	// ErrDecode is returned when a remote write message is not valid
+	ErrDecode = errors.New("invalid remote write message")
+)
+
+// Label is a label name and value pair
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value with a timestamp in milliseconds
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries has labels and samples of a series
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// WriteRequest is a remote write request with time series and
+// the set of metric family names which are known to be counters.
+type WriteRequest struct {
+	Series   []*TimeSeries
+	Counters map[string]bool
+}
+
+// Decode decodes an uncompressed remote write request
+func Decode(data []byte) (req *WriteRequest, err error) {
+	req = &WriteRequest{Counters: map[string]bool{}}
+
+	err = fields(data, func(num, wire int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireBytes:
+			s, err := decodeSeries(b)
+			if err != nil {
+				return err
+			}
+
+			req.Series = append(req.Series, s)
+		case num == 3 && wire == wireBytes:
+			return decodeMetadata(b, req.Counters)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func decodeSeries(data []byte) (s *TimeSeries, err error) {
+	s = &TimeSeries{}
+
+	err = fields(data, func(num, wire int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireBytes:
+			l := Label{}
+			err := fields(b, func(num, wire int, v uint64, b []byte) error {
+				switch {
+				case num == 1 && wire == wireBytes:
+					l.Name = string(b)
+				case num == 2 && wire == wireBytes:
+					l.Value = string(b)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			s.Labels = append(s.Labels, l)
+		case num == 2 && wire == wireBytes:
+			p := Sample{}
+			err := fields(b, func(num, wire int, v uint64, b []byte) error {
+				switch {
+				case num == 1 && wire == wireFixed64:
+					p.Value = math.Float64frombits(v)
+				case num == 2 && wire == wireVarint:
+					p.Timestamp = int64(v)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				return err
+			}
+
+			s.Samples = append(s.Samples, p)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func decodeMetadata(data []byte, counters map[string]bool) (err error) {
+	var typ uint64
+	var name string
+
+	err = fields(data, func(num, wire int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireVarint:
+			typ = v
+		case num == 2 && wire == wireBytes:
+			name = string(b)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if typ == typeCounter && name != "" {
+		counters[name] = true
+	}
+
+	return nil
+}
+
+// fields calls the function for each field in a protobuf message. Numeric
+// values are given with `v` and length delimited values are given with `b`.
+func fields(data []byte, fn func(num, wire int, v uint64, b []byte) error) (err error) {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrDecode
+		}
+
+		data = data[n:]
+		num := int(key >> 3)
+		wire := int(key & 0x7)
+
+		var v uint64
+		var b []byte
+
+		switch wire {
+		case wireVarint:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return ErrDecode
+			}
+
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return ErrDecode
+			}
+
+			v = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return ErrDecode
+			}
+
+			b = data[n : n+int(l)]
+			data = data[n+int(l):]
+		case wireFixed32:
+			if len(data) < 4 {
+				return ErrDecode
+			}
+
+			v = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return ErrDecode
+		}
+
+		if num <= 0 {
+			return ErrDecode
+		}
+
+		if err := fn(num, wire, v, b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// encoding helpers used to create remote write messages for tests
+
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	return append(b, buf[:n]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	return append(b, buf...)
+}
+
+func appendKey(b []byte, num, wire int) []byte {
+	return appendUvarint(b, uint64(num<<3|wire))
+}
+
+func appendBytes(b []byte, num int, v []byte) []byte {
+	b = appendKey(b, num, wireBytes)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func encodeSeries(s *TimeSeries) (b []byte) {
+	for _, l := range s.Labels {
+		var lb []byte
+		lb = appendBytes(lb, 1, []byte(l.Name))
+		lb = appendBytes(lb, 2, []byte(l.Value))
+		b = appendBytes(b, 1, lb)
+	}
+
+	for _, p := range s.Samples {
+		var pb []byte
+		pb = appendKey(pb, 1, wireFixed64)
+		pb = appendFixed64(pb, math.Float64bits(p.Value))
+		pb = appendKey(pb, 2, wireVarint)
+		pb = appendUvarint(pb, uint64(p.Timestamp))
+		b = appendBytes(b, 2, pb)
+	}
+
+	return b
+}
+
+func encodeRequest(series []*TimeSeries, counters []string) (b []byte) {
+	for _, s := range series {
+		b = appendBytes(b, 1, encodeSeries(s))
+	}
+
+	for _, name := range counters {
+		var mb []byte
+		mb = appendKey(mb, 1, wireVarint)
+		mb = appendUvarint(mb, typeCounter)
+		mb = appendBytes(mb, 2, []byte(name))
+		mb = appendBytes(mb, 4, []byte("help text"))
+		b = appendBytes(b, 3, mb)
+	}
+
+	return b
+}
+
+func TestDecode(t *testing.T) {
+	series := []*TimeSeries{
+		{
+			Labels:  []Label{{"__name__", "up"}, {"job", "api"}},
+			Samples: []Sample{{1, 1450000000000}, {0.5, 1450000015000}},
+		},
+		{
+			Labels:  []Label{{"__name__", "requests"}},
+			Samples: []Sample{{10, 1450000000000}},
+		},
+	}
+
+	data := encodeRequest(series, []string{"requests"})
+
+	// unknown fields must be skipped
+	data = appendKey(data, 9, wireFixed32)
+	data = append(data, 1, 2, 3, 4)
+
+	req, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(req.Series, series) {
+		t.Fatal("wrong series")
+	}
+
+	if !reflect.DeepEqual(req.Counters, map[string]bool{"requests": true}) {
+		t.Fatal("wrong counters")
+	}
+
+	// truncated messages must fail
+	if _, err := Decode(data[:len(data)-10]); err != ErrDecode {
+		t.Fatal("should fail with invalid data")
+	}
+}
@@ -0,0 +1,136 @@
+package query
+
+import (
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// Functions below create derived series from series with points `step`
+// nanoseconds apart. Points of derived series have the derived value as
+// the total with a count of 1 so that total/count gives the value. Points
+// which cannot be calculated due to missing data will have a zero count.
+// Given series are not modified.
+
+// Rate returns totals of points per second.
+func Rate(s *protocol.Series, step int64) (res *protocol.Series) {
+	res = derived(s)
+	secs := float64(step) / float64(time.Second)
+
+	for i, p := range s.Points {
+		if p.Count != 0 {
+			res.Points[i] = protocol.Point{Total: p.Total / secs, Count: 1}
+		}
+	}
+
+	return res
+}
+
+// Derivative returns the change of the value per second compared to the
+// previous point with data. The first point with data will not have a value.
+func Derivative(s *protocol.Series, step int64) (res *protocol.Series) {
+	res = derived(s)
+	secs := float64(step) / float64(time.Second)
+	prev := -1
+
+	for i, p := range s.Points {
+		if p.Count == 0 {
+			continue
+		}
+
+		if prev >= 0 {
+			q := s.Points[prev]
+			diff := p.Total/p.Count - q.Total/q.Count
+			res.Points[i] = protocol.Point{Total: diff / (float64(i-prev) * secs), Count: 1}
+		}
+
+		prev = i
+	}
+
+	return res
+}
+
+// CumSum returns the sum of values of all points up to each point.
+func CumSum(s *protocol.Series) (res *protocol.Series) {
+	res = derived(s)
+	sum := 0.0
+
+	for i, p := range s.Points {
+		if p.Count != 0 {
+			sum += p.Total / p.Count
+			res.Points[i] = protocol.Point{Total: sum, Count: 1}
+		}
+	}
+
+	return res
+}
+
+// MovingAvg returns the average value of points with data in a window of
+// `n` points ending with each point. Windows without data have no value.
+func MovingAvg(s *protocol.Series, n int) (res *protocol.Series) {
+	res = derived(s)
+	sum, count := 0.0, 0.0
+
+	for i, p := range s.Points {
+		if p.Count != 0 {
+			sum += p.Total / p.Count
+			count++
+		}
+
+		if j := i - n; j >= 0 && s.Points[j].Count != 0 {
+			q := s.Points[j]
+			sum -= q.Total / q.Count
+			count--
+		}
+
+		if count > 0 {
+			res.Points[i] = protocol.Point{Total: sum / count, Count: 1}
+		}
+	}
+
+	return res
+}
+
+// Scale returns values multiplied by a factor.
+func Scale(s *protocol.Series, factor float64) (res *protocol.Series) {
+	res = derived(s)
+
+	for i, p := range s.Points {
+		if p.Count != 0 {
+			res.Points[i] = protocol.Point{Total: p.Total / p.Count * factor, Count: 1}
+		}
+	}
+
+	return res
+}
+
+// Divide returns values of series `a` divided by values of series `b`.
+// Both series must have the same start and step. Points are matched by
+// their index and the result has fields of `a`. Points where either side
+// has no data or `b` has a zero value will not have a value.
+func Divide(a, b *protocol.Series) (res *protocol.Series) {
+	res = derived(a)
+
+	for i, p := range a.Points {
+		if i >= len(b.Points) {
+			break
+		}
+
+		q := b.Points[i]
+		if p.Count == 0 || q.Count == 0 || q.Total == 0 {
+			continue
+		}
+
+		res.Points[i] = protocol.Point{Total: (p.Total / p.Count) / (q.Total / q.Count), Count: 1}
+	}
+
+	return res
+}
+
+// derived creates an empty series with same fields and point count
+func derived(s *protocol.Series) (res *protocol.Series) {
+	return &protocol.Series{
+		Fields: append([]string{}, s.Fields...),
+		Points: make([]protocol.Point, len(s.Points)),
+	}
+}
@@ -0,0 +1,75 @@
+package query
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func series(points ...protocol.Point) *protocol.Series {
+	return &protocol.Series{Fields: []string{"a", "b"}, Points: points}
+}
+
+func TestRate(t *testing.T) {
+	s := series(protocol.Point{60, 2}, protocol.Point{}, protocol.Point{120, 1})
+	exp := series(protocol.Point{1, 1}, protocol.Point{}, protocol.Point{2, 1})
+
+	if res := Rate(s, int64(time.Minute)); !equal(res, exp) {
+		t.Fatal("wrong result", res)
+	}
+}
+
+func TestDerivative(t *testing.T) {
+	s := series(protocol.Point{}, protocol.Point{10, 1}, protocol.Point{}, protocol.Point{40, 2}, protocol.Point{50, 1})
+	exp := series(protocol.Point{}, protocol.Point{}, protocol.Point{}, protocol.Point{5, 1}, protocol.Point{30, 1})
+
+	if res := Derivative(s, int64(time.Second)); !equal(res, exp) {
+		t.Fatal("wrong result", res)
+	}
+}
+
+func TestCumSum(t *testing.T) {
+	s := series(protocol.Point{1, 1}, protocol.Point{}, protocol.Point{4, 2}, protocol.Point{3, 1})
+	exp := series(protocol.Point{1, 1}, protocol.Point{}, protocol.Point{3, 1}, protocol.Point{6, 1})
+
+	if res := CumSum(s); !equal(res, exp) {
+		t.Fatal("wrong result", res)
+	}
+}
+
+func TestMovingAvg(t *testing.T) {
+	s := series(protocol.Point{2, 1}, protocol.Point{8, 2}, protocol.Point{}, protocol.Point{}, protocol.Point{6, 1})
+	exp := series(protocol.Point{2, 1}, protocol.Point{3, 1}, protocol.Point{4, 1}, protocol.Point{}, protocol.Point{6, 1})
+
+	if res := MovingAvg(s, 2); !equal(res, exp) {
+		t.Fatal("wrong result", res)
+	}
+}
+
+func TestScale(t *testing.T) {
+	s := series(protocol.Point{4, 2}, protocol.Point{})
+	exp := series(protocol.Point{200, 1}, protocol.Point{})
+
+	if res := Scale(s, 100); !equal(res, exp) {
+		t.Fatal("wrong result", res)
+	}
+
+	if s.Points[0].Total != 4 {
+		t.Fatal("should not modify the series")
+	}
+}
+
+func TestDivide(t *testing.T) {
+	a := series(protocol.Point{6, 2}, protocol.Point{1, 1}, protocol.Point{}, protocol.Point{5, 1})
+	b := &protocol.Series{
+		Fields: []string{"c"},
+		Points: []protocol.Point{{12, 1}, {0, 1}, {1, 1}},
+	}
+
+	exp := series(protocol.Point{0.25, 1}, protocol.Point{}, protocol.Point{}, protocol.Point{})
+
+	if res := Divide(a, b); !equal(res, exp) {
+		t.Fatal("wrong result", res)
+	}
+}
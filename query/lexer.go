@@ -0,0 +1,65 @@
+package query
+
+import (
+	"strings"
+	"unicode"
+)
+
+// tokenKind is the type of a token
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenPipe
+)
+
+// token is a lexical token in a query with its position (1-based column)
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lex splits a query into tokens. Words are sequences of characters
+// other than whitespace, parentheses, commas and pipes. The last token is
+// always an EOF token positioned right after the end of the query.
+func lex(str string) (tokens []token) {
+	i := 0
+	for i < len(str) {
+		c := rune(str[i])
+
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i + 1})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i + 1})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{tokenComma, ",", i + 1})
+			i++
+		case c == '|':
+			tokens = append(tokens, token{tokenPipe, "|", i + 1})
+			i++
+		default:
+			end := strings.IndexFunc(str[i:], func(r rune) bool {
+				return unicode.IsSpace(r) || r == '(' || r == ')' || r == ',' || r == '|'
+			})
+
+			if end < 0 {
+				end = len(str) - i
+			}
+
+			tokens = append(tokens, token{tokenWord, str[i : i+end], i + 1})
+			i += end
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "", len(str) + 1})
+}
@@ -0,0 +1,47 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tokens := lex("sum by (2, 3) of a.*.b\tfrom -6h")
+	exp := []token{
+		{tokenWord, "sum", 1},
+		{tokenWord, "by", 5},
+		{tokenLParen, "(", 8},
+		{tokenWord, "2", 9},
+		{tokenComma, ",", 10},
+		{tokenWord, "3", 12},
+		{tokenRParen, ")", 13},
+		{tokenWord, "of", 15},
+		{tokenWord, "a.*.b", 18},
+		{tokenWord, "from", 24},
+		{tokenWord, "-6h", 29},
+		{tokenEOF, "", 32},
+	}
+
+	if !reflect.DeepEqual(tokens, exp) {
+		t.Fatal("wrong tokens", tokens)
+	}
+
+	tokens = lex("a|rate |scale 2")
+	exp = []token{
+		{tokenWord, "a", 1},
+		{tokenPipe, "|", 2},
+		{tokenWord, "rate", 3},
+		{tokenPipe, "|", 8},
+		{tokenWord, "scale", 9},
+		{tokenWord, "2", 15},
+		{tokenEOF, "", 16},
+	}
+
+	if !reflect.DeepEqual(tokens, exp) {
+		t.Fatal("wrong tokens", tokens)
+	}
+
+	if tokens := lex("  "); len(tokens) != 1 || tokens[0] != (token{tokenEOF, "", 3}) {
+		t.Fatal("wrong tokens", tokens)
+	}
+}
@@ -0,0 +1,312 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+// SyntaxError is returned when a query cannot be parsed.
+// Pos is the 1-based column where the error was found.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// parser parses a list of tokens into a query
+type parser struct {
+	tokens []token
+	next   int
+	now    time.Time
+}
+
+// Parse parses a query string. Relative times in the query are calculated
+// from `now`. The query syntax is:
+//
+//	[AGG [by (N, ...)] of] PATTERN from TIME [to TIME] [step DURATION] [| FUNC ...]
+//
+// AGG is one of sum, avg, min, max or count. Series are grouped by field
+// values at given 1-based positions of the pattern (all series are merged
+// into one if "by" is not given). PATTERN is a dot separated list of index
+// fields where "*" matches any value. TIME can be "now", a relative time
+// ("-6h", "now-1d"), an RFC3339 timestamp or unix time in nanoseconds.
+// The end of the range defaults to "now".
+//
+// Functions are applied to all result series in given order (see Stage).
+//
+//	sum by (2) of app.*.latency from -6h to now step 5m
+//	sum by (2) of app.*.errors from -1d step 1h | divide app.*.requests | scale 100
+func Parse(str string, now time.Time) (q *Query, err error) {
+	p := &parser{tokens: lex(str), now: now}
+	return p.parse()
+}
+
+func (p *parser) parse() (q *Query, err error) {
+	q = &Query{}
+
+	first := p.peek()
+	if first.kind == tokenWord && isAgg(first.text) {
+		if kw := p.tokens[p.next+1]; kw.kind == tokenWord && (kw.text == "by" || kw.text == "of") {
+			q.Agg = Agg(first.text)
+			p.next++
+
+			if kw.text == "by" {
+				p.next++
+				if q.By, err = p.parseBy(); err != nil {
+					return nil, err
+				}
+			}
+
+			if _, err := p.expect("of"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if q.Fields, err = p.parsePattern(q.By); err != nil {
+		return nil, err
+	}
+
+	if _, err := p.expect("from"); err != nil {
+		return nil, err
+	}
+
+	from, err := p.parseTime()
+	if err != nil {
+		return nil, err
+	}
+
+	to, end := p.now, p.peek()
+	if end.kind == tokenWord && end.text == "to" {
+		p.next++
+		end = p.peek()
+		if to, err = p.parseTime(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !from.Before(to) {
+		return nil, &SyntaxError{end.pos, "end of the time range must be after the start"}
+	}
+
+	q.From = uint64(from.UnixNano())
+	q.To = uint64(to.UnixNano())
+
+	if tk := p.peek(); tk.kind == tokenWord && tk.text == "step" {
+		p.next++
+		st, err := p.word("a duration")
+		if err != nil {
+			return nil, err
+		}
+
+		d, err := ParseDuration(st.text)
+		if err != nil || d <= 0 {
+			return nil, &SyntaxError{st.pos, "invalid step " + strconv.Quote(st.text)}
+		}
+
+		q.Step = int64(d)
+	}
+
+	for p.peek().kind == tokenPipe {
+		p.next++
+		st, err := p.parseStage(q.By)
+		if err != nil {
+			return nil, err
+		}
+
+		q.Stages = append(q.Stages, st)
+	}
+
+	if tk := p.peek(); tk.kind != tokenEOF {
+		return nil, &SyntaxError{tk.pos, "unexpected " + strconv.Quote(tk.text)}
+	}
+
+	return q, nil
+}
+
+// parsePattern parses a field pattern which must have
+// fields at all positions used to group series.
+func (p *parser) parsePattern(by []int) (fields []string, err error) {
+	tk, err := p.word("a field pattern")
+	if err != nil {
+		return nil, err
+	}
+
+	fields = strings.Split(tk.text, ".")
+	for _, f := range fields {
+		if f == "" {
+			return nil, &SyntaxError{tk.pos, "empty field in pattern " + strconv.Quote(tk.text)}
+		}
+	}
+
+	for _, n := range by {
+		if n > len(fields) {
+			return nil, &SyntaxError{tk.pos, fmt.Sprintf("pattern has no field at position %d", n)}
+		}
+	}
+
+	return fields, nil
+}
+
+// parseStage parses a function name and its arguments
+func (p *parser) parseStage(by []int) (st *Stage, err error) {
+	tk, err := p.word("a function")
+	if err != nil {
+		return nil, err
+	}
+
+	st = &Stage{Func: tk.text}
+
+	switch st.Func {
+	case FuncRate, FuncDerivative, FuncCumSum:
+	case FuncMovingAvg:
+		arg, err := p.word("a window size")
+		if err != nil {
+			return nil, err
+		}
+
+		if st.N, err = strconv.Atoi(arg.text); err != nil || st.N < 1 {
+			return nil, &SyntaxError{arg.pos, "invalid window size " + strconv.Quote(arg.text)}
+		}
+	case FuncScale:
+		arg, err := p.word("a factor")
+		if err != nil {
+			return nil, err
+		}
+
+		if st.Factor, err = strconv.ParseFloat(arg.text, 64); err != nil {
+			return nil, &SyntaxError{arg.pos, "invalid factor " + strconv.Quote(arg.text)}
+		}
+	case FuncDivide:
+		if st.Fields, err = p.parsePattern(by); err != nil {
+			return nil, err
+		}
+	case FuncFill:
+		arg, err := p.word("a fill mode")
+		if err != nil {
+			return nil, err
+		}
+
+		switch arg.text {
+		case "null":
+			st.Fill = kadiyadb.FillNull
+		case "zero":
+			st.Fill = kadiyadb.FillZero
+		case "previous":
+			st.Fill = kadiyadb.FillPrevious
+		case "linear":
+			st.Fill = kadiyadb.FillLinear
+		default:
+			return nil, &SyntaxError{arg.pos, "invalid fill mode " + strconv.Quote(arg.text)}
+		}
+	default:
+		return nil, &SyntaxError{tk.pos, "unknown function " + strconv.Quote(tk.text)}
+	}
+
+	return st, nil
+}
+
+// parseBy parses a parenthesized list of field positions
+func (p *parser) parseBy() (by []int, err error) {
+	if tk := p.take(); tk.kind != tokenLParen {
+		return nil, p.unexpected(tk, `"("`)
+	}
+
+	for {
+		tk, err := p.word("a field position")
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := strconv.Atoi(tk.text)
+		if err != nil || n < 1 {
+			return nil, &SyntaxError{tk.pos, "invalid field position " + strconv.Quote(tk.text)}
+		}
+
+		by = append(by, n)
+
+		switch tk := p.take(); tk.kind {
+		case tokenComma:
+		case tokenRParen:
+			return by, nil
+		default:
+			return nil, p.unexpected(tk, `"," or ")"`)
+		}
+	}
+}
+
+// parseTime parses the next word as a time value
+func (p *parser) parseTime() (t time.Time, err error) {
+	tk, err := p.word("a time")
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	t, err = ParseTime(tk.text, p.now)
+	if err != nil || t.UnixNano() < 0 {
+		return time.Time{}, &SyntaxError{tk.pos, "invalid time " + strconv.Quote(tk.text)}
+	}
+
+	return t, nil
+}
+
+// expect consumes the next token which must be the given keyword
+func (p *parser) expect(kw string) (tk token, err error) {
+	tk = p.take()
+	if tk.kind != tokenWord || tk.text != kw {
+		return tk, p.unexpected(tk, strconv.Quote(kw))
+	}
+
+	return tk, nil
+}
+
+// word consumes the next token which must be a word
+func (p *parser) word(what string) (tk token, err error) {
+	tk = p.take()
+	if tk.kind != tokenWord {
+		return tk, p.unexpected(tk, what)
+	}
+
+	return tk, nil
+}
+
+// unexpected creates a syntax error for an unexpected token
+func (p *parser) unexpected(tk token, what string) (err error) {
+	if tk.kind == tokenEOF {
+		return &SyntaxError{tk.pos, "expected " + what + " but found end of query"}
+	}
+
+	return &SyntaxError{tk.pos, "expected " + what + " but found " + strconv.Quote(tk.text)}
+}
+
+// peek returns the next token without consuming it
+func (p *parser) peek() (tk token) {
+	return p.tokens[p.next]
+}
+
+// take consumes the next token. The EOF token is never consumed.
+func (p *parser) take() (tk token) {
+	tk = p.tokens[p.next]
+	if tk.kind != tokenEOF {
+		p.next++
+	}
+
+	return tk
+}
+
+// isAgg checks whether a word is a known aggregation
+func isAgg(str string) bool {
+	switch Agg(str) {
+	case Sum, Avg, Min, Max, Count:
+		return true
+	}
+
+	return false
+}
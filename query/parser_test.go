@@ -0,0 +1,113 @@
+package query
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Unix(1450000000, 0)
+	ns := func(d time.Duration) uint64 {
+		return uint64(now.Add(d).UnixNano())
+	}
+
+	valid := map[string]*Query{
+		"sum by (2) of app.*.latency from -6h to now step 5m": {
+			Agg:    Sum,
+			By:     []int{2},
+			Fields: []string{"app", "*", "latency"},
+			From:   ns(-6 * time.Hour),
+			To:     ns(0),
+			Step:   int64(5 * time.Minute),
+		},
+		"max of a.b from now-1d": {
+			Agg:    Max,
+			Fields: []string{"a", "b"},
+			From:   ns(-24 * time.Hour),
+			To:     ns(0),
+		},
+		"count by (1,2) of *.* from -2h to -1h": {
+			Agg:    Count,
+			By:     []int{1, 2},
+			Fields: []string{"*", "*"},
+			From:   ns(-2 * time.Hour),
+			To:     ns(-time.Hour),
+		},
+		"sum by (2) of a.*.errors from -1h | divide a.*.requests|scale 100 | movavg 3 | rate | fill linear": {
+			Agg:    Sum,
+			By:     []int{2},
+			Fields: []string{"a", "*", "errors"},
+			From:   ns(-time.Hour),
+			To:     ns(0),
+			Stages: []*Stage{
+				{Func: FuncDivide, Fields: []string{"a", "*", "requests"}},
+				{Func: FuncScale, Factor: 100},
+				{Func: FuncMovingAvg, N: 3},
+				{Func: FuncRate},
+				{Func: FuncFill, Fill: kadiyadb.FillLinear},
+			},
+		},
+		// "sum" is a pattern here as it's not followed by "by" or "of"
+		"sum from -1h step 1m": {
+			Fields: []string{"sum"},
+			From:   ns(-time.Hour),
+			To:     ns(0),
+			Step:   int64(time.Minute),
+		},
+	}
+
+	for str, exp := range valid {
+		q, err := Parse(str, now)
+		if err != nil {
+			t.Fatal(str, err)
+		}
+
+		if !reflect.DeepEqual(q, exp) {
+			t.Fatal("wrong query", str, q)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	now := time.Unix(1450000000, 0)
+
+	invalid := map[string]SyntaxError{
+		"":                                      {1, "expected a field pattern but found end of query"},
+		"sum by 2 of a from -1h":                {8, `expected "(" but found "2"`},
+		"sum by (2 of a from -1h":               {11, `expected "," or ")" but found "of"`},
+		"sum by (0) of a from -1h":              {9, `invalid field position "0"`},
+		"sum by (3) of a.b from -1h":            {15, "pattern has no field at position 3"},
+		"sum by (1) a from -1h":                 {12, `expected "of" but found "a"`},
+		"a..b from -1h":                         {1, `empty field in pattern "a..b"`},
+		"a.b":                                   {4, `expected "from" but found end of query`},
+		"a.b from":                              {9, "expected a time but found end of query"},
+		"a.b from yesterday":                    {10, `invalid time "yesterday"`},
+		"a.b from -1h to -2h":                   {17, "end of the time range must be after the start"},
+		"a.b from -1h step 0s":                  {19, `invalid step "0s"`},
+		"a.b from -1h step 1m extra":            {22, `unexpected "extra"`},
+		"a.b from -1h to now step 1m )":         {29, `unexpected ")"`},
+		"a.b from -1h |":                        {15, "expected a function but found end of query"},
+		"a.b from -1h | avg":                    {16, `unknown function "avg"`},
+		"a.b from -1h | movavg 0":               {23, `invalid window size "0"`},
+		"a.b from -1h | scale x":                {22, `invalid factor "x"`},
+		"sum by (2) of a.b from -1h | divide c": {37, "pattern has no field at position 2"},
+		"a.b from -1h | fill nope":              {21, `invalid fill mode "nope"`},
+		"a.b from -1h | rate 5":                 {21, `unexpected "5"`},
+	}
+
+	for str, exp := range invalid {
+		_, err := Parse(str, now)
+		serr, ok := err.(*SyntaxError)
+		if !ok || *serr != exp {
+			t.Fatal("wrong error", str, err)
+		}
+	}
+
+	err := &SyntaxError{5, "oops"}
+	if err.Error() != "syntax error at position 5: oops" {
+		t.Fatal("wrong message", err.Error())
+	}
+}
@@ -0,0 +1,371 @@
+// Package query parses text queries and runs them on kadiyadb databases.
+// Queries select series with an index field pattern and a time range and
+// can group and aggregate matching series (see Parse for the syntax).
+package query
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// Agg is an aggregation applied to series matching a query
+type Agg string
+
+const (
+	// Sum sums up totals and counts of all series in a group
+	Sum Agg = "sum"
+
+	// Avg averages values (total/count) of series in a group
+	Avg Agg = "avg"
+
+	// Min picks the lowest value (total/count) of series in a group
+	Min Agg = "min"
+
+	// Max picks the highest value (total/count) of series in a group
+	Max Agg = "max"
+
+	// Count counts series with data in a group
+	Count Agg = "count"
+)
+
+const (
+	// FuncRate converts totals to totals per second (see Rate)
+	FuncRate = "rate"
+
+	// FuncDerivative calculates change per second (see Derivative)
+	FuncDerivative = "derivative"
+
+	// FuncCumSum calculates cumulative sums (see CumSum)
+	FuncCumSum = "cumsum"
+
+	// FuncMovingAvg calculates moving averages (see MovingAvg)
+	FuncMovingAvg = "movavg"
+
+	// FuncScale multiplies values by a factor (see Scale)
+	FuncScale = "scale"
+
+	// FuncDivide divides values by values of other series (see Divide)
+	FuncDivide = "divide"
+
+	// FuncFill fills points without data (see kadiyadb.Fill)
+	FuncFill = "fill"
+)
+
+var (
+	// ErrInvAgg is returned when the query has an unknown aggregation
+	ErrInvAgg = errors.New("invalid aggregation")
+
+	// ErrInvFunc is returned when the query has an unknown function
+	ErrInvFunc = errors.New("invalid function")
+)
+
+// Query is a parsed query. Queries are usually created with Parse.
+type Query struct {
+	// Agg is the aggregation (no aggregation if empty)
+	Agg Agg
+
+	// By has 1-based positions of fields used to group series
+	By []int
+
+	// Fields is the index field pattern
+	Fields []string
+
+	// From and To is the time range in nanoseconds
+	From, To uint64
+
+	// Step is the time between points of the result in nanoseconds. The
+	// coarsest resolution of fetched chunks is used if it's zero.
+	Step int64
+
+	// Stages are functions applied to result series in order
+	Stages []*Stage
+}
+
+// Stage is a function applied to all series of a query result.
+type Stage struct {
+	// Func is the name of the function (one of Func* constants)
+	Func string
+
+	// N is the window size in points for FuncMovingAvg
+	N int
+
+	// Factor is the multiplier for FuncScale
+	Factor float64
+
+	// Fill is the fill mode for FuncFill
+	Fill kadiyadb.FillMode
+
+	// Fields is the divisor field pattern for FuncDivide. Divisor series
+	// are fetched, grouped and aggregated the same way as the query. Result
+	// series are divided by the divisor series with the same fields, or by
+	// the only divisor series if both sides have a single series. Series
+	// without a matching divisor series are removed from the result.
+	Fields []string
+}
+
+// Run fetches data for the query from the database and returns a single
+// chunk with points `Step` apart. Without an aggregation, the chunk has all
+// matching series. With an aggregation, the chunk has a series per group.
+// Values of aggregated points are total/count as with any other point and
+// points without data in any series of a group will have a zero count.
+// Series in the result are sorted by their fields. Stages are applied last.
+func (q *Query) Run(db *kadiyadb.DB) (res *protocol.Chunk, err error) {
+	if q.Agg != "" && !isAgg(string(q.Agg)) {
+		return nil, ErrInvAgg
+	}
+
+	for _, st := range q.Stages {
+		if !st.valid() {
+			return nil, ErrInvFunc
+		}
+	}
+
+	if res, err = q.fetch(db); err != nil {
+		return nil, err
+	}
+
+	for _, st := range q.Stages {
+		if res.Series, err = st.apply(db, q, res); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// fetch fetches, resamples and aggregates series without applying stages
+func (q *Query) fetch(db *kadiyadb.DB) (res *protocol.Chunk, err error) {
+	db.Fetch(q.From, q.To, q.Fields, func(chunks []*protocol.Chunk, ferr error) {
+		if ferr != nil {
+			err = ferr
+			return
+		}
+
+		step := q.Step
+		if step == 0 {
+			step = coarsest(chunks)
+		}
+
+		// Resample also copies data so the result can be
+		// used after returning from the fetch handler.
+		res, err = kadiyadb.Resample(chunks, step)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res == nil {
+		res = &protocol.Chunk{From: q.From, To: q.To, Series: []*protocol.Series{}}
+		return res, nil
+	}
+
+	if q.Agg != "" {
+		res.Series = q.aggregate(res.Series)
+	}
+
+	sort.Sort(byFields(res.Series))
+
+	return res, nil
+}
+
+// aggregate groups series and applies the aggregation to each group
+func (q *Query) aggregate(series []*protocol.Series) (res []*protocol.Series) {
+	res = []*protocol.Series{}
+	groups := map[string]*protocol.Series{}
+
+	for _, s := range series {
+		fields := q.Fields
+		if len(q.By) > 0 {
+			fields = make([]string, len(q.By))
+			for i, n := range q.By {
+				if n <= len(s.Fields) {
+					fields[i] = s.Fields[n-1]
+				}
+			}
+		}
+
+		key := strings.Join(fields, "\x00")
+		g, ok := groups[key]
+		if !ok {
+			g = &protocol.Series{
+				Fields: append([]string{}, fields...),
+				Points: make([]protocol.Point, len(s.Points)),
+			}
+
+			groups[key] = g
+			res = append(res, g)
+		}
+
+		for i, p := range s.Points {
+			q.merge(&g.Points[i], p)
+		}
+	}
+
+	return res
+}
+
+// merge merges a point of a series into the aggregated point
+func (q *Query) merge(a *protocol.Point, p protocol.Point) {
+	if q.Agg == Sum {
+		a.Total += p.Total
+		a.Count += p.Count
+		return
+	}
+
+	if p.Count == 0 {
+		return
+	}
+
+	v := p.Total / p.Count
+
+	switch q.Agg {
+	case Avg:
+		a.Total += v
+		a.Count++
+	case Min:
+		if a.Count == 0 || v < a.Total {
+			a.Total, a.Count = v, 1
+		}
+	case Max:
+		if a.Count == 0 || v > a.Total {
+			a.Total, a.Count = v, 1
+		}
+	case Count:
+		a.Total++
+		a.Count = 1
+	}
+}
+
+// valid checks whether the stage has a known function and valid arguments
+func (st *Stage) valid() bool {
+	switch st.Func {
+	case FuncRate, FuncDerivative, FuncCumSum, FuncScale:
+		return true
+	case FuncMovingAvg:
+		return st.N > 0
+	case FuncDivide:
+		return len(st.Fields) > 0
+	case FuncFill:
+		return st.Fill >= kadiyadb.FillNull && st.Fill <= kadiyadb.FillLinear
+	}
+
+	return false
+}
+
+// apply applies the stage function to all series of a query result
+func (st *Stage) apply(db *kadiyadb.DB, q *Query, c *protocol.Chunk) (res []*protocol.Series, err error) {
+	if len(c.Series) == 0 {
+		return c.Series, nil
+	}
+
+	step := int64(c.To-c.From) / int64(len(c.Series[0].Points))
+
+	switch st.Func {
+	case FuncDivide:
+		return st.divide(db, q, c, step)
+	case FuncFill:
+		return kadiyadb.Fill([]*protocol.Chunk{c}, st.Fill)[0].Series, nil
+	}
+
+	res = make([]*protocol.Series, 0, len(c.Series))
+	for _, s := range c.Series {
+		switch st.Func {
+		case FuncRate:
+			s = Rate(s, step)
+		case FuncDerivative:
+			s = Derivative(s, step)
+		case FuncCumSum:
+			s = CumSum(s)
+		case FuncMovingAvg:
+			s = MovingAvg(s, st.N)
+		case FuncScale:
+			s = Scale(s, st.Factor)
+		}
+
+		res = append(res, s)
+	}
+
+	return res, nil
+}
+
+// divide fetches divisor series and divides matching result series
+func (st *Stage) divide(db *kadiyadb.DB, q *Query, c *protocol.Chunk, step int64) (res []*protocol.Series, err error) {
+	dq := &Query{
+		Agg:    q.Agg,
+		By:     q.By,
+		Fields: st.Fields,
+		From:   c.From,
+		To:     c.To,
+		Step:   step,
+	}
+
+	dc, err := dq.fetch(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Series) == 1 && len(dc.Series) == 1 {
+		return []*protocol.Series{Divide(c.Series[0], dc.Series[0])}, nil
+	}
+
+	divisors := make(map[string]*protocol.Series, len(dc.Series))
+	for _, s := range dc.Series {
+		divisors[strings.Join(s.Fields, "\x00")] = s
+	}
+
+	res = []*protocol.Series{}
+	for _, s := range c.Series {
+		if d, ok := divisors[strings.Join(s.Fields, "\x00")]; ok {
+			res = append(res, Divide(s, d))
+		}
+	}
+
+	return res, nil
+}
+
+// byFields sorts series by their fields
+type byFields []*protocol.Series
+
+func (s byFields) Len() int      { return len(s) }
+func (s byFields) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byFields) Less(i, j int) bool {
+	a, b := s[i].Fields, s[j].Fields
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+
+	return len(a) < len(b)
+}
+
+// coarsest returns the lowest common multiple of resolutions of all chunks
+// which is the smallest step all chunks can be resampled to.
+func coarsest(chunks []*protocol.Chunk) (step int64) {
+	step = 1
+	for _, c := range chunks {
+		for _, s := range c.Series {
+			if n := int64(len(s.Points)); n > 0 {
+				res := int64(c.To-c.From) / n
+				step = step / gcd(step, res) * res
+				break
+			}
+		}
+	}
+
+	return step
+}
+
+// gcd returns the greatest common divisor of two positive integers
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
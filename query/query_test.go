@@ -0,0 +1,216 @@
+package query
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+const (
+	dir = "/tmp/test-query"
+)
+
+func setup(t *testing.T) (db *kadiyadb.DB, now time.Time) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kadiyadb.Open(dir, &kadiyadb.Params{
+		Duration:    int64(time.Hour),
+		Resolution:  int64(time.Minute),
+		Retention:   int64(24 * time.Hour),
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two points (one minute apart) for 3 series from the start of the hour
+	data := []struct {
+		fields       []string
+		total, count float64
+	}{
+		{[]string{"app", "a", "latency"}, 10, 1},
+		{[]string{"app", "a", "latency"}, 30, 1},
+		{[]string{"app", "b", "latency"}, 40, 2},
+		{[]string{"web", "c", "latency"}, 5, 1},
+	}
+
+	base := uint64(time.Now().UnixNano())
+	base -= base % uint64(time.Hour)
+	for i := uint64(0); i < 2; i++ {
+		for _, d := range data {
+			ts := base + i*uint64(time.Minute)
+			if err := db.Track(ts, d.fields, d.total, d.count); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// queries are run as if it's 2 minutes after the start of the hour
+	return db, time.Unix(0, int64(base)).Add(2 * time.Minute)
+}
+
+func run(t *testing.T, db *kadiyadb.DB, now time.Time, str string) (c *protocol.Chunk) {
+	q, err := Parse(str, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = q.Run(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func TestRun(t *testing.T) {
+	db, now := setup(t)
+	defer os.RemoveAll(dir)
+	defer db.Close()
+
+	rng := " from -2m to now"
+
+	cases := map[string][]*protocol.Series{
+		"*.*.latency" + rng: {
+			{Fields: []string{"app", "a", "latency"}, Points: []protocol.Point{{40, 2}, {40, 2}}},
+			{Fields: []string{"app", "b", "latency"}, Points: []protocol.Point{{40, 2}, {40, 2}}},
+			{Fields: []string{"web", "c", "latency"}, Points: []protocol.Point{{5, 1}, {5, 1}}},
+		},
+		"sum of *.*.latency" + rng + " step 2m": {
+			{Fields: []string{"*", "*", "latency"}, Points: []protocol.Point{{170, 10}}},
+		},
+		"sum by (1) of *.*.latency" + rng: {
+			{Fields: []string{"app"}, Points: []protocol.Point{{80, 4}, {80, 4}}},
+			{Fields: []string{"web"}, Points: []protocol.Point{{5, 1}, {5, 1}}},
+		},
+		"avg by (1) of *.*.latency" + rng: {
+			{Fields: []string{"app"}, Points: []protocol.Point{{40, 2}, {40, 2}}},
+			{Fields: []string{"web"}, Points: []protocol.Point{{5, 1}, {5, 1}}},
+		},
+		"min of *.*.latency" + rng: {
+			{Fields: []string{"*", "*", "latency"}, Points: []protocol.Point{{5, 1}, {5, 1}}},
+		},
+		"max by (3) of app.*.latency" + rng: {
+			{Fields: []string{"latency"}, Points: []protocol.Point{{20, 1}, {20, 1}}},
+		},
+		"count by (1) of *.*.latency" + rng: {
+			{Fields: []string{"app"}, Points: []protocol.Point{{2, 1}, {2, 1}}},
+			{Fields: []string{"web"}, Points: []protocol.Point{{1, 1}, {1, 1}}},
+		},
+	}
+
+	for str, exp := range cases {
+		c := run(t, db, now, str)
+		if len(c.Series) != len(exp) {
+			t.Fatal("wrong series count", str, c.Series)
+		}
+
+		for i, s := range c.Series {
+			if !equal(s, exp[i]) {
+				t.Fatal("wrong series", str, s, exp[i])
+			}
+		}
+	}
+
+	// points without data in the range have zero counts
+	c := run(t, db, now, "sum of *.*.latency from -2m to now+1m")
+	if len(c.Series) != 1 || len(c.Series[0].Points) != 3 || c.Series[0].Points[2].Count != 0 {
+		t.Fatal("wrong result", c.Series)
+	}
+
+	// no matching series
+	c = run(t, db, now, "sum of none from -2m")
+	if len(c.Series) != 0 {
+		t.Fatal("should not have series")
+	}
+
+	// step must be a multiple of the resolution
+	q, err := Parse("*.*.latency from -2m step 90s", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.Run(db); err != kadiyadb.ErrInvStep {
+		t.Fatal("should return an error", err)
+	}
+
+	q.Agg = "median"
+	if _, err := q.Run(db); err != ErrInvAgg {
+		t.Fatal("should return an error", err)
+	}
+}
+
+func TestRunStages(t *testing.T) {
+	db, now := setup(t)
+	defer os.RemoveAll(dir)
+	defer db.Close()
+
+	cases := map[string][]*protocol.Series{
+		"app.a.latency from -2m to now | rate": {
+			{Fields: []string{"app", "a", "latency"}, Points: []protocol.Point{{40.0 / 60, 1}, {40.0 / 60, 1}}},
+		},
+		"sum by (1) of *.*.latency from -2m to now | divide *.*.latency": {
+			{Fields: []string{"app"}, Points: []protocol.Point{{1, 1}, {1, 1}}},
+			{Fields: []string{"web"}, Points: []protocol.Point{{1, 1}, {1, 1}}},
+		},
+		"sum by (1) of app.*.latency from -2m to now | divide *.*.latency": {
+			{Fields: []string{"app"}, Points: []protocol.Point{{1, 1}, {1, 1}}},
+		},
+		"sum of *.*.latency from -2m to now+1m | fill previous": {
+			{Fields: []string{"*", "*", "latency"}, Points: []protocol.Point{{85, 5}, {85, 5}, {17, 1}}},
+		},
+		"sum of app.*.latency from -2m to now | divide web.*.latency | scale 0.5 | cumsum": {
+			{Fields: []string{"app", "*", "latency"}, Points: []protocol.Point{{2, 1}, {4, 1}}},
+		},
+	}
+
+	for str, exp := range cases {
+		c := run(t, db, now, str)
+		if len(c.Series) != len(exp) {
+			t.Fatal("wrong series count", str, c.Series)
+		}
+
+		for i, s := range c.Series {
+			if !equal(s, exp[i]) {
+				t.Fatal("wrong series", str, s, exp[i])
+			}
+		}
+	}
+
+	q, err := Parse("*.*.latency from -2m", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Stages = []*Stage{{Func: FuncMovingAvg}}
+	if _, err := q.Run(db); err != ErrInvFunc {
+		t.Fatal("should return an error", err)
+	}
+}
+
+func equal(a, b *protocol.Series) bool {
+	if len(a.Fields) != len(b.Fields) || len(a.Points) != len(b.Points) {
+		return false
+	}
+
+	for i := range a.Fields {
+		if a.Fields[i] != b.Fields[i] {
+			return false
+		}
+	}
+
+	for i := range a.Points {
+		if a.Points[i] != b.Points[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,130 @@
+package query
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvTime is returned when a time value cannot be parsed
+	ErrInvTime = errors.New("invalid time")
+
+	// ErrInvDuration is returned when a duration cannot be parsed
+	ErrInvDuration = errors.New("invalid duration")
+
+	// ErrInvRange is returned when a time range cannot be parsed
+	ErrInvRange = errors.New("invalid time range")
+)
+
+// ParseDuration parses a duration. In addition to units supported by
+// time.ParseDuration, "d" (24 hours) and "w" (7 days) can be used.
+func ParseDuration(str string) (d time.Duration, err error) {
+	neg := false
+	if str != "" && (str[0] == '-' || str[0] == '+') {
+		neg = str[0] == '-'
+		str = str[1:]
+	}
+
+	if str == "" || str[0] == '-' || str[0] == '+' {
+		return 0, ErrInvDuration
+	}
+
+	for str != "" {
+		i := strings.IndexAny(str, "dw")
+		if i < 0 {
+			part, err := time.ParseDuration(str)
+			if err != nil {
+				return 0, ErrInvDuration
+			}
+
+			d += part
+			break
+		}
+
+		// "d" and "w" are the largest units so they must come first
+		// (e.g. "1d12h"). The number before it must be an integer.
+		n, err := strconv.ParseInt(str[:i], 10, 64)
+		if err != nil || n < 0 {
+			return 0, ErrInvDuration
+		}
+
+		unit := 24 * time.Hour
+		if str[i] == 'w' {
+			unit *= 7
+		}
+
+		d += time.Duration(n) * unit
+		str = str[i+1:]
+	}
+
+	if neg {
+		d = -d
+	}
+
+	return d, nil
+}
+
+// ParseTime parses a time value relative to given current time.
+// Supported formats are "now", "now-6h", "-6h", "now+1h", RFC3339
+// timestamps and integer unix timestamps in nanoseconds.
+func ParseTime(str string, now time.Time) (t time.Time, err error) {
+	switch {
+	case str == "now":
+		return now, nil
+	case strings.HasPrefix(str, "now"):
+		d, err := ParseDuration(str[3:])
+		if err != nil || (str[3] != '-' && str[3] != '+') {
+			return time.Time{}, ErrInvTime
+		}
+
+		return now.Add(d), nil
+	case strings.HasPrefix(str, "-"):
+		d, err := ParseDuration(str)
+		if err != nil {
+			return time.Time{}, ErrInvTime
+		}
+
+		return now.Add(d), nil
+	}
+
+	if ns, err := strconv.ParseInt(str, 10, 64); err == nil && ns >= 0 {
+		return time.Unix(0, ns), nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, str); err == nil {
+		return t, nil
+	}
+
+	return time.Time{}, ErrInvTime
+}
+
+// ParseRange parses a time range in "FROM..TO" format where both ends can
+// use any format supported by ParseTime (e.g. "-24h..now"). The end of the
+// range defaults to now if it's omitted ("-24h.."). Returned timestamps are
+// in nanoseconds and the start of the range must be before the end.
+func ParseRange(str string, now time.Time) (from, to uint64, err error) {
+	i := strings.Index(str, "..")
+	if i < 0 {
+		return 0, 0, ErrInvRange
+	}
+
+	start, err := ParseTime(str[:i], now)
+	if err != nil {
+		return 0, 0, ErrInvRange
+	}
+
+	end := now
+	if str[i+2:] != "" {
+		if end, err = ParseTime(str[i+2:], now); err != nil {
+			return 0, 0, ErrInvRange
+		}
+	}
+
+	if start.UnixNano() < 0 || !start.Before(end) {
+		return 0, 0, ErrInvRange
+	}
+
+	return uint64(start.UnixNano()), uint64(end.UnixNano()), nil
+}
@@ -0,0 +1,83 @@
+package query
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	valid := map[string]time.Duration{
+		"5m":     5 * time.Minute,
+		"1h30m":  90 * time.Minute,
+		"2d":     48 * time.Hour,
+		"1w":     7 * 24 * time.Hour,
+		"1w2d3h": 9*24*time.Hour + 3*time.Hour,
+		"-6h":    -6 * time.Hour,
+		"+1d":    24 * time.Hour,
+	}
+
+	for str, exp := range valid {
+		if d, err := ParseDuration(str); err != nil || d != exp {
+			t.Fatal("wrong duration", str, d, err)
+		}
+	}
+
+	for _, str := range []string{"", "-", "x", "1x", "1.5d", "d", "1h2d", "--1h"} {
+		if _, err := ParseDuration(str); err != ErrInvDuration {
+			t.Fatal("should fail", str)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Unix(1450000000, 0)
+
+	valid := map[string]time.Time{
+		"now":                  now,
+		"now-6h":               now.Add(-6 * time.Hour),
+		"now+1d":               now.Add(24 * time.Hour),
+		"-30m":                 now.Add(-30 * time.Minute),
+		"1449999000000000000":  time.Unix(1449999000, 0),
+		"2015-12-13T09:46:40Z": time.Unix(1450000000, 0),
+	}
+
+	for str, exp := range valid {
+		if ts, err := ParseTime(str, now); err != nil || !ts.Equal(exp) {
+			t.Fatal("wrong time", str, ts, err)
+		}
+	}
+
+	for _, str := range []string{"", "nowx", "now6h", "-x", "2015-12-13", "x"} {
+		if _, err := ParseTime(str, now); err != ErrInvTime {
+			t.Fatal("should fail", str)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	now := time.Unix(1450000000, 0)
+	ns := func(d time.Duration) uint64 {
+		return uint64(now.Add(d).UnixNano())
+	}
+
+	valid := map[string][2]uint64{
+		"-24h..now":                 {ns(-24 * time.Hour), ns(0)},
+		"-2d..":                     {ns(-48 * time.Hour), ns(0)},
+		"now-1w..now-1d":            {ns(-7 * 24 * time.Hour), ns(-24 * time.Hour)},
+		"2015-12-13T00:00:00Z..-1h": {uint64(time.Date(2015, 12, 13, 0, 0, 0, 0, time.UTC).UnixNano()), ns(-time.Hour)},
+		"1449990000000000000..1450000000000000000": {1449990000000000000, 1450000000000000000},
+	}
+
+	for str, exp := range valid {
+		from, to, err := ParseRange(str, now)
+		if err != nil || from != exp[0] || to != exp[1] {
+			t.Fatal("wrong range", str, from, to, err)
+		}
+	}
+
+	for _, str := range []string{"", "-1h", "..now", "-1h..x", "now..-1h", "now..now"} {
+		if _, _, err := ParseRange(str, now); err != ErrInvRange {
+			t.Fatal("should fail", str)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package kadiyadb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/changelog"
+)
+
+// ReloadError is returned when a param file is reloaded with changes
+// to params which cannot be applied while the database is running.
+type ReloadError struct {
+	Param string
+	Old   string
+	New   string
+}
+
+func (e *ReloadError) Error() string {
+	return fmt.Sprintf("cannot change %s from %s to %s without a restart",
+		e.Param, e.Old, e.New)
+}
+
+// Reload reads the param file in the database directory again and applies
+// changes which are safe to make while the database is running. These are
+// epoch cache sizes (maxROEpochs, maxRWEpochs) and retention. If any other
+// param is changed, a *ReloadError is returned and no changes are applied.
+func (d *DB) Reload() (err error) {
+	data, err := ioutil.ReadFile(path.Join(d.dir, paramfile))
+	if err != nil {
+		return err
+	}
+
+	p, err := ParseParams(data)
+	if err != nil {
+		return err
+	}
+
+	if !p.valid() {
+		return ErrInvParams
+	}
+
+	rps := make(map[int64]*Params, len(p.Rollups))
+	for _, r := range p.Rollups {
+		rp := p.rollup(r)
+		rps[rp.Resolution] = rp
+	}
+
+	if err := d.check(p); err != nil {
+		return err
+	}
+
+	if err := d.checkRollups(p, rps); err != nil {
+		return err
+	}
+
+	d.apply(p)
+	for _, r := range d.rollups {
+		r.apply(rps[r.params.Resolution])
+	}
+
+	return nil
+}
+
+// check checks whether the database can use given params without a restart
+func (d *DB) check(p *Params) (err error) {
+	d.histmtx.RLock()
+	defer d.histmtx.RUnlock()
+
+	if p.Duration != d.params.Duration {
+		return &ReloadError{
+			Param: "duration",
+			Old:   time.Duration(d.params.Duration).String(),
+			New:   time.Duration(p.Duration).String(),
+		}
+	}
+
+	if p.Resolution != d.params.Resolution {
+		return &ReloadError{
+			Param: "resolution",
+			Old:   time.Duration(d.params.Resolution).String(),
+			New:   time.Duration(p.Resolution).String(),
+		}
+	}
+
+	if old, next := changeLogName(d.params.ChangeLog), changeLogName(p.ChangeLog); old != next {
+		return &ReloadError{
+			Param: "changelog",
+			Old:   old,
+			New:   next,
+		}
+	}
+
+	return nil
+}
+
+// checkRollups checks whether rollups can use given params without a restart
+// Rollups cannot be added or removed and their durations cannot be changed.
+func (d *DB) checkRollups(p *Params, rps map[int64]*Params) (err error) {
+	changed := len(rps) != len(d.rollups)
+
+	for _, r := range d.rollups {
+		if rp, ok := rps[r.params.Resolution]; !ok || r.check(rp) != nil {
+			changed = true
+		}
+	}
+
+	if changed {
+		prev := make([]string, len(d.rollups))
+		for i, r := range d.rollups {
+			prev[i] = rollupName(r.params)
+		}
+
+		next := make([]string, len(p.Rollups))
+		for i, r := range p.Rollups {
+			next[i] = rollupName(p.rollup(r))
+		}
+
+		return &ReloadError{
+			Param: "rollups",
+			Old:   "[" + strings.Join(prev, " ") + "]",
+			New:   "[" + strings.Join(next, " ") + "]",
+		}
+	}
+
+	return nil
+}
+
+// apply applies safe param changes (epoch cache sizes and retention)
+// The cache is resized after unlocking histmtx because the cache calls
+// d.meta (which needs histmtx) while its own lock is held.
+func (d *DB) apply(p *Params) {
+	d.histmtx.Lock()
+
+	resize := p.MaxROEpochs != d.params.MaxROEpochs ||
+		p.MaxRWEpochs != d.params.MaxRWEpochs
+
+	if resize {
+		d.params.MaxROEpochs = p.MaxROEpochs
+		d.params.MaxRWEpochs = p.MaxRWEpochs
+	}
+
+	expire := p.Retention != d.params.Retention
+	if expire {
+		d.params.RetentionStr = p.RetentionStr
+		d.params.Retention = p.Retention
+	}
+
+	d.histmtx.Unlock()
+
+	if resize {
+		d.cache.Resize(p.MaxRWEpochs, p.MaxROEpochs)
+	}
+
+	if expire {
+		d.rwake()
+	}
+}
+
+// changeLogName returns a short description of change log options
+func changeLogName(o *changelog.Options) string {
+	if o == nil {
+		return "disabled"
+	}
+
+	return fmt.Sprintf("%d/%d", o.SegmentSize, o.MaxSegments)
+}
+
+// rollupName returns a short description of a rollup: "duration/resolution"
+func rollupName(p *Params) string {
+	return time.Duration(p.Duration).String() + "/" + time.Duration(p.Resolution).String()
+}
+
+// Watch checks param files of given databases periodically and reloads
+// databases when their param files are modified. Errors are logged and
+// the database will continue to use previous params. The dbs map must
+// not be modified until watching is stopped with the returned function.
+func Watch(dbs map[string]*DB, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	mtimes := make(map[string]time.Time, len(dbs))
+
+	for name, db := range dbs {
+		if info, err := os.Stat(path.Join(db.dir, paramfile)); err == nil {
+			mtimes[name] = info.ModTime()
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			for name, db := range dbs {
+				info, err := os.Stat(path.Join(db.dir, paramfile))
+				if err != nil || info.ModTime().Equal(mtimes[name]) {
+					continue
+				}
+
+				mtimes[name] = info.ModTime()
+				if err := db.Reload(); err != nil {
+					fmt.Println("DB Error: reload:", name, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
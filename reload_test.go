@@ -0,0 +1,167 @@
+package kadiyadb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeParams(t *testing.T, data string) {
+	if err := ioutil.WriteFile(dir+"/test1/params.json", []byte(data), 0777); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir+"/test1", 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	writeParams(t, `{
+    "duration": "1h",
+    "resolution": "1m",
+    "retention": "24h",
+    "maxROEpochs": 10,
+    "maxRWEpochs": 3
+  }`)
+
+	db := LoadAll(dir)["test1"]
+	if db == nil {
+		t.Fatal("missing db")
+	}
+
+	// Test 1: safe changes
+	writeParams(t, `{
+    "duration": "1h",
+    "resolution": "1m",
+    "retention": "48h",
+    "maxROEpochs": 5,
+    "maxRWEpochs": 1
+  }`)
+
+	if err := db.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.params.Retention != int64(48*time.Hour) ||
+		db.params.MaxROEpochs != 5 ||
+		db.params.MaxRWEpochs != 1 {
+		t.Fatal("params not updated")
+	}
+
+	// Test 2: unsafe changes
+	writeParams(t, `{
+    "duration": "1h",
+    "resolution": "10s",
+    "retention": "24h",
+    "maxROEpochs": 5,
+    "maxRWEpochs": 1
+  }`)
+
+	err := db.Reload()
+	if rerr, ok := err.(*ReloadError); !ok {
+		t.Fatal("should return a reload error")
+	} else if rerr.Param != "resolution" || rerr.Old != "1m0s" || rerr.New != "10s" {
+		t.Fatal("wrong error values")
+	}
+
+	if db.params.Retention != int64(48*time.Hour) {
+		t.Fatal("params should not change")
+	}
+
+	// Test 3: invalid values
+	writeParams(t, `{
+    "duration": "1h",
+    "resolution": "1m",
+    "retention": "24h",
+    "maxROEpochs": 5,
+    "maxRWEpochs": 0
+  }`)
+
+	if err := db.Reload(); err != ErrInvParams {
+		t.Fatal("should return an error")
+	}
+
+	// Test 4: rollups cannot be added
+	writeParams(t, `{
+    "duration": "1h",
+    "resolution": "1m",
+    "retention": "24h",
+    "maxROEpochs": 5,
+    "maxRWEpochs": 1,
+    "rollups": [{"resolution": "1h", "retention": "48h"}]
+  }`)
+
+	err = db.Reload()
+	if rerr, ok := err.(*ReloadError); !ok {
+		t.Fatal("should return a reload error")
+	} else if rerr.Param != "rollups" || rerr.Old != "[]" || rerr.New != "[12h0m0s/1h0m0s]" {
+		t.Fatal("wrong error values")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir+"/test1", 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	writeParams(t, `{
+    "duration": "1h",
+    "resolution": "1m",
+    "retention": "24h",
+    "maxROEpochs": 10,
+    "maxRWEpochs": 3
+  }`)
+
+	dbs := LoadAll(dir)
+	stop := Watch(dbs, 10*time.Millisecond)
+	defer stop()
+
+	writeParams(t, `{
+    "duration": "1h",
+    "resolution": "1m",
+    "retention": "24h",
+    "maxROEpochs": 4,
+    "maxRWEpochs": 3
+  }`)
+
+	// make sure modified time is different
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(dir+"/test1/params.json", future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	db := dbs["test1"]
+	for i := 0; ; i++ {
+		db.histmtx.RLock()
+		n := db.params.MaxROEpochs
+		db.histmtx.RUnlock()
+
+		if n == 4 {
+			break
+		} else if i == 100 {
+			t.Fatal("params not reloaded")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
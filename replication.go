@@ -0,0 +1,477 @@
+package kadiyadb
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/kadirahq/kadiyadb/epoch"
+)
+
+const (
+	// offsetfile is the first entry of archives written with WriteEpoch.
+	// It has the end of the change log when the epoch was copied. It's kept
+	// in epoch directories restored with ReadEpoch but it's never copied.
+	offsetfile = ".offset"
+)
+
+var (
+	// ErrNoEpoch is returned when an epoch does not exist in the database
+	ErrNoEpoch = errors.New("epoch not found")
+
+	// ErrEpochExists is returned when restoring an epoch which already exists
+	ErrEpochExists = errors.New("epoch already exists")
+
+	// ErrNoRollup is returned when a rollup does not exist in the database
+	ErrNoRollup = errors.New("rollup not found")
+)
+
+// Snapshot describes the state of a database when a replica starts copying
+// it. Epochs older than the cutoff are sealed. A replica copies sealed epochs
+// and rebuilds active epochs by replaying the change log from the first entry.
+// Sealed epochs can still be written to, therefore change log entries made to
+// a sealed epoch are replayed only if they were written after the epoch was
+// copied (at or after the offset returned by ReadEpoch). Active epochs can
+// only be fully replicated if the change log still has all of their writes.
+// Rollups usually keep data for longer than the change log so all rollup
+// epochs are copied and entries made before a rollup epoch was copied are
+// not replayed to that epoch (see ReplayTo).
+type Snapshot struct {
+	// Offset is the end of the change log when the snapshot was made
+	Offset int64 `json:"offset"`
+
+	// First is the offset of the first entry in the change log
+	First int64 `json:"first"`
+
+	// Cutoff is the start time of the oldest active epoch
+	Cutoff int64 `json:"cutoff"`
+
+	// Epochs has start times of sealed epochs on disk in ascending order
+	Epochs []int64 `json:"epochs"`
+
+	// Rollups has start times of all rollup epochs on disk by rollup name
+	Rollups map[string][]int64 `json:"rollups,omitempty"`
+}
+
+// Snapshot makes a snapshot of the database for replication. Epochs which
+// can still be loaded for writing (the last MaxRWEpochs epochs at given time)
+// are considered active. The database must have a change log.
+func (d *DB) Snapshot(now int64) (s *Snapshot, err error) {
+	if d.changes == nil {
+		return nil, ErrNoChangeLog
+	}
+
+	m, _ := d.split(now)
+
+	d.histmtx.RLock()
+	cutoff := m.Start - (d.params.MaxRWEpochs-1)*m.Duration
+	d.histmtx.RUnlock()
+
+	s = &Snapshot{
+		Offset: d.changes.End(),
+		First:  d.changes.First(),
+		Cutoff: cutoff,
+		Epochs: []int64{},
+	}
+
+	starts, err := d.epochs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, start := range starts {
+		if start < cutoff {
+			s.Epochs = append(s.Epochs, start)
+		}
+	}
+
+	if len(d.rollups) > 0 {
+		s.Rollups = make(map[string][]int64, len(d.rollups))
+	}
+
+	for _, r := range d.rollups {
+		starts, err := r.epochs()
+		if err != nil {
+			return nil, err
+		}
+
+		s.Rollups[r.name()] = append([]int64{}, starts...)
+	}
+
+	return s, nil
+}
+
+// WriteEpoch writes a copy of epoch files to w in tar format. Writes to the
+// epoch are blocked while the copy is made. The end of the change log when
+// the copy was made is written to the archive before epoch files.
+func (d *DB) WriteEpoch(start int64, w io.Writer) (err error) {
+	tmp, end, err := d.copyEpoch(start)
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	return writeEpoch(w, tmp, end)
+}
+
+// WriteRollupEpoch writes a copy of the files of a rollup epoch like
+// WriteEpoch. The end of the change log of this database is written to the
+// archive because rollups do not have change logs.
+func (d *DB) WriteRollupEpoch(rollup string, start int64, w io.Writer) (err error) {
+	r := d.findRollup(rollup)
+	if r == nil {
+		return ErrNoRollup
+	}
+
+	tmp, end, err := d.copyRollupEpoch(r, start)
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	return writeEpoch(w, tmp, end)
+}
+
+// writeEpoch writes the change log offset and files of a copied epoch to w
+func writeEpoch(w io.Writer, tmp string, end int64) (err error) {
+	tw := tar.NewWriter(w)
+	offset := []byte(strconv.FormatInt(end, 10))
+	hdr := &tar.Header{
+		Name:    offsetfile,
+		Mode:    0644,
+		Size:    int64(len(offset)),
+		ModTime: time.Now(),
+	}
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(offset); err != nil {
+		return err
+	}
+
+	if err := writeTar(tw, tmp, "", nil); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// ReadEpoch reads epoch files written with WriteEpoch into the database.
+// Files are extracted into a temporary directory and moved into place only
+// if the epoch metadata matches what this database expects for the epoch.
+// It returns the end of the change log of the source database when the
+// epoch was copied. Change log entries of the epoch before this offset are
+// already included in copied files. The offset is stored with the epoch. If
+// the epoch already exists, it returns ErrEpochExists with the stored offset
+// (or -1 if the epoch was not restored with ReadEpoch).
+func (d *DB) ReadEpoch(start int64, r io.Reader) (offset int64, err error) {
+	name := strconv.FormatInt(start, 10)
+	dir := path.Join(d.dir, name)
+
+	if _, err := os.Stat(dir); err == nil {
+		offset, err := readOffset(dir)
+		if err != nil {
+			return -1, ErrEpochExists
+		}
+
+		return offset, ErrEpochExists
+	}
+
+	tmp, err := ioutil.TempDir(d.dir, "."+name+"-")
+	if err != nil {
+		return 0, err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	if err := readTar(tar.NewReader(r), tmp); err != nil {
+		return 0, err
+	}
+
+	offset, err = readOffset(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	m, err := epoch.ReadMeta(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.meta(start).Check(m); err != nil {
+		return 0, err
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return 0, err
+	}
+
+	return offset, os.Rename(tmp, dir)
+}
+
+// ReadRollupEpoch reads rollup epoch files written with WriteRollupEpoch
+// into a rollup of the database like ReadEpoch.
+func (d *DB) ReadRollupEpoch(rollup string, start int64, r io.Reader) (offset int64, err error) {
+	rdb := d.findRollup(rollup)
+	if rdb == nil {
+		return 0, ErrNoRollup
+	}
+
+	return rdb.ReadEpoch(start, r)
+}
+
+// readOffset reads the change log offset stored in an epoch directory
+func readOffset(dir string) (offset int64, err error) {
+	data, err := ioutil.ReadFile(path.Join(dir, offsetfile))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// copyEpoch copies epoch files into a temporary directory while writes to
+// the epoch are blocked. The caller must remove the directory when done.
+// It also returns the end of the change log (if any) when the copy was made.
+// Change log entries of the epoch before this offset are in the copy.
+func (d *DB) copyEpoch(start int64) (tmp string, end int64, err error) {
+	d.freeze(start)
+	defer d.unfreeze(start)
+
+	if d.changes != nil {
+		end = d.changes.End()
+	}
+
+	tmp, err = d.copyFrozen(start)
+	return tmp, end, err
+}
+
+// copyRollupEpoch copies an epoch of a rollup like copyEpoch. It returns the
+// end of the change log of this database. All writes to this database are
+// blocked until the rollup epoch is frozen, therefore entries before this
+// offset are written to the rollup as well (rollups are written while the
+// barrier of this database is read locked).
+func (d *DB) copyRollupEpoch(r *DB, start int64) (tmp string, end int64, err error) {
+	d.barrier.Lock()
+	r.freeze(start)
+	if d.changes != nil {
+		end = d.changes.End()
+	}
+	d.barrier.Unlock()
+
+	defer r.unfreeze(start)
+
+	tmp, err = r.copyFrozen(start)
+	return tmp, end, err
+}
+
+// copyFrozen copies files of a frozen epoch into a temporary directory
+func (d *DB) copyFrozen(start int64) (tmp string, err error) {
+	name := strconv.FormatInt(start, 10)
+	dir := path.Join(d.dir, name)
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", ErrNoEpoch
+	}
+
+	// writes made before freezing may only be in memory mapped pages
+	if err := d.cache.SyncEpoch(start); err != nil {
+		return "", err
+	}
+
+	tmp, err = ioutil.TempDir(d.dir, ".copy-"+name+"-")
+	if err != nil {
+		return "", err
+	}
+
+	if err := copyDir(dir, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+
+	return tmp, nil
+}
+
+// epochs returns start times of epoch directories in ascending order
+func (d *DB) epochs() (starts []int64, err error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+
+		// only epoch directories are named with numbers
+		start, err := strconv.ParseInt(file.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		starts = append(starts, start)
+	}
+
+	sort.Sort(int64s(starts))
+	return starts, nil
+}
+
+// writeTar writes all files inside dir to tw with given name prefix.
+// Written files are added to the manifest if it's not nil.
+func writeTar(tw *tar.Writer, dir, prefix string, m *Manifest) (err error) {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(path.Join(prefix, rel))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		return writeFile(tw, p, hdr.Name, info.Size(), m)
+	})
+}
+
+// writeFile writes the content of a file to tw (after writing its header).
+// The file is added to the manifest with its checksum if it's not nil.
+func writeFile(tw *tar.Writer, p, name string, size int64, m *Manifest) (err error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.CopyN(io.MultiWriter(tw, h), file, size); err != nil {
+		return err
+	}
+
+	if m != nil {
+		m.Files = append(m.Files, &ManifestFile{
+			Name:   name,
+			Size:   size,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+
+	return nil
+}
+
+// readTar extracts files and directories from tr into dir
+func readTar(tr *tar.Reader, dir string) (err error) {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + hdr.Name)[1:]
+		if name == "" {
+			continue
+		}
+
+		dst := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+
+			if err := extract(tr, dst, hdr.Size); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// extract writes the content of the current tar entry to a file
+func extract(r io.Reader, dst string, size int64) (err error) {
+	file, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(file, r, size); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// copyDir copies all files and directories inside src into dst
+func copyDir(src, dst string) (err error) {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		// offsets of restored epochs are not valid for copies
+		if !info.Mode().IsRegular() || info.Name() == offsetfile {
+			return nil
+		}
+
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+
+		defer in.Close()
+
+		return extract(in, target, info.Size())
+	})
+}
+
+// int64s is used to sort int64 values in ascending order
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
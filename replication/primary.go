@@ -0,0 +1,214 @@
+// Package replication copies databases from a primary server to replicas.
+// Replication is asynchronous. A replica starts by requesting a snapshot
+// from the primary, copies sealed epochs and then reads the change log of the
+// primary database from the first entry. All rollup epochs are copied as
+// well because rollups keep data for longer. Change log entries are tracked on
+// the replica therefore both servers end up with the same point values.
+// Databases on the primary must have change logs (see kadiyadb.Params).
+//
+// The primary serves these endpoints (see Paths):
+//
+//	GET /replication/snapshot?db=name                 database snapshot
+//	GET /replication/epoch?db=name&start=N            epoch files (tar)
+//	GET /replication/epoch?db=name&rollup=R&start=N   rollup epoch files (tar)
+//	GET /replication/changes?db=name&offset=N&limit=M change log entries
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb/changelog"
+)
+
+const (
+	// PathSnapshot is the path used to request database snapshots
+	PathSnapshot = "/replication/snapshot"
+
+	// PathEpoch is the path used to request epoch files
+	PathEpoch = "/replication/epoch"
+
+	// PathChanges is the path used to request change log entries
+	PathChanges = "/replication/changes"
+
+	// maxLimit is the maximum number of entries sent with a response
+	maxLimit = 10000
+)
+
+var (
+	// Paths has all paths which should be routed to the primary handler
+	Paths = []string{PathSnapshot, PathEpoch, PathChanges}
+)
+
+var (
+	// ErrNoDB is returned when the requested database does not exist
+	ErrNoDB = errors.New("database not found")
+
+	// ErrBehind is returned when the replica needs change log entries which
+	// are no longer available in the primary (removed with old segments).
+	ErrBehind = errors.New("replica is behind the primary change log")
+
+	// ErrNoState is returned when a replica is created without a state file
+	ErrNoState = errors.New("replica state file is required")
+)
+
+// Changes is a response with change log entries
+type Changes struct {
+	// Entries are change log entries starting from the requested offset
+	Entries []*changelog.Entry `json:"entries"`
+
+	// Next is the offset to use when requesting next entries
+	Next int64 `json:"next"`
+
+	// End is the current end of the change log in the primary
+	End int64 `json:"end"`
+}
+
+// Primary handles requests made by replicas
+type Primary struct {
+	dbs kadiyadb.Databases
+}
+
+// NewPrimary creates a handler which serves given databases to replicas.
+// It should be registered with the server for all paths in Paths.
+func NewPrimary(dbs kadiyadb.Databases) (p *Primary) {
+	return &Primary{dbs: dbs}
+}
+
+func (p *Primary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	q := r.URL.Query()
+	db := p.dbs.DB(q.Get("db"))
+	if db == nil {
+		writeError(w, http.StatusNotFound, ErrNoDB)
+		return
+	}
+
+	switch path.Clean(r.URL.Path) {
+	case PathSnapshot:
+		p.handleSnapshot(w, db)
+	case PathEpoch:
+		p.handleEpoch(w, db, q.Get("rollup"), q.Get("start"))
+	case PathChanges:
+		p.handleChanges(w, db, q.Get("offset"), q.Get("limit"))
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (p *Primary) handleSnapshot(w http.ResponseWriter, db *kadiyadb.DB) {
+	s, err := db.Snapshot(time.Now().UnixNano())
+	if err == kadiyadb.ErrNoChangeLog {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (p *Primary) handleEpoch(w http.ResponseWriter, db *kadiyadb.DB, rollup, startStr string) {
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid start"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+
+	// errors after writing the first byte cannot be sent to the client
+	// but the replica will fail to read the incomplete tar stream
+	cw := &countWriter{w: w}
+	if rollup != "" {
+		err = db.WriteRollupEpoch(rollup, start, cw)
+	} else {
+		err = db.WriteEpoch(start, cw)
+	}
+
+	if err == nil || cw.n > 0 {
+		return
+	}
+
+	w.Header().Del("Content-Type")
+
+	if err == kadiyadb.ErrNoEpoch || err == kadiyadb.ErrNoRollup {
+		writeError(w, http.StatusNotFound, err)
+	} else {
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// countWriter counts bytes written to the underlying writer
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (p *Primary) handleChanges(w http.ResponseWriter, db *kadiyadb.DB, offsetStr, limitStr string) {
+	offset, err := strconv.ParseInt(offsetStr, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid offset"))
+		return
+	}
+
+	limit := maxLimit
+	if limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid limit"))
+			return
+		}
+
+		if limit > maxLimit {
+			limit = maxLimit
+		}
+	}
+
+	entries, next, err := db.ReadChanges(offset, limit)
+	switch err {
+	case nil:
+	case kadiyadb.ErrNoChangeLog:
+		writeError(w, http.StatusConflict, err)
+		return
+	case changelog.ErrOffset:
+		writeError(w, http.StatusGone, err)
+		return
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &Changes{
+		Entries: entries,
+		Next:    next,
+		End:     db.Changes().End(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
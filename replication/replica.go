@@ -0,0 +1,472 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb/atomicfile"
+	"github.com/kadirahq/kadiyadb/changelog"
+)
+
+const (
+	// defaultInterval is the default time between requests when caught up
+	defaultInterval = time.Second
+
+	// defaultBatch is the default number of entries requested at once
+	defaultBatch = 1000
+)
+
+// Options is used to configure a replica
+type Options struct {
+	// URL is the base URL of the primary server ("http://host:8000")
+	URL string
+
+	// Database is the name of the database on the primary server
+	Database string
+
+	// State is the file used to store the replication state (required).
+	// Replication continues from the stored state when a replica starts.
+	// Without the state file, change log entries would be applied again
+	// after each restart which counts them more than once in the replica.
+	State string
+
+	// Interval is the time to wait before requesting new entries
+	// when the replica has caught up with the primary (default: 1s)
+	Interval time.Duration
+
+	// Batch is the maximum number of entries requested at once (default: 1000)
+	Batch int
+
+	// Client is used to make requests (default: http.DefaultClient)
+	Client *http.Client
+}
+
+// Status describes the progress of a replica
+type Status struct {
+	// Ready is true after sealed epochs are copied from the primary
+	Ready bool `json:"ready"`
+
+	// Offset is the primary change log offset of the next entry to apply
+	Offset int64 `json:"offset"`
+
+	// End is the end of the primary change log when it was last checked
+	End int64 `json:"end"`
+
+	// Lag is the number of change log bytes not applied to the replica
+	Lag int64 `json:"lag"`
+
+	// Synced is the last time the replica had applied all entries
+	Synced time.Time `json:"synced"`
+
+	// Error is the last replication error (empty after a successful request)
+	Error string `json:"error,omitempty"`
+}
+
+// state is stored in the state file to continue replicating after restarts
+type state struct {
+	Snapshot *kadiyadb.Snapshot `json:"snapshot"`
+	Ready    bool               `json:"ready"`
+	Offset   int64              `json:"offset"`
+
+	// Epochs has change log offsets of copied epochs by epoch start time
+	Epochs map[int64]int64 `json:"epochs"`
+
+	// Rollups has change log offsets of copied rollup epochs by rollup name
+	// and epoch start time
+	Rollups map[string]map[int64]int64 `json:"rollups"`
+}
+
+// Replica copies a database from a primary server and keeps applying
+// changes made to it. Change log entries are applied at least once: if the
+// replica stops after applying entries (or copying an epoch) but before
+// storing its state, these entries will be applied again when it starts.
+type Replica struct {
+	db     *kadiyadb.DB
+	opts   Options
+	state  state
+	mtx    *sync.Mutex
+	status Status
+	smtx   *sync.Mutex
+
+	stop chan struct{}
+	wg   *sync.WaitGroup
+}
+
+// NewReplica creates a replica which writes to given database. The database
+// should be empty when replication starts and it should only be written to
+// by the replica. It starts replicating in the background immediately.
+// ErrNoState is returned if a state file is not given with options.
+func NewReplica(db *kadiyadb.DB, opts *Options) (r *Replica, err error) {
+	if opts.State == "" {
+		return nil, ErrNoState
+	}
+
+	r = &Replica{
+		db:   db,
+		opts: *opts,
+		mtx:  &sync.Mutex{},
+		smtx: &sync.Mutex{},
+		stop: make(chan struct{}),
+		wg:   &sync.WaitGroup{},
+	}
+
+	if r.opts.Interval <= 0 {
+		r.opts.Interval = defaultInterval
+	}
+
+	if r.opts.Batch <= 0 {
+		r.opts.Batch = defaultBatch
+	}
+
+	if r.opts.Client == nil {
+		r.opts.Client = http.DefaultClient
+	}
+
+	r.opts.URL = strings.TrimRight(r.opts.URL, "/")
+
+	data, err := ioutil.ReadFile(r.opts.State)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, &r.state); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.state.Epochs == nil {
+		r.state.Epochs = map[int64]int64{}
+	}
+
+	if r.state.Rollups == nil {
+		r.state.Rollups = map[string]map[int64]int64{}
+	}
+
+	r.status.Ready = r.state.Ready
+	r.status.Offset = r.state.Offset
+
+	r.wg.Add(1)
+	go r.loop()
+
+	return r, nil
+}
+
+// Status returns the current status of the replica
+func (r *Replica) Status() (s Status) {
+	r.smtx.Lock()
+	defer r.smtx.Unlock()
+
+	return r.status
+}
+
+// Pull copies sealed epochs if it's not done yet and applies one batch of
+// change log entries from the primary. It returns the number of entries
+// read from the primary and whether the replica has caught up.
+func (r *Replica) Pull() (n int, done bool, err error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	n, done, err = r.pull()
+
+	r.smtx.Lock()
+	if err != nil {
+		r.status.Error = err.Error()
+	} else {
+		r.status.Error = ""
+	}
+	r.smtx.Unlock()
+
+	return n, done, err
+}
+
+// Replicas is a set of replicas by database name. It can be used as an
+// HTTP handler which responds with the status of each replica.
+type Replicas map[string]*Replica
+
+func (rs Replicas) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	res := make(map[string]Status, len(rs))
+	for name, replica := range rs {
+		res[name] = replica.Status()
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// Close stops replicating
+func (r *Replica) Close() (err error) {
+	close(r.stop)
+	r.wg.Wait()
+	return nil
+}
+
+// pull applies a batch of entries. The mutex must be locked.
+func (r *Replica) pull() (n int, done bool, err error) {
+	if !r.state.Ready {
+		if err := r.baseline(); err != nil {
+			return 0, false, err
+		}
+	}
+
+	q := url.Values{}
+	q.Set("db", r.opts.Database)
+	q.Set("offset", strconv.FormatInt(r.state.Offset, 10))
+	q.Set("limit", strconv.Itoa(r.opts.Batch))
+
+	res, err := r.get(PathChanges, q)
+	if err != nil {
+		return 0, false, err
+	}
+
+	defer res.Body.Close()
+
+	changes := &Changes{}
+	if err := json.NewDecoder(res.Body).Decode(changes); err != nil {
+		return 0, false, err
+	}
+
+	for _, e := range changes.Entries {
+		want := func(rollup string, start int64) bool {
+			return !r.copied(rollup, start, e)
+		}
+
+		if err := r.db.ReplayTo(e, want); err != nil {
+			// continue from the failed entry next time
+			r.state.Offset = e.Offset
+			r.save()
+			return 0, false, err
+		}
+	}
+
+	if len(changes.Entries) > 0 {
+		r.state.Offset = changes.Next
+		if err := r.save(); err != nil {
+			return 0, false, err
+		}
+	}
+
+	done = changes.Next >= changes.End
+
+	r.smtx.Lock()
+	r.status.Offset = r.state.Offset
+	r.status.End = changes.End
+	r.status.Lag = changes.End - r.state.Offset
+	if done {
+		r.status.Synced = time.Now()
+	}
+	r.smtx.Unlock()
+
+	return len(changes.Entries), done, nil
+}
+
+// baseline requests a snapshot and copies sealed epochs and rollup epochs.
+// The snapshot is stored before copying epochs so it's not changed if copying
+// fails. Epochs which are already copied are skipped.
+func (r *Replica) baseline() (err error) {
+	if r.state.Snapshot == nil {
+		q := url.Values{}
+		q.Set("db", r.opts.Database)
+
+		res, err := r.get(PathSnapshot, q)
+		if err != nil {
+			return err
+		}
+
+		defer res.Body.Close()
+
+		snap := &kadiyadb.Snapshot{}
+		if err := json.NewDecoder(res.Body).Decode(snap); err != nil {
+			return err
+		}
+
+		r.state.Snapshot = snap
+		r.state.Offset = snap.First
+		r.state.Epochs = map[int64]int64{}
+		r.state.Rollups = map[string]map[int64]int64{}
+		if err := r.save(); err != nil {
+			return err
+		}
+	}
+
+	for _, start := range r.state.Snapshot.Epochs {
+		if _, ok := r.state.Epochs[start]; ok {
+			continue
+		}
+
+		if err := r.copyEpoch("", start); err != nil {
+			return err
+		}
+	}
+
+	for rollup, starts := range r.state.Snapshot.Rollups {
+		for _, start := range starts {
+			if _, ok := r.state.Rollups[rollup][start]; ok {
+				continue
+			}
+
+			if err := r.copyEpoch(rollup, start); err != nil {
+				return err
+			}
+		}
+	}
+
+	r.state.Ready = true
+
+	r.smtx.Lock()
+	r.status.Ready = true
+	r.smtx.Unlock()
+
+	return r.save()
+}
+
+// copyEpoch copies an epoch (or a rollup epoch if rollup is not empty) from
+// the primary and stores the change log offset of the copy. Epochs removed
+// from the primary and epochs of rollups the replica does not have are not
+// copied.
+func (r *Replica) copyEpoch(rollup string, start int64) (err error) {
+	q := url.Values{}
+	q.Set("db", r.opts.Database)
+	q.Set("start", strconv.FormatInt(start, 10))
+	if rollup != "" {
+		q.Set("rollup", rollup)
+	}
+
+	res, err := r.get(PathEpoch, q)
+	if err == kadiyadb.ErrNoEpoch {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	var offset int64
+	if rollup != "" {
+		offset, err = r.db.ReadRollupEpoch(rollup, start, res.Body)
+	} else {
+		offset, err = r.db.ReadEpoch(start, res.Body)
+	}
+
+	switch {
+	case err == kadiyadb.ErrNoRollup:
+		return nil
+	case err == kadiyadb.ErrEpochExists && offset >= 0:
+		// copied before storing the state, use the offset of that copy
+	case err != nil:
+		return err
+	}
+
+	if rollup == "" {
+		r.state.Epochs[start] = offset
+		return r.save()
+	}
+
+	if r.state.Rollups[rollup] == nil {
+		r.state.Rollups[rollup] = map[int64]int64{}
+	}
+
+	r.state.Rollups[rollup][start] = offset
+	return r.save()
+}
+
+// copied checks whether a change log entry is already in a copied epoch of
+// the database (empty rollup name) or a rollup. Entries of sealed epochs
+// which were not copied (removed from the primary) are skipped if they were
+// written before the snapshot was made. Rollup epochs which were not copied
+// are rebuilt from the change log.
+func (r *Replica) copied(rollup string, start int64, e *changelog.Entry) bool {
+	if rollup != "" {
+		offset, ok := r.state.Rollups[rollup][start]
+		return ok && e.Offset < offset
+	}
+
+	// epochs of the primary are used as epochs are only copied
+	// if they are the same in the primary and the replica
+	if offset, ok := r.state.Epochs[e.Epoch]; ok {
+		return e.Offset < offset
+	}
+
+	snap := r.state.Snapshot
+	return e.Epoch < snap.Cutoff && e.Offset < snap.Offset
+}
+
+// get makes a request to the primary and checks the response status
+func (r *Replica) get(p string, q url.Values) (res *http.Response, err error) {
+	res, err = r.opts.Client.Get(r.opts.URL + p + "?" + q.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusOK {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusGone {
+		return nil, ErrBehind
+	}
+
+	body := struct{ Error string }{}
+	json.NewDecoder(res.Body).Decode(&body)
+
+	// epochs can be removed by the retention policy after the snapshot
+	if res.StatusCode == http.StatusNotFound && body.Error == kadiyadb.ErrNoEpoch.Error() {
+		return nil, kadiyadb.ErrNoEpoch
+	}
+
+	return nil, fmt.Errorf("primary returned status %d: %s", res.StatusCode, body.Error)
+}
+
+// save writes the replication state to the state file.
+// The mutex must be locked when calling this function.
+func (r *Replica) save() (err error) {
+	data, err := json.Marshal(r.state)
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(r.opts.State, data)
+}
+
+func (r *Replica) loop() {
+	defer r.wg.Done()
+
+	for {
+		_, done, err := r.Pull()
+		if err != nil {
+			fmt.Println("Replication Error:", r.opts.Database, err)
+		}
+
+		// keep pulling without waiting until the replica catches up
+		if err == nil && !done {
+			select {
+			case <-r.stop:
+				return
+			default:
+				continue
+			}
+		}
+
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(r.opts.Interval):
+		}
+	}
+}
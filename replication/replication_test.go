@@ -0,0 +1,432 @@
+package replication
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/changelog"
+)
+
+const (
+	dir = "/tmp/test-replication"
+)
+
+// databases is a fixed set of databases for the primary handler
+type databases map[string]*kadiyadb.DB
+
+func (d databases) DB(name string) (db *kadiyadb.DB) {
+	return d[name]
+}
+
+func open(t *testing.T, name string, cl bool) (db *kadiyadb.DB) {
+	p := &kadiyadb.Params{
+		Duration:    int64(time.Hour),
+		Resolution:  int64(time.Minute),
+		Retention:   int64(24 * time.Hour),
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	if cl {
+		p.ChangeLog = &changelog.Options{}
+	}
+
+	db, err := kadiyadb.Open(dir+"/"+name, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func track(t *testing.T, db *kadiyadb.DB, ts time.Time, fields []string, total float64) {
+	if err := db.Track(uint64(ts.UnixNano()), fields, total, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// total returns the sum of all point totals of a series in a time range
+func total(t *testing.T, db *kadiyadb.DB, from, to time.Time, fields []string) (sum float64) {
+	db.Fetch(uint64(from.UnixNano()), uint64(to.UnixNano()), fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range chunks {
+			for _, s := range c.Series {
+				for _, p := range s.Points {
+					sum += p.Total
+				}
+			}
+		}
+	})
+
+	return sum
+}
+
+// wait pulls from the primary until the replica catches up
+func wait(t *testing.T, r *Replica) {
+	for i := 0; i < 100; i++ {
+		_, done, err := r.Pull()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if done {
+			return
+		}
+	}
+
+	t.Fatal("replica did not catch up")
+}
+
+func TestReplica(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	primary := open(t, "primary", true)
+	defer primary.Close()
+
+	replica := open(t, "replica", false)
+	defer replica.Close()
+
+	mux := http.NewServeMux()
+	p := NewPrimary(databases{"test": primary})
+	for _, path := range Paths {
+		mux.Handle(path, p)
+	}
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	now := time.Now().Truncate(time.Hour)
+	old := now.Add(-3 * time.Hour)
+
+	// sealed epoch (copied) and active epoch (replayed)
+	track(t, primary, old, []string{"a", "b"}, 3)
+	track(t, primary, old.Add(time.Minute), []string{"a", "c"}, 4)
+	track(t, primary, now, []string{"a", "b"}, 5)
+
+	r, err := NewReplica(replica, &Options{
+		URL:      ts.URL,
+		Database: "test",
+		State:    dir + "/state.json",
+		Interval: time.Hour,
+		Batch:    2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait(t, r)
+
+	if sum := total(t, replica, old, old.Add(time.Hour), []string{"a", "*"}); sum != 7 {
+		t.Fatal("wrong sealed epoch total", sum)
+	}
+
+	if sum := total(t, replica, now, now.Add(time.Hour), []string{"a", "*"}); sum != 5 {
+		t.Fatal("wrong active epoch total", sum)
+	}
+
+	// late write to a sealed epoch made after the snapshot
+	track(t, primary, old, []string{"a", "b"}, 1)
+	track(t, primary, now, []string{"a", "c"}, 2)
+
+	wait(t, r)
+
+	if sum := total(t, replica, old, old.Add(time.Hour), []string{"a", "*"}); sum != 8 {
+		t.Fatal("wrong sealed epoch total", sum)
+	}
+
+	if sum := total(t, replica, now, now.Add(time.Hour), []string{"a", "*"}); sum != 7 {
+		t.Fatal("wrong active epoch total", sum)
+	}
+
+	s := r.Status()
+	if !s.Ready || s.Lag != 0 || s.Offset != primary.Changes().End() || s.Synced.IsZero() {
+		t.Fatal("wrong status", s)
+	}
+
+	res := httptest.NewRecorder()
+	Replicas{"test": r}.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+
+	statuses := map[string]Status{}
+	if err := json.Unmarshal(res.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	} else if statuses["test"].Offset != s.Offset {
+		t.Fatal("wrong status response", statuses)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new replica continues from the saved state
+	track(t, primary, now, []string{"a", "b"}, 10)
+
+	r, err = NewReplica(replica, &Options{
+		URL:      ts.URL,
+		Database: "test",
+		State:    dir + "/state.json",
+		Interval: time.Hour,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	wait(t, r)
+
+	if sum := total(t, replica, now, now.Add(time.Hour), []string{"a", "*"}); sum != 17 {
+		t.Fatal("wrong active epoch total", sum)
+	}
+}
+
+func TestReplicaCopyOffset(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	primary := open(t, "primary", true)
+	defer primary.Close()
+
+	replica := open(t, "replica", false)
+	defer replica.Close()
+
+	now := time.Now().Truncate(time.Hour)
+	old := now.Add(-3 * time.Hour)
+	track(t, primary, old, []string{"a"}, 3)
+
+	// write to the sealed epoch after the snapshot but before the copy
+	p := NewPrimary(databases{"test": primary})
+	mux := http.NewServeMux()
+	mux.Handle(PathSnapshot, p)
+	mux.Handle(PathChanges, p)
+	mux.HandleFunc(PathEpoch, func(w http.ResponseWriter, r *http.Request) {
+		if err := primary.Track(uint64(old.UnixNano()), []string{"a"}, 1, 1); err != nil {
+			t.Error(err)
+		}
+
+		p.ServeHTTP(w, r)
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// replicas without state files would apply entries again after restarts
+	if _, err := NewReplica(replica, &Options{URL: ts.URL, Database: "test"}); err != ErrNoState {
+		t.Fatal("should require a state file")
+	}
+
+	r, err := NewReplica(replica, &Options{
+		URL:      ts.URL,
+		Database: "test",
+		State:    dir + "/state.json",
+		Interval: time.Hour,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	wait(t, r)
+
+	// the write is in the copy and it's not replayed
+	if sum := total(t, replica, old, old.Add(time.Hour), []string{"a"}); sum != 4 {
+		t.Fatal("wrong sealed epoch total", sum)
+	}
+}
+
+func TestReplicaRollups(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	rp := &kadiyadb.Params{
+		Duration:   int64(24 * time.Hour),
+		Resolution: int64(time.Hour),
+		Retention:  int64(7 * 24 * time.Hour),
+	}
+
+	openr := func(name string, cl bool) (db *kadiyadb.DB) {
+		p := &kadiyadb.Params{
+			Duration:    int64(time.Hour),
+			Resolution:  int64(time.Minute),
+			Retention:   int64(24 * time.Hour),
+			MaxROEpochs: 2,
+			MaxRWEpochs: 2,
+			Rollups:     []*kadiyadb.Params{rp},
+		}
+
+		if cl {
+			p.ChangeLog = &changelog.Options{}
+		}
+
+		db, err := kadiyadb.Open(dir+"/"+name, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return db
+	}
+
+	primary := openr("primary", true)
+	replica := openr("replica", false)
+
+	now := time.Now().Truncate(time.Hour)
+	old := now.Add(-3 * time.Hour)
+	track(t, primary, old, []string{"a"}, 3)
+	track(t, primary, now, []string{"a"}, 5)
+
+	// writes to sealed epochs while epochs and rollup epochs are copied
+	p := NewPrimary(databases{"test": primary})
+	mux := http.NewServeMux()
+	mux.Handle(PathSnapshot, p)
+	mux.Handle(PathChanges, p)
+	mux.HandleFunc(PathEpoch, func(w http.ResponseWriter, r *http.Request) {
+		if err := primary.Track(uint64(old.UnixNano()), []string{"a"}, 1, 1); err != nil {
+			t.Error(err)
+		}
+
+		p.ServeHTTP(w, r)
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	r, err := NewReplica(replica, &Options{
+		URL:      ts.URL,
+		Database: "test",
+		State:    dir + "/state.json",
+		Interval: time.Hour,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait(t, r)
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.state.Rollups["rollup_1h0m0s"]) == 0 {
+		t.Fatal("rollup epochs are not copied", r.state)
+	}
+
+	// copied epochs keep the offset of the copy
+	start := old.UnixNano()
+	offset, err := replica.ReadEpoch(start, nil)
+	if err != kadiyadb.ErrEpochExists || offset != r.state.Epochs[start] {
+		t.Fatal("wrong offset", offset, err)
+	}
+
+	from, to := old.Add(-time.Hour), now.Add(time.Hour)
+	exp := total(t, primary, from, to, []string{"a"})
+	if sum := total(t, replica, from, to, []string{"a"}); sum != exp {
+		t.Fatal("wrong total", sum, exp)
+	}
+
+	if err := primary.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := replica.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rollups have the same data as rollups of the primary
+	rp.MaxROEpochs, rp.MaxRWEpochs = 2, 2
+	sums := make([]float64, 2)
+	for i, name := range []string{"primary", "replica"} {
+		db, err := kadiyadb.Open(dir+"/"+name+"/rollup_1h0m0s", rp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sums[i] = total(t, db, from, to, []string{"a"})
+		db.Close()
+	}
+
+	if sums[0] == 0 || sums[0] != sums[1] {
+		t.Fatal("wrong rollup totals", sums)
+	}
+}
+
+func TestPrimaryErrors(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	db := open(t, "nolog", false)
+	defer db.Close()
+
+	p := NewPrimary(databases{"nolog": db})
+
+	cases := []struct {
+		method, url string
+		code        int
+	}{
+		{"GET", PathSnapshot + "?db=nope", 404},
+		{"POST", PathSnapshot + "?db=nolog", 405},
+		{"GET", PathSnapshot + "?db=nolog", 409},
+		{"GET", PathChanges + "?db=nolog&offset=0", 409},
+		{"GET", PathChanges + "?db=nolog&offset=x", 400},
+		{"GET", PathEpoch + "?db=nolog&start=x", 400},
+		{"GET", PathEpoch + "?db=nolog&start=1", 404},
+		{"GET", PathEpoch + "?db=nolog&rollup=nope&start=1", 404},
+	}
+
+	for _, c := range cases {
+		res := httptest.NewRecorder()
+		p.ServeHTTP(res, httptest.NewRequest(c.method, c.url, nil))
+		if res.Code != c.code {
+			t.Fatal("wrong status", c.method, c.url, res.Code)
+		}
+	}
+
+	// the epoch cannot be copied because paths in the copy are longer
+	// than the maximum path length (copies are made in the db directory)
+	start := strconv.FormatInt(time.Now().Truncate(time.Hour).UnixNano(), 10)
+	long := dir + "/nolog/" + start
+	for len(long)+201 < 4090 {
+		long += "/" + strings.Repeat("x", 200)
+	}
+	if n := 4090 - len(long) - 1; n > 0 {
+		long += "/" + strings.Repeat("x", n)
+	}
+
+	if err := os.MkdirAll(long, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// errors before writing any data are sent to the replica
+	res := httptest.NewRecorder()
+	p.ServeHTTP(res, httptest.NewRequest("GET", PathEpoch+"?db=nolog&start="+start, nil))
+	if res.Code != 500 || res.Body.Len() == 0 {
+		t.Fatal("wrong status", res.Code)
+	}
+}
@@ -0,0 +1,101 @@
+package kadiyadb
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+var (
+	// ErrInvStep is returned when the resample step is not a multiple
+	// of the resolution of one or more chunks given to be resampled.
+	ErrInvStep = errors.New("invalid resample step")
+)
+
+// FetchStep fetches data the same way as Fetch but merges chunks into a
+// single chunk with points `step` nanoseconds apart. The step must be a
+// multiple of resolutions of all epochs in the requested time range.
+func (d *DB) FetchStep(from, to uint64, step int64, fields []string, fn Handler) {
+	d.Fetch(from, to, fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		chunk, err := Resample(chunks, step)
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		if chunk == nil {
+			fn([]*protocol.Chunk{}, nil)
+			return
+		}
+
+		fn([]*protocol.Chunk{chunk}, nil)
+	})
+}
+
+// Resample merges consecutive chunks (possibly with different resolutions)
+// into a single chunk with points `step` nanoseconds apart starting from the
+// start of the first chunk. Totals and counts of merged points are summed up.
+// Series are matched by their fields and are ordered by first appearance.
+// The result does not share memory with given chunks.
+func Resample(chunks []*protocol.Chunk, step int64) (res *protocol.Chunk, err error) {
+	if step <= 0 {
+		return nil, ErrInvStep
+	}
+
+	if len(chunks) == 0 {
+		return nil, nil
+	}
+
+	from := chunks[0].From
+	to := chunks[len(chunks)-1].To
+	size := (int64(to-from) + step - 1) / step
+
+	res = &protocol.Chunk{
+		From:   from,
+		To:     from + uint64(size*step),
+		Series: []*protocol.Series{},
+	}
+
+	byFields := map[string]*protocol.Series{}
+
+	for _, c := range chunks {
+		for _, s := range c.Series {
+			count := int64(len(s.Points))
+			if count == 0 {
+				continue
+			}
+
+			resolution := int64(c.To-c.From) / count
+			if step%resolution != 0 {
+				return nil, ErrInvStep
+			}
+
+			key := strings.Join(s.Fields, "\x00")
+			rs, ok := byFields[key]
+			if !ok {
+				rs = &protocol.Series{
+					Fields: append([]string{}, s.Fields...),
+					Points: make([]protocol.Point, size),
+				}
+
+				byFields[key] = rs
+				res.Series = append(res.Series, rs)
+			}
+
+			start := int64(c.From - from)
+			for i, p := range s.Points {
+				j := (start + int64(i)*resolution) / step
+				rs.Points[j].Total += p.Total
+				rs.Points[j].Count += p.Count
+			}
+		}
+	}
+
+	return res, nil
+}
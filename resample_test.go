@@ -0,0 +1,54 @@
+package kadiyadb
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestResample(t *testing.T) {
+	chunks := []*protocol.Chunk{
+		{
+			From: 0,
+			To:   4,
+			Series: []*protocol.Series{
+				{Fields: []string{"a"}, Points: []protocol.Point{{1, 1}, {2, 1}}},
+			},
+		},
+		{
+			From: 4,
+			To:   8,
+			Series: []*protocol.Series{
+				{Fields: []string{"b"}, Points: []protocol.Point{{1, 1}, {1, 1}, {1, 1}, {1, 1}}},
+				{Fields: []string{"a"}, Points: []protocol.Point{{1, 1}, {1, 1}, {1, 1}, {1, 1}}},
+			},
+		},
+	}
+
+	res, err := Resample(chunks, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := &protocol.Chunk{
+		From: 0,
+		To:   8,
+		Series: []*protocol.Series{
+			{Fields: []string{"a"}, Points: []protocol.Point{{3, 2}, {4, 4}}},
+			{Fields: []string{"b"}, Points: []protocol.Point{{0, 0}, {4, 4}}},
+		},
+	}
+
+	if !reflect.DeepEqual(res, exp) {
+		t.Fatal("wrong result")
+	}
+
+	if _, err := Resample(chunks, 3); err != ErrInvStep {
+		t.Fatal("should return an error")
+	}
+
+	if res, err := Resample(nil, 4); err != nil || res != nil {
+		t.Fatal("should return nil")
+	}
+}
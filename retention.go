@@ -0,0 +1,59 @@
+package kadiyadb
+
+import (
+	"time"
+)
+
+var (
+	// retentionInterval is the time between two runs of the retention worker.
+	// Expired epochs are removed from the disk when the retention worker runs.
+	retentionInterval = time.Minute
+)
+
+// retain runs the retention worker until the database is closed
+// The worker can be run immediately by sending a value to d.wake.
+func (d *DB) retain() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+
+		d.expire()
+	}
+}
+
+// rwake runs the retention worker without waiting for the next interval.
+// This does not block if the worker is already scheduled to run.
+func (d *DB) rwake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// expire removes all epochs which only have data older than retention
+func (d *DB) expire() {
+	d.histmtx.RLock()
+	retention := d.params.Retention
+	d.histmtx.RUnlock()
+
+	// all points in epochs before the epoch containing
+	// the retention start time are older than retention
+	now := time.Now().UnixNano()
+	m, _ := d.split(now - retention)
+
+	// epochs cannot be frozen while expiring and frozen epochs are kept
+	// because they are being copied (see copyEpoch)
+	d.barrier.RLock()
+	defer d.barrier.RUnlock()
+
+	d.cache.Expire(m.Start, func(start int64) bool {
+		return d.frozen[start]
+	})
+}
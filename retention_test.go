@@ -0,0 +1,86 @@
+package kadiyadb
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpire(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UnixNano()
+	old := now - 2*p.Retention
+	fields := []string{"a", "b"}
+
+	if err := db.Track(uint64(old), fields, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Track(uint64(now), fields, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// epochs loaded in read-write mode are not expired
+	// reopen the database to make sure they're unloaded
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// frozen epochs are being copied and they are not expired
+	db.freeze(old - old%p.Duration)
+	db.expire()
+
+	oldDir := dir + "/" + strconv.FormatInt(old-old%p.Duration, 10)
+	if _, err := os.Stat(oldDir); err != nil {
+		t.Fatal("frozen epoch should not be removed")
+	}
+
+	db.unfreeze(old - old%p.Duration)
+	db.expire()
+
+	if _, err := os.Stat(oldDir); !os.IsNotExist(err) {
+		t.Fatal("old epoch should be removed")
+	}
+
+	newDir := dir + "/" + strconv.FormatInt(now-now%p.Duration, 10)
+	if _, err := os.Stat(newDir); err != nil {
+		t.Fatal("new epoch should not be removed")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closing again should not panic
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,158 @@
+package kadiyadb
+
+import (
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	// rollup directory prefix
+	// rollup directories will be named "rollup_1h0m0s, rollup_24h0m0s, ..."
+	prefixrollup = "rollup_"
+)
+
+// rollups is used to sort rollup databases by resolution
+type rollups []*DB
+
+func (a rollups) Len() int           { return len(a) }
+func (a rollups) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a rollups) Less(i, j int) bool { return a[i].params.Resolution < a[j].params.Resolution }
+
+// rollup returns a copy of rollup params with default values filled in.
+// Unless a duration is given, rollup epochs have the same number of points
+// as database epochs (or less, if needed to evenly divide the retention).
+// Rollups use the same epoch cache size limits unless they are given.
+func (p *Params) rollup(r *Params) (rp *Params) {
+	params := *r
+
+	if params.Duration == 0 && params.Resolution > 0 && p.Resolution > 0 {
+		params.Duration = params.Resolution * (p.Duration / p.Resolution)
+		if params.Retention%params.Resolution == 0 {
+			params.Duration = gcd(params.Duration, params.Retention)
+		}
+
+		params.DurationStr = time.Duration(params.Duration).String()
+	}
+
+	if params.MaxROEpochs == 0 {
+		params.MaxROEpochs = p.MaxROEpochs
+	}
+
+	if params.MaxRWEpochs == 0 {
+		params.MaxRWEpochs = p.MaxRWEpochs
+	}
+
+	return &params
+}
+
+// validRollups checks whether rollup params can be used with the database.
+// Rollups must have coarser resolutions than the database and other rollups
+// with finer resolutions. Rollups cannot have rollups or change logs.
+func (p *Params) validRollups() bool {
+	resolutions := make(map[int64]bool, len(p.Rollups))
+
+	for _, r := range p.Rollups {
+		if r == nil {
+			return false
+		}
+
+		rp := p.rollup(r)
+		if len(rp.Rollups) > 0 ||
+			rp.ChangeLog != nil ||
+			rp.Resolution <= p.Resolution ||
+			resolutions[rp.Resolution] ||
+			!rp.valid() {
+			return false
+		}
+
+		resolutions[rp.Resolution] = true
+	}
+
+	return true
+}
+
+// openRollups opens all rollup databases in the database directory.
+// Rollups are sorted by resolution starting from the finest resolution.
+func (d *DB) openRollups() (err error) {
+	for _, r := range d.params.Rollups {
+		rp := d.params.rollup(r)
+		dir := rollupDir(d.dir, rp.Resolution)
+
+		db, err := Open(dir, rp)
+		if err != nil {
+			return err
+		}
+
+		d.rollups = append(d.rollups, db)
+	}
+
+	sort.Sort(rollups(d.rollups))
+
+	return nil
+}
+
+// tier returns the database (this one or a rollup) with the finest resolution
+// which still retains data from given time. If none of them retains data for
+// given time, the one with the longest retention period will be returned.
+func (d *DB) tier(ts int64) (db *DB) {
+	now := time.Now().UnixNano()
+	best := d
+	bestRet := d.retention()
+
+	if now-bestRet <= ts {
+		return d
+	}
+
+	for _, r := range d.rollups {
+		ret := r.retention()
+		if now-ret <= ts {
+			return r
+		}
+
+		if ret > bestRet {
+			best = r
+			bestRet = ret
+		}
+	}
+
+	return best
+}
+
+// retention returns the current retention period of the database
+func (d *DB) retention() (ret int64) {
+	d.histmtx.RLock()
+	defer d.histmtx.RUnlock()
+
+	return d.params.Retention
+}
+
+// gcd returns the greatest common divisor of a and b
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
+
+// name returns the name of a rollup database (its directory name)
+func (d *DB) name() string {
+	return path.Base(d.dir)
+}
+
+// findRollup returns the rollup with given name or nil if it does not exist
+func (d *DB) findRollup(name string) (r *DB) {
+	for _, r := range d.rollups {
+		if r.name() == name {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// rollupDir returns the directory used to store a rollup database
+func rollupDir(dir string, res int64) string {
+	return path.Join(dir, prefixrollup+time.Duration(res).String())
+}
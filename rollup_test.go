@@ -0,0 +1,154 @@
+package kadiyadb
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestParseParamsRollups(t *testing.T) {
+	data := []byte(`
+  {
+    "duration": "1h",
+    "resolution": "1m",
+    "retention": "2h",
+    "maxROEpochs": 10,
+    "maxRWEpochs": 3,
+    "rollups": [
+      {"resolution": "1h", "retention": "48h"},
+      {"duration": "120h", "resolution": "24h", "retention": "8760h", "maxROEpochs": 1}
+    ]
+  }`)
+
+	p, err := ParseParams(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.valid() {
+		t.Fatal("params should be valid")
+	}
+
+	r0 := p.rollup(p.Rollups[0])
+	if r0.Duration != int64(12*time.Hour) ||
+		r0.Resolution != int64(time.Hour) ||
+		r0.Retention != int64(48*time.Hour) ||
+		r0.MaxROEpochs != 10 ||
+		r0.MaxRWEpochs != 3 {
+		t.Fatal("wrong rollup params")
+	}
+
+	r1 := p.rollup(p.Rollups[1])
+	if r1.Duration != int64(120*time.Hour) ||
+		r1.MaxROEpochs != 1 ||
+		r1.MaxRWEpochs != 3 {
+		t.Fatal("wrong rollup params")
+	}
+
+	// rollups must have a coarser resolution
+	p.Rollups[0].Resolution = p.Resolution
+	if p.valid() {
+		t.Fatal("params should be invalid")
+	}
+}
+
+func TestRollups(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    int64(time.Hour),
+		Retention:   int64(2 * time.Hour),
+		Resolution:  int64(time.Minute),
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+		Rollups: []*Params{
+			{Resolution: int64(24 * time.Hour), Retention: int64(240 * time.Hour)},
+			{Resolution: int64(time.Hour), Retention: int64(48 * time.Hour)},
+		},
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.rollups) != 2 ||
+		db.rollups[0].params.Resolution != int64(time.Hour) ||
+		db.rollups[1].params.Resolution != int64(24*time.Hour) {
+		t.Fatal("wrong rollups")
+	}
+
+	if _, err := os.Stat(dir + "/rollup_1h0m0s"); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UnixNano()
+	hour := int64(time.Hour)
+	start := now - now%hour - 3*hour
+	fields := []string{"a", "b"}
+
+	for i := int64(0); i < 4; i++ {
+		ts := uint64(start + i*int64(time.Minute))
+		if err := db.Track(ts, fields, 2, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	// older than raw data retention, should use the 1h rollup
+	db.Fetch(uint64(start), uint64(start+hour), fields, func(res []*protocol.Chunk, err error) {
+		defer wg.Done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || len(res[0].Series) != 1 {
+			t.Fatal("wrong result")
+		}
+
+		points := []protocol.Point{{8, 4}}
+		if !reflect.DeepEqual(res[0].Series[0].Points, points) {
+			t.Fatal("wrong points")
+		}
+	})
+
+	// within raw data retention, should use raw data
+	from := uint64(now - now%hour)
+	db.Fetch(from, from+uint64(time.Minute), fields, func(res []*protocol.Chunk, err error) {
+		defer wg.Done()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res) != 1 || res[0].To-res[0].From != uint64(time.Minute) {
+			t.Fatal("wrong result")
+		}
+	})
+
+	wg.Wait()
+
+	if db.tier(now-int64(1000*time.Hour)) != db.rollups[1] {
+		t.Fatal("should use the rollup with longest retention")
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,187 @@
+package rpc
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	// ErrBadResponse is returned when the response doesn't match the request
+	ErrBadResponse = errors.New("invalid response")
+)
+
+// Client sends requests to a server. Requests can be sent concurrently
+// from multiple goroutines and they will be pipelined on one connection.
+type Client struct {
+	conn  net.Conn
+	w     *bufio.Writer
+	wmtx  *sync.Mutex
+	calls map[uint64]chan *Response
+	cmtx  *sync.Mutex
+	next  uint64
+	err   error
+}
+
+// Dial connects to a server on given address
+func Dial(addr string) (c *Client, err error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn), nil
+}
+
+// NewClient creates a client which uses given connection
+func NewClient(conn net.Conn) (c *Client) {
+	c = &Client{
+		conn:  conn,
+		w:     bufio.NewWriter(conn),
+		wmtx:  &sync.Mutex{},
+		calls: map[uint64]chan *Response{},
+		cmtx:  &sync.Mutex{},
+	}
+
+	go c.read()
+
+	return c
+}
+
+// Call sends a request and waits for its response. The request id
+// is set by the client. Errors set on the response are returned.
+// If the request cannot be written, the stream may have a partial
+// frame in it therefore the connection fails with all pending calls.
+func (c *Client) Call(req *Request) (res *Response, err error) {
+	ch := make(chan *Response, 1)
+
+	c.cmtx.Lock()
+	if c.err != nil {
+		err := c.err
+		c.cmtx.Unlock()
+		return nil, err
+	}
+	c.next++
+	req.Id = c.next
+	c.calls[req.Id] = ch
+	c.cmtx.Unlock()
+
+	data, err := encodeFrame(req)
+	if err != nil {
+		c.cmtx.Lock()
+		delete(c.calls, req.Id)
+		c.cmtx.Unlock()
+		return nil, err
+	}
+
+	c.wmtx.Lock()
+	_, err = c.w.Write(data)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	c.wmtx.Unlock()
+
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	res, ok := <-ch
+	if !ok {
+		c.cmtx.Lock()
+		err := c.err
+		c.cmtx.Unlock()
+		return nil, err
+	}
+
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+
+	return res, nil
+}
+
+// Track sends a batch of track requests. Results are in the same order
+// as requests and each of them contain an error if the request failed.
+func (c *Client) Track(reqs []*TrackReq) (res []*TrackRes, err error) {
+	r, err := c.Call(&Request{Track: reqs})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Track) != len(reqs) {
+		return nil, ErrBadResponse
+	}
+
+	return r.Track, nil
+}
+
+// Fetch sends a batch of fetch requests. Results are in the same order
+// as requests and each of them contain an error if the request failed.
+func (c *Client) Fetch(reqs []*FetchReq) (res []*FetchRes, err error) {
+	r, err := c.Call(&Request{Fetch: reqs})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(r.Fetch) != len(reqs) {
+		return nil, ErrBadResponse
+	}
+
+	return r.Fetch, nil
+}
+
+// Close closes the connection. Pending calls will fail with ErrClosed.
+func (c *Client) Close() (err error) {
+	c.cmtx.Lock()
+	defer c.cmtx.Unlock()
+
+	// the connection is already closed if it has failed
+	if c.err != nil {
+		return nil
+	}
+
+	c.err = ErrClosed
+	return c.conn.Close()
+}
+
+// read reads responses and sends them to waiting calls. When the
+// connection fails, all pending calls and future calls will fail.
+func (c *Client) read() {
+	r := bufio.NewReader(c.conn)
+
+	for {
+		res := &Response{}
+		if err := readFrame(r, res); err != nil {
+			c.fail(err)
+			return
+		}
+
+		c.cmtx.Lock()
+		ch, ok := c.calls[res.Id]
+		delete(c.calls, res.Id)
+		c.cmtx.Unlock()
+
+		if ok {
+			ch <- res
+		}
+	}
+}
+
+// fail closes all pending calls after a connection error
+func (c *Client) fail(err error) {
+	c.cmtx.Lock()
+	defer c.cmtx.Unlock()
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	for id, ch := range c.calls {
+		close(ch)
+		delete(c.calls, id)
+	}
+
+	c.conn.Close()
+}
@@ -0,0 +1,144 @@
+package rpc
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	dbs := setup(t)
+	defer dbs["test"].Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(dbs)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	c, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := hour()
+
+	// pipeline requests from multiple goroutines on the same connection
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res, err := c.Track([]*TrackReq{
+				{Database: "test", Time: now, Fields: []string{"a", "b"}, Total: 1, Count: 1},
+				{Database: "test", Time: now, Fields: []string{"a", "c"}, Total: 2, Count: 1},
+			})
+
+			if err != nil {
+				errs <- err
+			} else if res[0].Error != "" || res[1].Error != "" {
+				t.Error("wrong track results")
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	res, err := c.Fetch([]*FetchReq{
+		{Database: "test", From: now, To: now + uint64(time.Minute), Fields: []string{"a", "b"}},
+		{Database: "test", From: now, To: now + uint64(time.Minute), Fields: []string{"a", "*"}},
+		{Database: "nope", From: now, To: now + uint64(time.Minute), Fields: []string{"a"}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res) != 3 ||
+		len(res[0].Chunks) != 1 ||
+		len(res[0].Chunks[0].Series) != 1 ||
+		res[0].Chunks[0].Series[0].Points[0].Total != 100 ||
+		res[0].Chunks[0].Series[0].Points[0].Count != 100 {
+		t.Fatal("wrong fetch result")
+	}
+
+	if len(res[1].Chunks) != 1 || len(res[1].Chunks[0].Series) != 2 {
+		t.Fatal("wrong wildcard fetch result")
+	}
+
+	if res[2].Error != ErrNoDB.Error() {
+		t.Fatal("should fail with missing databases")
+	}
+
+	if _, err := c.Call(&Request{}); err == nil || err.Error() != ErrEmpty.Error() {
+		t.Fatal("should return request errors")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Track([]*TrackReq{{Database: "test"}}); err == nil {
+		t.Fatal("should fail after the server is closed")
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failConn is a connection which fails to write after n bytes
+type failConn struct {
+	net.Conn
+	n int
+}
+
+func (c *failConn) Write(p []byte) (n int, err error) {
+	if len(p) > c.n {
+		n, _ = c.Conn.Write(p[:c.n])
+		c.n = 0
+		return n, errors.New("write failed")
+	}
+
+	c.n -= len(p)
+	return c.Conn.Write(p)
+}
+
+func TestClientWriteError(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	// the peer reads the partial frame written before the error
+	go ioutil.ReadAll(peer)
+
+	c := NewClient(&failConn{Conn: conn, n: 2})
+	defer c.Close()
+
+	req := &Request{Track: []*TrackReq{{Database: "test"}}}
+	if _, err := c.Call(req); err == nil || err.Error() != "write failed" {
+		t.Fatal("should return the write error", err)
+	}
+
+	// the stream has a partial frame therefore the connection must fail
+	if _, err := c.Call(req); err == nil || err.Error() != "write failed" {
+		t.Fatal("should fail after a write error", err)
+	}
+}
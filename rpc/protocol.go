@@ -0,0 +1,2 @@
+//go:generate protoc -I $PWD -I $GOPATH/src -I $GOPATH/src/github.com/google/protobuf/src --gogofaster_out=. $PWD/protocol.proto
+package rpc
@@ -0,0 +1,87 @@
+// Package rpc implements a binary request/response protocol over TCP.
+// Messages are protocol buffers (see protocol.proto) written to the
+// connection with a length prefix. Each request has an id which is sent
+// back with its response therefore clients can pipeline requests and
+// the server can respond to them in any order.
+//
+// Frame Format:
+//
+//	+----------------+------------------------------+
+//	| length: uint32 | message: protobuf (length B) |
+//	+----------------+------------------------------+
+//
+// The length is encoded in big-endian byte order.
+package rpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// MaxFrameSize is the maximum size of a message in bytes
+	MaxFrameSize = 1024 * 1024 * 64
+)
+
+var (
+	// ErrFrameSize is returned when a message is larger than MaxFrameSize
+	ErrFrameSize = errors.New("frame size exceeds the limit")
+
+	// ErrClosed is returned when using a closed client
+	ErrClosed = errors.New("connection closed")
+)
+
+// message is implemented by protocol buffer messages used with rpc
+type message interface {
+	Size() int
+	MarshalTo(data []byte) (int, error)
+	Unmarshal(data []byte) error
+}
+
+// writeFrame encodes the message and writes it with a length prefix
+func writeFrame(w io.Writer, m message) (err error) {
+	data, err := encodeFrame(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// encodeFrame encodes the message with a length prefix
+func encodeFrame(m message) (data []byte, err error) {
+	size := m.Size()
+	if size > MaxFrameSize {
+		return nil, ErrFrameSize
+	}
+
+	data = make([]byte, 4+size)
+	binary.BigEndian.PutUint32(data, uint32(size))
+	if _, err := m.MarshalTo(data[4:]); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// readFrame reads a length prefixed message and decodes it into m
+func readFrame(r io.Reader, m message) (err error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(head[:])
+	if size > MaxFrameSize {
+		return ErrFrameSize
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	return m.Unmarshal(data)
+}
@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func TestFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	req := &Request{
+		Id: 5,
+		Track: []*TrackReq{
+			{Database: "test", Time: 10, Fields: []string{"a", "b"}, Total: 1.5, Count: 2},
+		},
+		Fetch: []*FetchReq{
+			{Database: "test", From: 10, To: 20, Fields: []string{"a", "*"}},
+		},
+	}
+
+	res := &Response{
+		Id: 5,
+		Track: []*TrackRes{
+			{Error: "err"},
+		},
+		Fetch: []*FetchRes{
+			{Chunks: []*protocol.Chunk{{
+				From: 10,
+				To:   20,
+				Series: []*protocol.Series{
+					{Fields: []string{"a", "b"}, Points: []protocol.Point{{1.5, 2}}},
+				},
+			}}},
+		},
+	}
+
+	if err := writeFrame(buf, req); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(buf, res); err != nil {
+		t.Fatal(err)
+	}
+
+	req2 := &Request{}
+	if err := readFrame(buf, req2); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(req, req2) {
+		t.Fatal("wrong request")
+	}
+
+	res2 := &Response{}
+	if err := readFrame(buf, res2); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(res, res2) {
+		t.Fatal("wrong response")
+	}
+
+	// frames larger than the limit must not be read
+	head := make([]byte, 4)
+	binary.BigEndian.PutUint32(head, MaxFrameSize+1)
+	if err := readFrame(bytes.NewBuffer(head), &Request{}); err != ErrFrameSize {
+		t.Fatal("should fail with large frames")
+	}
+}
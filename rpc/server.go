@@ -0,0 +1,280 @@
+package rpc
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+const (
+	// maxPending is the maximum number of requests of a connection which are
+	// processed concurrently. More requests are not read until one completes.
+	maxPending = 64
+)
+
+var (
+	// ErrNoDB is returned when the requested database does not exist
+	ErrNoDB = errors.New("database not found")
+
+	// ErrEmpty is returned when a request has no track or fetch requests
+	ErrEmpty = errors.New("empty request")
+)
+
+// DBMap is a map of databases which can be used as kadiyadb.Databases.
+// The map must not be modified while it's used by a server.
+type DBMap map[string]*kadiyadb.DB
+
+// DB returns the database with given name or nil if it doesn't exist
+func (m DBMap) DB(name string) (db *kadiyadb.DB) {
+	return m[name]
+}
+
+// Server dispatches requests received over TCP to databases
+type Server struct {
+	dbs    kadiyadb.Databases
+	lis    net.Listener
+	conns  map[net.Conn]bool
+	mtx    *sync.Mutex
+	wg     *sync.WaitGroup
+	closed bool
+}
+
+// NewServer creates a server which serves given databases
+func NewServer(dbs kadiyadb.Databases) (s *Server) {
+	return &Server{
+		dbs:   dbs,
+		conns: map[net.Conn]bool{},
+		mtx:   &sync.Mutex{},
+		wg:    &sync.WaitGroup{},
+	}
+}
+
+// ListenAndServe starts the server on given address. This function
+// blocks until the server is stopped with the Close method (or fails).
+func (s *Server) ListenAndServe(addr string) (err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve accepts connections from given listener. This function
+// blocks until the server is stopped with the Close method (or fails).
+func (s *Server) Serve(l net.Listener) (err error) {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		l.Close()
+		return nil
+	}
+	s.lis = l
+	s.mtx.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			closed := s.closed
+			s.mtx.Unlock()
+
+			if closed {
+				return nil
+			}
+
+			return err
+		}
+
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mtx.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections, closes all active connections
+// and waits until requests which are being processed are completed.
+func (s *Server) Close() (err error) {
+	s.mtx.Lock()
+	s.closed = true
+
+	if s.lis != nil {
+		if err := s.lis.Close(); err != nil {
+			s.mtx.Unlock()
+			return err
+		}
+	}
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mtx.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// serveConn reads requests from the connection and processes them
+// concurrently (up to maxPending requests at a time). Responses are
+// written as soon as they are ready.
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	wmtx := &sync.Mutex{}
+	reqs := &sync.WaitGroup{}
+	pending := make(chan struct{}, maxPending)
+
+	for {
+		req := &Request{}
+		if err := readFrame(r, req); err != nil {
+			break
+		}
+
+		pending <- struct{}{}
+		reqs.Add(1)
+		go func() {
+			defer func() { <-pending }()
+			defer reqs.Done()
+			res := s.Handle(req)
+
+			wmtx.Lock()
+			defer wmtx.Unlock()
+
+			// the frame is not written if it's too large and only this
+			// request fails (other requests can use the connection)
+			err := writeFrame(w, res)
+			if err == ErrFrameSize {
+				err = writeFrame(w, &Response{Id: req.Id, Error: err.Error()})
+			}
+
+			if err != nil {
+				conn.Close()
+				return
+			}
+
+			if err := w.Flush(); err != nil {
+				conn.Close()
+			}
+		}()
+	}
+
+	reqs.Wait()
+	conn.Close()
+
+	s.mtx.Lock()
+	delete(s.conns, conn)
+	s.mtx.Unlock()
+}
+
+// Handle processes a request and returns the response. Track requests
+// are processed before fetch requests when both are in the same batch.
+func (s *Server) Handle(req *Request) (res *Response) {
+	res = &Response{Id: req.Id}
+
+	if len(req.Track) == 0 && len(req.Fetch) == 0 {
+		res.Error = ErrEmpty.Error()
+		return res
+	}
+
+	if len(req.Track) > 0 {
+		res.Track = make([]*TrackRes, len(req.Track))
+		for i, r := range req.Track {
+			res.Track[i] = s.track(r)
+		}
+	}
+
+	if len(req.Fetch) > 0 {
+		res.Fetch = make([]*FetchRes, len(req.Fetch))
+		for i, r := range req.Fetch {
+			res.Fetch[i] = s.fetch(r)
+		}
+	}
+
+	return res
+}
+
+func (s *Server) track(req *TrackReq) (res *TrackRes) {
+	res = &TrackRes{}
+
+	db := s.dbs.DB(req.Database)
+	if db == nil {
+		res.Error = ErrNoDB.Error()
+		return res
+	}
+
+	// wildcards and empty fields can only be used in fetch requests
+	if len(req.Fields) == 0 {
+		res.Error = index.ErrInvFields.Error()
+		return res
+	}
+
+	for _, f := range req.Fields {
+		if f == "" || f == "*" {
+			res.Error = index.ErrInvFields.Error()
+			return res
+		}
+	}
+
+	if err := db.Track(req.Time, req.Fields, req.Total, req.Count); err != nil {
+		res.Error = err.Error()
+	}
+
+	return res
+}
+
+func (s *Server) fetch(req *FetchReq) (res *FetchRes) {
+	res = &FetchRes{}
+
+	db := s.dbs.DB(req.Database)
+	if db == nil {
+		res.Error = ErrNoDB.Error()
+		return res
+	}
+
+	// Fetch result is only valid inside the handler function
+	// therefore a copy is made to encode it after it returns.
+	db.Fetch(req.From, req.To, req.Fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			res.Error = err.Error()
+			return
+		}
+
+		res.Chunks = copyChunks(chunks)
+	})
+
+	return res
+}
+
+// copyChunks makes a copy of chunks which does not share memory with them
+func copyChunks(chunks []*protocol.Chunk) (res []*protocol.Chunk) {
+	res = make([]*protocol.Chunk, len(chunks))
+
+	for i, c := range chunks {
+		series := make([]*protocol.Series, len(c.Series))
+		for j, s := range c.Series {
+			series[j] = &protocol.Series{
+				Fields: append([]string{}, s.Fields...),
+				Points: append([]protocol.Point{}, s.Points...),
+			}
+		}
+
+		res[i] = &protocol.Chunk{From: c.From, To: c.To, Series: series}
+	}
+
+	return res
+}
@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb/index"
+)
+
+const (
+	dir = "/tmp/test-rpc"
+)
+
+func setup(t *testing.T) (dbs DBMap) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := kadiyadb.Open(dir+"/test", &kadiyadb.Params{
+		Duration:    int64(time.Hour),
+		Resolution:  int64(time.Minute),
+		Retention:   int64(24 * time.Hour),
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return DBMap{"test": db}
+}
+
+func hour() uint64 {
+	now := uint64(time.Now().UnixNano())
+	return now - now%uint64(time.Hour)
+}
+
+func TestHandle(t *testing.T) {
+	dbs := setup(t)
+	defer dbs["test"].Close()
+
+	s := NewServer(dbs)
+	now := hour()
+
+	res := s.Handle(&Request{Id: 3})
+	if res.Id != 3 || res.Error != ErrEmpty.Error() {
+		t.Fatal("should fail with empty requests")
+	}
+
+	res = s.Handle(&Request{
+		Id: 4,
+		Track: []*TrackReq{
+			{Database: "test", Time: now, Fields: []string{"a", "b"}, Total: 5, Count: 1},
+			{Database: "nope", Time: now, Fields: []string{"a", "b"}, Total: 5, Count: 1},
+			{Database: "test", Time: now, Fields: []string{"a", "*"}, Total: 5, Count: 1},
+		},
+		Fetch: []*FetchReq{
+			{Database: "test", From: now, To: now + uint64(time.Minute), Fields: []string{"a", "b"}},
+			{Database: "test", From: now + 1, To: now, Fields: []string{"a", "b"}},
+		},
+	})
+
+	if res.Id != 4 || res.Error != "" {
+		t.Fatal("wrong response")
+	}
+
+	if len(res.Track) != 3 ||
+		res.Track[0].Error != "" ||
+		res.Track[1].Error != ErrNoDB.Error() ||
+		res.Track[2].Error != index.ErrInvFields.Error() {
+		t.Fatal("wrong track results")
+	}
+
+	if len(res.Fetch) != 2 ||
+		res.Fetch[0].Error != "" ||
+		res.Fetch[1].Error == "" {
+		t.Fatal("wrong fetch results")
+	}
+
+	chunks := res.Fetch[0].Chunks
+	if len(chunks) != 1 ||
+		len(chunks[0].Series) != 1 ||
+		chunks[0].Series[0].Points[0].Total != 5 {
+		t.Fatal("wrong chunks")
+	}
+}
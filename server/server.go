@@ -0,0 +1,836 @@
+// Package server exposes kadiyadb databases over HTTP with JSON encoding.
+//
+// Endpoints:
+//
+//	GET  /health                     server health check
+//	GET  /metrics                    internal metrics (Prometheus text format)
+//	GET  /db                         list database names
+//	POST /db/{name}                  create a database (body: params.json)
+//	POST /db/{name}/track            track one or more measurements
+//	GET  /db/{name}/fetch            fetch data (from, to, fields)
+//	GET  /db/{name}/query            run a text query (q)
+//	GET  /db/{name}/subscribe        stream live updates (fields, buffer)
+//	GET  /db/{name}/backup           download a backup (tar, see DB.Backup)
+//
+// Track requests take a measurement or an array of measurements:
+//
+//	{"time": 1450000000000000000, "fields": ["a", "b"], "total": 5, "count": 1}
+//
+// Fetch requests take timestamps in nanoseconds and comma separated fields:
+//
+//	/db/{name}/fetch?from=1450000000000000000&to=1450003600000000000&fields=a,*
+//
+// Relative time ranges can be used instead of from and to timestamps:
+//
+//	/db/{name}/fetch?range=-24h..now&fields=a,*
+//
+// Points can be merged into calendar day or week buckets of a timezone
+// (UTC if not given). A chunk is returned for each day or week:
+//
+//	/db/{name}/fetch?range=-7d..now&fields=a,*&bucket=day&tz=Asia/Colombo
+//
+// Fetch requests can select N series with highest (top) or lowest (bottom)
+// scores where rank is one of sum (default), avg, max or last:
+//
+//	/db/{name}/fetch?from=...&to=...&fields=a,*&top=10&rank=max
+//
+// Subscribe requests stream updated point values of series matching the
+// fields pattern as server-sent events (one JSON update in each event):
+//
+//	/db/{name}/subscribe?fields=a,*&buffer=100
+//
+// Fetch requests can fill points without data with the fill parameter
+// which can be null, zero, previous or linear. When it's given, points
+// without data (after filling) are encoded as null instead of an object:
+//
+//	/db/{name}/fetch?from=...&to=...&fields=a,*&fill=null
+//
+// Query requests take a query string (see package query for the syntax):
+//
+//	/db/{name}/query?q=sum+by+(2)+of+app.*.latency+from+-6h+step+5m
+//	/db/{name}/query?q=sum+of+app.*.errors+from+-1d+step+1h+|+divide+app.*.requests
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+	"github.com/kadirahq/kadiyadb/index"
+	"github.com/kadirahq/kadiyadb/metrics"
+	"github.com/kadirahq/kadiyadb/query"
+)
+
+const (
+	// paramfile is the name of the param file in database directories
+	// This must be the same file name used by kadiyadb.LoadAll function.
+	paramfile = "params.json"
+
+	// maxBodySize is the maximum size of a request body in bytes
+	maxBodySize = 1024 * 1024 * 10
+
+	// defaultBuffer is the default buffer size of subscriptions
+	defaultBuffer = 1000
+)
+
+var (
+	// ErrNoDB is returned when the requested database does not exist
+	ErrNoDB = errors.New("database not found")
+
+	// ErrDBExists is returned when creating a database which already exists
+	ErrDBExists = errors.New("database already exists")
+
+	// ErrInvName is returned when the database name is not valid
+	ErrInvName = errors.New("invalid database name")
+)
+
+// Measurement is a single measurement sent with track requests
+type Measurement struct {
+	Time   uint64   `json:"time"`
+	Fields []string `json:"fields"`
+	Total  float64  `json:"total"`
+	Count  float64  `json:"count"`
+}
+
+// Server serves all databases in a directory over HTTP
+type Server struct {
+	dir    string
+	dbs    map[string]*kadiyadb.DB
+	dbsmtx *sync.RWMutex
+	srv    *http.Server
+
+	// extra handlers registered with the Handle method
+	handlers map[string]http.Handler
+	hmtx     *sync.RWMutex
+
+	// closed when the server is closing to end streaming requests
+	closing chan struct{}
+	once    *sync.Once
+}
+
+// New creates a server with all databases available in given directory
+func New(dir string) (s *Server) {
+	dbs := kadiyadb.LoadAll(dir)
+	if dbs == nil {
+		dbs = map[string]*kadiyadb.DB{}
+	}
+
+	return &Server{
+		dir:    dir,
+		dbs:    dbs,
+		dbsmtx: &sync.RWMutex{},
+
+		handlers: map[string]http.Handler{},
+		hmtx:     &sync.RWMutex{},
+
+		closing: make(chan struct{}),
+		once:    &sync.Once{},
+	}
+}
+
+// Handle registers a handler for requests with given path (e.g. "/write").
+// This can be used to serve other protocols with the same HTTP server.
+// Registered handlers are used before the handlers for built-in endpoints.
+func (s *Server) Handle(path string, h http.Handler) {
+	s.hmtx.Lock()
+	defer s.hmtx.Unlock()
+
+	s.handlers[path] = h
+}
+
+// DB returns the database with given name or nil if it doesn't exist
+func (s *Server) DB(name string) (db *kadiyadb.DB) {
+	s.dbsmtx.RLock()
+	defer s.dbsmtx.RUnlock()
+
+	return s.dbs[name]
+}
+
+// Names returns names of all databases in sorted order
+func (s *Server) Names() (names []string) {
+	s.dbsmtx.RLock()
+	defer s.dbsmtx.RUnlock()
+
+	names = make([]string, 0, len(s.dbs))
+	for name := range s.dbs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Create creates a new database with given param file content. The param
+// file is stored in the database directory to be used when loading it again.
+// Names starting with an underscore are reserved for internal databases.
+func (s *Server) Create(name string, data []byte) (db *kadiyadb.DB, err error) {
+	if name == "" || name[0] == '.' || name[0] == '_' || strings.ContainsAny(name, "/\\") {
+		return nil, ErrInvName
+	}
+
+	return s.create(name, data)
+}
+
+// CreateInternal creates a new database with a reserved name (starting with
+// an underscore) such as the database used to record stats of the process.
+func (s *Server) CreateInternal(name string, data []byte) (db *kadiyadb.DB, err error) {
+	if len(name) < 2 || name[0] != '_' || strings.ContainsAny(name, "/\\") {
+		return nil, ErrInvName
+	}
+
+	return s.create(name, data)
+}
+
+// create creates a new database with a valid name
+func (s *Server) create(name string, data []byte) (db *kadiyadb.DB, err error) {
+	params, err := kadiyadb.ParseParams(data)
+	if err != nil {
+		return nil, err
+	}
+
+	s.dbsmtx.Lock()
+	defer s.dbsmtx.Unlock()
+
+	base := path.Join(s.dir, name)
+	if _, ok := s.dbs[name]; ok {
+		return nil, ErrDBExists
+	} else if _, err := os.Stat(base); err == nil {
+		return nil, ErrDBExists
+	}
+
+	// the directory is removed on errors to be able to create it again
+	db, err = kadiyadb.Open(base, params)
+	if err != nil {
+		os.RemoveAll(base)
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(path.Join(base, paramfile), data, 0644); err != nil {
+		db.Close()
+		os.RemoveAll(base)
+		return nil, err
+	}
+
+	s.dbs[name] = db
+	return db, nil
+}
+
+// ListenAndServe starts the HTTP server on given address. This function
+// blocks until the server is stopped with the Close method (or fails).
+func (s *Server) ListenAndServe(addr string) (err error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(l)
+}
+
+// Serve starts the HTTP server on given listener. This function
+// blocks until the server is stopped with the Close method (or fails).
+func (s *Server) Serve(l net.Listener) (err error) {
+	s.dbsmtx.Lock()
+	s.srv = &http.Server{Handler: s}
+	srv := s.srv
+	s.dbsmtx.Unlock()
+
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Close gracefully stops the server. It waits for active requests to
+// complete (up to given timeout), syncs and closes all databases.
+func (s *Server) Close(timeout time.Duration) (err error) {
+	s.once.Do(func() { close(s.closing) })
+
+	s.dbsmtx.RLock()
+	srv := s.srv
+	s.dbsmtx.RUnlock()
+
+	// Active requests need to read the dbs map to complete
+	// therefore the lock must not be held while shutting down.
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.dbsmtx.Lock()
+	defer s.dbsmtx.Unlock()
+
+	for name, db := range s.dbs {
+		if err := db.Sync(); err != nil {
+			return err
+		}
+
+		if err := db.Close(); err != nil {
+			return err
+		}
+
+		delete(s.dbs, name)
+	}
+
+	return nil
+}
+
+// ServeHTTP routes HTTP requests to request handlers
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.hmtx.RLock()
+	h, ok := s.handlers[r.URL.Path]
+	s.hmtx.RUnlock()
+
+	if ok {
+		h.ServeHTTP(w, r)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "health":
+		s.handleHealth(w, r)
+	case len(parts) == 1 && parts[0] == "metrics":
+		s.handleMetrics(w, r)
+	case len(parts) == 1 && parts[0] == "db":
+		s.handleList(w, r)
+	case len(parts) == 2 && parts[0] == "db":
+		s.handleCreate(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "db" && parts[2] == "track":
+		s.handleTrack(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "db" && parts[2] == "fetch":
+		s.handleFetch(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "db" && parts[2] == "query":
+		s.handleQuery(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "db" && parts[2] == "subscribe":
+		s.handleSubscribe(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "db" && parts[2] == "backup":
+		s.handleBackup(w, r, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "ok",
+		"databases": len(s.Names()),
+	})
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	metrics.Handler().ServeHTTP(w, r)
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"databases": s.Names(),
+	})
+}
+
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// params are validated first to separate them from storage errors
+	if _, err := kadiyadb.ParseParams(data); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := s.Create(name, data); err == ErrDBExists {
+		writeError(w, http.StatusConflict, err)
+		return
+	} else if err == ErrInvName || err == kadiyadb.ErrInvParams {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"database": name,
+	})
+}
+
+func (s *Server) handleTrack(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	db := s.DB(name)
+	if db == nil {
+		writeError(w, http.StatusNotFound, ErrNoDB)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ms, err := decodeMeasurements(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	for _, m := range ms {
+		if err := db.Track(m.Time, m.Fields, m.Total, m.Count); err == kadiyadb.ErrInvTime {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"tracked": len(ms),
+	})
+}
+
+func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	db := s.DB(name)
+	if db == nil {
+		writeError(w, http.StatusNotFound, ErrNoDB)
+		return
+	}
+
+	q := r.URL.Query()
+
+	from, to, err := fetchRange(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	fields := strings.Split(q.Get("fields"), ",")
+
+	fill, nulls := kadiyadb.FillNull, q.Get("fill") != ""
+	if nulls {
+		if fill, err = fillMode(q.Get("fill")); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	// Fetch result is only valid inside the handler function
+	// therefore the response is encoded inside the handler.
+	handler := func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			writeError(w, fetchStatus(err), err)
+			return
+		}
+
+		if nulls {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"chunks": nullChunks(kadiyadb.Fill(chunks, fill)),
+			})
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"chunks": chunks,
+		})
+	}
+
+	top := q.Get("top") != "" || q.Get("bottom") != ""
+
+	if b := q.Get("bucket"); b != "" {
+		if top {
+			writeError(w, http.StatusBadRequest, errors.New("bucket cannot be used with top/bottom"))
+			return
+		}
+
+		bucket, loc, err := bucketOptions(b, q.Get("tz"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		db.FetchBuckets(from, to, fields, bucket, loc, handler)
+		return
+	}
+
+	if !top {
+		db.Fetch(from, to, fields, handler)
+		return
+	}
+
+	opts, err := topOptions(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	db.FetchTop(from, to, fields, opts, handler)
+}
+
+// fetchStatus returns the status code for an error returned when reading
+// data. Invalid requests are client errors and others are storage errors.
+func fetchStatus(err error) (code int) {
+	switch err {
+	case kadiyadb.ErrInvTime,
+		kadiyadb.ErrInvFill,
+		kadiyadb.ErrInvTop,
+		kadiyadb.ErrInvBucket,
+		kadiyadb.ErrInvStep,
+		index.ErrInvFields,
+		query.ErrInvAgg,
+		query.ErrInvFunc:
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// fetchRange parses the time range from range or from and to parameters
+func fetchRange(q url.Values) (from, to uint64, err error) {
+	if rng := q.Get("range"); rng != "" {
+		return query.ParseRange(rng, time.Now())
+	}
+
+	if from, err = strconv.ParseUint(q.Get("from"), 10, 64); err != nil {
+		return 0, 0, errors.New("invalid from")
+	}
+
+	if to, err = strconv.ParseUint(q.Get("to"), 10, 64); err != nil {
+		return 0, 0, errors.New("invalid to")
+	}
+
+	return from, to, nil
+}
+
+// bucketOptions parses bucket and tz parameters (tz defaults to UTC)
+func bucketOptions(b, tz string) (bucket kadiyadb.Bucket, loc *time.Location, err error) {
+	switch b {
+	case "day":
+		bucket = kadiyadb.BucketDay
+	case "week":
+		bucket = kadiyadb.BucketWeek
+	default:
+		return 0, nil, errors.New("invalid bucket")
+	}
+
+	if loc, err = time.LoadLocation(tz); err != nil {
+		return 0, nil, errors.New("invalid tz")
+	}
+
+	return bucket, loc, nil
+}
+
+// topOptions creates top-N options from top, bottom and rank parameters
+func topOptions(q url.Values) (opts *kadiyadb.TopOptions, err error) {
+	opts = &kadiyadb.TopOptions{}
+
+	n := q.Get("top")
+	if n == "" {
+		n = q.Get("bottom")
+		opts.Bottom = true
+	}
+
+	if opts.N, err = strconv.Atoi(n); err != nil || opts.N <= 0 {
+		return nil, errors.New("invalid top/bottom count")
+	}
+
+	switch q.Get("rank") {
+	case "", "sum":
+		opts.By = kadiyadb.RankSum
+	case "avg":
+		opts.By = kadiyadb.RankAvg
+	case "max":
+		opts.By = kadiyadb.RankMax
+	case "last":
+		opts.By = kadiyadb.RankLast
+	default:
+		return nil, errors.New("invalid rank")
+	}
+
+	return opts, nil
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	db := s.DB(name)
+	if db == nil {
+		writeError(w, http.StatusNotFound, ErrNoDB)
+		return
+	}
+
+	q, err := query.Parse(r.URL.Query().Get("q"), time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	chunk, err := q.Run(db)
+	if err != nil {
+		writeError(w, fetchStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"chunk": chunk,
+	})
+}
+
+func (s *Server) handleSubscribe(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	db := s.DB(name)
+	if db == nil {
+		writeError(w, http.StatusNotFound, ErrNoDB)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	q := r.URL.Query()
+
+	buffer := defaultBuffer
+	if str := q.Get("buffer"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid buffer"))
+			return
+		}
+
+		buffer = n
+	}
+
+	sub := db.Subscribe(strings.Split(q.Get("fields"), ","), buffer)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	done := r.Context().Done()
+	enc := json.NewEncoder(w)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-s.closing:
+			return
+		case u, ok := <-sub.C:
+			if !ok {
+				return
+			}
+
+			// json encoder adds a newline after the value
+			io.WriteString(w, "data: ")
+			if err := enc.Encode(u); err != nil {
+				return
+			}
+
+			io.WriteString(w, "\n")
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	db := s.DB(name)
+	if db == nil {
+		writeError(w, http.StatusNotFound, ErrNoDB)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.tar"`)
+
+	// errors after writing the first byte cannot be sent to the client
+	// but the archive will not have a manifest and it cannot be restored
+	if err := db.Backup(w); err != nil {
+		fmt.Println("Server Error: backup:", name, err)
+	}
+}
+
+// fillMode parses the fill parameter
+func fillMode(str string) (mode kadiyadb.FillMode, err error) {
+	switch str {
+	case "null":
+		return kadiyadb.FillNull, nil
+	case "zero":
+		return kadiyadb.FillZero, nil
+	case "previous":
+		return kadiyadb.FillPrevious, nil
+	case "linear":
+		return kadiyadb.FillLinear, nil
+	}
+
+	return 0, errors.New("invalid fill")
+}
+
+// nullChunk is a chunk encoded with null points
+type nullChunk struct {
+	From   uint64        `json:"from"`
+	To     uint64        `json:"to"`
+	Series []*nullSeries `json:"series"`
+}
+
+// nullSeries is a series encoded with null points
+type nullSeries struct {
+	Fields []string     `json:"fields"`
+	Points []*nullPoint `json:"points"`
+}
+
+// nullPoint is a point with data (nil if the point has no data)
+type nullPoint struct {
+	Total float64 `json:"total"`
+	Count float64 `json:"count"`
+}
+
+// nullChunks converts chunks to be encoded with
+// null values for points without data (Count == 0)
+func nullChunks(chunks []*protocol.Chunk) (res []*nullChunk) {
+	res = make([]*nullChunk, len(chunks))
+	for i, c := range chunks {
+		nc := &nullChunk{
+			From:   c.From,
+			To:     c.To,
+			Series: make([]*nullSeries, len(c.Series)),
+		}
+
+		for j, s := range c.Series {
+			ns := &nullSeries{
+				Fields: s.Fields,
+				Points: make([]*nullPoint, len(s.Points)),
+			}
+
+			for k, p := range s.Points {
+				if p.Count != 0 {
+					ns.Points[k] = &nullPoint{Total: p.Total, Count: p.Count}
+				}
+			}
+
+			nc.Series[j] = ns
+		}
+
+		res[i] = nc
+	}
+
+	return res
+}
+
+// decodeMeasurements decodes a measurement or an array of measurements
+func decodeMeasurements(data []byte) (ms []*Measurement, err error) {
+	trimmed := strings.TrimSpace(string(data))
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(data, &ms); err != nil {
+			return nil, err
+		}
+	} else {
+		m := &Measurement{}
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+
+		ms = []*Measurement{m}
+	}
+
+	// all measurements are validated before tracking any of them
+	for _, m := range ms {
+		if m == nil || len(m.Fields) == 0 {
+			return nil, errors.New("measurement fields are required")
+		}
+
+		for _, f := range m.Fields {
+			if f == "" || f == "*" {
+				return nil, index.ErrInvFields
+			}
+		}
+
+		if int64(m.Time) < 0 {
+			return nil, kadiyadb.ErrInvTime
+		}
+	}
+
+	return ms, nil
+}
+
+// writeJSON writes a value to the response encoded as JSON
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error to the response encoded as JSON
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]interface{}{
+		"error": err.Error(),
+	})
+}
@@ -0,0 +1,522 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+const (
+	dir = "/tmp/test-server"
+)
+
+var params = `{
+  "duration": "1h",
+  "resolution": "1m",
+  "retention": "24h",
+  "maxROEpochs": 2,
+  "maxRWEpochs": 2
+}`
+
+func request(t *testing.T, method, url, body string, code int, v interface{}) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != code {
+		t.Fatal("wrong status", method, url, res.StatusCode, string(data))
+	}
+
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func setup(t *testing.T) (s *Server, ts *httptest.Server) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	s = New(dir)
+	ts = httptest.NewServer(s)
+
+	return s, ts
+}
+
+func TestHealth(t *testing.T) {
+	s, ts := setup(t)
+	defer ts.Close()
+	defer s.Close(time.Second)
+
+	res := map[string]interface{}{}
+	request(t, "GET", ts.URL+"/health", "", 200, &res)
+	if res["status"] != "ok" {
+		t.Fatal("wrong status")
+	}
+
+	request(t, "POST", ts.URL+"/health", "", 405, nil)
+	request(t, "GET", ts.URL+"/nope", "", 404, nil)
+}
+
+func TestCreateList(t *testing.T) {
+	s, ts := setup(t)
+	defer ts.Close()
+	defer s.Close(time.Second)
+
+	request(t, "POST", ts.URL+"/db/test1", params, 201, nil)
+	request(t, "POST", ts.URL+"/db/test1", params, 409, nil)
+	request(t, "POST", ts.URL+"/db/.test", params, 400, nil)
+	request(t, "POST", ts.URL+"/db/_internal", params, 400, nil)
+	request(t, "POST", ts.URL+"/db/test2", `{"duration": "1h"}`, 400, nil)
+
+	res := struct{ Databases []string }{}
+	request(t, "GET", ts.URL+"/db", "", 200, &res)
+	if len(res.Databases) != 1 || res.Databases[0] != "test1" {
+		t.Fatal("wrong databases", res.Databases)
+	}
+
+	// the param file must be stored to load the database again
+	data, err := ioutil.ReadFile(dir + "/test1/params.json")
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != params {
+		t.Fatal("wrong param file")
+	}
+
+	// reserved names can only be used for internal databases
+	if _, err := s.CreateInternal("test2", []byte(params)); err != ErrInvName {
+		t.Fatal("should return an error")
+	}
+
+	if _, err := s.CreateInternal("_internal", []byte(params)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := New(dir).Names(); len(names) != 2 || names[0] != "_internal" || names[1] != "test1" {
+		t.Fatal("wrong databases after reload", names)
+	}
+}
+
+func TestTrackFetch(t *testing.T) {
+	s, ts := setup(t)
+	defer ts.Close()
+	defer s.Close(time.Second)
+
+	request(t, "POST", ts.URL+"/db/test1", params, 201, nil)
+
+	now := uint64(time.Now().UnixNano())
+	now -= now % uint64(time.Hour)
+	nowStr := strconv.FormatUint(now, 10)
+
+	single := `{"time": ` + nowStr + `, "fields": ["a", "b"], "total": 5, "count": 1}`
+	batch := `[
+    {"time": ` + nowStr + `, "fields": ["a", "b"], "total": 3, "count": 2},
+    {"time": ` + nowStr + `, "fields": ["a", "c"], "total": 1, "count": 1}
+  ]`
+
+	res := map[string]int{}
+	request(t, "POST", ts.URL+"/db/test1/track", single, 200, &res)
+	if res["tracked"] != 1 {
+		t.Fatal("wrong tracked count")
+	}
+
+	request(t, "POST", ts.URL+"/db/test1/track", batch, 200, &res)
+	if res["tracked"] != 2 {
+		t.Fatal("wrong tracked count")
+	}
+
+	request(t, "POST", ts.URL+"/db/test1/track", `{"time": 0}`, 400, nil)
+	request(t, "POST", ts.URL+"/db/test1/track", `{"time": 0, "fields": ["a", ""]}`, 400, nil)
+	request(t, "POST", ts.URL+"/db/test1/track", `{"time": 9223372036854775808, "fields": ["a"]}`, 400, nil)
+
+	// nothing should be tracked if any measurement is invalid
+	invalid := `[
+    {"time": ` + nowStr + `, "fields": ["a", "d"], "total": 1, "count": 1},
+    {"time": ` + nowStr + `, "fields": ["a", "*"], "total": 1, "count": 1}
+  ]`
+	request(t, "POST", ts.URL+"/db/test1/track", invalid, 400, nil)
+	request(t, "POST", ts.URL+"/db/test1/track", `{`, 400, nil)
+	request(t, "POST", ts.URL+"/db/test2/track", single, 404, nil)
+	request(t, "GET", ts.URL+"/db/test1/track", "", 405, nil)
+
+	type series struct {
+		Fields []string
+		Points []struct{ Total, Count float64 }
+	}
+
+	out := struct {
+		Chunks []struct {
+			From, To uint64
+			Series   []series
+		}
+	}{}
+
+	to := strconv.FormatUint(now+uint64(2*time.Minute), 10)
+	url := ts.URL + "/db/test1/fetch?from=" + nowStr + "&to=" + to + "&fields=a,b"
+	request(t, "GET", url, "", 200, &out)
+
+	if len(out.Chunks) != 1 {
+		t.Fatal("wrong chunk count", len(out.Chunks))
+	}
+
+	c := out.Chunks[0]
+	if c.From != now || len(c.Series) != 1 {
+		t.Fatal("wrong chunk")
+	}
+
+	s1 := c.Series[0]
+	if len(s1.Points) != 2 ||
+		s1.Points[0].Total != 8 ||
+		s1.Points[0].Count != 3 ||
+		s1.Points[1].Total != 0 {
+		t.Fatal("wrong points", s1.Points)
+	}
+
+	url = ts.URL + "/db/test1/fetch?from=" + nowStr + "&to=" + to + "&fields=a,*"
+	request(t, "GET", url, "", 200, &out)
+	if len(out.Chunks) != 1 || len(out.Chunks[0].Series) != 2 {
+		t.Fatal("wrong wildcard result")
+	}
+
+	// b has the highest sum and the highest average
+	url = ts.URL + "/db/test1/fetch?from=" + nowStr + "&to=" + to + "&fields=a,*&top=1"
+	request(t, "GET", url, "", 200, &out)
+	if len(out.Chunks) != 1 || len(out.Chunks[0].Series) != 1 || out.Chunks[0].Series[0].Fields[1] != "b" {
+		t.Fatal("wrong top result")
+	}
+
+	request(t, "GET", url+"&rank=avg", "", 200, &out)
+	if len(out.Chunks[0].Series) != 1 || out.Chunks[0].Series[0].Fields[1] != "b" {
+		t.Fatal("wrong top result")
+	}
+
+	url = ts.URL + "/db/test1/fetch?from=" + nowStr + "&to=" + to + "&fields=a,*&bottom=1&rank=max"
+	request(t, "GET", url, "", 200, &out)
+	if len(out.Chunks[0].Series) != 1 || out.Chunks[0].Series[0].Fields[1] != "c" {
+		t.Fatal("wrong bottom result")
+	}
+
+	url = ts.URL + "/db/test1/fetch?range=-2h..now%2B1h&fields=a,b&bucket=day"
+	request(t, "GET", url, "", 200, &out)
+	if len(out.Chunks) == 0 {
+		t.Fatal("wrong bucket result")
+	}
+
+	sum := 0.0
+	for _, c := range out.Chunks {
+		if len(c.Series) != 1 || len(c.Series[0].Points) != 1 {
+			t.Fatal("wrong bucket result")
+		}
+
+		sum += c.Series[0].Points[0].Total
+	}
+
+	if sum != 8 {
+		t.Fatal("wrong bucket total", sum)
+	}
+
+	request(t, "GET", url+"&tz=UTC", "", 200, nil)
+	request(t, "GET", url+"&tz=Nowhere/Nope", "", 400, nil)
+	request(t, "GET", url+"&top=1", "", 400, nil)
+	request(t, "GET", ts.URL+"/db/test1/fetch?range=now..-1h&fields=a", "", 400, nil)
+
+	url = ts.URL + "/db/test1/fetch?from=" + nowStr + "&to=" + to + "&fields=a,*"
+	request(t, "GET", url+"&top=0", "", 400, nil)
+	request(t, "GET", url+"&fill=nope", "", 400, nil)
+
+	// points without data are encoded as null with the fill parameter
+	filled := struct {
+		Chunks []struct {
+			Series []struct {
+				Fields []string
+				Points []*struct{ Total, Count float64 }
+			}
+		}
+	}{}
+
+	request(t, "GET", url+"&fill=null&top=1", "", 200, &filled)
+	if len(filled.Chunks) != 1 || len(filled.Chunks[0].Series) != 1 {
+		t.Fatal("wrong fill result")
+	}
+
+	points := filled.Chunks[0].Series[0].Points
+	if len(points) != 2 || points[0] == nil || points[0].Total != 8 || points[1] != nil {
+		t.Fatal("wrong points", points)
+	}
+
+	request(t, "GET", url+"&fill=previous&top=1", "", 200, &filled)
+	points = filled.Chunks[0].Series[0].Points
+	if len(points) != 2 || points[1] == nil || points[1].Total*3 != 8 || points[1].Count != 1 {
+		t.Fatal("wrong points", points)
+	}
+	request(t, "GET", url+"&top=1&rank=median", "", 400, nil)
+	request(t, "GET", ts.URL+"/db/test1/fetch?from=x&to=1&fields=a", "", 400, nil)
+	request(t, "GET", ts.URL+"/db/test2/fetch?from=0&to=1&fields=a", "", 404, nil)
+}
+
+func TestStatusCodes(t *testing.T) {
+	s, ts := setup(t)
+	defer ts.Close()
+	defer s.Close(time.Second)
+
+	request(t, "POST", ts.URL+"/db/test1", params, 201, nil)
+
+	now := uint64(time.Now().UnixNano())
+	now -= now % uint64(time.Hour)
+	prev := now - uint64(time.Hour)
+	nowStr := strconv.FormatUint(now, 10)
+	prevStr := strconv.FormatUint(prev, 10)
+
+	// invalid requests are client errors
+	u := ts.URL + "/db/test1/fetch?from=" + nowStr + "&to=" + prevStr + "&fields=a"
+	request(t, "GET", u, "", 400, nil)
+
+	q := "a from " + nowStr + " to " + prevStr
+	request(t, "GET", ts.URL+"/db/test1/query?q="+url.QueryEscape(q), "", 400, nil)
+
+	// an epoch which cannot be loaded is a storage error
+	edir := dir + "/test1/" + prevStr
+	if err := os.MkdirAll(edir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(edir+"/meta.json", []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	u = ts.URL + "/db/test1/fetch?from=" + prevStr + "&to=" + nowStr + "&fields=a"
+	request(t, "GET", u, "", 500, nil)
+
+	q = "a from " + prevStr + " to " + nowStr
+	request(t, "GET", ts.URL+"/db/test1/query?q="+url.QueryEscape(q), "", 500, nil)
+
+	// databases cannot be created when the directory is not usable
+	s.dbsmtx.Lock()
+	s.dir = "/dev/null"
+	s.dbsmtx.Unlock()
+
+	request(t, "POST", ts.URL+"/db/test2", params, 500, nil)
+	request(t, "POST", ts.URL+"/db/test2", `{"duration": "1h"}`, 400, nil)
+}
+
+func TestQuery(t *testing.T) {
+	s, ts := setup(t)
+	defer ts.Close()
+	defer s.Close(time.Second)
+
+	request(t, "POST", ts.URL+"/db/test1", params, 201, nil)
+
+	now := uint64(time.Now().UnixNano())
+	now -= now % uint64(time.Hour)
+	nowStr := strconv.FormatUint(now, 10)
+
+	batch := `[
+    {"time": ` + nowStr + `, "fields": ["a", "b"], "total": 3, "count": 1},
+    {"time": ` + nowStr + `, "fields": ["a", "c"], "total": 4, "count": 1}
+  ]`
+
+	request(t, "POST", ts.URL+"/db/test1/track", batch, 200, nil)
+
+	out := struct {
+		Chunk struct {
+			From, To uint64
+			Series   []struct {
+				Fields []string
+				Points []struct{ Total, Count float64 }
+			}
+		}
+	}{}
+
+	to := strconv.FormatUint(now+uint64(2*time.Minute), 10)
+	q := "sum by (1) of a.* from " + nowStr + " to " + to + " step 2m"
+	request(t, "GET", ts.URL+"/db/test1/query?q="+url.QueryEscape(q), "", 200, &out)
+
+	c := out.Chunk
+	if c.From != now || len(c.Series) != 1 {
+		t.Fatal("wrong chunk")
+	}
+
+	s1 := c.Series[0]
+	if len(s1.Fields) != 1 || s1.Fields[0] != "a" ||
+		len(s1.Points) != 1 ||
+		s1.Points[0].Total != 7 ||
+		s1.Points[0].Count != 2 {
+		t.Fatal("wrong series", s1)
+	}
+
+	res := map[string]string{}
+	q = "sum by 1 of a.* from -1h"
+	request(t, "GET", ts.URL+"/db/test1/query?q="+url.QueryEscape(q), "", 400, &res)
+	if res["error"] != `syntax error at position 8: expected "(" but found "1"` {
+		t.Fatal("wrong error", res["error"])
+	}
+
+	request(t, "GET", ts.URL+"/db/test2/query?q=a+from+-1h", "", 404, nil)
+	request(t, "POST", ts.URL+"/db/test1/query?q=a+from+-1h", "", 405, nil)
+}
+
+func TestSubscribe(t *testing.T) {
+	s, ts := setup(t)
+	defer ts.Close()
+	defer s.Close(time.Second)
+
+	request(t, "POST", ts.URL+"/db/test1", params, 201, nil)
+	request(t, "GET", ts.URL+"/db/test2/subscribe?fields=a,*", "", 404, nil)
+	request(t, "GET", ts.URL+"/db/test1/subscribe?fields=a,*&buffer=x", "", 400, nil)
+
+	res, err := http.Get(ts.URL + "/db/test1/subscribe?fields=a,*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("wrong content type", ct)
+	}
+
+	now := uint64(time.Now().UnixNano())
+	now -= now % uint64(time.Hour)
+	nowStr := strconv.FormatUint(now, 10)
+
+	batch := `[
+    {"time": ` + nowStr + `, "fields": ["b", "c"], "total": 3, "count": 1},
+    {"time": ` + nowStr + `, "fields": ["a", "c"], "total": 4, "count": 1}
+  ]`
+
+	request(t, "POST", ts.URL+"/db/test1/track", batch, 200, nil)
+
+	line, err := bufio.NewReader(res.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(line, "data: ") {
+		t.Fatal("wrong event", line)
+	}
+
+	u := struct {
+		Fields       []string
+		Time         uint64
+		Total, Count float64
+	}{}
+
+	if err := json.Unmarshal([]byte(line[len("data: "):]), &u); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(u.Fields) != 2 || u.Fields[0] != "a" || u.Fields[1] != "c" ||
+		u.Time != now || u.Total != 4 || u.Count != 1 {
+		t.Fatal("wrong update", u)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	s, ts := setup(t)
+	defer ts.Close()
+	defer s.Close(time.Second)
+
+	request(t, "POST", ts.URL+"/db/test1", params, 201, nil)
+	request(t, "GET", ts.URL+"/db/test2/backup", "", 404, nil)
+	request(t, "POST", ts.URL+"/db/test1/backup", "", 405, nil)
+
+	res, err := http.Get(ts.URL + "/db/test1/backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+
+	if err := kadiyadb.Restore(res.Body, dir+"/restored"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(dir + "/restored/params.json")
+	if err != nil {
+		t.Fatal(err)
+	} else if string(data) != params {
+		t.Fatal("wrong param file")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s, ts := setup(t)
+	defer ts.Close()
+	defer s.Close(time.Second)
+
+	s.Handle("/write", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	request(t, "POST", ts.URL+"/write", "", 204, nil)
+	request(t, "POST", ts.URL+"/write/x", "", 404, nil)
+	request(t, "GET", ts.URL+"/health", "", 200, nil)
+}
+
+func TestMetrics(t *testing.T) {
+	s, ts := setup(t)
+	defer ts.Close()
+	defer s.Close(time.Second)
+
+	request(t, "POST", ts.URL+"/db/test1", params, 201, nil)
+
+	now := strconv.FormatUint(uint64(time.Now().UnixNano()), 10)
+	body := `{"time": ` + now + `, "fields": ["a"], "total": 1, "count": 1}`
+	request(t, "POST", ts.URL+"/db/test1/track", body, 200, nil)
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{
+		"kadiyadb_epoch_cache_requests_total",
+		"kadiyadb_epoch_cache_evictions_total",
+		"kadiyadb_epochs_loaded",
+		"kadiyadb_index_nodes_created_total",
+		"kadiyadb_index_log_bytes_total",
+		"kadiyadb_track_duration_seconds_count",
+		"kadiyadb_fetch_duration_seconds_count",
+	} {
+		if !strings.Contains(string(data), "\n"+name) {
+			t.Fatal("missing metric", name)
+		}
+	}
+
+	request(t, "POST", ts.URL+"/metrics", "", 405, nil)
+}
@@ -0,0 +1,345 @@
+// Package statsd receives statsd metrics over UDP, aggregates them in
+// memory for each resolution interval of the database and tracks them
+// in the database as total/count pairs when the interval is over.
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+)
+
+const (
+	// maxPacketSize is the maximum size of a UDP packet
+	maxPacketSize = 65536
+
+	// flushInterval is the maximum time between flushes. Aggregated data
+	// is tracked in the database soon after a resolution interval is over.
+	flushInterval = time.Second
+
+	// missingTag is the default field value used for missing tags
+	missingTag = "_"
+)
+
+// Options is used to configure how metrics are mapped to fields.
+// Fields are made with dot separated parts of the metric name
+// followed by values of tags in the order given with `Tags`.
+//
+//	api.latency:20|ms|#host:h1,region:us  (Tags: region, host, app)
+//	=> ["api", "latency", "us", "h1", "_"]
+type Options struct {
+	// Tags has tag keys in the order they are added to fields
+	Tags []string
+
+	// Missing is used when a tag is not available (default: "_")
+	Missing string
+}
+
+// Stats has counters for lines processed by the listener
+type Stats struct {
+	Received  uint64
+	Malformed uint64
+	Tracked   uint64
+	Failed    uint64
+}
+
+// bucket has aggregated values for a field set in an interval
+type bucket struct {
+	fields []string
+	total  float64
+	count  float64
+}
+
+// gauge has the last value of a gauge and the interval it was updated in
+type gauge struct {
+	value float64
+	start int64
+}
+
+// slot has buckets for all field sets in an interval
+type slot struct {
+	end     int64
+	buckets map[string]*bucket
+}
+
+// Listener receives statsd lines and tracks them in a database
+type Listener struct {
+	db      *kadiyadb.DB
+	tags    []string
+	missing string
+
+	slots  map[int64]*slot
+	gauges map[string]*gauge
+	mtx    *sync.Mutex
+
+	received  uint64
+	malformed uint64
+	tracked   uint64
+	failed    uint64
+
+	pcs    []net.PacketConn
+	lmtx   *sync.Mutex
+	wg     *sync.WaitGroup
+	stop   chan struct{}
+	closed bool
+}
+
+// New creates a listener which tracks metrics in given database.
+// Aggregated data is flushed to the database in the background.
+func New(db *kadiyadb.DB, opts *Options) (l *Listener) {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	missing := opts.Missing
+	if missing == "" {
+		missing = missingTag
+	}
+
+	l = &Listener{
+		db:      db,
+		tags:    opts.Tags,
+		missing: missing,
+		slots:   map[int64]*slot{},
+		gauges:  map[string]*gauge{},
+		mtx:     &sync.Mutex{},
+		lmtx:    &sync.Mutex{},
+		wg:      &sync.WaitGroup{},
+		stop:    make(chan struct{}),
+	}
+
+	l.wg.Add(1)
+	go l.flushLoop()
+
+	return l
+}
+
+// Stats returns line counters of the listener. The tracked
+// and failed counters are updated when data is flushed.
+func (l *Listener) Stats() (s Stats) {
+	return Stats{
+		Received:  atomic.LoadUint64(&l.received),
+		Malformed: atomic.LoadUint64(&l.malformed),
+		Tracked:   atomic.LoadUint64(&l.tracked),
+		Failed:    atomic.LoadUint64(&l.failed),
+	}
+}
+
+// Handle parses a line and adds it to the current interval
+func (l *Listener) Handle(line string) (err error) {
+	return l.handle(line, time.Now())
+}
+
+func (l *Listener) handle(line string, now time.Time) (err error) {
+	atomic.AddUint64(&l.received, 1)
+
+	m, err := Parse(line)
+	if err != nil {
+		atomic.AddUint64(&l.malformed, 1)
+		return err
+	}
+
+	fields, ok := l.fields(m)
+	if !ok {
+		atomic.AddUint64(&l.malformed, 1)
+		return ErrMalformed
+	}
+
+	ts := now.UnixNano()
+	res := l.db.ResolutionAt(uint64(ts))
+	start := ts - ts%res
+	key := strings.Join(fields, "\x00")
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	s, ok := l.slots[start]
+	if !ok {
+		s = &slot{end: start + res, buckets: map[string]*bucket{}}
+		l.slots[start] = s
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{fields: fields}
+		s.buckets[key] = b
+	}
+
+	switch m.Type {
+	case Counter, Timer:
+		b.total += m.Value / m.Rate
+		b.count += 1 / m.Rate
+	case Gauge:
+		value := m.Value
+		if g, ok := l.gauges[key]; ok && m.Relative {
+			value += g.value
+		}
+
+		l.gauges[key] = &gauge{value: value, start: start}
+		b.total = value
+		b.count = 1
+	}
+
+	return nil
+}
+
+// fields makes the field set for a metric using its name and tags
+func (l *Listener) fields(m *Metric) (fields []string, ok bool) {
+	fields = strings.Split(m.Name, ".")
+	for _, f := range fields {
+		if f == "" || f == "*" {
+			return nil, false
+		}
+	}
+
+	for _, key := range l.tags {
+		value, ok := m.Tags[key]
+		if !ok || value == "*" {
+			value = l.missing
+		}
+
+		fields = append(fields, value)
+	}
+
+	return fields, true
+}
+
+// Flush tracks aggregated data of all intervals which are over
+func (l *Listener) Flush() (err error) {
+	return l.flush(time.Now().UnixNano())
+}
+
+// flush tracks aggregated data of intervals which end before given time
+// Gauges which were not updated in the last interval flushed are removed
+// therefore relative values start from zero after an interval without them.
+func (l *Listener) flush(now int64) (err error) {
+	l.mtx.Lock()
+	ready := map[int64]*slot{}
+	last := int64(math.MinInt64)
+	for start, s := range l.slots {
+		if s.end <= now {
+			ready[start] = s
+			delete(l.slots, start)
+
+			if start > last {
+				last = start
+			}
+		}
+	}
+
+	for key, g := range l.gauges {
+		if g.start < last {
+			delete(l.gauges, key)
+		}
+	}
+	l.mtx.Unlock()
+
+	for start, s := range ready {
+		for _, b := range s.buckets {
+			if e := l.db.Track(uint64(start), b.fields, b.total, b.count); e != nil {
+				atomic.AddUint64(&l.failed, 1)
+				if err == nil {
+					err = e
+				}
+
+				continue
+			}
+
+			atomic.AddUint64(&l.tracked, 1)
+		}
+	}
+
+	return err
+}
+
+func (l *Listener) flushLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := l.Flush(); err != nil {
+			fmt.Println("StatsD Error: flush:", err)
+		}
+	}
+}
+
+// ListenUDP starts reading UDP packets on given address
+func (l *Listener) ListenUDP(addr string) (err error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	return l.ServeUDP(pc)
+}
+
+// ServeUDP starts reading packets from given connection in the
+// background. The connection will be closed when Close is called.
+func (l *Listener) ServeUDP(pc net.PacketConn) (err error) {
+	l.lmtx.Lock()
+	defer l.lmtx.Unlock()
+
+	if l.closed {
+		pc.Close()
+		return nil
+	}
+
+	l.pcs = append(l.pcs, pc)
+	l.wg.Add(1)
+	go l.readPackets(pc)
+
+	return nil
+}
+
+// Close stops the listener and tracks all aggregated data
+// including data of intervals which are not over yet.
+func (l *Listener) Close() (err error) {
+	l.lmtx.Lock()
+	if l.closed {
+		l.lmtx.Unlock()
+		return nil
+	}
+
+	l.closed = true
+	close(l.stop)
+	for _, pc := range l.pcs {
+		pc.Close()
+	}
+	l.lmtx.Unlock()
+
+	l.wg.Wait()
+
+	return l.flush(math.MaxInt64)
+}
+
+func (l *Listener) readPackets(pc net.PacketConn) {
+	defer l.wg.Done()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				l.Handle(line)
+			}
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kadirahq/kadiyadb"
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+var (
+	tmpdirs = "/tmp/test-statsd/"
+)
+
+func setups(t testing.TB) func() {
+	if err := os.RemoveAll(tmpdirs); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		if err := os.RemoveAll(tmpdirs); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	defer setups(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdirs, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	l := New(db, &Options{Tags: []string{"region", "host"}})
+
+	now := time.Now().Truncate(time.Hour)
+	next := now.Add(time.Minute)
+	from := uint64(now.UnixNano())
+	to := uint64(next.Add(time.Minute).UnixNano())
+
+	lines := []struct {
+		line string
+		time time.Time
+	}{
+		{"a.c:1|c|#host:h1", now},
+		{"a.c:2|c|@0.5|#host:h1", now.Add(time.Second)},
+		{"a.c:3|c|#host:h1", next},
+		{"a.t:10|ms|#region:us,host:h1", now},
+		{"a.t:20|ms|#region:us,host:h1", now},
+		{"a.g:10|g", now},
+		{"a.g:-3|g", now.Add(time.Second)},
+		{"a.g:+1|g", next},
+		{"a..g:1|g", now},
+	}
+
+	for _, item := range lines {
+		l.handle(item.line, item.time)
+	}
+
+	// only the first interval is over at this time
+	if err := l.flush(next.UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Fetch(from, to, []string{"a", "c", "_", "h1"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ps := res[0].Series[0].Points
+		if len(ps) != 2 ||
+			ps[0] != (protocol.Point{Total: 5, Count: 3}) ||
+			ps[1] != (protocol.Point{}) {
+			t.Fatal("wrong counter points", ps)
+		}
+	})
+
+	db.Fetch(from, to, []string{"a", "t", "us", "h1"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ps := res[0].Series[0].Points
+		if len(ps) != 2 || ps[0] != (protocol.Point{Total: 30, Count: 2}) {
+			t.Fatal("wrong timer points", ps)
+		}
+	})
+
+	db.Fetch(from, to, []string{"a", "g", "_", "_"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ps := res[0].Series[0].Points
+		if len(ps) != 2 || ps[0] != (protocol.Point{Total: 7, Count: 1}) {
+			t.Fatal("wrong gauge points", ps)
+		}
+	})
+
+	// remaining data is flushed when closing
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Fetch(from, to, []string{"a", "c", "_", "h1"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ps := res[0].Series[0].Points
+		if len(ps) != 2 || ps[1] != (protocol.Point{Total: 3, Count: 1}) {
+			t.Fatal("wrong counter points", ps)
+		}
+	})
+
+	db.Fetch(from, to, []string{"a", "g", "_", "_"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ps := res[0].Series[0].Points
+		if len(ps) != 2 || ps[1] != (protocol.Point{Total: 8, Count: 1}) {
+			t.Fatal("wrong gauge points", ps)
+		}
+	})
+
+	if s := l.Stats(); s != (Stats{Received: 9, Malformed: 1, Tracked: 5}) {
+		t.Fatal("wrong stats", s)
+	}
+}
+
+func TestGaugeExpire(t *testing.T) {
+	defer setups(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdirs, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	l := New(db, nil)
+	defer l.Close()
+
+	now := time.Now().Truncate(time.Hour)
+	next := now.Add(time.Minute)
+
+	l.handle("a.g:10|g", now)
+	l.handle("a.h:10|g", now)
+	if err := l.flush(next.UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	// gauges updated in the last flushed interval are kept
+	l.mtx.Lock()
+	count := len(l.gauges)
+	l.mtx.Unlock()
+
+	if count != 2 {
+		t.Fatal("wrong gauge count", count)
+	}
+
+	l.handle("a.g:+1|g", next)
+	if err := l.flush(next.Add(time.Minute).UnixNano()); err != nil {
+		t.Fatal(err)
+	}
+
+	l.mtx.Lock()
+	g, ok := l.gauges["a\x00g"]
+	count = len(l.gauges)
+	l.mtx.Unlock()
+
+	if count != 1 || !ok || g.value != 11 {
+		t.Fatal("should remove gauges without updates")
+	}
+}
+
+func TestListen(t *testing.T) {
+	defer setups(t)()
+
+	p := &kadiyadb.Params{
+		Duration:    3600000000000,
+		Retention:   86400000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := kadiyadb.Open(tmpdirs, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	l := New(db, nil)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ServeUDP(pc); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "a:1|c\na:2|c\nbad")
+	conn.Close()
+
+	for i := 0; i < 100 && l.Stats().Received < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	now := time.Now()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := l.Stats(); s.Received != 3 || s.Malformed != 1 {
+		t.Fatal("wrong stats", s)
+	}
+
+	// points may fall on either side of a minute boundary
+	from := uint64(now.Truncate(time.Minute).Add(-time.Minute).UnixNano())
+	db.Fetch(from, from+120000000000, []string{"a"}, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		total := 0.0
+		for _, c := range res {
+			for _, s := range c.Series {
+				for _, p := range s.Points {
+					total += p.Total
+				}
+			}
+		}
+
+		if math.Abs(total-3) > 1e-9 {
+			t.Fatal("wrong total", total)
+		}
+	})
+}
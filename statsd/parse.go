@@ -0,0 +1,117 @@
+package statsd
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrMalformed is returned when a line is not in the statsd format
+	ErrMalformed = errors.New("malformed statsd line")
+)
+
+// Type is the statsd metric type
+type Type int
+
+const (
+	// Counter values are summed up (type "c")
+	Counter Type = iota
+
+	// Timer values are averaged (types "ms" and "h")
+	Timer
+
+	// Gauge keeps the last value (type "g"). Values with a sign
+	// are added to the previous value of the gauge.
+	Gauge
+)
+
+// Metric is a measurement parsed from a statsd line
+type Metric struct {
+	Name     string
+	Value    float64
+	Type     Type
+	Rate     float64
+	Relative bool
+	Tags     map[string]string
+}
+
+// Parse parses a line in the statsd format with optional sample rate
+// and tags. Tags without a value are ignored as they can't be mapped.
+// Gauges can have a sample rate but it's not used (the rate is always 1).
+//
+//	name:value|type|@rate|#key:value,key:value
+func Parse(line string) (m *Metric, err error) {
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 || len(parts) > 4 {
+		return nil, ErrMalformed
+	}
+
+	i := strings.LastIndex(parts[0], ":")
+	if i <= 0 {
+		return nil, ErrMalformed
+	}
+
+	m = &Metric{
+		Name: parts[0][:i],
+		Rate: 1,
+	}
+
+	valStr := parts[0][i+1:]
+	value, err := strconv.ParseFloat(valStr, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, ErrMalformed
+	}
+
+	m.Value = value
+
+	switch parts[1] {
+	case "c":
+		m.Type = Counter
+	case "ms", "h":
+		m.Type = Timer
+	case "g":
+		m.Type = Gauge
+		m.Relative = strings.HasPrefix(valStr, "+") || strings.HasPrefix(valStr, "-")
+	default:
+		return nil, ErrMalformed
+	}
+
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			rate, err := strconv.ParseFloat(p[1:], 64)
+			if err != nil || !(rate > 0 && rate <= 1) {
+				return nil, ErrMalformed
+			}
+
+			// sample rates are ignored for gauges
+			if m.Type != Gauge {
+				m.Rate = rate
+			}
+		case strings.HasPrefix(p, "#"):
+			m.Tags = parseTags(p[1:])
+		default:
+			return nil, ErrMalformed
+		}
+	}
+
+	return m, nil
+}
+
+// parseTags parses comma separated key:value pairs
+func parseTags(str string) (tags map[string]string) {
+	tags = map[string]string{}
+
+	for _, tag := range strings.Split(str, ",") {
+		i := strings.Index(tag, ":")
+		if i <= 0 || i == len(tag)-1 {
+			continue
+		}
+
+		tags[tag[:i]] = tag[i+1:]
+	}
+
+	return tags
+}
@@ -0,0 +1,57 @@
+package statsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	valid := map[string]*Metric{
+		"a.b:1|c":        {Name: "a.b", Value: 1, Type: Counter, Rate: 1},
+		"a.b:1.5|c|@0.1": {Name: "a.b", Value: 1.5, Type: Counter, Rate: 0.1},
+		"a:20|ms":        {Name: "a", Value: 20, Type: Timer, Rate: 1},
+		"a:20|h|@0.5":    {Name: "a", Value: 20, Type: Timer, Rate: 0.5},
+		"a:5|g":          {Name: "a", Value: 5, Type: Gauge, Rate: 1},
+		"a:5|g|@0.5":     {Name: "a", Value: 5, Type: Gauge, Rate: 1},
+		"a:-5|g":         {Name: "a", Value: -5, Type: Gauge, Rate: 1, Relative: true},
+		"a:+5|g":         {Name: "a", Value: 5, Type: Gauge, Rate: 1, Relative: true},
+		"a:1|c|#x:1,y:2,z": {
+			Name: "a", Value: 1, Type: Counter, Rate: 1,
+			Tags: map[string]string{"x": "1", "y": "2"},
+		},
+		"a:1|c|@0.5|#x:1": {
+			Name: "a", Value: 1, Type: Counter, Rate: 0.5,
+			Tags: map[string]string{"x": "1"},
+		},
+	}
+
+	for line, exp := range valid {
+		m, err := Parse(line)
+		if err != nil {
+			t.Fatal(line, err)
+		} else if !reflect.DeepEqual(m, exp) {
+			t.Fatal("wrong metric", line, m)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"a.b",
+		"a.b:1",
+		":1|c",
+		"a:x|c",
+		"a:NaN|ms",
+		"a:1|s",
+		"a:1|c|@0",
+		"a:1|c|@2",
+		"a:1|c|@x",
+		"a:1|c|x",
+		"a:1|c|@1|#x:1|y",
+	}
+
+	for _, line := range invalid {
+		if _, err := Parse(line); err != ErrMalformed {
+			t.Fatal("should fail", line)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package kadiyadb
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kadirahq/kadiyadb/epoch"
+)
+
+// Update is a point value sent to subscribers when a series is tracked
+type Update struct {
+	// Fields of the updated series
+	Fields []string `json:"fields"`
+
+	// Time is the start of the updated point in nanoseconds
+	Time uint64 `json:"time"`
+
+	// Total and Count are values of the point after the update
+	Total float64 `json:"total"`
+	Count float64 `json:"count"`
+}
+
+// Subscription receives updates of series matching a field pattern.
+// Updates waiting to be received are coalesced by series and point so
+// only the latest value of a point is received. When the buffer is full,
+// the oldest waiting update is dropped to make room for the new one.
+type Subscription struct {
+	// C receives updates. It's closed when the subscription is closed.
+	C <-chan *Update
+
+	db      *DB
+	pattern []string
+	size    int
+	dropped uint64
+
+	// updates waiting to be sent to C
+	pending map[string]*Update
+	order   []string
+	mtx     *sync.Mutex
+
+	out  chan *Update
+	wake chan struct{}
+	stop chan struct{}
+	once *sync.Once
+}
+
+// Subscribe creates a subscription for series matching a field pattern.
+// The '*' can be used to match any value for a field. Parent field sets are
+// also updated by Track therefore a pattern can match them too. The buffer
+// size is the maximum number of updates waiting to be received.
+func (d *DB) Subscribe(pattern []string, buffer int) (s *Subscription) {
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	out := make(chan *Update)
+	s = &Subscription{
+		C:       out,
+		db:      d,
+		pattern: append([]string{}, pattern...),
+		size:    buffer,
+		pending: map[string]*Update{},
+		mtx:     &sync.Mutex{},
+		out:     out,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		once:    &sync.Once{},
+	}
+
+	d.submtx.Lock()
+	d.subs[s] = struct{}{}
+	d.submtx.Unlock()
+
+	go s.deliver()
+
+	return s
+}
+
+// Dropped returns the number of updates dropped because the buffer was full
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops the subscription and closes the update channel
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.db.submtx.Lock()
+		delete(s.db.subs, s)
+		s.db.submtx.Unlock()
+
+		close(s.stop)
+	})
+}
+
+// push adds an update to the buffer without blocking
+func (s *Subscription) push(u *Update) {
+	key := strings.Join(u.Fields, "\x00") + "\x00" + strconv.FormatUint(u.Time, 10)
+
+	s.mtx.Lock()
+	if _, ok := s.pending[key]; !ok {
+		if len(s.order) >= s.size {
+			delete(s.pending, s.order[0])
+			s.order = s.order[1:]
+			atomic.AddUint64(&s.dropped, 1)
+		}
+
+		s.order = append(s.order, key)
+	}
+
+	s.pending[key] = u
+	s.mtx.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest update from the buffer
+func (s *Subscription) pop() (u *Update) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if len(s.order) == 0 {
+		return nil
+	}
+
+	key := s.order[0]
+	s.order = s.order[1:]
+	u = s.pending[key]
+	delete(s.pending, key)
+
+	return u
+}
+
+// deliver sends buffered updates to the channel until stopped
+func (s *Subscription) deliver() {
+	defer close(s.out)
+
+	for {
+		u := s.pop()
+		if u == nil {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+
+		select {
+		case s.out <- u:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// publish sends updated point values to subscriptions matching any of
+// the field sets updated by Track (all prefixes of tracked fields).
+func (d *DB) publish(e *epoch.Epoch, m *epoch.Meta, pos int64, fields []string) {
+	d.submtx.RLock()
+	defer d.submtx.RUnlock()
+
+	if len(d.subs) == 0 {
+		return
+	}
+
+	ts := uint64(m.Start + pos*m.Resolution)
+
+	for i := 1; i <= len(fields); i++ {
+		fieldset := fields[:i]
+
+		var u *Update
+		for s := range d.subs {
+			if !matches(s.pattern, fieldset) {
+				continue
+			}
+
+			if u == nil {
+				if u = readUpdate(e, pos, fieldset, ts); u == nil {
+					break
+				}
+			}
+
+			s.push(u)
+		}
+	}
+}
+
+// readUpdate reads the current value of a point from an epoch
+func readUpdate(e *epoch.Epoch, pos int64, fields []string, ts uint64) (u *Update) {
+	e.RLock()
+	defer e.RUnlock()
+
+	points, _, err := e.Fetch(pos, pos+1, fields)
+	if err != nil || len(points) != 1 || len(points[0]) != 1 {
+		return nil
+	}
+
+	p := points[0][0]
+
+	return &Update{
+		Fields: append([]string{}, fields...),
+		Time:   ts,
+		Total:  p.Total,
+		Count:  p.Count,
+	}
+}
+
+// matches checks whether fields match a field pattern
+func matches(pattern, fields []string) bool {
+	if len(pattern) != len(fields) {
+		return false
+	}
+
+	for i, f := range pattern {
+		if f != "*" && f != fields[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,114 @@
+package kadiyadb
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, s *Subscription) (u *Update) {
+	select {
+	case u = <-s.C:
+		return u
+	case <-time.After(time.Second):
+		t.Fatal("update not received")
+	}
+
+	return nil
+}
+
+func TestSubscribe(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	s1 := db.Subscribe([]string{"a", "*"}, 10)
+	s2 := db.Subscribe([]string{"a"}, 10)
+	s3 := db.Subscribe([]string{"x", "*"}, 1)
+
+	// timestamp is inside the second point
+	ts := uint64(p.Resolution + 5)
+	if err := db.Track(ts, []string{"a", "b"}, 5, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	u := receive(t, s1)
+	if len(u.Fields) != 2 || u.Fields[1] != "b" || u.Time != uint64(p.Resolution) || u.Total != 5 || u.Count != 1 {
+		t.Fatal("wrong update", u)
+	}
+
+	// parent field sets are updated too
+	u = receive(t, s2)
+	if len(u.Fields) != 1 || u.Fields[0] != "a" || u.Total != 5 || u.Count != 1 {
+		t.Fatal("wrong update", u)
+	}
+
+	// updates to the same point are coalesced
+	for i := 0; i < 3; i++ {
+		if err := db.Track(ts, []string{"a", "b"}, 5, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; ; i++ {
+		if i == 3 {
+			t.Fatal("updates not coalesced")
+		}
+
+		if u = receive(t, s1); u.Count == 4 {
+			break
+		}
+	}
+
+	if u.Total != 20 {
+		t.Fatal("wrong update", u)
+	}
+
+	// oldest updates are dropped when the buffer is full
+	for _, f := range []string{"1", "2", "3", "4"} {
+		if err := db.Track(ts, []string{"x", f}, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s3.Dropped() == 0 {
+		t.Fatal("should drop updates")
+	}
+
+	for {
+		if u = receive(t, s3); u.Fields[1] == "4" {
+			break
+		}
+	}
+
+	s1.Close()
+	s1.Close()
+	if _, ok := <-s1.C; ok {
+		t.Fatal("channel should be closed")
+	}
+
+	// closing the database closes all subscriptions
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*Subscription{s2, s3} {
+		for range s.C {
+		}
+	}
+}
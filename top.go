@@ -0,0 +1,187 @@
+package kadiyadb
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+// RankBy is the score used to rank series with FetchTop
+type RankBy int
+
+const (
+	// RankSum ranks series by the sum of totals in the range
+	RankSum RankBy = iota
+
+	// RankAvg ranks series by the sum of totals divided by the sum of counts
+	RankAvg
+
+	// RankMax ranks series by the highest point value (total/count)
+	RankMax
+
+	// RankLast ranks series by the value of the last point with data
+	RankLast
+)
+
+var (
+	// ErrInvTop is returned when top-N options are invalid
+	ErrInvTop = errors.New("invalid top-N options")
+)
+
+// TopOptions selects series returned by FetchTop
+type TopOptions struct {
+	// By is the score used to rank series
+	By RankBy
+
+	// N is the maximum number of series to return
+	N int
+
+	// Bottom selects series with lowest scores instead of highest
+	Bottom bool
+}
+
+// FetchTop fetches data the same way as Fetch but only returns up to `N`
+// series with the highest (or lowest) scores over the whole time range.
+// Scores are calculated over all chunks inside the fetch handler without
+// copying points therefore only selected series are given to `fn`.
+func (d *DB) FetchTop(from, to uint64, fields []string, opts *TopOptions, fn Handler) {
+	if opts == nil || opts.N <= 0 || opts.By < RankSum || opts.By > RankLast {
+		fn(nil, ErrInvTop)
+		return
+	}
+
+	d.Fetch(from, to, fields, func(chunks []*protocol.Chunk, err error) {
+		if err != nil {
+			fn(nil, err)
+			return
+		}
+
+		fn(Top(chunks, opts), nil)
+	})
+}
+
+// Top selects up to `N` series with the highest (or lowest) scores from
+// consecutive chunks. Series are matched by their fields and series without
+// data in any chunk are not ranked. Each resulting chunk has selected series
+// ordered by rank. Ties are broken by comparing fields. Result chunks share
+// series with given chunks.
+func Top(chunks []*protocol.Chunk, opts *TopOptions) (res []*protocol.Chunk) {
+	scores := map[string]*score{}
+
+	for _, c := range chunks {
+		for _, s := range c.Series {
+			key := strings.Join(s.Fields, "\x00")
+			sc, ok := scores[key]
+			if !ok {
+				sc = &score{key: key}
+				scores[key] = sc
+			}
+
+			sc.add(s.Points)
+		}
+	}
+
+	ranked := make([]*score, 0, len(scores))
+	for _, sc := range scores {
+		if sc.count > 0 {
+			ranked = append(ranked, sc)
+		}
+	}
+
+	sort.Sort(&byScore{ranked, opts.By, opts.Bottom})
+
+	if len(ranked) > opts.N {
+		ranked = ranked[:opts.N]
+	}
+
+	rank := make(map[string]int, len(ranked))
+	for i, sc := range ranked {
+		rank[sc.key] = i
+	}
+
+	res = make([]*protocol.Chunk, len(chunks))
+	for i, c := range chunks {
+		selected := make([]*protocol.Series, len(ranked))
+		for _, s := range c.Series {
+			if j, ok := rank[strings.Join(s.Fields, "\x00")]; ok {
+				selected[j] = s
+			}
+		}
+
+		series := make([]*protocol.Series, 0, len(ranked))
+		for _, s := range selected {
+			if s != nil {
+				series = append(series, s)
+			}
+		}
+
+		res[i] = &protocol.Chunk{From: c.From, To: c.To, Series: series}
+	}
+
+	return res
+}
+
+// score has values used to rank a series
+type score struct {
+	key   string
+	total float64
+	count float64
+	max   float64
+	last  float64
+}
+
+// add updates the score with points of the next chunk
+func (s *score) add(points []protocol.Point) {
+	for _, p := range points {
+		if p.Count == 0 {
+			continue
+		}
+
+		v := p.Total / p.Count
+		if s.count == 0 || v > s.max {
+			s.max = v
+		}
+
+		s.last = v
+		s.total += p.Total
+		s.count += p.Count
+	}
+}
+
+// value returns the score value for a ranking method
+func (s *score) value(by RankBy) float64 {
+	switch by {
+	case RankAvg:
+		return s.total / s.count
+	case RankMax:
+		return s.max
+	case RankLast:
+		return s.last
+	}
+
+	return s.total
+}
+
+// byScore sorts scores by rank
+type byScore struct {
+	scores []*score
+	by     RankBy
+	bottom bool
+}
+
+func (s *byScore) Len() int      { return len(s.scores) }
+func (s *byScore) Swap(i, j int) { s.scores[i], s.scores[j] = s.scores[j], s.scores[i] }
+func (s *byScore) Less(i, j int) bool {
+	a, b := s.scores[i].value(s.by), s.scores[j].value(s.by)
+	if a == b {
+		return s.scores[i].key < s.scores[j].key
+	}
+
+	if s.bottom {
+		return a < b
+	}
+
+	return a > b
+}
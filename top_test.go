@@ -0,0 +1,144 @@
+package kadiyadb
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kadirahq/kadiyadb-protocol"
+)
+
+func topFields(chunks []*protocol.Chunk) (res [][]string) {
+	for _, c := range chunks {
+		fields := []string{}
+		for _, s := range c.Series {
+			fields = append(fields, s.Fields[0])
+		}
+
+		res = append(res, fields)
+	}
+
+	return res
+}
+
+func TestTop(t *testing.T) {
+	chunks := []*protocol.Chunk{
+		{
+			From: 0,
+			To:   2,
+			Series: []*protocol.Series{
+				{Fields: []string{"a"}, Points: []protocol.Point{{10, 1}, {0, 0}}},
+				{Fields: []string{"b"}, Points: []protocol.Point{{4, 4}, {4, 4}}},
+				{Fields: []string{"c"}, Points: []protocol.Point{{0, 0}, {0, 0}}},
+			},
+		},
+		{
+			From: 2,
+			To:   4,
+			Series: []*protocol.Series{
+				{Fields: []string{"c"}, Points: []protocol.Point{{6, 1}, {0, 0}}},
+				{Fields: []string{"b"}, Points: []protocol.Point{{0, 0}, {20, 1}}},
+				{Fields: []string{"d"}, Points: []protocol.Point{{0, 0}, {0, 0}}},
+			},
+		},
+	}
+
+	// scores (d has no data and is never ranked)
+	//   sum:  a=10 b=28 c=6
+	//   avg:  a=10 b=3.1 c=6
+	//   max:  a=10 b=20 c=6
+	//   last: a=10 b=20 c=6
+	cases := []struct {
+		opts *TopOptions
+		exp  [][]string
+	}{
+		{&TopOptions{By: RankSum, N: 2}, [][]string{{"b", "a"}, {"b"}}},
+		{&TopOptions{By: RankAvg, N: 2}, [][]string{{"a", "c"}, {"c"}}},
+		{&TopOptions{By: RankMax, N: 1}, [][]string{{"b"}, {"b"}}},
+		{&TopOptions{By: RankLast, N: 10}, [][]string{{"b", "a", "c"}, {"b", "c"}}},
+		{&TopOptions{By: RankSum, N: 2, Bottom: true}, [][]string{{"c", "a"}, {"c"}}},
+	}
+
+	for i, c := range cases {
+		res := Top(chunks, c.opts)
+		if len(res) != 2 || res[1].From != 2 || res[1].To != 4 {
+			t.Fatal("wrong chunks", i)
+		}
+
+		got := topFields(res)
+		for j := range got {
+			if len(got[j]) != len(c.exp[j]) {
+				t.Fatal("wrong series", i, got)
+			}
+
+			for k := range got[j] {
+				if got[j][k] != c.exp[j][k] {
+					t.Fatal("wrong series", i, got)
+				}
+			}
+		}
+	}
+}
+
+func TestFetchTop(t *testing.T) {
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Params{
+		Duration:    3600000000000,
+		Retention:   36000000000000,
+		Resolution:  60000000000,
+		MaxROEpochs: 2,
+		MaxRWEpochs: 2,
+	}
+
+	db, err := Open(dir, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+	defer db.Close()
+
+	// a is busier in the first epoch but b is busier overall
+	data := []struct {
+		ts     int64
+		fields []string
+		total  float64
+	}{
+		{p.Duration - p.Resolution, []string{"a"}, 5},
+		{p.Duration - p.Resolution, []string{"b"}, 1},
+		{p.Duration, []string{"b"}, 7},
+		{p.Duration, []string{"c"}, 2},
+	}
+
+	for _, d := range data {
+		if err := db.Track(uint64(d.ts), d.fields, d.total, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	from, to := uint64(p.Duration-p.Resolution), uint64(p.Duration+p.Resolution)
+	opts := &TopOptions{By: RankSum, N: 2}
+
+	db.FetchTop(from, to, []string{"*"}, opts, func(res []*protocol.Chunk, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := topFields(res)
+		if len(got) != 2 ||
+			len(got[0]) != 2 || got[0][0] != "b" || got[0][1] != "a" ||
+			len(got[1]) != 1 || got[1][0] != "b" {
+			t.Fatal("wrong series", got)
+		}
+	})
+
+	for _, opts := range []*TopOptions{nil, {N: 0}, {By: RankLast + 1, N: 1}} {
+		db.FetchTop(from, to, []string{"*"}, opts, func(res []*protocol.Chunk, err error) {
+			if err != ErrInvTop {
+				t.Fatal("should return an error")
+			}
+		})
+	}
+}